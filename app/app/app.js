@@ -9,6 +9,7 @@ angular.module("ccj16reg", [
 	"ccj16reg.view.recordlist",
 	"ccj16reg.view.register",
 	"ccj16reg.view.registration",
+	"ccj16reg.view.sessions",
 	"ccj16reg.view.summary.pack",
 	"ccj16reg.view.emailConfirmation",
 ])
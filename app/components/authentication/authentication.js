@@ -1,37 +1,48 @@
 angular.module("ccj16reg.authentication", [])
 .factory("authentication", function($http, $q) {
 	"use strict";
-	var loggedInP = null;
+	var statusP = null;
+	var status = function() {
+		if (statusP === null) {
+			statusP = $http.get("/api/authentication/isLoggedIn").then(function(response) {
+				return response.data;
+			});
+		}
+		return statusP;
+	};
 	return {
 		isLoggedIn: function() {
-			if (loggedInP === null) {
-				loggedInP = $q(function(resolve, reject) {
-					$http.get("/api/authentication/isLoggedIn").then(function(response) {
-						if (response.data === "true") {
-							resolve(true);
-						} else {
-							resolve(false);
-						}
-					}, function(response) {
-						reject(response);
-					});
-				});
-			}
-			return loggedInP;
+			return status().then(function(data) {
+				return data.loggedIn === true;
+			});
+		},
+		// Resolves to the administrator's role, or an empty string.
+		role: function() {
+			return status().then(function(data) {
+				return data.role || "";
+			});
+		},
+		// Ends the session on the server, so the cookie can't be reused.
+		logout: function() {
+			return $http.post("/api/authentication/logout").then(function() {
+				statusP = $q.when({loggedIn: false, email: "", role: ""});
+			});
 		},
-		tryGoogleToken: function(token) {
-			loggedInP = $q(function(resolve, reject) {
-				$http.post("/api/authentication/googletoken", token).then(function(response) {
-					if (response.data === "true") {
-						resolve(true);
-					} else {
-						resolve(false);
-					}
-				}, function(response) {
-					reject(response);
-				});
+		// Resolves to the session status once logged in.  Otherwise it isn't
+		// logged in, and says whether a code is required or the account is
+		// locked.
+		logInLocally: function(email, password, code) {
+			return $http.post("/api/authentication/local/login", {email: email, password: password, code: code || ""}).then(function(response) {
+				statusP = $q.when(response.data);
+				return response.data;
+			}, function(response) {
+				if (response.status === 401 && response.data && response.data.codeRequired) {
+					return {loggedIn: false, codeRequired: true};
+				} else if (response.status === 401 || response.status === 403 || response.status === 429) {
+					return {loggedIn: false, locked: response.status === 429};
+				}
+				return $q.reject(response);
 			});
-			return loggedInP;
 		},
 	};
 });
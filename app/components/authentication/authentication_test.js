@@ -5,11 +5,10 @@ describe("ccj16reg.authentication module", function() {
 	beforeEach(module("ccj16reg.authentication"));
 
 	describe("authentication service", function() {
-		var $httpBackend, $rootScope, authentication;
+		var $httpBackend, authentication;
 
 		beforeEach(inject(function($injector, _authentication_) {
 			$httpBackend = $injector.get("$httpBackend");
-			$rootScope = $injector.get("$rootScope");
 
 			authentication = _authentication_;
 		}))
@@ -19,7 +18,7 @@ describe("ccj16reg.authentication module", function() {
 			$httpBackend.verifyNoOutstandingRequest();
 		});
 		it("should return unauthenticated when session is blank", function() {
-			$httpBackend.expectGET("/api/authentication/isLoggedIn").respond(200, "false")
+			$httpBackend.expectGET("/api/authentication/isLoggedIn").respond(200, {loggedIn: false, email: "", role: ""})
 			var gspy = jasmine.createSpy("gspy");
 			var bspy = jasmine.createSpy("bspy");
 
@@ -31,7 +30,7 @@ describe("ccj16reg.authentication module", function() {
 			expect(gspy).toHaveBeenCalledWith(false);
 		});
 		it("should return authenticated when session reports success", function() {
-			$httpBackend.expectGET("/api/authentication/isLoggedIn").respond(200, "true")
+			$httpBackend.expectGET("/api/authentication/isLoggedIn").respond(200, {loggedIn: true, email: "admin@example.com", role: "registrar"})
 			var gspy = jasmine.createSpy("gspy");
 			var bspy = jasmine.createSpy("bspy");
 
@@ -42,28 +41,56 @@ describe("ccj16reg.authentication module", function() {
 
 			expect(gspy).toHaveBeenCalledWith(true);
 		});
-		it("should send a valid request to the backend and succeed.", function() {
-			$httpBackend.expectPOST("/api/authentication/googletoken", "goodToken").respond(200, "true")
+		it("should return the role from the session", function() {
+			$httpBackend.expectGET("/api/authentication/isLoggedIn").respond(200, {loggedIn: true, email: "admin@example.com", role: "finance"})
+			var gspy = jasmine.createSpy("gspy");
 
-			var responseP = authentication.tryGoogleToken("goodToken");
+			authentication.isLoggedIn();
+			authentication.role().then(gspy);
+			$httpBackend.flush();
+			expect(gspy).toHaveBeenCalledWith("finance");
+		});
+		it("should log in with a local account", function() {
+			$httpBackend.expectPOST("/api/authentication/local/login", {email: "admin@example.com", password: "correct horse", code: ""}).respond(200, {loggedIn: true, email: "admin@example.com", role: "superadmin"})
 			var gspy = jasmine.createSpy("gspy");
-			var bspy = jasmine.createSpy("bspy");
-			responseP.then(gspy, bspy);
+
+			authentication.logInLocally("admin@example.com", "correct horse").then(gspy);
 			$httpBackend.flush();
-			expect(gspy).toHaveBeenCalled();
-			expect(bspy).not.toHaveBeenCalled();
+			expect(gspy).toHaveBeenCalledWith({loggedIn: true, email: "admin@example.com", role: "superadmin"});
 
-			expect(gspy).toHaveBeenCalledWith(true);
+			var rspy = jasmine.createSpy("rspy");
+			authentication.role().then(rspy);
+			$httpBackend.flush();
+			expect(rspy).toHaveBeenCalledWith("superadmin");
+		});
+		it("should report when a local account needs a code", function() {
+			$httpBackend.expectPOST("/api/authentication/local/login").respond(401, {codeRequired: true})
+			var gspy = jasmine.createSpy("gspy");
 
-			gspy = jasmine.createSpy("gspy");
-			bspy = jasmine.createSpy("bspy");
+			authentication.logInLocally("admin@example.com", "correct horse").then(gspy);
+			$httpBackend.flush();
+			expect(gspy).toHaveBeenCalledWith({loggedIn: false, codeRequired: true});
+		});
+		it("should report a locked local account", function() {
+			$httpBackend.expectPOST("/api/authentication/local/login").respond(429, "Account locked")
+			var gspy = jasmine.createSpy("gspy");
 
-			authentication.isLoggedIn().then(gspy, bspy);
-			$rootScope.$digest();
-			expect(gspy).toHaveBeenCalled();
-			expect(bspy).not.toHaveBeenCalled();
+			authentication.logInLocally("admin@example.com", "correct horse").then(gspy);
+			$httpBackend.flush();
+			expect(gspy).toHaveBeenCalledWith({loggedIn: false, locked: true});
+		});
+		it("should forget the session when logging out", function() {
+			$httpBackend.expectGET("/api/authentication/isLoggedIn").respond(200, {loggedIn: true, email: "admin@example.com", role: "superadmin"})
+			$httpBackend.expectPOST("/api/authentication/logout").respond(204, "")
+			var gspy = jasmine.createSpy("gspy");
 
-			expect(gspy).toHaveBeenCalledWith(true);
+			authentication.isLoggedIn();
+			authentication.logout().then(function() {
+				return authentication.isLoggedIn();
+			}).then(gspy);
+			$httpBackend.flush();
+			$httpBackend.verifyNoOutstandingRequest();
+			expect(gspy).toHaveBeenCalledWith(false);
 		});
 	});
 });
@@ -0,0 +1,127 @@
+angular.module("ccj16reg.challenge", ["ccj16reg.config"])
+.constant("captchaScripts", {
+	hcaptcha: {src: "https://js.hcaptcha.com/1/api.js?render=explicit&onload=ccjCaptchaLoaded", global: "hcaptcha"},
+	recaptcha: {src: "https://www.google.com/recaptcha/api.js?render=explicit&onload=ccjCaptchaLoaded", global: "grecaptcha"},
+})
+.factory("Challenge", function($http, $q, $window, Config) {
+	"use strict";
+	var challenge = Config.challenge;
+	var captchaResponse, resetWidget;
+
+	// Counts the leading zero bits of a hash, as the server does.
+	function leadingZeroBits(hash) {
+		var bits = 0;
+		for (var i = 0; i < hash.length; i++) {
+			if (hash[i] !== 0) {
+				return bits + Math.clz32(hash[i]) - 24;
+			}
+			bits += 8;
+		}
+		return bits;
+	}
+
+	// Finds a counter whose SHA-256 hash with the challenge has enough
+	// leading zero bits, hashing a batch of counters at a time.
+	function solveProofOfWork(issued, difficulty) {
+		var encoder = new $window.TextEncoder();
+		function tryBatch(start) {
+			var attempts = [];
+			for (var counter = start; counter < start + 1000; counter++) {
+				attempts.push(issued + ":" + counter);
+			}
+			return $q.all(attempts.map(function(answer) {
+				return $q.when($window.crypto.subtle.digest("SHA-256", encoder.encode(answer))).then(function(hash) {
+					return leadingZeroBits(new Uint8Array(hash)) >= difficulty ? answer : undefined;
+				});
+			})).then(function(answers) {
+				for (var i = 0; i < answers.length; i++) {
+					if (answers[i]) {
+						return answers[i];
+					}
+				}
+				return tryBatch(start + 1000);
+			});
+		}
+		return tryBatch(0);
+	}
+
+	return {
+		// Which challenge the page needs to show, if any.
+		type: challenge ? challenge.type : undefined,
+		siteKey: challenge ? challenge.siteKey : undefined,
+		needsWidget: !!challenge && (challenge.type === "hcaptcha" || challenge.type === "recaptcha"),
+		// Called by the CAPTCHA widget as it is answered or expires.
+		setCaptchaResponse: function(response, reset) {
+			captchaResponse = response;
+			if (reset) {
+				resetWidget = reset;
+			}
+		},
+		// Resolves to the answer to send with a registration, which is empty
+		// if none is needed.
+		answer: function() {
+			if (!challenge) {
+				return $q.resolve("");
+			}
+			switch (challenge.type) {
+			case "proofofwork":
+				return $http.get("/api/challenge").then(function(res) {
+					return solveProofOfWork(res.data.challenge, res.data.difficulty);
+				});
+			case "fake":
+				return $q.resolve("pass");
+			}
+			return captchaResponse ? $q.resolve(captchaResponse) : $q.reject("Please complete the CAPTCHA first");
+		},
+		// Answers only work once, so a new one is needed after each attempt.
+		reset: function() {
+			captchaResponse = undefined;
+			if (resetWidget) {
+				resetWidget();
+			}
+		},
+	};
+})
+// Shows the CAPTCHA from the provider given in the config.
+.directive("ccjCaptcha", function($window, $document, $q, Challenge, captchaScripts) {
+	"use strict";
+	var loaded;
+	function loadScript() {
+		var script = captchaScripts[Challenge.type];
+		if (!loaded) {
+			loaded = $q(function(resolve) {
+				$window.ccjCaptchaLoaded = function() {
+					resolve($window[script.global]);
+				};
+				var tag = $document[0].createElement("script");
+				tag.src = script.src;
+				tag.async = true;
+				$document[0].body.appendChild(tag);
+			});
+		}
+		return loaded;
+	}
+	return {
+		restrict: "A",
+		link: function(scope, element) {
+			loadScript().then(function(api) {
+				var widget = api.render(element[0], {
+					sitekey: Challenge.siteKey,
+					callback: function(response) {
+						scope.$applyAsync(function() {
+							Challenge.setCaptchaResponse(response);
+						});
+					},
+					"expired-callback": function() {
+						scope.$applyAsync(function() {
+							Challenge.setCaptchaResponse(undefined);
+						});
+					},
+				});
+				Challenge.setCaptchaResponse(undefined, function() {
+					api.reset(widget);
+				});
+			});
+		},
+	};
+});
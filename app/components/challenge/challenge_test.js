@@ -0,0 +1,61 @@
+"use strict";
+
+describe("Challenge service", function() {
+	var config;
+
+	beforeEach(module("ccj16reg.challenge", function($provide) {
+		config = {};
+		$provide.constant("Config", config);
+	}));
+
+	it("should answer with nothing when no challenge is needed", inject(function($rootScope, Challenge) {
+		var spy = jasmine.createSpy("spy");
+		Challenge.answer().then(spy);
+		$rootScope.$digest();
+		expect(spy).toHaveBeenCalledWith("");
+		expect(Challenge.needsWidget).toBe(false);
+	}));
+
+	it("should pass the fake challenge", function() {
+		config.challenge = {type: "fake"};
+		inject(function($rootScope, Challenge) {
+			var spy = jasmine.createSpy("spy");
+			Challenge.answer().then(spy);
+			$rootScope.$digest();
+			expect(spy).toHaveBeenCalledWith("pass");
+		});
+	});
+
+	describe("with a CAPTCHA", function() {
+		beforeEach(function() {
+			config.challenge = {type: "hcaptcha", siteKey: "site"};
+		});
+
+		it("should need the widget answered first", inject(function($rootScope, Challenge) {
+			var good = jasmine.createSpy("good");
+			var bad = jasmine.createSpy("bad");
+			expect(Challenge.needsWidget).toBe(true);
+			Challenge.answer().then(good, bad);
+			$rootScope.$digest();
+			expect(good).not.toHaveBeenCalled();
+			expect(bad).toHaveBeenCalled();
+		}));
+
+		it("should answer with the widget's response until reset", inject(function($rootScope, Challenge) {
+			var reset = jasmine.createSpy("reset");
+			var spy = jasmine.createSpy("spy");
+			Challenge.setCaptchaResponse(undefined, reset);
+			Challenge.setCaptchaResponse("token");
+			Challenge.answer().then(spy);
+			$rootScope.$digest();
+			expect(spy).toHaveBeenCalledWith("token");
+
+			Challenge.reset();
+			expect(reset).toHaveBeenCalled();
+			var bad = jasmine.createSpy("bad");
+			Challenge.answer().catch(bad);
+			$rootScope.$digest();
+			expect(bad).toHaveBeenCalled();
+		}));
+	});
+});
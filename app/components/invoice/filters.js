@@ -22,3 +22,13 @@ angular.module("ccj16reg.invoice.filters", [])
 		return sum
 	}
 })
+.filter("paymentSum", function() {
+	"use strict";
+	return function(input) {
+		var sum = 0;
+		for (var i = 0; input && i < input.length; ++i) {
+			sum += input[i].amount;
+		}
+		return sum;
+	};
+})
@@ -65,4 +65,19 @@ describe("ccj16reg.invoice module", function() {
 			expect(invoiceSum(items)).toBe(600)
 		})
 	})
+
+	describe("paymentSum filter", function() {
+		var paymentSum;
+
+		beforeEach(inject(function(_paymentSumFilter_) {
+			paymentSum = _paymentSumFilter_;
+		}));
+		it("should return zero without any payments", function() {
+			expect(paymentSum(undefined)).toBe(0);
+			expect(paymentSum([])).toBe(0);
+		});
+		it("should add up the payments", function() {
+			expect(paymentSum([{amount: 1000}, {amount: 250}])).toBe(1250);
+		});
+	});
 });
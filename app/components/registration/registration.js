@@ -31,8 +31,37 @@ angular.module("ccj16reg.registration", ["ngResource"])
 			}
 		})
 	}
+	// Gives the registration a new security key, so the old link stops
+	// working.  Resolves to the new key.
+	res.prototype.rotateKey = function() {
+		var reg = this;
+		return $http.post("/api/preregistration/" + reg.securityKey + "/rotate").then(function(response) {
+			reg.securityKey = response.data.securityKey;
+			return reg.securityKey;
+		}, function(response) {
+			return $q.reject(response.data);
+		});
+	}
+	// Creates the registration, sending the answer to any challenge the
+	// server asks registrations to pass.  Resolves to the saved registration.
+	res.prototype.create = function(challengeResponse) {
+		var reg = this;
+		var headers = {};
+		if (challengeResponse) {
+			headers["X-Challenge-Response"] = challengeResponse;
+		}
+		return $http.post("/api/preregistration", reg, {headers: headers}).then(function(response) {
+			return angular.extend(reg, response.data);
+		});
+	}
+	res.requestLink = function(email) {
+		return $http.post("/api/preregistration/recover", {email: email});
+	}
 	res.confirmEmail = function(email, token) {
-		return $http.put("/api/confirmpreregistration?email=" + email, token);
+		return $http.put("/api/confirmpreregistration", {email: email, token: token});
+	}
+	res.resendConfirmation = function(email) {
+		return $http.post("/api/confirmpreregistration/resend", {email: email});
 	}
 	return res;
 })
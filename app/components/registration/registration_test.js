@@ -207,7 +207,7 @@ describe("ccj16reg.registration module", function() {
 			it("that succeeds with valid information", function() {
 				var good;
 
-				$httpBackend.expectPUT("/api/confirmpreregistration?email=test@example.com", "validToken").respond(204, "");
+				$httpBackend.expectPUT("/api/confirmpreregistration", {email: "test@example.com", token: "validToken"}).respond(204, "");
 
 				Registration.confirmEmail("test@example.com", "validToken").then(function() {
 					good = true;
@@ -222,7 +222,7 @@ describe("ccj16reg.registration module", function() {
 			it("that fails with bad information", function() {
 				var good;
 
-				$httpBackend.expectPUT("/api/confirmpreregistration?email=test@example.com", "badToken").respond(400, "");
+				$httpBackend.expectPUT("/api/confirmpreregistration", {email: "test@example.com", token: "badToken"}).respond(400, "");
 
 				Registration.confirmEmail("test@example.com", "badToken").then(function() {
 					good = true;
@@ -234,6 +234,43 @@ describe("ccj16reg.registration module", function() {
 
 				expect(good).toBe(false);
 			});
+			it("that can send a new token", function() {
+				$httpBackend.expectPOST("/api/confirmpreregistration/resend", {email: "test@example.com"}).respond(202, "");
+
+				Registration.resendConfirmation("test@example.com");
+				$httpBackend.flush();
+			});
+		});
+
+		it("should move to the new key when rotating", function() {
+			var reg = new Registration({securityKey: "old"});
+			$httpBackend.expectPOST("/api/preregistration/old/rotate").respond(200, {securityKey: "new"});
+			var spy = jasmine.createSpy("spy");
+
+			reg.rotateKey().then(spy);
+			$httpBackend.flush();
+			expect(spy).toHaveBeenCalledWith("new");
+			expect(reg.securityKey).toBe("new");
+		});
+
+		it("should send the challenge answer when creating", function() {
+			var reg = new Registration({groupName: "1st Testingway"});
+			$httpBackend.expectPOST("/api/preregistration", {groupName: "1st Testingway"}, function(headers) {
+				return headers["X-Challenge-Response"] === "answer";
+			}).respond(201, {groupName: "1st Testingway", securityKey: "key"});
+			var spy = jasmine.createSpy("spy");
+
+			reg.create("answer").then(spy);
+			$httpBackend.flush();
+			expect(spy).toHaveBeenCalledWith(reg);
+			expect(reg.securityKey).toBe("key");
+		});
+
+		it("should ask for a link by email", function() {
+			$httpBackend.expectPOST("/api/preregistration/recover", {email: "leader@example.com"}).respond(202, "");
+
+			Registration.requestLink("leader@example.com");
+			$httpBackend.flush();
 		});
 	});
 
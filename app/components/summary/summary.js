@@ -3,6 +3,7 @@ angular.module("ccj16reg.summary", ["ngResource"])
 	"use strict";
 	var r = $resource("/api/summary/", null, {
 		"getPack": { method: "GET", url: "/api/summary/pack" },
+		"getCouncil": { method: "GET", url: "/api/summary/council", isArray: true },
 	})
 
 	delete r.save
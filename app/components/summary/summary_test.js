@@ -25,5 +25,14 @@ describe("ccj16reg.summary module", function() {
 			expect(summaryInfo).toBeDefined();
 			expect(summaryInfo.prop).toBe("value");
 		});
+		it("should request the used and allocated spots per council for getCouncil function", function() {
+			$httpBackend.expectGET("/api/summary/council").respond(200, [{council: "Voyageur", youthCount: 6}])
+
+			var councils = summary.getCouncil();
+			$httpBackend.flush();
+			expect(councils.length).toBe(1);
+			expect(councils[0].council).toBe("Voyageur");
+			expect(councils[0].youthCount).toBe(6);
+		});
 	});
 });
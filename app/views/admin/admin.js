@@ -11,6 +11,14 @@ angular.module("ccj16reg.view.admin", ["ngRoute", "ngMaterial", "ccj16reg.authen
 	});
 })
 
-.controller("AdminCtrl", function() {
+.controller("AdminCtrl", function($scope, $location, authentication) {
 	"use strict";
+	authentication.role().then(function(role) {
+		$scope.role = role;
+	});
+	$scope.logout = function() {
+		authentication.logout().then(function() {
+			$location.path("/login");
+		});
+	};
 });
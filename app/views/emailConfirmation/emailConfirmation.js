@@ -12,6 +12,8 @@ angular.module("ccj16reg.view.emailConfirmation", ["ngRoute", "ngMaterial", "ccj
 	"use strict";
 	$scope.verifying = true;
 	$scope.error = false;
+	$scope.expired = false;
+	$scope.resent = false;
 
 	$scope.email = $routeParams.email;
 	var token = $routeParams.token;
@@ -22,7 +24,13 @@ angular.module("ccj16reg.view.emailConfirmation", ["ngRoute", "ngMaterial", "ccj
 			$scope.verifying = false;
 		}, function(resp) {
 			$scope.verifying = false;
+			$scope.expired = resp.status === 410;
 			$scope.error = resp.data.trim();
 		});
 	}
+	$scope.resend = function() {
+		Registration.resendConfirmation($scope.email).then(function() {
+			$scope.resent = true;
+		});
+	};
 });
@@ -1,4 +1,4 @@
-angular.module("ccj16reg.view.login", ["ngRoute", "ngMaterial", "ccj16reg.authentication"])
+angular.module("ccj16reg.view.login", ["ngRoute", "ngMaterial", "ccj16reg.authentication", "ccj16reg.config"])
 
 .config(function($routeProvider) {
 	"use strict";
@@ -8,36 +8,49 @@ angular.module("ccj16reg.view.login", ["ngRoute", "ngMaterial", "ccj16reg.authen
 	});
 })
 
-.controller("LoginCtrl", function($scope, $location, $mdDialog, authentication) {
+.constant("loginErrors", {
+	state: "The login took too long or was started elsewhere, please try again.",
+	cancelled: "The login was cancelled.",
+	provider: "Failed to talk to the login provider, please try again.",
+	token: "The login provider's response couldn't be verified, please try again.",
+	refused: "Server refused your account, please try again.",
+})
+
+.controller("LoginCtrl", function($scope, $location, $mdDialog, authentication, loginErrors, Config) {
 	"use strict";
-	gapi.signin.render("myButton", {
-		callback: function(authResult) {
-			$scope.$apply(function() {
-				callback(authResult);
-			});
-		},
-	});
-	function callback(authResult) {
-		if (authResult.code) {
-			authentication.tryGoogleToken(authResult.code).then(function(loggedIn) {
-				if (!loggedIn) {
-					$mdDialog.show(
-						$mdDialog.alert()
-							.title("Failed to login")
-							.content("Server refused your account, please try again.")
-							.ok("OK")
-					);
-				} else {
-					$location.path("/admin/");
-				}
-			}, function() {
-				$mdDialog.show(
-					$mdDialog.alert()
-						.title("Failed to login")
-						.content("Server messed up, please complain loudly.")
-						.ok("OK")
-				);
-			});
-		}
+	$scope.providerLogin = Config.providerLogin;
+	$scope.localLogin = Config.localLogin;
+	$scope.account = {};
+	$scope.codeRequired = false;
+
+	function showError(content) {
+		$mdDialog.show(
+			$mdDialog.alert()
+				.title("Failed to login")
+				.content(content)
+				.ok("OK")
+		);
 	}
+
+	var error = $location.search().error;
+	if (error) {
+		$location.search("error", null);
+		showError(loginErrors[error] || "Server messed up, please complain loudly.");
+	}
+
+	$scope.logInLocally = function() {
+		authentication.logInLocally($scope.account.email, $scope.account.password, $scope.account.code).then(function(status) {
+			if (status.codeRequired) {
+				$scope.codeRequired = true;
+			} else if (status.loggedIn) {
+				$location.path("/admin/");
+			} else if (status.locked) {
+				showError("Your account is locked after too many failed logins, please try again later.");
+			} else {
+				showError("Wrong email address, password or code, please try again.");
+			}
+		}, function() {
+			showError("Server messed up, please complain loudly.");
+		});
+	};
 });
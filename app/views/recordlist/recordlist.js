@@ -1,4 +1,4 @@
-angular.module("ccj16reg.view.recordlist", ["ngRoute", "ngMaterial", "ccj16reg.registration", "ccj16reg.common"])
+angular.module("ccj16reg.view.recordlist", ["ngRoute", "ngMaterial", "ccj16reg.registration", "ccj16reg.authentication", "ccj16reg.common"])
 
 .config(function($routeProvider, resolveLoginRequired) {
 	"use strict";
@@ -35,9 +35,13 @@ angular.module("ccj16reg.view.recordlist", ["ngRoute", "ngMaterial", "ccj16reg.r
 	$scope.registrations = Registration.query({select: "registered"});
 })
 
-.controller("WaitingRecordListCtrl", function($scope, $mdDialog, Registration) {
+.controller("WaitingRecordListCtrl", function($scope, $mdDialog, Registration, authentication) {
 	"use strict";
 	$scope.registrations = Registration.query({select: "waiting"});
+	$scope.canPromote = false;
+	authentication.role().then(function(role) {
+		$scope.canPromote = role === "registrar" || role === "superadmin";
+	});
 	$scope.promote = function(index, ev) {
 		var reg = $scope.registrations[index]
 
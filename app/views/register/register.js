@@ -1,9 +1,11 @@
-angular.module("ccj16reg.view.register", ["ngRoute", "ngSanitize", "ngMaterial", "ccj16reg.registration", "ccj16reg.config"])
+angular.module("ccj16reg.view.register", ["ngRoute", "ngSanitize", "ngMaterial", "ccj16reg.registration", "ccj16reg.config", "ccj16reg.challenge"])
 
 .config(function($routeProvider, Config) {
 	"use strict";
 	var template = "views/register/register.html"
-	if (!Config.registrationOpen) {
+	if (Config.registrationPhase === "notYetOpen") {
+		template = "views/register/register_notyetopen.html"
+	} else if (!Config.registrationOpen) {
 		template = "views/register/register_closed.html"
 	} else if (Config.registrationOnWaitingList) {
 		template = "views/register/register_waitlist.html"
@@ -14,9 +16,33 @@ angular.module("ccj16reg.view.register", ["ngRoute", "ngSanitize", "ngMaterial",
 	});
 })
 
-.controller("RegisterCtrl", function($scope, $location, $mdDialog, Registration) {
+.controller("RegisterCtrl", function($scope, $location, $mdDialog, $http, Config, Registration, Challenge) {
 	"use strict";
 	$scope.registration = new Registration();
+	// Answers are always sent as strings, the server normalizes them.
+	$scope.registration.customFields = {};
+	$scope.formFields = Config.formFields || [];
+	$scope.opensAt = Config.phaseChangesAt;
+	$scope.councilSuggestions = [];
+	$scope.groupSuggestions = [];
+	$scope.showCaptcha = Challenge.needsWidget;
+
+	// Offers the names from the council and group directory, so packs are
+	// registered under the names the organizers know them by.
+	$scope.suggestCouncils = function() {
+		$http.get("/api/directory/autocomplete", {params: {q: $scope.registration.council || ""}}).then(function(res) {
+			$scope.councilSuggestions = res.data;
+		});
+	};
+	$scope.suggestGroups = function() {
+		if (!$scope.registration.council) {
+			$scope.groupSuggestions = [];
+			return;
+		}
+		$http.get("/api/directory/autocomplete", {params: {council: $scope.registration.council, q: $scope.registration.groupName || ""}}).then(function(res) {
+			$scope.groupSuggestions = res.data;
+		});
+	};
 
 	$scope.$watch("registration.agreedToEmailTerms()", function(checked) {
 		$scope.registrationTosAccepted = checked;
@@ -42,15 +68,26 @@ angular.module("ccj16reg.view.register", ["ngRoute", "ngSanitize", "ngMaterial",
 			onComplete: submitSaveRequest,
 		});
 		function submitSaveRequest() {
-			$scope.registration.$save().then(function(reg) {
+			Challenge.answer().then(function(answer) {
+				return $scope.registration.create(answer);
+			}).then(function(reg) {
 				$mdDialog.hide();
 				$location.path("/registration/" + reg.securityKey)
 			}, function(msg) {
+				Challenge.reset();
+				var content = "Server message: " + msg.data;
+				if (angular.isString(msg)) {
+					content = msg;
+				} else if (msg.status === 422 && msg.data && msg.data.errors) {
+					content = "Please correct the following: " + msg.data.errors.map(function(err) {
+						return err.field + " " + err.message;
+					}).join(", ");
+				}
 				$mdDialog.hide();
 				$mdDialog.show(
 					$mdDialog.alert()
 						.title("Failed to create registration")
-						.content("Server message: " + msg.data)
+						.content(content)
 						.ok("OK")
 				);
 			});
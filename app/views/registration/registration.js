@@ -11,13 +11,42 @@ angular.module("ccj16reg.view.registration", ["ngRoute", "ngMaterial", "ccj16reg
 			},
 		},
 	});
+	$routeProvider.when("/recover", {
+		templateUrl: "views/registration/recover.html",
+		controller: "RecoverCtrl",
+	});
 })
 
-.controller("RegistrationCtrl", function($scope, $routeParams, $window, registrationData) {
+.controller("RegistrationCtrl", function($scope, $routeParams, $window, $location, $mdDialog, registrationData) {
 	"use strict";
 	$scope.registration = registrationData;
 	$scope.$emit("CurrentGroupInformationChanged", registrationData);
 	$scope.printPage = function() {
 		$window.print();
 	};
+	$scope.rotateKey = function(ev) {
+		$mdDialog.show(
+			$mdDialog.confirm()
+				.title("Get a new link?")
+				.content("The current link to this page, including the one in your emails, will stop working.")
+				.ok("Get a new link")
+				.cancel("Cancel")
+				.targetEvent(ev)
+		).then(function() {
+			return registrationData.rotateKey();
+		}).then(function(securityKey) {
+			$location.path("/registration/" + securityKey);
+		});
+	};
+})
+
+.controller("RecoverCtrl", function($scope, Registration) {
+	"use strict";
+	$scope.email = "";
+	$scope.sent = false;
+	$scope.requestLink = function() {
+		Registration.requestLink($scope.email).then(function() {
+			$scope.sent = true;
+		});
+	};
 });
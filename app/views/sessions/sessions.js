@@ -0,0 +1,33 @@
+angular.module("ccj16reg.view.sessions", ["ngRoute", "ngMaterial", "ccj16reg.common"])
+
+.config(function($routeProvider, resolveLoginRequired) {
+	"use strict";
+	$routeProvider.when("/admin/sessions", {
+		templateUrl: "views/sessions/sessions.html",
+		controller: "SessionListCtrl",
+		resolve: {
+			checkAuth: resolveLoginRequired,
+		},
+	});
+})
+
+.controller("SessionListCtrl", function($scope, $http, $mdDialog) {
+	"use strict";
+	$scope.sessions = [];
+	$http.get("/api/authentication/sessions").then(function(response) {
+		$scope.sessions = response.data;
+	});
+	$scope.revoke = function(index) {
+		var session = $scope.sessions[index];
+		$http.delete("/api/authentication/sessions/" + session.id).then(function() {
+			$scope.sessions.splice(index, 1);
+		}, function(response) {
+			$mdDialog.show(
+				$mdDialog.alert()
+					.title("Failed to revoke session")
+					.content("Server message: " + response.data)
+					.ok("OK")
+			);
+		});
+	};
+});
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+	"github.com/spacemonkeygo/errors"
+	"github.com/spacemonkeygo/errors/errhttp"
+)
+
+var (
+	AdminSessionError    = errors.NewClass("Admin session error")
+	AdminSessionNotFound = AdminSessionError.NewClass("Session does not exist", errhttp.SetStatusCode(404))
+)
+
+var (
+	BOLT_ADMINSESSIONBUCKET = []byte("BUCKET_ADMINSESSION")
+)
+
+// Last seen times are only stored this often, rather than on every request.
+const adminSessionTouchInterval = time.Minute
+
+// An administrator's login, tracked on the server so it can expire and be
+// revoked independently of the cookie holding it.
+type AdminSession struct {
+	ID string `json:"id"`
+	// The administrator and the event they logged in through.
+	Email     string `json:"email"`
+	EventID   string `json:"eventId"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"userAgent"`
+
+	Created  time.Time `json:"created"`
+	LastSeen time.Time `json:"lastSeen"`
+
+	Revoked   bool   `json:"revoked"`
+	RevokedBy string `json:"revokedBy,omitempty"`
+
+	// Set when listing sessions, for the one making the request.
+	Current bool `json:"current"`
+}
+
+// Whether the session can still be used, given how long it may sit idle and
+// how long it may last at most.
+func (s *AdminSession) active(now time.Time, idleTimeout, lifetime time.Duration) bool {
+	return !s.Revoked && now.Before(s.LastSeen.Add(idleTimeout)) && now.Before(s.Created.Add(lifetime))
+}
+
+type AdminSessionDb interface {
+	CreateSession(session *AdminSession) error
+	// Returns the session if it is still active, marking it as seen.
+	TouchSession(id string, now time.Time, idleTimeout, lifetime time.Duration) (*AdminSession, error)
+	GetSession(id string) (*AdminSession, error)
+	RevokeSession(id, revokedBy string) error
+	GetActiveSessions(now time.Time, idleTimeout, lifetime time.Duration) ([]*AdminSession, error)
+	// Deletes the sessions that can no longer be used, so they don't pile up.
+	SweepSessions(now time.Time, idleTimeout, lifetime time.Duration) error
+}
+
+type adminSessionDbBolt struct {
+	db boltorm.DB
+}
+
+// Admin sessions are shared by every event, like the cookies holding them.
+func NewAdminSessionDb(db boltorm.DB) (AdminSessionDb, error) {
+	if err := db.Update(func(tx boltorm.Tx) error {
+		return tx.CreateBucketIfNotExists(BOLT_ADMINSESSIONBUCKET)
+	}); err != nil {
+		return nil, err
+	}
+	return &adminSessionDbBolt{db}, nil
+}
+
+func newAdminSessionID() (string, error) {
+	var random [24]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return "", AdminSessionError.Wrap(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(random[:]), nil
+}
+
+func (d *adminSessionDbBolt) CreateSession(session *AdminSession) error {
+	return d.db.Update(func(tx boltorm.Tx) error {
+		return tx.Insert(BOLT_ADMINSESSIONBUCKET, []byte(session.ID), session)
+	})
+}
+
+func (d *adminSessionDbBolt) TouchSession(id string, now time.Time, idleTimeout, lifetime time.Duration) (session *AdminSession, err error) {
+	err = d.db.View(func(tx boltorm.Tx) error {
+		session = &AdminSession{}
+		return tx.Get(BOLT_ADMINSESSIONBUCKET, []byte(id), session)
+	})
+	if boltorm.ErrKeyDoesNotExist.Contains(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !session.active(now, idleTimeout, lifetime) {
+		return nil, nil
+	}
+	if now.Sub(session.LastSeen) < adminSessionTouchInterval {
+		return session, nil
+	}
+	return session, d.db.Update(func(tx boltorm.Tx) error {
+		// Checked again, in case it was revoked in between.
+		current := &AdminSession{}
+		if err := tx.Get(BOLT_ADMINSESSIONBUCKET, []byte(id), current); err != nil {
+			return err
+		}
+		if current.Revoked {
+			session = nil
+			return nil
+		}
+		current.LastSeen = now
+		session = current
+		return tx.Update(BOLT_ADMINSESSIONBUCKET, []byte(id), current)
+	})
+}
+
+func (d *adminSessionDbBolt) GetSession(id string) (session *AdminSession, err error) {
+	return session, d.db.View(func(tx boltorm.Tx) error {
+		session = &AdminSession{}
+		if err := tx.Get(BOLT_ADMINSESSIONBUCKET, []byte(id), session); err != nil {
+			if boltorm.ErrKeyDoesNotExist.Contains(err) {
+				return AdminSessionNotFound.New("%s", id)
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+func (d *adminSessionDbBolt) RevokeSession(id, revokedBy string) error {
+	return d.db.Update(func(tx boltorm.Tx) error {
+		session := &AdminSession{}
+		if err := tx.Get(BOLT_ADMINSESSIONBUCKET, []byte(id), session); err != nil {
+			if boltorm.ErrKeyDoesNotExist.Contains(err) {
+				return AdminSessionNotFound.New("%s", id)
+			}
+			return err
+		}
+		session.Revoked = true
+		session.RevokedBy = revokedBy
+		return tx.Update(BOLT_ADMINSESSIONBUCKET, []byte(id), session)
+	})
+}
+
+// Lists the active sessions, most recently seen first.
+func (d *adminSessionDbBolt) GetActiveSessions(now time.Time, idleTimeout, lifetime time.Duration) (sessions []*AdminSession, err error) {
+	sessions = []*AdminSession{}
+	return sessions, d.db.View(func(tx boltorm.Tx) error {
+		res, err := tx.GetAll(BOLT_ADMINSESSIONBUCKET, &AdminSession{})
+		if err != nil {
+			return err
+		}
+		for _, session := range res.([]*AdminSession) {
+			if session.active(now, idleTimeout, lifetime) {
+				sessions = append(sessions, session)
+			}
+		}
+		sort.Slice(sessions, func(i, j int) bool {
+			return sessions[i].LastSeen.After(sessions[j].LastSeen)
+		})
+		return nil
+	})
+}
+
+func (d *adminSessionDbBolt) SweepSessions(now time.Time, idleTimeout, lifetime time.Duration) error {
+	return d.db.Update(func(tx boltorm.Tx) error {
+		res, err := tx.GetAll(BOLT_ADMINSESSIONBUCKET, &AdminSession{})
+		if err != nil {
+			return err
+		}
+		for _, session := range res.([]*AdminSession) {
+			if !session.active(now, idleTimeout, lifetime) {
+				if err := tx.Delete(BOLT_ADMINSESSIONBUCKET, []byte(session.ID)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func requestIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type AdminSessionHandler struct {
+	db          AdminSessionDb
+	authHandler *AuthenticationHandler
+}
+
+// Sessions are shared by every event, but event administrators only see and
+// end those logged in through their own event.  Administrators from the
+// flags can log in to any event, so see them all.
+func (h *AdminSessionHandler) visible(r *http.Request, session *AdminSession) bool {
+	return session.EventID == h.authHandler.eventID() || h.authHandler.globalAdmin(h.authHandler.sessionUser(r))
+}
+
+func (h *AdminSessionHandler) GetAll(w http.ResponseWriter, r *http.Request) {
+	auth := h.authHandler.config.Auth
+	sessions, err := h.db.GetActiveSessions(time.Now(), auth.IdleTimeout, auth.SessionLifetime)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	current := h.authHandler.sessionID(r)
+	visible := []*AdminSession{}
+	for _, session := range sessions {
+		if h.visible(r, session) {
+			session.Current = session.ID == current
+			visible = append(visible, session)
+		}
+	}
+	writeJSON(w, http.StatusOK, visible)
+}
+
+func (h *AdminSessionHandler) Revoke(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["ID"]
+	session, err := h.db.GetSession(id)
+	if err == nil && !h.visible(r, session) {
+		err = AdminSessionNotFound.New("%s", id)
+	}
+	if err == nil {
+		err = h.db.RevokeSession(id, h.authHandler.sessionUser(r))
+	}
+	if err != nil {
+		if !AdminSessionNotFound.Contains(err) {
+			log.Printf("Failed to revoke admin session %s!  Error: %s", id, err)
+		}
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func NewAdminSessionHandler(r *mux.Router, db AdminSessionDb, authHandler *AuthenticationHandler) *AdminSessionHandler {
+	h := &AdminSessionHandler{
+		db:          db,
+		authHandler: authHandler,
+	}
+
+	r.HandleFunc("/authentication/sessions", authHandler.RoleFunc(h.GetAll, RoleSuperadmin)).Methods("GET")
+	r.HandleFunc("/authentication/sessions/{ID}", authHandler.RoleFunc(h.Revoke, RoleSuperadmin)).Methods("DELETE")
+
+	return h
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestAdminSessionDb(t *testing.T) {
+	Convey("With an admin session", t, func() {
+		sessionDb, err := NewAdminSessionDb(boltorm.NewMemoryDB())
+		So(err, ShouldBeNil)
+		created := time.Date(2016, 7, 1, 9, 0, 0, 0, time.UTC)
+		So(sessionDb.CreateSession(&AdminSession{ID: "a", Email: "admin@example.com", Created: created, LastSeen: created}), ShouldBeNil)
+		touch := func(now time.Time) *AdminSession {
+			session, err := sessionDb.TouchSession("a", now, 2*time.Hour, 12*time.Hour)
+			So(err, ShouldBeNil)
+			return session
+		}
+
+		Convey("Using it should keep it alive", func() {
+			for now := created; now.Before(created.Add(11 * time.Hour)); now = now.Add(time.Hour) {
+				So(touch(now), ShouldNotBeNil)
+			}
+			So(touch(created.Add(11*time.Hour)).LastSeen, ShouldResemble, created.Add(11*time.Hour))
+		})
+		Convey("It should end after sitting idle", func() {
+			So(touch(created.Add(2*time.Hour-time.Second)), ShouldNotBeNil)
+			So(touch(created.Add(4*time.Hour)), ShouldBeNil)
+		})
+		Convey("It should end after its lifetime however much it is used", func() {
+			for now := created; now.Before(created.Add(12 * time.Hour)); now = now.Add(time.Hour) {
+				So(touch(now), ShouldNotBeNil)
+			}
+			So(touch(created.Add(12*time.Hour)), ShouldBeNil)
+		})
+		Convey("Revoking it should end it", func() {
+			So(sessionDb.RevokeSession("a", "other@example.com"), ShouldBeNil)
+			So(touch(created), ShouldBeNil)
+			So(AdminSessionNotFound.Contains(sessionDb.RevokeSession("b", "other@example.com")), ShouldBeTrue)
+		})
+		Convey("Unknown sessions should not be active", func() {
+			session, err := sessionDb.TouchSession("b", created, 2*time.Hour, 12*time.Hour)
+			So(err, ShouldBeNil)
+			So(session, ShouldBeNil)
+		})
+		Convey("Only active sessions should be listed, most recent first", func() {
+			So(sessionDb.CreateSession(&AdminSession{ID: "b", Email: "admin@example.com", Created: created, LastSeen: created.Add(time.Hour)}), ShouldBeNil)
+			So(sessionDb.CreateSession(&AdminSession{ID: "c", Email: "admin@example.com", Created: created, LastSeen: created, Revoked: true}), ShouldBeNil)
+			active, err := sessionDb.GetActiveSessions(created.Add(time.Hour), 2*time.Hour, 12*time.Hour)
+			So(err, ShouldBeNil)
+			So(len(active), ShouldEqual, 2)
+			So(active[0].ID, ShouldEqual, "b")
+			So(active[1].ID, ShouldEqual, "a")
+			active, err = sessionDb.GetActiveSessions(created.Add(2*time.Hour+time.Second), 2*time.Hour, 12*time.Hour)
+			So(err, ShouldBeNil)
+			So(len(active), ShouldEqual, 1)
+		})
+		Convey("Sweeping should delete the sessions that can't be used", func() {
+			So(sessionDb.CreateSession(&AdminSession{ID: "b", Email: "admin@example.com", Created: created, LastSeen: created.Add(time.Hour)}), ShouldBeNil)
+			So(sessionDb.CreateSession(&AdminSession{ID: "c", Email: "admin@example.com", Created: created.Add(time.Hour), LastSeen: created.Add(time.Hour), Revoked: true}), ShouldBeNil)
+			So(sessionDb.SweepSessions(created.Add(2*time.Hour+time.Second), 2*time.Hour, 12*time.Hour), ShouldBeNil)
+			_, err := sessionDb.GetSession("a")
+			So(AdminSessionNotFound.Contains(err), ShouldBeTrue)
+			_, err = sessionDb.GetSession("c")
+			So(AdminSessionNotFound.Contains(err), ShouldBeTrue)
+			session, err := sessionDb.GetSession("b")
+			So(err, ShouldBeNil)
+			So(session.Email, ShouldEqual, "admin@example.com")
+		})
+	})
+}
+
+func TestAdminSessionHandler(t *testing.T) {
+	Convey("With tracked admin sessions", t, func() {
+		config := &configType{}
+		config.Auth.AllowedEmails = stringSliceConfig{"admin@example.com", "other@example.com"}
+		config.Auth.IdleTimeout = 2 * time.Hour
+		config.Auth.SessionLifetime = 12 * time.Hour
+		sessionDb, err := NewAdminSessionDb(boltorm.NewMemoryDB())
+		So(err, ShouldBeNil)
+		store := sessions.NewCookieStore([]byte("A"))
+		authHandler := NewAuthenticationHandler(mux.NewRouter(), config, store, nil, nil, sessionDb, nil)
+		// Sessions are kept per request, and mux passes its handlers a copy
+		// of it, so route without it for the session to be saved.
+		newSite := func(authHandler *AuthenticationHandler) http.Handler {
+			sessionRouter := mux.NewRouter()
+			NewAdminSessionHandler(sessionRouter, sessionDb, authHandler)
+			router := http.NewServeMux()
+			router.HandleFunc("/authentication/isLoggedIn", authHandler.VerifySession)
+			router.HandleFunc("/authentication/logout", authHandler.Logout)
+			router.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+				So(authHandler.logIn(r, r.FormValue("email")), ShouldBeNil)
+			})
+			router.Handle("/authentication/sessions", sessionRouter)
+			router.Handle("/authentication/sessions/", sessionRouter)
+			return &sessionSaver{router}
+		}
+		site := newSite(authHandler)
+
+		requestTo := func(site http.Handler, method, path string, cookies []string) *httptest.ResponseRecorder {
+			r, err := http.NewRequest(method, "http://localhost:8080"+path, nil)
+			So(err, ShouldBeNil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			r.Header.Set("User-Agent", "Test Browser")
+			r.Header["Cookie"] = cookies
+			w := httptest.NewRecorder()
+			site.ServeHTTP(w, r)
+			return w
+		}
+		request := func(method, path string, cookies []string) *httptest.ResponseRecorder {
+			return requestTo(site, method, path, cookies)
+		}
+		loggedIn := func(cookies []string) bool {
+			status := &sessionStatus{}
+			So(json.Unmarshal(request("GET", "/authentication/isLoggedIn", cookies).Body.Bytes(), status), ShouldBeNil)
+			return status.LoggedIn
+		}
+		listSessionsOn := func(site http.Handler, cookies []string) []*AdminSession {
+			w := requestTo(site, "GET", "/authentication/sessions", cookies)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			list := []*AdminSession{}
+			So(json.Unmarshal(w.Body.Bytes(), &list), ShouldBeNil)
+			return list
+		}
+		listSessions := func(cookies []string) []*AdminSession {
+			return listSessionsOn(site, cookies)
+		}
+
+		cookies := request("POST", "/login?email=admin@example.com", nil).Header()["Set-Cookie"]
+		So(loggedIn(cookies), ShouldBeTrue)
+
+		Convey("Logging in should be listed", func() {
+			list := listSessions(cookies)
+			So(len(list), ShouldEqual, 1)
+			So(list[0].Email, ShouldEqual, "admin@example.com")
+			So(list[0].IP, ShouldEqual, "192.0.2.1")
+			So(list[0].UserAgent, ShouldEqual, "Test Browser")
+			So(list[0].Current, ShouldBeTrue)
+		})
+		Convey("Logging out should end the session, even for copies of the cookie", func() {
+			w := request("POST", "/authentication/logout", cookies)
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			So(loggedIn(w.Header()["Set-Cookie"]), ShouldBeFalse)
+			So(loggedIn(cookies), ShouldBeFalse)
+		})
+		Convey("Revoking a session should end it", func() {
+			otherCookies := request("POST", "/login?email=other@example.com", nil).Header()["Set-Cookie"]
+			list := listSessions(cookies)
+			So(len(list), ShouldEqual, 2)
+			So(list[0].Current, ShouldBeFalse)
+			So(request("DELETE", "/authentication/sessions/"+list[0].ID, cookies).Code, ShouldEqual, http.StatusNoContent)
+			So(loggedIn(otherCookies), ShouldBeFalse)
+			So(loggedIn(cookies), ShouldBeTrue)
+			So(request("DELETE", "/authentication/sessions/unknown", cookies).Code, ShouldEqual, http.StatusNotFound)
+		})
+		Convey("With an administrator of another event", func() {
+			eventSite := newSite(NewAuthenticationHandler(mux.NewRouter(), config, store, testEvent(), nil, sessionDb, nil))
+			eventCookies := requestTo(eventSite, "POST", "/login?email=regional@example.com", nil).Header()["Set-Cookie"]
+			Convey("They should only see their event's sessions", func() {
+				list := listSessionsOn(eventSite, eventCookies)
+				So(len(list), ShouldEqual, 1)
+				So(list[0].Email, ShouldEqual, "regional@example.com")
+				So(list[0].EventID, ShouldEqual, "regional")
+			})
+			Convey("They should not be able to end other events' sessions", func() {
+				So(len(listSessions(cookies)), ShouldEqual, 2)
+				So(requestTo(eventSite, "DELETE", "/authentication/sessions/"+listSessions(cookies)[1].ID, eventCookies).Code, ShouldEqual, http.StatusNotFound)
+				So(loggedIn(cookies), ShouldBeTrue)
+			})
+			Convey("Administrators from the flags should see every event's sessions", func() {
+				list := listSessionsOn(eventSite, cookies)
+				So(len(list), ShouldEqual, 2)
+			})
+		})
+		Convey("Sessions logged in before they were tracked should be logged out", func() {
+			r := &http.Request{}
+			sess, err := store.New(r, globalSessionName)
+			So(err, ShouldBeNil)
+			sess.Values[authStatusLoggedIn] = true
+			sess.Values[authUserEmail] = "admin@example.com"
+			w := httptest.NewRecorder()
+			store.Save(r, w, sess)
+			So(loggedIn(w.Header()["Set-Cookie"]), ShouldBeFalse)
+		})
+	})
+}
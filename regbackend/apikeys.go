@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+	"github.com/spacemonkeygo/errors"
+	"github.com/spacemonkeygo/errors/errhttp"
+)
+
+var (
+	APIKeyError    = errors.NewClass("API key error")
+	APIKeyNotFound = APIKeyError.NewClass("API key does not exist", errhttp.SetStatusCode(404))
+)
+
+var (
+	BOLT_APIKEYBUCKET = []byte("BUCKET_APIKEY")
+)
+
+// Keys last this long unless they are given another expiry when created.
+const apiKeyDefaultLifetime = 365 * 24 * time.Hour
+
+// Like admin sessions, last used times are only stored this often.
+const apiKeyTouchInterval = time.Minute
+
+// Keys act as an administrator with one of these roles.  Managing keys,
+// roles and the event itself stays with logged in superadmins.
+var apiKeyScopes = []string{RoleViewer, RoleRegistrar, RoleFinance}
+
+// A key scripts use to reach the admin API without logging in, given as
+// "Authorization: Bearer <id>.<secret>".  Only a hash of the secret is
+// stored, so the key is only ever shown when it is created.
+type APIKey struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// The role the key acts with.
+	Scope      string `json:"scope"`
+	SecretHash string `json:"-"`
+
+	CreatedBy string    `json:"createdBy"`
+	Created   time.Time `json:"created"`
+	// Zero until the key is first used.
+	LastUsed time.Time `json:"lastUsed"`
+	Expires  time.Time `json:"expires"`
+
+	Revoked   bool   `json:"revoked"`
+	RevokedBy string `json:"revokedBy,omitempty"`
+}
+
+func (k *APIKey) active(now time.Time) bool {
+	return !k.Revoked && now.Before(k.Expires)
+}
+
+// Who changes made with the key are recorded as.
+func (k *APIKey) user() string {
+	return "apikey:" + k.Name
+}
+
+func apiKeySecretHash(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// Generates the key's id and secret, returning the full key to hand out.
+func newAPIKeySecret(key *APIKey) (string, error) {
+	var id [9]byte
+	var secret [32]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", APIKeyError.Wrap(err)
+	}
+	if _, err := rand.Read(secret[:]); err != nil {
+		return "", APIKeyError.Wrap(err)
+	}
+	key.ID = base64.RawURLEncoding.EncodeToString(id[:])
+	secretString := base64.RawURLEncoding.EncodeToString(secret[:])
+	key.SecretHash = apiKeySecretHash(secretString)
+	return key.ID + "." + secretString, nil
+}
+
+type APIKeyDb interface {
+	// Stores a new key, returning the full key to hand out.
+	CreateKey(key *APIKey) (string, error)
+	// Returns the key if it is valid and active, marking it as used.
+	Authenticate(token string, now time.Time) (*APIKey, error)
+	RevokeKey(id, revokedBy string) error
+	GetKeys() ([]*APIKey, error)
+}
+
+type apiKeyDbBolt struct {
+	db boltorm.DB
+}
+
+func NewAPIKeyDb(db boltorm.DB) (APIKeyDb, error) {
+	if err := db.Update(func(tx boltorm.Tx) error {
+		return tx.CreateBucketIfNotExists(BOLT_APIKEYBUCKET)
+	}); err != nil {
+		return nil, err
+	}
+	return &apiKeyDbBolt{db}, nil
+}
+
+func (d *apiKeyDbBolt) CreateKey(key *APIKey) (string, error) {
+	token, err := newAPIKeySecret(key)
+	if err != nil {
+		return "", err
+	}
+	return token, d.db.Update(func(tx boltorm.Tx) error {
+		return tx.Insert(BOLT_APIKEYBUCKET, []byte(key.ID), key)
+	})
+}
+
+func (d *apiKeyDbBolt) Authenticate(token string, now time.Time) (key *APIKey, err error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, nil
+	}
+	err = d.db.View(func(tx boltorm.Tx) error {
+		key = &APIKey{}
+		return tx.Get(BOLT_APIKEYBUCKET, []byte(parts[0]), key)
+	})
+	if boltorm.ErrKeyDoesNotExist.Contains(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(apiKeySecretHash(parts[1])), []byte(key.SecretHash)) != 1 || !key.active(now) {
+		return nil, nil
+	}
+	if now.Sub(key.LastUsed) < apiKeyTouchInterval {
+		return key, nil
+	}
+	return key, d.db.Update(func(tx boltorm.Tx) error {
+		// Checked again, in case it was revoked in between.
+		current := &APIKey{}
+		if err := tx.Get(BOLT_APIKEYBUCKET, []byte(key.ID), current); err != nil {
+			return err
+		}
+		if current.Revoked {
+			key = nil
+			return nil
+		}
+		current.LastUsed = now
+		key = current
+		return tx.Update(BOLT_APIKEYBUCKET, []byte(current.ID), current)
+	})
+}
+
+func (d *apiKeyDbBolt) RevokeKey(id, revokedBy string) error {
+	return d.db.Update(func(tx boltorm.Tx) error {
+		key := &APIKey{}
+		if err := tx.Get(BOLT_APIKEYBUCKET, []byte(id), key); err != nil {
+			if boltorm.ErrKeyDoesNotExist.Contains(err) {
+				return APIKeyNotFound.New("%s", id)
+			}
+			return err
+		}
+		key.Revoked = true
+		key.RevokedBy = revokedBy
+		return tx.Update(BOLT_APIKEYBUCKET, []byte(id), key)
+	})
+}
+
+// Lists every key, revoked and expired ones included, newest first.
+func (d *apiKeyDbBolt) GetKeys() (keys []*APIKey, err error) {
+	keys = []*APIKey{}
+	return keys, d.db.View(func(tx boltorm.Tx) error {
+		res, err := tx.GetAll(BOLT_APIKEYBUCKET, &APIKey{})
+		if err != nil {
+			return err
+		}
+		keys = res.([]*APIKey)
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].Created.After(keys[j].Created)
+		})
+		return nil
+	})
+}
+
+// Returns the bearer token the request was sent with, if any.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < len("Bearer ") || !strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[len("Bearer "):]), true
+}
+
+type apiKeyContextKey struct{}
+
+// Returns the request carrying the key its token was checked against, so
+// it is only authenticated once.
+func withAPIKey(r *http.Request, key *APIKey) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key))
+}
+
+// Returns the key the request's token was checked against, nil if it had none
+// or it wasn't valid.
+func requestAPIKey(r *http.Request) *APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey{}).(*APIKey)
+	return key
+}
+
+type APIKeyHandler struct {
+	db          APIKeyDb
+	authHandler *AuthenticationHandler
+}
+
+func (h *APIKeyHandler) GetAll(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.db.GetKeys()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
+
+// Creates a key, returning it along with the only copy of its secret.
+func (h *APIKeyHandler) Create(w http.ResponseWriter, r *http.Request) {
+	input := struct {
+		Name    string     `json:"name"`
+		Scope   string     `json:"scope"`
+		Expires *time.Time `json:"expires"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid API key json given", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	key := &APIKey{
+		Name:      strings.TrimSpace(input.Name),
+		Scope:     input.Scope,
+		CreatedBy: h.authHandler.sessionUser(r),
+		Created:   now,
+		Expires:   now.Add(apiKeyDefaultLifetime),
+	}
+	if input.Expires != nil {
+		key.Expires = *input.Expires
+	}
+
+	verr := &ValidationError{}
+	if key.Name == "" {
+		verr.add("name", "is required")
+	}
+	if indexOf(apiKeyScopes, key.Scope) < 0 {
+		verr.add("scope", "must be one of %s", strings.Join(apiKeyScopes, ", "))
+	}
+	if !key.Expires.After(now) {
+		verr.add("expires", "must be in the future")
+	}
+	if len(verr.Errors) != 0 {
+		writeValidationError(w, verr)
+		return
+	}
+
+	token, err := h.db.CreateKey(key)
+	if err != nil {
+		log.Printf("Failed to create API key %s!  Error: %s", key.Name, err)
+		httpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, struct {
+		*APIKey
+		Key string `json:"key"`
+	}{key, token})
+}
+
+func (h *APIKeyHandler) Revoke(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["ID"]
+	if err := h.db.RevokeKey(id, h.authHandler.sessionUser(r)); err != nil {
+		if !APIKeyNotFound.Contains(err) {
+			log.Printf("Failed to revoke API key %s!  Error: %s", id, err)
+		}
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func NewAPIKeyHandler(r *mux.Router, db APIKeyDb, authHandler *AuthenticationHandler) *APIKeyHandler {
+	h := &APIKeyHandler{
+		db:          db,
+		authHandler: authHandler,
+	}
+
+	r.HandleFunc("/apikeys", authHandler.RoleFunc(h.GetAll, RoleSuperadmin)).Methods("GET")
+	r.HandleFunc("/apikeys", authHandler.RoleFunc(h.Create, RoleSuperadmin)).Methods("POST")
+	r.HandleFunc("/apikeys/{ID}", authHandler.RoleFunc(h.Revoke, RoleSuperadmin)).Methods("DELETE")
+
+	return h
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestAPIKeyDb(t *testing.T) {
+	Convey("With an API key", t, func() {
+		keyDb, err := NewAPIKeyDb(boltorm.NewMemoryDB())
+		So(err, ShouldBeNil)
+		created := time.Date(2016, 7, 1, 9, 0, 0, 0, time.UTC)
+		key := &APIKey{Name: "dashboard", Scope: RoleViewer, Created: created, Expires: created.Add(24 * time.Hour)}
+		token, err := keyDb.CreateKey(key)
+		So(err, ShouldBeNil)
+		authenticate := func(token string, now time.Time) *APIKey {
+			key, err := keyDb.Authenticate(token, now)
+			So(err, ShouldBeNil)
+			return key
+		}
+
+		Convey("Only a hash of it should be stored", func() {
+			keys, err := keyDb.GetKeys()
+			So(err, ShouldBeNil)
+			So(len(keys), ShouldEqual, 1)
+			So(keys[0].SecretHash, ShouldNotEqual, "")
+			So(token, ShouldNotContainSubstring, keys[0].SecretHash)
+		})
+		Convey("It should authenticate and record its use", func() {
+			used := authenticate(token, created.Add(time.Hour))
+			So(used, ShouldNotBeNil)
+			So(used.Name, ShouldEqual, "dashboard")
+			keys, err := keyDb.GetKeys()
+			So(err, ShouldBeNil)
+			So(keys[0].LastUsed, ShouldResemble, created.Add(time.Hour))
+		})
+		Convey("A wrong secret should be refused", func() {
+			So(authenticate(key.ID+".wrong", created), ShouldBeNil)
+			So(authenticate(key.ID, created), ShouldBeNil)
+			So(authenticate("unknown."+token, created), ShouldBeNil)
+		})
+		Convey("It should stop working once it expires", func() {
+			So(authenticate(token, created.Add(24*time.Hour)), ShouldBeNil)
+		})
+		Convey("It should stop working once revoked", func() {
+			So(keyDb.RevokeKey(key.ID, "admin@example.com"), ShouldBeNil)
+			So(authenticate(token, created), ShouldBeNil)
+			So(APIKeyNotFound.Contains(keyDb.RevokeKey("unknown", "admin@example.com")), ShouldBeTrue)
+		})
+	})
+}
+
+// Counts the keys looked up, to check each request only does so once.
+type countingAPIKeyDb struct {
+	APIKeyDb
+	authenticated int
+}
+
+func (d *countingAPIKeyDb) Authenticate(token string, now time.Time) (*APIKey, error) {
+	d.authenticated++
+	return d.APIKeyDb.Authenticate(token, now)
+}
+
+func TestAPIKeyHandler(t *testing.T) {
+	Convey("With API keys accepted", t, func() {
+		db := boltorm.NewMemoryDB()
+		invDb, err := NewInvoiceDb(db)
+		So(err, ShouldBeNil)
+		config := &configType{}
+		config.Auth.AllowedEmails = stringSliceConfig{"admin@example.com"}
+		prdb, err := NewPreRegBoltDb(db, config, invDb)
+		So(err, ShouldBeNil)
+		bolt, err := NewAPIKeyDb(db)
+		So(err, ShouldBeNil)
+		keyDb := &countingAPIKeyDb{APIKeyDb: bolt}
+		store := sessions.NewCookieStore([]byte("A"))
+		router := mux.NewRouter()
+		authHandler := NewAuthenticationHandler(router, config, store, nil, nil, nil, keyDb)
+		NewAPIKeyHandler(router, keyDb, authHandler)
+		newTestPreRegHandler(router, config, prdb, newTestFormSchemaDb(db), authHandler, nil)
+		site := &xsrfVerifierHandler{&xsrfTokenCreator{nil, config, store}, router, authHandler}
+
+		rec := &GroupPreRegistration{GroupName: "Group", PackName: "A", Council: "Voyageur", ContactLeaderEmail: "a@example.com"}
+		So(prdb.CreateRecord(rec), ShouldBeNil)
+
+		// Logged in superadmins pass the XSRF check the way the app does.
+		adminRequest := func(method, path string, body []byte) *httptest.ResponseRecorder {
+			r, err := http.NewRequest(method, "http://localhost:8080"+path, bytes.NewReader(body))
+			So(err, ShouldBeNil)
+			r.Header["Cookie"] = sessionCookie(store, map[interface{}]interface{}{
+				authStatusLoggedIn: true,
+				authUserEmail:      "admin@example.com",
+				xsrfSessionToken:   "token",
+			})
+			r.Header.Set("X-Xsrf-Token", "token")
+			w := httptest.NewRecorder()
+			site.ServeHTTP(w, r)
+			return w
+		}
+		keyRequest := func(method, path, token string) *httptest.ResponseRecorder {
+			r, err := http.NewRequest(method, "http://localhost:8080"+path, nil)
+			So(err, ShouldBeNil)
+			r.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			site.ServeHTTP(w, r)
+			return w
+		}
+		createKey := func(body string) (int, map[string]interface{}) {
+			w := adminRequest("POST", "/apikeys", []byte(body))
+			created := map[string]interface{}{}
+			json.Unmarshal(w.Body.Bytes(), &created)
+			return w.Code, created
+		}
+
+		code, created := createKey(`{"name": "treasurer", "scope": "finance"}`)
+		So(code, ShouldEqual, http.StatusCreated)
+		token, _ := created["key"].(string)
+		So(token, ShouldNotEqual, "")
+
+		Convey("The key should work without a session or XSRF token", func() {
+			So(keyRequest("GET", "/preregistration", token).Code, ShouldEqual, http.StatusOK)
+			So(keyRequest("GET", "/preregistration/export", token).Code, ShouldEqual, http.StatusOK)
+		})
+		Convey("The key should only be looked up once per request", func() {
+			keyDb.authenticated = 0
+			So(keyRequest("GET", "/preregistration", token).Code, ShouldEqual, http.StatusOK)
+			So(keyDb.authenticated, ShouldEqual, 1)
+		})
+		Convey("The key should be limited to its scope", func() {
+			So(keyRequest("POST", "/preregistration/"+rec.SecurityKey+"/promote", token).Code, ShouldEqual, http.StatusForbidden)
+			So(keyRequest("GET", "/apikeys", token).Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("Bad keys should still need an XSRF token", func() {
+			So(keyRequest("GET", "/preregistration", "bad.key").Code, ShouldEqual, http.StatusBadRequest)
+		})
+		Convey("Listing keys should leave out their secrets", func() {
+			w := adminRequest("GET", "/apikeys", nil)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldContainSubstring, "treasurer")
+			So(w.Body.String(), ShouldNotContainSubstring, token[len(created["id"].(string))+1:])
+		})
+		Convey("A revoked key should stop working", func() {
+			So(adminRequest("DELETE", "/apikeys/"+created["id"].(string), nil).Code, ShouldEqual, http.StatusNoContent)
+			So(keyRequest("GET", "/preregistration", token).Code, ShouldEqual, http.StatusBadRequest)
+		})
+		Convey("Bad keys should not be created", func() {
+			code, _ := createKey(`{"name": "", "scope": "superadmin"}`)
+			So(code, ShouldEqual, http.StatusUnprocessableEntity)
+			code, _ = createKey(`{"name": "old", "scope": "viewer", "expires": "2016-01-01T00:00:00Z"}`)
+			So(code, ShouldEqual, http.StatusUnprocessableEntity)
+		})
+	})
+}
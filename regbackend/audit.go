@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+)
+
+type AuditEntry struct {
+	ID         uint64    `json:"id"`
+	Time       time.Time `json:"time"`
+	User       string    `json:"user"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Action     string    `json:"action"`
+	Detail     string    `json:"detail"`
+}
+
+type AuditLog interface {
+	Record(entry *AuditEntry) error
+	GetAll() ([]*AuditEntry, error)
+}
+
+var (
+	BOLT_AUDITBUCKET = []byte("BUCKET_AUDIT")
+)
+
+type auditLogBolt struct {
+	db boltorm.DB
+}
+
+func NewAuditLog(db boltorm.DB) (AuditLog, error) {
+	if err := db.Update(func(tx boltorm.Tx) error {
+		return tx.CreateBucketIfNotExists(BOLT_AUDITBUCKET)
+	}); err != nil {
+		return nil, err
+	}
+	return &auditLogBolt{db}, nil
+}
+
+func (a *auditLogBolt) Record(entry *AuditEntry) error {
+	return a.db.Update(func(tx boltorm.Tx) error {
+		id, err := tx.NextSequenceForBucket(BOLT_AUDITBUCKET)
+		if err != nil {
+			return err
+		}
+		entry.ID = id
+		entry.Time = time.Now()
+		var idBytes [8]byte
+		binary.BigEndian.PutUint64(idBytes[:], entry.ID)
+		return tx.Insert(BOLT_AUDITBUCKET, idBytes[:], entry)
+	})
+}
+
+func (a *auditLogBolt) GetAll() (entries []*AuditEntry, err error) {
+	return entries, a.db.View(func(tx boltorm.Tx) error {
+		if res, err := tx.GetAll(BOLT_AUDITBUCKET, &AuditEntry{}); err != nil {
+			return err
+		} else {
+			entries = res.([]*AuditEntry)
+		}
+		return nil
+	})
+}
+
+// Builds an audit entry for an action taken by the user behind the given request.
+func newAuditEntry(r *http.Request, authHandler *AuthenticationHandler, action, detail string) *AuditEntry {
+	return &AuditEntry{
+		User:       authHandler.sessionUser(r),
+		RemoteAddr: r.RemoteAddr,
+		Action:     action,
+		Detail:     detail,
+	}
+}
+
+type AuditHandler struct {
+	log AuditLog
+}
+
+func (h *AuditHandler) GetAll(w http.ResponseWriter, r *http.Request) {
+	entries, err := h.log.GetAll()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	if err := json.NewEncoder(buf).Encode(entries); err != nil {
+		http.Error(w, "Failed to get audit log", http.StatusInternalServerError)
+		return
+	}
+	w.Header()["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, buf)
+}
+
+func NewAuditHandler(r *mux.Router, log AuditLog, authHandler *AuthenticationHandler) *AuditHandler {
+	h := &AuditHandler{
+		log: log,
+	}
+
+	r.HandleFunc("/audit", authHandler.RoleFunc(h.GetAll, RoleSuperadmin)).Methods("GET")
+
+	return h
+}
@@ -1,22 +1,31 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/gob"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	"google.golang.org/api/plus/v1"
 )
 
 type authStatusType int
 
 const (
 	authStatusLoggedIn authStatusType = 0
+	authUserEmail      authStatusType = 1
+	// The event the administrator logged in through, empty for the default one.
+	authEventID authStatusType = 2
+	// The state and nonce of a login through the provider that hasn't
+	// finished yet.
+	authOIDCState authStatusType = 3
+	authOIDCNonce authStatusType = 4
+	// The server side record of the login, see adminsessions.go.
+	authSessionID authStatusType = 5
 )
 
 func init() {
@@ -26,88 +35,351 @@ func init() {
 type AuthenticationHandler struct {
 	config *configType
 	store  sessions.Store
+	// Nil for the default event.
+	event *Event
+	// Nil when only the administrators from the configuration may log in.
+	roles RoleDb
+	oidc  *oidcProvider
+	// Nil when logins aren't tracked on the server, so they only end when
+	// the cookie does.
+	adminSessions AdminSessionDb
+	// Nil when API keys aren't accepted.
+	apiKeys APIKeyDb
 }
 
-func (a *AuthenticationHandler) sessionIsLoggedin(r *http.Request) bool {
+func (a *AuthenticationHandler) eventID() string {
+	if a.event == nil {
+		return ""
+	}
+	return a.event.ID
+}
+
+func (a *AuthenticationHandler) globalAdmin(email string) bool {
+	for _, allowedEmail := range a.config.Auth.AllowedEmails {
+		if allowedEmail == email {
+			return true
+		}
+	}
+	return false
+}
+
+// The administrators from the flags, followed by the event's own.
+func (a *AuthenticationHandler) configuredAdmins() []string {
+	emails := append([]string{}, a.config.Auth.AllowedEmails...)
+	if a.event != nil {
+		emails = append(emails, a.event.AdminEmails...)
+	}
+	return emails
+}
+
+// Administrators from the flags can log in to any event, event
+// administrators only to their own.
+func (a *AuthenticationHandler) allowedAdmin(email string) bool {
+	if a.globalAdmin(email) {
+		return true
+	} else if a.event == nil {
+		return false
+	}
+	for _, adminEmail := range a.event.AdminEmails {
+		if adminEmail == email {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the administrator's role, or an empty string if they have none.
+// Configured administrators are always superadmins, so they can't be
+// locked out through the stored roles.
+func (a *AuthenticationHandler) role(email string) (string, error) {
+	if a.allowedAdmin(email) {
+		return RoleSuperadmin, nil
+	} else if a.roles == nil || email == "" {
+		return "", nil
+	}
+	return a.roles.GetRole(email)
+}
+
+// Returns the role of the administrator logged in to the request's session,
+// looked up on every request so role changes apply straight away.
+// Sessions are shared between events, so a login through another event only
+// counts here for administrators from the flags.
+func (a *AuthenticationHandler) sessionRole(r *http.Request) string {
+	if _, ok := bearerToken(r); ok {
+		if key := requestAPIKey(r); key != nil {
+			return key.Scope
+		}
+		return ""
+	}
 	sess, _ := sessions.GetRegistry(r).Get(a.store, globalSessionName)
 	if sess == nil || sess.Values[authStatusLoggedIn] == nil || !sess.Values[authStatusLoggedIn].(bool) {
-		return false
-	} else {
-		return true
+		return ""
+	}
+	email, _ := sess.Values[authUserEmail].(string)
+	eventID, _ := sess.Values[authEventID].(string)
+	if eventID != a.eventID() && !a.globalAdmin(email) {
+		return ""
 	}
+	if a.adminSessions != nil {
+		id, _ := sess.Values[authSessionID].(string)
+		session, err := a.adminSessions.TouchSession(id, time.Now(), a.config.Auth.IdleTimeout, a.config.Auth.SessionLifetime)
+		if err != nil {
+			log.Printf("Failed to look up the session of %s, treating them as logged out!  Error: %s", email, err)
+			return ""
+		} else if session == nil || session.Email != email {
+			return ""
+		}
+	}
+	role, err := a.role(email)
+	if err != nil {
+		log.Printf("Failed to look up the role of %s, treating them as logged out!  Error: %s", email, err)
+		return ""
+	}
+	return role
+}
+
+// Returns the key for the token if it is valid.  Requests with a token only
+// ever act as its key, never as the session they might also have.
+func (a *AuthenticationHandler) apiKey(token string) *APIKey {
+	if a.apiKeys == nil {
+		return nil
+	}
+	key, err := a.apiKeys.Authenticate(token, time.Now())
+	if err != nil {
+		log.Printf("Failed to look up API key, refusing it!  Error: %s", err)
+		return nil
+	}
+	return key
+}
+
+func (a *AuthenticationHandler) sessionIsLoggedin(r *http.Request) bool {
+	return a.sessionRole(r) != ""
+}
+
+// Returns the email address of the administrator logged in to the request's
+// session, or who it was made as for API keys.
+func (a *AuthenticationHandler) sessionUser(r *http.Request) string {
+	if _, ok := bearerToken(r); ok {
+		if key := requestAPIKey(r); key != nil {
+			return key.user()
+		}
+		return ""
+	}
+	sess, _ := sessions.GetRegistry(r).Get(a.store, globalSessionName)
+	if sess == nil {
+		return ""
+	}
+	email, _ := sess.Values[authUserEmail].(string)
+	return email
+}
+
+type sessionStatus struct {
+	LoggedIn bool   `json:"loggedIn"`
+	Email    string `json:"email"`
+	Role     string `json:"role"`
 }
 
 func (a *AuthenticationHandler) VerifySession(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain")
-	if a.sessionIsLoggedin(r) {
-		w.Write([]byte("true"))
-	} else {
-		w.Write([]byte("false"))
+	status := sessionStatus{}
+	if status.Role = a.sessionRole(r); status.Role != "" {
+		status.LoggedIn = true
+		status.Email = a.sessionUser(r)
 	}
+	writeJSON(w, http.StatusOK, status)
 }
 
-func (a *AuthenticationHandler) VerifyGoogleToken(w http.ResponseWriter, r *http.Request) {
-	var code string
-	if codeB, err := ioutil.ReadAll(r.Body); err != nil {
-		http.Error(w, "Failed to read code!", http.StatusBadRequest)
-		return
-	} else {
-		code = string(codeB)
+// Where the provider sends administrators back to, on the host they started
+// logging in from so each event's own host names work.
+func (a *AuthenticationHandler) oidcConfig(r *http.Request, discovery *oidcDiscovery) *oauth2.Config {
+	scheme := "https"
+	if develop && r.TLS == nil {
+		scheme = "http"
 	}
-	conf := &oauth2.Config{
+	return &oauth2.Config{
 		ClientID:     a.config.Auth.ClientID,
 		ClientSecret: a.config.Auth.ClientSecret,
-		RedirectURL:  "postmessage",
-		Endpoint:     google.Endpoint,
+		RedirectURL:  scheme + "://" + r.Host + "/api/authentication/oidc/callback",
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  discovery.AuthorizationEndpoint,
+			TokenURL: discovery.TokenEndpoint,
+		},
+		Scopes: []string{"openid", "email"},
 	}
-	tok, err := conf.Exchange(oauth2.NoContext, code)
+}
+
+// Sends the administrator to the provider, remembering a fresh state and
+// nonce in their session to check the response against.
+func (a *AuthenticationHandler) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	} else if a.config.Auth.ClientID == "" {
+		http.Error(w, "Logging in through a provider isn't set up", http.StatusNotFound)
+		return
+	}
+	discovery, err := a.oidc.endpoints()
 	if err != nil {
-		log.Print("Failed to exchange code, err ", err)
-		http.Error(w, "Failed to talk to Google!", http.StatusInternalServerError)
+		log.Print("Failed to discover the OpenID Connect provider, err ", err)
+		http.Error(w, "Failed to talk to the login provider!", http.StatusBadGateway)
 		return
 	}
-	client := conf.Client(oauth2.NoContext, tok)
+	sess, err := sessions.GetRegistry(r).Get(a.store, globalSessionName)
+	if sess == nil {
+		log.Panicf("Failed to get session, err %s", err)
+	}
+	state, err := oidcRandom()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	nonce, err := oidcRandom()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	sess.Values[authOIDCState] = state
+	sess.Values[authOIDCNonce] = nonce
+	http.Redirect(w, r, a.oidcConfig(r, discovery).AuthCodeURL(state, oauth2.SetAuthURLParam("nonce", nonce)), http.StatusFound)
+}
 
-	plusService, err := plus.New(client)
+// Finishes logging in once the provider sends the administrator back, and
+// sends them on to the admin pages, or back to the login page with the
+// reason it failed.
+func (a *AuthenticationHandler) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+	sess, err := sessions.GetRegistry(r).Get(a.store, globalSessionName)
+	if sess == nil {
+		log.Panicf("Failed to get session, err %s", err)
+	}
+	state, _ := sess.Values[authOIDCState].(string)
+	nonce, _ := sess.Values[authOIDCNonce].(string)
+	// Each login attempt can only be finished once.
+	delete(sess.Values, authOIDCState)
+	delete(sess.Values, authOIDCNonce)
+	failed := func(reason string) {
+		http.Redirect(w, r, "/login?error="+reason, http.StatusFound)
+	}
+
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(r.FormValue("state"))) != 1 {
+		failed("state")
+		return
+	} else if r.FormValue("error") != "" || r.FormValue("code") == "" {
+		failed("cancelled")
+		return
+	}
+	discovery, err := a.oidc.endpoints()
 	if err != nil {
-		log.Panic("Shouldn't happen, err: ", err)
+		log.Print("Failed to discover the OpenID Connect provider, err ", err)
+		failed("provider")
+		return
 	}
-	meGetter := plusService.People.Get("me")
-	me, err := meGetter.Do()
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, a.oidc.client)
+	tok, err := a.oidcConfig(r, discovery).Exchange(ctx, r.FormValue("code"))
 	if err != nil {
-		log.Print("Failed to get the user, err ", err)
-		http.Error(w, "Failed to get user information!", http.StatusInternalServerError)
-	}
-	var primaryEmail string
-	for _, emailInfo := range me.Emails {
-		if emailInfo.Type == "account" {
-			primaryEmail = emailInfo.Value
-			break
-		}
+		log.Print("Failed to exchange code, err ", err)
+		failed("provider")
+		return
 	}
-	var validEmail bool
-	for _, allowedEmail := range a.config.Auth.AllowedEmails {
-		if allowedEmail == primaryEmail {
-			validEmail = true
-			break
+	rawIDToken, _ := tok.Extra("id_token").(string)
+	claims, err := a.oidc.verify(rawIDToken, a.config.Auth.ClientID, nonce, time.Now())
+	if err != nil {
+		log.Print("Refused ID token, err ", err)
+		failed("token")
+		return
+	}
+	role, err := a.role(claims.Email)
+	if err != nil {
+		log.Print("Failed to look up the user's role, err ", err)
+		http.Error(w, "Failed to check user's role!", http.StatusInternalServerError)
+		return
+	}
+	if role == "" {
+		log.Printf("Refused login from %s, who has no role", claims.Email)
+		failed("refused")
+		return
+	}
+	if err := a.logIn(r, claims.Email); err != nil {
+		log.Print("Failed to record the login, err ", err)
+		http.Error(w, "Failed to log in!", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/admin/", http.StatusFound)
+}
+
+// Logs the request's session in as the administrator, once they've proven
+// who they are.
+func (a *AuthenticationHandler) logIn(r *http.Request, email string) error {
+	sess, err := sessions.GetRegistry(r).Get(a.store, globalSessionName)
+	if sess == nil {
+		log.Panicf("Failed to get session, err %s", err)
+	}
+	if a.adminSessions != nil {
+		id, err := newAdminSessionID()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if err := a.adminSessions.CreateSession(&AdminSession{
+			ID:        id,
+			Email:     email,
+			EventID:   a.eventID(),
+			IP:        requestIP(r),
+			UserAgent: r.UserAgent(),
+			Created:   now,
+			LastSeen:  now,
+		}); err != nil {
+			return err
+		}
+		sess.Values[authSessionID] = id
+		// Logins are rare enough to clear out the old sessions as they come.
+		if err := a.adminSessions.SweepSessions(now, a.config.Auth.IdleTimeout, a.config.Auth.SessionLifetime); err != nil {
+			log.Printf("Failed to sweep expired admin sessions!  Error: %s", err)
 		}
 	}
-	if validEmail {
-		sess, err := sessions.GetRegistry(r).Get(a.store, globalSessionName)
-		if sess == nil {
-			log.Panicf("Failed to get session, err %s", err)
+	// Saved under a new id, so whoever knew the one from before logging
+	// in can't share the login.
+	sess.ID = ""
+	sess.Values[authStatusLoggedIn] = true
+	sess.Values[authUserEmail] = email
+	sess.Values[authEventID] = a.eventID()
+	return nil
+}
+
+// Returns the id of the request's server side login record, if any.
+func (a *AuthenticationHandler) sessionID(r *http.Request) string {
+	sess, _ := sessions.GetRegistry(r).Get(a.store, globalSessionName)
+	if sess == nil {
+		return ""
+	}
+	id, _ := sess.Values[authSessionID].(string)
+	return id
+}
+
+// Ends the login, both in the cookie and on the server so a copy of the
+// cookie can't be used either.
+func (a *AuthenticationHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	sess, err := sessions.GetRegistry(r).Get(a.store, globalSessionName)
+	if sess == nil {
+		log.Panicf("Failed to get session, err %s", err)
+	}
+	if id, _ := sess.Values[authSessionID].(string); id != "" && a.adminSessions != nil {
+		email, _ := sess.Values[authUserEmail].(string)
+		if err := a.adminSessions.RevokeSession(id, email); err != nil && !AdminSessionNotFound.Contains(err) {
+			log.Print("Failed to revoke session on logout, err ", err)
+			httpError(w, err)
+			return
 		}
-		sess.Values[authStatusLoggedIn] = true
-		w.Header().Set("Content-Type", "text/plain")
-		w.WriteHeader(200)
-		w.Write([]byte("true"))
-	} else {
-		w.Header().Set("Content-Type", "text/plain")
-		w.WriteHeader(200)
-		w.Write([]byte("false"))
 	}
+	for _, key := range []authStatusType{authStatusLoggedIn, authUserEmail, authEventID, authSessionID} {
+		delete(sess.Values, key)
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
+// Lets through administrators with any role.
 func (a *AuthenticationHandler) AdminFunc(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if !a.sessionIsLoggedin(r) {
@@ -118,14 +390,40 @@ func (a *AuthenticationHandler) AdminFunc(h http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-func NewAuthenticationHandler(r *mux.Router, config *configType, store sessions.Store) *AuthenticationHandler {
+// Only lets through administrators with one of the roles.  Superadmins are
+// always let through.
+func (a *AuthenticationHandler) RoleFunc(h http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if role := a.sessionRole(r); role == RoleSuperadmin || (role != "" && indexOf(roles, role) >= 0) {
+			h(w, r)
+		} else {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		}
+	}
+}
+
+// Serves the endpoints the browser is sent to while logging in through the
+// provider.  Being reached by following links and redirects they can't carry
+// the XSRF header, so go on the site ahead of the api, with its path.
+func (a *AuthenticationHandler) handleOIDC(siteRouter *http.ServeMux) {
+	siteRouter.Handle("/api/authentication/oidc/login", disableCacheHandler{http.HandlerFunc(a.OIDCLogin)})
+	siteRouter.Handle("/api/authentication/oidc/callback", disableCacheHandler{http.HandlerFunc(a.OIDCCallback)})
+}
+
+func NewAuthenticationHandler(r *mux.Router, config *configType, store sessions.Store, event *Event, roles RoleDb, adminSessions AdminSessionDb, apiKeys APIKeyDb) *AuthenticationHandler {
 	authHandler := &AuthenticationHandler{
 		store:  store,
 		config: config,
+		event:  event,
+		roles:  roles,
+		oidc:   newOIDCProvider(config.Auth.Issuer, &http.Client{Timeout: oidcTimeout}),
+
+		adminSessions: adminSessions,
+		apiKeys:       apiKeys,
 	}
 
 	r.HandleFunc("/authentication/isLoggedIn", authHandler.VerifySession).Methods("GET")
-	r.HandleFunc("/authentication/googletoken", authHandler.VerifyGoogleToken).Methods("POST")
+	r.HandleFunc("/authentication/logout", authHandler.Logout).Methods("POST")
 
 	return authHandler
 }
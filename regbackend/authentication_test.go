@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -11,6 +14,56 @@ import (
 	"testing"
 )
 
+// An authentication handler for tests that need nothing more than the
+// administrators in the configuration.
+func newTestAuthHandler(config *configType, store sessions.Store) *AuthenticationHandler {
+	return &AuthenticationHandler{config: config, store: store}
+}
+
+// Returns the cookie for a session with the values.
+func sessionCookie(store sessions.Store, values map[interface{}]interface{}) []string {
+	r := &http.Request{}
+	sess, err := store.New(r, globalSessionName)
+	So(err, ShouldBeNil)
+	for k, v := range values {
+		sess.Values[k] = v
+	}
+	w := httptest.NewRecorder()
+	So(store.Save(r, w, sess), ShouldBeNil)
+	return w.Header()["Set-Cookie"]
+}
+
+// Returns the cookie for a session logged in as the administrator.
+func loggedInAs(store sessions.Store, email string) []string {
+	return sessionCookie(store, map[interface{}]interface{}{
+		authStatusLoggedIn: true,
+		authUserEmail:      email,
+	})
+}
+
+// Serves a request to h with the cookies, if any.  Bodies other than bytes
+// or strings are sent as json.
+func testRequest(h http.Handler, method, path string, body interface{}, cookies []string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		reader = bytes.NewReader(b)
+	case string:
+		reader = bytes.NewReader([]byte(b))
+	default:
+		data, err := json.Marshal(b)
+		So(err, ShouldBeNil)
+		reader = bytes.NewReader(data)
+	}
+	r, err := http.NewRequest(method, "http://localhost:8080"+path, reader)
+	So(err, ShouldBeNil)
+	r.Header["Cookie"] = cookies
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
 func TestVerifySession(t *testing.T) {
 	Convey("With initialized pieces", t, func() {
 		r, err := http.NewRequest("GET", "http://localhost:8080/api/authentication/isLoggedIn", nil)
@@ -19,27 +72,35 @@ func TestVerifySession(t *testing.T) {
 		sess, err := sessions.GetRegistry(r).Get(store, globalSessionName)
 		So(err, ShouldBeNil)
 		So(sess, ShouldNotBeNil)
-		aH := AuthenticationHandler{&configType{}, store}
+		config := &configType{}
+		config.Auth.AllowedEmails = stringSliceConfig{"admin@example.com"}
+		aH := newTestAuthHandler(config, store)
 		helper := func(output string) {
 			w := httptest.NewRecorder()
 			aH.VerifySession(w, r)
 			w.Flush()
-			So(w.HeaderMap.Get("Content-Type"), ShouldEqual, "text/plain")
+			So(w.HeaderMap.Get("Content-Type"), ShouldEqual, "application/json")
 			body, err := ioutil.ReadAll(w.Body)
 			So(err, ShouldBeNil)
-			So(string(body), ShouldResemble, output)
+			So(string(body), ShouldResemble, output+"\n")
 		}
-		Convey("Succeed when session is marked as true", func() {
+		sess.Values[authUserEmail] = "admin@example.com"
+		Convey("Succeed with the role when session is marked as true", func() {
 			sess.Values[authStatusLoggedIn] = true
-			helper("true")
+			helper(`{"loggedIn":true,"email":"admin@example.com","role":"superadmin"}`)
 		})
 		Convey("Fail when session is marked as false", func() {
 			sess.Values[authStatusLoggedIn] = false
-			helper("false")
+			helper(`{"loggedIn":false,"email":"","role":""}`)
 		})
 		Convey("Fail when session is missing the value", func() {
 			delete(sess.Values, authStatusLoggedIn)
-			helper("false")
+			helper(`{"loggedIn":false,"email":"","role":""}`)
+		})
+		Convey("Fail when the administrator no longer has a role", func() {
+			sess.Values[authStatusLoggedIn] = true
+			sess.Values[authUserEmail] = "former@example.com"
+			helper(`{"loggedIn":false,"email":"","role":""}`)
 		})
 	})
 }
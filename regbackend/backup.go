@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/spacemonkeygo/errors"
+)
+
+var (
+	BackupError        = errors.NewClass("Backup error")
+	BackupInvalidError = BackupError.NewClass("Invalid backup snapshot")
+)
+
+const (
+	backupPrefix         = "records-"
+	backupSuffix         = ".bolt"
+	backupChecksumSuffix = ".sha256"
+	backupTimeFormat     = "20060102T150405.000000000Z"
+)
+
+type BackupService struct {
+	db        *bolt.DB
+	directory string
+	interval  time.Duration
+	retention int
+}
+
+func NewBackupService(db *bolt.DB, directory string, interval time.Duration, retention int) (*BackupService, error) {
+	if interval <= 0 {
+		return nil, BackupError.New("Backup interval must be positive, got %s", interval)
+	}
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, BackupError.New("Failed to create backup directory %s: %s", directory, err)
+	}
+	return &BackupService{
+		db:        db,
+		directory: directory,
+		interval:  interval,
+		retention: retention,
+	}, nil
+}
+
+// Takes a consistent snapshot of the database, writes it and its checksum
+// into the backup directory and rotates out old snapshots.  Returns the path
+// of the new snapshot.
+func (b *BackupService) Snapshot() (string, error) {
+	name := backupPrefix + time.Now().UTC().Format(backupTimeFormat) + backupSuffix
+	path := filepath.Join(b.directory, name)
+
+	file, err := ioutil.TempFile(b.directory, ".snapshot")
+	if err != nil {
+		return "", BackupError.New("Failed to create snapshot file: %s", err)
+	}
+	tmpName := file.Name()
+	defer os.Remove(tmpName)
+
+	hash := sha256.New()
+	err = b.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(io.MultiWriter(file, hash))
+		return err
+	})
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", BackupError.New("Failed to write snapshot: %s", err)
+	}
+
+	checksum := fmt.Sprintf("%s  %s\n", hex.EncodeToString(hash.Sum(nil)), name)
+	if err := ioutil.WriteFile(path+backupChecksumSuffix, []byte(checksum), 0600); err != nil {
+		return "", BackupError.New("Failed to write snapshot checksum: %s", err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(path + backupChecksumSuffix)
+		return "", BackupError.New("Failed to move snapshot into place: %s", err)
+	}
+
+	if err := b.rotate(); err != nil {
+		return path, err
+	}
+	return path, nil
+}
+
+// Returns the snapshots in the backup directory, oldest first.
+func (b *BackupService) Snapshots() ([]string, error) {
+	infos, err := ioutil.ReadDir(b.directory)
+	if err != nil {
+		return nil, BackupError.New("Failed to list backup directory: %s", err)
+	}
+	var snapshots []string
+	for _, info := range infos {
+		name := info.Name()
+		if info.Mode().IsRegular() && strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+			snapshots = append(snapshots, filepath.Join(b.directory, name))
+		}
+	}
+	// The timestamp format sorts lexically.
+	sort.Strings(snapshots)
+	return snapshots, nil
+}
+
+func (b *BackupService) rotate() error {
+	if b.retention <= 0 {
+		return nil
+	}
+	snapshots, err := b.Snapshots()
+	if err != nil {
+		return err
+	}
+	for len(snapshots) > b.retention {
+		if err := os.Remove(snapshots[0]); err != nil {
+			return BackupError.New("Failed to remove old snapshot %s: %s", snapshots[0], err)
+		}
+		if err := os.Remove(snapshots[0] + backupChecksumSuffix); err != nil && !os.IsNotExist(err) {
+			return BackupError.New("Failed to remove old snapshot checksum %s: %s", snapshots[0], err)
+		}
+		snapshots = snapshots[1:]
+	}
+	return nil
+}
+
+// Takes a snapshot every interval until the quit channel is closed or sent
+// to.  The done channel is closed once the scheduler has stopped.
+func (b *BackupService) Run() (chan<- struct{}, <-chan struct{}) {
+	quitC := make(chan struct{})
+	doneC := make(chan struct{})
+	go func() {
+		defer close(doneC)
+		ticker := time.NewTicker(b.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if path, err := b.Snapshot(); err != nil {
+					log.Print("Failed to take database snapshot: ", err)
+				} else {
+					log.Print("Took database snapshot ", path)
+				}
+			case <-quitC:
+				return
+			}
+		}
+	}()
+	return quitC, doneC
+}
+
+func verifySnapshotChecksum(path string) error {
+	checksumFile, err := os.Open(path + backupChecksumSuffix)
+	if err != nil {
+		return BackupInvalidError.New("Failed to open checksum for %s: %s", path, err)
+	}
+	defer checksumFile.Close()
+	line, err := bufio.NewReader(checksumFile).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return BackupInvalidError.New("Failed to read checksum for %s: %s", path, err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 2 || fields[1] != filepath.Base(path) {
+		return BackupInvalidError.New("Malformed checksum file for %s", path)
+	}
+
+	snapshot, err := os.Open(path)
+	if err != nil {
+		return BackupInvalidError.New("Failed to open snapshot %s: %s", path, err)
+	}
+	defer snapshot.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, snapshot); err != nil {
+		return BackupInvalidError.New("Failed to read snapshot %s: %s", path, err)
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != fields[0] {
+		return BackupInvalidError.New("Checksum mismatch for snapshot %s", path)
+	}
+	return nil
+}
+
+// Verifies a snapshot's checksum, then opens it and checks it has the schema this binary expects.
+func VerifySnapshot(path string) error {
+	if err := verifySnapshotChecksum(path); err != nil {
+		return err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return BackupInvalidError.New("Failed to open snapshot %s: %s", path, err)
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		if err := checkSchema(tx); err != nil {
+			return BackupInvalidError.New("Snapshot %s failed verification: %s", path, err)
+		}
+		return nil
+	})
+}
+
+// Replaces the database at dbPath with the given snapshot after verifying it.
+// The previous database is kept alongside with a .pre-restore suffix.  The
+// server must not be running, which is checked by taking the database lock.
+func RestoreSnapshot(path, dbPath string) (string, error) {
+	if err := VerifySnapshot(path); err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(dbPath); err == nil {
+		db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second})
+		if err != nil {
+			return "", BackupError.New("Failed to lock database %s, is the server still running? (%s)", dbPath, err)
+		}
+		db.Close()
+	}
+
+	tmpPath := dbPath + ".restoring"
+	if err := copyFile(path, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return "", BackupError.New("Failed to copy snapshot into place: %s", err)
+	}
+	var previousPath string
+	if _, err := os.Stat(dbPath); err == nil {
+		previousPath = dbPath + ".pre-restore-" + time.Now().UTC().Format(backupTimeFormat)
+		if err := os.Rename(dbPath, previousPath); err != nil {
+			os.Remove(tmpPath)
+			return "", BackupError.New("Failed to move current database aside: %s", err)
+		}
+	}
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		return previousPath, BackupError.New("Failed to move snapshot into place: %s", err)
+	}
+	return previousPath, nil
+}
+
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func restoreCommand(config *configType, args []string) error {
+	if len(args) != 1 {
+		return CommandError.New("Usage: restore <snapshot>")
+	}
+	previousPath, err := RestoreSnapshot(args[0], config.General.Database)
+	if err != nil {
+		return err
+	}
+	if previousPath != "" {
+		log.Printf("Restored %s, previous database kept at %s", args[0], previousPath)
+	} else {
+		log.Printf("Restored %s", args[0])
+	}
+	return nil
+}
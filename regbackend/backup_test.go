@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/boltdb/bolt"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestBackupService(t *testing.T) {
+	Convey("With a bolt database holding a registration", t, func() {
+		dir, err := ioutil.TempDir("", "backups")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			So(os.RemoveAll(dir), ShouldBeNil)
+		})
+		dbPath := filepath.Join(dir, "records.bolt")
+		db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second})
+		So(err, ShouldBeNil)
+		So(ensureSchemaVersion(db), ShouldBeNil)
+		ormDb := boltorm.NewBoltDB(db)
+		invDb, err := NewInvoiceDb(ormDb)
+		So(err, ShouldBeNil)
+		prdb, err := NewPreRegBoltDb(ormDb, &configType{}, invDb)
+		So(err, ShouldBeNil)
+		rec := GroupPreRegistration{
+			PackName:           "Pack A",
+			GroupName:          "Test Group",
+			Council:            "1st Testingway",
+			ContactLeaderEmail: "testemail@example.test",
+		}
+		So(prdb.CreateRecord(&rec), ShouldBeNil)
+
+		backups, err := NewBackupService(db, filepath.Join(dir, "snapshots"), time.Hour, 2)
+		So(err, ShouldBeNil)
+
+		Convey("Taking a snapshot should succeed", func() {
+			path, err := backups.Snapshot()
+			So(err, ShouldBeNil)
+			Convey("And the snapshot should verify", func() {
+				So(VerifySnapshot(path), ShouldBeNil)
+			})
+			Convey("And a modified snapshot should fail verification", func() {
+				So(ioutil.WriteFile(path, []byte("corrupted"), 0600), ShouldBeNil)
+				So(BackupInvalidError.Contains(VerifySnapshot(path)), ShouldBeTrue)
+			})
+			Convey("And a snapshot without a checksum should fail verification", func() {
+				So(os.Remove(path+backupChecksumSuffix), ShouldBeNil)
+				So(BackupInvalidError.Contains(VerifySnapshot(path)), ShouldBeTrue)
+			})
+			Convey("And restoring it while the database is open should fail", func() {
+				_, err := RestoreSnapshot(path, dbPath)
+				So(BackupError.Contains(err), ShouldBeTrue)
+			})
+			Convey("And restoring it over a closed database", func() {
+				So(db.Close(), ShouldBeNil)
+				previousPath, err := RestoreSnapshot(path, dbPath)
+				So(err, ShouldBeNil)
+				Convey("Should keep the previous database", func() {
+					_, err := os.Stat(previousPath)
+					So(err, ShouldBeNil)
+				})
+				Convey("Should give a database with the registration", func() {
+					db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second})
+					So(err, ShouldBeNil)
+					defer db.Close()
+					restoredDb, err := NewPreRegBoltDb(boltorm.NewBoltDB(db), &configType{}, invDb)
+					So(err, ShouldBeNil)
+					restoredRec, err := restoredDb.GetRecord(rec.SecurityKey)
+					So(err, ShouldBeNil)
+					So(restoredRec.GroupName, ShouldEqual, rec.GroupName)
+				})
+			})
+		})
+
+		Convey("Taking more snapshots than the retention", func() {
+			var paths []string
+			for i := 0; i < 3; i++ {
+				path, err := backups.Snapshot()
+				So(err, ShouldBeNil)
+				paths = append(paths, path)
+			}
+			Convey("Should only keep the newest snapshots", func() {
+				snapshots, err := backups.Snapshots()
+				So(err, ShouldBeNil)
+				So(snapshots, ShouldResemble, paths[1:])
+			})
+			Convey("Should remove the checksum of the rotated out snapshot", func() {
+				_, err := os.Stat(paths[0] + backupChecksumSuffix)
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+
+		setSchemaVersion := func(version uint64) {
+			So(db.Update(func(tx *bolt.Tx) error {
+				var versionBytes [8]byte
+				binary.BigEndian.PutUint64(versionBytes[:], version)
+				return tx.Bucket(BOLT_METABUCKET).Put(boltSchemaVersionKey, versionBytes[:])
+			}), ShouldBeNil)
+		}
+		Convey("A snapshot from an older version should still verify", func() {
+			setSchemaVersion(1)
+			So(db.Update(func(tx *bolt.Tx) error {
+				return tx.DeleteBucket(BOLT_GROUPSECURITYKEYBUCKET)
+			}), ShouldBeNil)
+			path, err := backups.Snapshot()
+			So(err, ShouldBeNil)
+			So(VerifySnapshot(path), ShouldBeNil)
+		})
+		Convey("A snapshot from a newer version should fail verification", func() {
+			setSchemaVersion(schemaVersion + 1)
+			path, err := backups.Snapshot()
+			So(err, ShouldBeNil)
+			So(BackupInvalidError.Contains(VerifySnapshot(path)), ShouldBeTrue)
+		})
+		Convey("A snapshot of a database without the schema version should fail verification", func() {
+			So(db.Update(func(tx *bolt.Tx) error {
+				return tx.DeleteBucket(BOLT_METABUCKET)
+			}), ShouldBeNil)
+			path, err := backups.Snapshot()
+			So(err, ShouldBeNil)
+			So(BackupInvalidError.Contains(VerifySnapshot(path)), ShouldBeTrue)
+		})
+
+		Reset(func() {
+			db.Close()
+		})
+	})
+}
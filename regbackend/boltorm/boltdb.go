@@ -96,6 +96,18 @@ func (t *boltTx) Update(bucketName, key []byte, data interface{}) error {
 	return nil
 }
 
+func (t *boltTx) Delete(bucketName, key []byte) error {
+	bucket := t.tx.Bucket(bucketName)
+	if bucket.Bucket(key) == nil {
+		return ErrKeyDoesNotExist.New("Could not delete nonexistent record")
+	}
+	if err := bucket.DeleteBucket(key); err == bolt.ErrTxNotWritable {
+		return ErrTxNotWritable.New("Could not delete record")
+	} else {
+		return err
+	}
+}
+
 func (t *boltTx) NextSequenceForBucket(bucket []byte) (uint64, error) {
 	b := t.tx.Bucket(bucket)
 	n, err := b.NextSequence()
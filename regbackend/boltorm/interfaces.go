@@ -20,6 +20,8 @@ type Tx interface {
 	CreateBucketIfNotExists(name []byte) error
 	Insert(bucket, key []byte, data interface{}) error
 	Update(bucket, key []byte, data interface{}) error
+	// Removes the record along with every version of it.
+	Delete(bucket, key []byte) error
 	AddIndex(indexBucket, index, key []byte) error
 	NextSequenceForBucket(bucket []byte) (uint64, error)
 
@@ -25,7 +25,16 @@ func NewMemoryDB() DB {
 
 func (m *memoryDB) Update(fn func(tx Tx) error) error {
 	m.lock.Lock()
-	tx := &memoryTx{m, m.buckets, true, true}
+	// Work on a copy, so that a failed update leaves nothing behind, as with bolt.
+	buckets := make(map[string]*bucketData, len(*m.buckets))
+	for name, bucket := range *m.buckets {
+		data := make(map[string][][]byte, len(bucket.data))
+		for key, versions := range bucket.data {
+			data[key] = versions[:len(versions):len(versions)]
+		}
+		buckets[name] = &bucketData{data, bucket.seq}
+	}
+	tx := &memoryTx{m, &buckets, true, true}
 	defer tx.rollback()
 
 	if err := fn(tx); err != nil {
@@ -99,6 +108,18 @@ func (t *memoryTx) Update(bucket, key []byte, data interface{}) error {
 	return nil
 }
 
+func (t *memoryTx) Delete(bucket, key []byte) error {
+	if !t.writable {
+		return ErrTxNotWritable.New("Could not delete record")
+	}
+
+	if (*t.buckets)[string(bucket)].data[string(key)] == nil {
+		return ErrKeyDoesNotExist.New("Could not delete record")
+	}
+	delete((*t.buckets)[string(bucket)].data, string(key))
+	return nil
+}
+
 func (t *memoryTx) NextSequenceForBucket(bucket []byte) (uint64, error) {
 	b := (*t.buckets)[string(bucket)]
 	b.seq++
@@ -168,9 +189,11 @@ func (t *memoryTx) GetByIndex(indexBucket, dataBucket, index []byte, data interf
 
 func (t *memoryTx) CreateBucketIfNotExists(name []byte) error {
 	if t.writable {
-		(*t.buckets)[string(name)] = &bucketData{
-			data: make(map[string][][]byte),
-			seq:  0,
+		if _, ok := (*t.buckets)[string(name)]; !ok {
+			(*t.buckets)[string(name)] = &bucketData{
+				data: make(map[string][][]byte),
+				seq:  0,
+			}
 		}
 		return nil
 	} else {
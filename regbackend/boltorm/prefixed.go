@@ -0,0 +1,78 @@
+package boltorm
+
+type prefixedDB struct {
+	db     DB
+	prefix []byte
+}
+
+// Wraps db so that every bucket name is given the prefix, letting several
+// independent sets of buckets share one database.
+func NewPrefixedDB(db DB, prefix []byte) DB {
+	return &prefixedDB{db, prefix}
+}
+
+func (d *prefixedDB) Update(fn func(tx Tx) error) error {
+	return d.db.Update(func(tx Tx) error {
+		return fn(&prefixedTx{tx, d.prefix})
+	})
+}
+
+func (d *prefixedDB) View(fn func(tx Tx) error) error {
+	return d.db.View(func(tx Tx) error {
+		return fn(&prefixedTx{tx, d.prefix})
+	})
+}
+
+type prefixedTx struct {
+	tx     Tx
+	prefix []byte
+}
+
+func (t *prefixedTx) name(bucket []byte) []byte {
+	name := make([]byte, 0, len(t.prefix)+len(bucket))
+	return append(append(name, t.prefix...), bucket...)
+}
+
+func (t *prefixedTx) CreateBucketIfNotExists(name []byte) error {
+	return t.tx.CreateBucketIfNotExists(t.name(name))
+}
+
+func (t *prefixedTx) Insert(bucket, key []byte, data interface{}) error {
+	return t.tx.Insert(t.name(bucket), key, data)
+}
+
+func (t *prefixedTx) Update(bucket, key []byte, data interface{}) error {
+	return t.tx.Update(t.name(bucket), key, data)
+}
+
+func (t *prefixedTx) Delete(bucket, key []byte) error {
+	return t.tx.Delete(t.name(bucket), key)
+}
+
+func (t *prefixedTx) AddIndex(indexBucket, index, key []byte) error {
+	return t.tx.AddIndex(t.name(indexBucket), index, key)
+}
+
+func (t *prefixedTx) NextSequenceForBucket(bucket []byte) (uint64, error) {
+	return t.tx.NextSequenceForBucket(t.name(bucket))
+}
+
+func (t *prefixedTx) Get(bucket, key []byte, data interface{}) error {
+	return t.tx.Get(t.name(bucket), key, data)
+}
+
+func (t *prefixedTx) GetAll(bucket []byte, dataType interface{}) (interface{}, error) {
+	return t.tx.GetAll(t.name(bucket), dataType)
+}
+
+func (t *prefixedTx) GetByIndex(indexBucket, dataBucket, index []byte, data interface{}) error {
+	return t.tx.GetByIndex(t.name(indexBucket), t.name(dataBucket), index, data)
+}
+
+func (t *prefixedTx) GetAllByIndex(indexBucket, bucket []byte, dataType interface{}) (interface{}, error) {
+	return t.tx.GetAllByIndex(t.name(indexBucket), t.name(bucket), dataType)
+}
+
+func (t *prefixedTx) RemoveKeyFromIndex(indexBucket, key []byte) error {
+	return t.tx.RemoveKeyFromIndex(t.name(indexBucket), key)
+}
@@ -0,0 +1,43 @@
+package boltorm
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPrefixedDb(t *testing.T) {
+	Convey("With a prefixed memory DB", t, func() {
+		inner := NewMemoryDB()
+		db := NewPrefixedDB(inner, []byte("P_"))
+		Convey("the standard tests work", sharedTests(db))
+
+		Convey("Data stored through it", func() {
+			So(db.Update(func(tx Tx) error {
+				if err := tx.CreateBucketIfNotExists(bucket1); err != nil {
+					return err
+				}
+				return tx.Insert(bucket1, []byte("key"), &testData{5})
+			}), ShouldBeNil)
+			Convey("Should be in the prefixed bucket underneath", func() {
+				So(inner.View(func(tx Tx) error {
+					data := &testData{}
+					if err := tx.Get([]byte("P_B1"), []byte("key"), data); err != nil {
+						return err
+					}
+					So(data.I, ShouldEqual, 5)
+					return nil
+				}), ShouldBeNil)
+			})
+			Convey("Should not be seen through another prefix", func() {
+				other := NewPrefixedDB(inner, []byte("Q_"))
+				So(other.Update(func(tx Tx) error {
+					return tx.CreateBucketIfNotExists(bucket1)
+				}), ShouldBeNil)
+				So(other.View(func(tx Tx) error {
+					return tx.Get(bucket1, []byte("key"), &testData{})
+				}), ShouldNotBeNil)
+			})
+		})
+	})
+}
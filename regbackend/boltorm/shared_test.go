@@ -118,6 +118,83 @@ func sharedTests(db DB) func() {
 							})
 						})
 					})
+					Convey("And deleting it in a read only transaction", func() {
+						err := db.View(func(tx Tx) error {
+							return tx.Delete(bucket1, []byte("KeyA"))
+						})
+						Convey("Should fail with transaction is read only error", txReadOnlyTest(err))
+					})
+					Convey("And deleting it", func() {
+						So(db.Update(func(tx Tx) error {
+							return tx.Update(bucket1, []byte("KeyA"), &testData{6})
+						}), ShouldBeNil)
+						So(db.Update(func(tx Tx) error {
+							return tx.Delete(bucket1, []byte("KeyA"))
+						}), ShouldBeNil)
+						Convey("Should leave nothing to fetch", func() {
+							err := db.View(func(tx Tx) error {
+								return tx.Get(bucket1, []byte("KeyA"), &testData{})
+							})
+							So(ErrKeyDoesNotExist.Contains(err), ShouldBeTrue)
+						})
+						Convey("Should let it be inserted again", func() {
+							So(db.Update(func(tx Tx) error {
+								return tx.Insert(bucket1, []byte("KeyA"), &data)
+							}), ShouldBeNil)
+						})
+						Convey("And deleting it again should fail with a key not existing error", func() {
+							err := db.Update(func(tx Tx) error {
+								return tx.Delete(bucket1, []byte("KeyA"))
+							})
+							So(ErrKeyDoesNotExist.Contains(err), ShouldBeTrue)
+						})
+					})
+					Convey("And creating its bucket again should keep it", func() {
+						newData := testData{}
+						So(db.Update(func(tx Tx) error {
+							return tx.CreateBucketIfNotExists(bucket1)
+						}), ShouldBeNil)
+						So(db.View(func(tx Tx) error {
+							return tx.Get(bucket1, []byte("KeyA"), &newData)
+						}), ShouldBeNil)
+						So(newData, ShouldResemble, testData{5})
+					})
+					Convey("And updating it in a transaction that fails", func() {
+						failure := ErrGeneric.New("Failing on purpose")
+						err := db.Update(func(tx Tx) error {
+							if err := tx.Update(bucket1, []byte("KeyA"), &testData{6}); err != nil {
+								return err
+							}
+							if err := tx.Insert(bucket1, []byte("KeyB"), &data); err != nil {
+								return err
+							}
+							if err := tx.AddIndex(bucket2, []byte("IndexB"), []byte("KeyB")); err != nil {
+								return err
+							}
+							return failure
+						})
+						Convey("Should return the failure", func() {
+							So(err, ShouldEqual, failure)
+						})
+						Convey("Should leave the record unchanged", func() {
+							newData := testData{}
+							So(db.View(func(tx Tx) error {
+								return tx.Get(bucket1, []byte("KeyA"), &newData)
+							}), ShouldBeNil)
+							So(newData, ShouldResemble, testData{5})
+						})
+						Convey("Should not keep the inserted record or index", func() {
+							newData := testData{}
+							err := db.View(func(tx Tx) error {
+								return tx.Get(bucket1, []byte("KeyB"), &newData)
+							})
+							So(ErrKeyDoesNotExist.Contains(err), ShouldBeTrue)
+							err = db.View(func(tx Tx) error {
+								return tx.GetByIndex(bucket2, bucket1, []byte("IndexB"), &newData)
+							})
+							So(ErrKeyDoesNotExist.Contains(err), ShouldBeTrue)
+						})
+					})
 					Convey("And storing an index", func() {
 						err := db.Update(func(tx Tx) error {
 							return tx.AddIndex(bucket2, []byte("IndexA"), []byte("KeyA"))
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spacemonkeygo/errors"
+	"github.com/spacemonkeygo/errors/errhttp"
+)
+
+var (
+	ChallengeError = errors.NewClass("Challenge error", errhttp.SetStatusCode(503), errhttp.OverrideErrorBody("Unable to check the challenge right now, please try again later"))
+	// The front end gets a new challenge and tries again.
+	ChallengeFailed = ChallengeError.NewClass("Challenge failed", errhttp.SetStatusCode(403), errhttp.OverrideErrorBody("The challenge was not passed, please try again"))
+)
+
+// Group registrations can be made to pass one of these, to keep bots out.
+const (
+	ChallengeHCaptcha    = "hcaptcha"
+	ChallengeReCaptcha   = "recaptcha"
+	ChallengeProofOfWork = "proofofwork"
+	// Passed by answering "pass", for development and integration tests.
+	ChallengeFake = "fake"
+)
+
+var challengeTypes = []string{ChallengeHCaptcha, ChallengeReCaptcha, ChallengeProofOfWork, ChallengeFake}
+
+var challengeVerifyURLs = map[string]string{
+	ChallengeHCaptcha:  "https://api.hcaptcha.com/siteverify",
+	ChallengeReCaptcha: "https://www.google.com/recaptcha/api/siteverify",
+}
+
+// Proof of work challenges must be answered within this long, and only once.
+const proofOfWorkLifetime = 10 * time.Minute
+
+// What the front end needs to show the challenge, given through /config.
+type ChallengeConfig struct {
+	Type    string `json:"type"`
+	SiteKey string `json:"siteKey,omitempty"`
+	// Leading zero bits a proof of work answer needs.
+	Difficulty int `json:"difficulty,omitempty"`
+}
+
+type ChallengeVerifier interface {
+	Config() ChallengeConfig
+	// Checks the answer sent by the client at remoteIP.
+	Verify(response, remoteIP string, now time.Time) error
+}
+
+// Returns nil if registrations don't need to pass a challenge.
+func NewChallengeVerifier(config *configType) (ChallengeVerifier, error) {
+	c := config.Challenge
+	switch c.Type {
+	case "":
+		return nil, nil
+	case ChallengeHCaptcha, ChallengeReCaptcha:
+		verifyURL := c.VerifyURL
+		if verifyURL == "" {
+			verifyURL = challengeVerifyURLs[c.Type]
+		}
+		return &siteVerifyChallenge{
+			config:    ChallengeConfig{Type: c.Type, SiteKey: c.SiteKey},
+			secret:    c.Secret,
+			verifyURL: verifyURL,
+			client:    &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	case ChallengeProofOfWork:
+		return newProofOfWorkChallenge(c.Difficulty)
+	case ChallengeFake:
+		return fakeChallenge{}, nil
+	}
+	return nil, SetupErrors.New("Unknown challenge type %s", c.Type)
+}
+
+// Checks CAPTCHA answers with the provider.  hCaptcha and reCAPTCHA take
+// the same requests.
+type siteVerifyChallenge struct {
+	config    ChallengeConfig
+	secret    string
+	verifyURL string
+	client    *http.Client
+}
+
+func (c *siteVerifyChallenge) Config() ChallengeConfig {
+	return c.config
+}
+
+func (c *siteVerifyChallenge) Verify(response, remoteIP string, now time.Time) error {
+	if response == "" {
+		return ChallengeFailed.New("No response given")
+	}
+	resp, err := c.client.PostForm(c.verifyURL, url.Values{
+		"secret":   {c.secret},
+		"response": {response},
+		"remoteip": {remoteIP},
+		"sitekey":  {c.config.SiteKey},
+	})
+	if err != nil {
+		return ChallengeError.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ChallengeError.New("Verification returned status %d", resp.StatusCode)
+	}
+	result := struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return ChallengeError.Wrap(err)
+	}
+	if !result.Success {
+		return ChallengeFailed.New("Rejected by %s: %s", c.config.Type, strings.Join(result.ErrorCodes, ", "))
+	}
+	return nil
+}
+
+// Self hosted challenges, answered by finding a counter that gives a hash
+// of the challenge with enough leading zero bits.  Challenges are signed
+// rather than stored, but remembered once answered so they only work once.
+type proofOfWorkChallenge struct {
+	difficulty int
+	key        []byte
+
+	lock sync.Mutex
+	used map[string]time.Time
+}
+
+func newProofOfWorkChallenge(difficulty int) (*proofOfWorkChallenge, error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, SetupErrors.New("Failed to get entropy for proof of work challenges")
+	}
+	return &proofOfWorkChallenge{
+		difficulty: difficulty,
+		key:        key[:],
+		used:       make(map[string]time.Time),
+	}, nil
+}
+
+func (c *proofOfWorkChallenge) Config() ChallengeConfig {
+	return ChallengeConfig{Type: ChallengeProofOfWork, Difficulty: c.difficulty}
+}
+
+func (c *proofOfWorkChallenge) sign(payload string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Returns a new challenge, as "<unix time>.<nonce>.<signature>".
+func (c *proofOfWorkChallenge) NewChallenge(now time.Time) (string, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", ChallengeError.Wrap(err)
+	}
+	payload := strconv.FormatInt(now.Unix(), 10) + "." + base64.RawURLEncoding.EncodeToString(nonce[:])
+	return payload + "." + c.sign(payload), nil
+}
+
+func leadingZeroBits(hash []byte) int {
+	bits := 0
+	for _, b := range hash {
+		if b != 0 {
+			for b&0x80 == 0 {
+				bits++
+				b <<= 1
+			}
+			return bits
+		}
+		bits += 8
+	}
+	return bits
+}
+
+// Checks a "<challenge>:<counter>" answer.
+func (c *proofOfWorkChallenge) Verify(response, remoteIP string, now time.Time) error {
+	sep := strings.LastIndex(response, ":")
+	if sep < 0 {
+		return ChallengeFailed.New("Malformed response")
+	}
+	challenge := response[:sep]
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(c.sign(parts[0]+"."+parts[1])), []byte(parts[2])) {
+		return ChallengeFailed.New("Challenge not issued here")
+	}
+	issued, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || now.Sub(time.Unix(issued, 0)) > proofOfWorkLifetime {
+		return ChallengeFailed.New("Challenge expired")
+	}
+	hash := sha256.Sum256([]byte(response))
+	if leadingZeroBits(hash[:]) < c.difficulty {
+		return ChallengeFailed.New("Not enough work done")
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for k, answered := range c.used {
+		if now.Sub(answered) > proofOfWorkLifetime {
+			delete(c.used, k)
+		}
+	}
+	if _, ok := c.used[challenge]; ok {
+		return ChallengeFailed.New("Challenge already answered")
+	}
+	c.used[challenge] = now
+	return nil
+}
+
+type fakeChallenge struct{}
+
+func (fakeChallenge) Config() ChallengeConfig {
+	return ChallengeConfig{Type: ChallengeFake}
+}
+
+func (fakeChallenge) Verify(response, remoteIP string, now time.Time) error {
+	if response != "pass" {
+		return ChallengeFailed.New("Fake challenge not passed")
+	}
+	return nil
+}
+
+type ChallengeHandler struct {
+	challenge *proofOfWorkChallenge
+}
+
+func (h *ChallengeHandler) NewChallenge(w http.ResponseWriter, r *http.Request) {
+	challenge, err := h.challenge.NewChallenge(time.Now())
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Challenge  string `json:"challenge"`
+		Difficulty int    `json:"difficulty"`
+	}{challenge, h.challenge.difficulty})
+}
+
+// Only proof of work needs challenges handed out, the others come from the
+// provider.
+func NewChallengeHandler(r *mux.Router, verifier ChallengeVerifier) *ChallengeHandler {
+	challenge, ok := verifier.(*proofOfWorkChallenge)
+	if !ok {
+		return nil
+	}
+	h := &ChallengeHandler{challenge}
+	r.HandleFunc("/challenge", h.NewChallenge).Methods("GET")
+	return h
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+// Finds the counter a client would, for the challenge.
+func solveProofOfWork(challenge string, difficulty int) string {
+	for counter := 0; ; counter++ {
+		response := challenge + ":" + strconv.Itoa(counter)
+		hash := sha256.Sum256([]byte(response))
+		if leadingZeroBits(hash[:]) >= difficulty {
+			return response
+		}
+	}
+}
+
+func TestProofOfWorkChallenge(t *testing.T) {
+	Convey("With proof of work challenges", t, func() {
+		c, err := newProofOfWorkChallenge(8)
+		So(err, ShouldBeNil)
+		now := time.Date(2016, 7, 1, 9, 0, 0, 0, time.UTC)
+		challenge, err := c.NewChallenge(now)
+		So(err, ShouldBeNil)
+		response := solveProofOfWork(challenge, 8)
+
+		Convey("A solved challenge should pass once", func() {
+			So(c.Verify(response, "203.0.113.9", now.Add(time.Minute)), ShouldBeNil)
+			So(ChallengeFailed.Contains(c.Verify(response, "203.0.113.9", now.Add(time.Minute))), ShouldBeTrue)
+		})
+		Convey("Unsolved, expired or forged challenges should fail", func() {
+			for counter := 0; ; counter++ {
+				unsolved := challenge + ":" + strconv.Itoa(counter)
+				hash := sha256.Sum256([]byte(unsolved))
+				if leadingZeroBits(hash[:]) < 8 {
+					So(ChallengeFailed.Contains(c.Verify(unsolved, "", now)), ShouldBeTrue)
+					break
+				}
+			}
+			So(ChallengeFailed.Contains(c.Verify(response, "", now.Add(proofOfWorkLifetime+time.Second))), ShouldBeTrue)
+			other, err := newProofOfWorkChallenge(8)
+			So(err, ShouldBeNil)
+			So(ChallengeFailed.Contains(other.Verify(response, "", now)), ShouldBeTrue)
+			So(ChallengeFailed.Contains(c.Verify("nonsense", "", now)), ShouldBeTrue)
+		})
+	})
+	Convey("Leading zero bits should be counted across bytes", t, func() {
+		So(leadingZeroBits([]byte{0x80}), ShouldEqual, 0)
+		So(leadingZeroBits([]byte{0x00, 0x10}), ShouldEqual, 11)
+		So(leadingZeroBits([]byte{0x00, 0x00}), ShouldEqual, 16)
+	})
+}
+
+func TestSiteVerifyChallenge(t *testing.T) {
+	Convey("With a CAPTCHA provider", t, func() {
+		var form map[string][]string
+		status := http.StatusOK
+		provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			form = r.PostForm
+			w.WriteHeader(status)
+			if r.PostForm.Get("response") == "good" {
+				w.Write([]byte(`{"success": true}`))
+			} else {
+				w.Write([]byte(`{"success": false, "error-codes": ["invalid-input-response"]}`))
+			}
+		}))
+		defer provider.Close()
+		config := &configType{}
+		config.Challenge.Type = ChallengeHCaptcha
+		config.Challenge.SiteKey = "site"
+		config.Challenge.Secret = "secret"
+		config.Challenge.VerifyURL = provider.URL
+		c, err := NewChallengeVerifier(config)
+		So(err, ShouldBeNil)
+		So(c.Config(), ShouldResemble, ChallengeConfig{Type: ChallengeHCaptcha, SiteKey: "site"})
+
+		Convey("Answers it accepts should pass", func() {
+			So(c.Verify("good", "203.0.113.9", time.Now()), ShouldBeNil)
+			So(form["secret"], ShouldResemble, []string{"secret"})
+			So(form["remoteip"], ShouldResemble, []string{"203.0.113.9"})
+		})
+		Convey("Answers it refuses should fail", func() {
+			err := c.Verify("bad", "203.0.113.9", time.Now())
+			So(ChallengeFailed.Contains(err), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, "invalid-input-response")
+			So(ChallengeFailed.Contains(c.Verify("", "203.0.113.9", time.Now())), ShouldBeTrue)
+		})
+		Convey("The provider failing should not count as failing the challenge", func() {
+			status = http.StatusInternalServerError
+			err := c.Verify("good", "203.0.113.9", time.Now())
+			So(ChallengeError.Contains(err), ShouldBeTrue)
+			So(ChallengeFailed.Contains(err), ShouldBeFalse)
+		})
+	})
+}
+
+func TestRegistrationChallenge(t *testing.T) {
+	Convey("With registrations needing proof of work", t, func() {
+		db := boltorm.NewMemoryDB()
+		invDb, err := NewInvoiceDb(db)
+		So(err, ShouldBeNil)
+		config := &configType{}
+		config.General.EnableGroupReg = true
+		config.Challenge.Type = ChallengeProofOfWork
+		config.Challenge.Difficulty = 4
+		prdb, err := NewPreRegBoltDb(db, config, invDb)
+		So(err, ShouldBeNil)
+		challenge, err := NewChallengeVerifier(config)
+		So(err, ShouldBeNil)
+		router := mux.NewRouter()
+		So(NewChallengeHandler(router, challenge), ShouldNotBeNil)
+		ces := NewConfirmationEmailService("examplesite.com", "no-reply@examplesender.com", "no-reply", "info@infoexample.com", &testEmailSender{}, prdb)
+		NewGroupPreRegistrationHandler(router, config, prdb, newTestFormSchemaDb(db), nil, ces, challenge)
+
+		register := func(response string) int {
+			body := `{"packName": "A", "groupName": "1st Testingway", "council": "Council rock", "contactLeaderFirstName": "Jane", "contactLeaderLastName": "Doe", "contactLeaderPhoneNumber": "613-555-0100", "contactLeaderEmail": "leader@example.com", "contactLeaderAddress": {"address1": "1 Main St", "city": "Ottawa", "province": "ON", "postalCode": "K1A 0A1"}, "emailApprovalGivenAt": "2016-01-01T00:00:00Z", "estimatedYouth": 10, "estimatedLeaders": 3}`
+			r, err := http.NewRequest("POST", "http://localhost:8080/preregistration", bytes.NewReader([]byte(body)))
+			So(err, ShouldBeNil)
+			if response != "" {
+				r.Header.Set("X-Challenge-Response", response)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			return w.Code
+		}
+
+		Convey("Registering without an answer should be refused", func() {
+			So(register(""), ShouldEqual, http.StatusForbidden)
+		})
+		Convey("Registering with a solved challenge should work", func() {
+			r, err := http.NewRequest("GET", "http://localhost:8080/challenge", nil)
+			So(err, ShouldBeNil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			issued := w.Body.String()
+			start := strings.Index(issued, `"challenge":"`) + len(`"challenge":"`)
+			issued = issued[start : start+strings.Index(issued[start:], `"`)]
+			So(register(solveProofOfWork(issued, 4)), ShouldEqual, http.StatusCreated)
+		})
+		Convey("The requirement should be given in the config", func() {
+			r, err := http.NewRequest("GET", "http://localhost:8080/config", nil)
+			So(err, ShouldBeNil)
+			w := httptest.NewRecorder()
+			(&configHandler{config, prdb, nil, challenge}).ServeHTTP(w, r)
+			So(w.Body.String(), ShouldContainSubstring, `"challenge":{"type":"proofofwork","difficulty":4}`)
+		})
+	})
+}
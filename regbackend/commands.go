@@ -0,0 +1,41 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/spacemonkeygo/errors"
+)
+
+var (
+	CommandError = errors.NewClass("Command error")
+)
+
+type command struct {
+	usage string
+	run   func(config *configType, args []string) error
+}
+
+// Maintenance commands, run by passing the command name after any flags.
+var commands = map[string]command{
+	"restore":        {"restore <snapshot>: verify a backup snapshot and swap it in as the database", restoreCommand},
+	"decrypt-export": {"decrypt-export <private key> <export> <output>: decrypt and decompress an encrypted database export", decryptExportCommand},
+	"create-admin":   {"create-admin [--event <id>] <email>: create a local superadmin account, reading its password from standard input", createAdminCommand},
+}
+
+func commandUsage() string {
+	var lines []string
+	for _, cmd := range commands {
+		lines = append(lines, "  "+cmd.usage)
+	}
+	sort.Strings(lines)
+	return "Available commands:\n" + strings.Join(lines, "\n")
+}
+
+func runCommand(config *configType, args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return CommandError.New("Unknown command %s\n%s", args[0], commandUsage())
+	}
+	return cmd.run(config, args[1:])
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spacemonkeygo/errors"
+)
+
+var (
+	ConfigError        = errors.NewClass("Configuration error")
+	ConfigFileError    = ConfigError.NewClass("Invalid configuration file")
+	ConfigInvalidError = ConfigError.NewClass("Invalid configuration")
+)
+
+// Environment variables are named after the flags, upper cased with dots
+// turned into underscores, so -email.contactemail is REGBACKEND_EMAIL_CONTACTEMAIL.
+const configEnvPrefix = "REGBACKEND_"
+
+// Each section of configType and the prefix its flags are given.  The
+// general section has no prefix, its keys can also be given at the top of
+// the configuration file.
+var configSections = []struct {
+	prefix  string
+	section func(c *configType) interface{}
+}{
+	{"http", func(c *configType) interface{} { return &c.Http }},
+	{"email", func(c *configType) interface{} { return &c.Email }},
+	{"auth", func(c *configType) interface{} { return &c.Auth }},
+	{"", func(c *configType) interface{} { return &c.General }},
+	{"export", func(c *configType) interface{} { return &c.Export }},
+	{"documents", func(c *configType) interface{} { return &c.Documents }},
+	{"compliance", func(c *configType) interface{} { return &c.Compliance }},
+	{"backup", func(c *configType) interface{} { return &c.Backup }},
+	{"ratelimit", func(c *configType) interface{} { return &c.RateLimit }},
+	{"challenge", func(c *configType) interface{} { return &c.Challenge }},
+}
+
+type configField struct {
+	name   string
+	secret bool
+	value  reflect.Value
+}
+
+// Lists every configuration field under its flag name, in declaration order.
+func (c *configType) fields() []configField {
+	var fields []configField
+	for _, s := range configSections {
+		v := reflect.ValueOf(s.section(c)).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			name := strings.ToLower(v.Type().Field(i).Name)
+			if s.prefix != "" {
+				name = s.prefix + "." + name
+			}
+			fields = append(fields, configField{name, v.Type().Field(i).Tag.Get("secret") == "true", v.Field(i)})
+		}
+	}
+	return fields
+}
+
+func (f configField) set(value string) error {
+	switch field := f.value.Addr().Interface().(type) {
+	case *string:
+		*field = value
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return ConfigError.New("%s must be true or false, not %q", f.name, value)
+		}
+		*field = b
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return ConfigError.New("%s must be a whole number, not %q", f.name, value)
+		}
+		*field = n
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return ConfigError.New("%s must be a duration like 6h, not %q", f.name, value)
+		}
+		*field = d
+	case *stringSliceConfig:
+		return field.Set(value)
+	default:
+		return ConfigError.New("%s can't be set from a string", f.name)
+	}
+	return nil
+}
+
+func (f configField) String() string {
+	if slice, ok := f.value.Interface().(stringSliceConfig); ok {
+		return strings.Join(slice, ",")
+	}
+	return fmt.Sprint(f.value.Interface())
+}
+
+// Reads a configuration file in a subset of TOML: [section] headers, and
+// key = value pairs where the value is a quoted string, a number, true or
+// false, or an array of strings.  Keys are matched to flag names ignoring
+// case, so contactEmail under [email] sets -email.contactemail.
+func parseConfigFile(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(stripConfigComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, ConfigFileError.New("line %d: unterminated section header", lineNo)
+			}
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			if section == "general" {
+				section = ""
+			}
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, ConfigFileError.New("line %d: expected key = value", lineNo)
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:eq]))
+		if key == "" {
+			return nil, ConfigFileError.New("line %d: missing key", lineNo)
+		}
+		value, err := parseConfigValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, ConfigFileError.New("line %d: %s", lineNo, errors.GetMessage(err))
+		}
+		if section != "" {
+			key = section + "." + key
+		}
+		if _, ok := values[key]; ok {
+			return nil, ConfigFileError.New("line %d: %s is set more than once", lineNo, key)
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
+
+// Removes a trailing comment, leaving any # inside quoted strings alone.
+func stripConfigComment(line string) string {
+	inString := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			if inString {
+				i++
+			}
+		case '"':
+			inString = !inString
+		case '#':
+			if !inString {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+func parseConfigValue(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		unquoted, err := strconv.Unquote(raw)
+		if err != nil {
+			return "", ConfigFileError.New("badly quoted string")
+		}
+		return unquoted, nil
+	case strings.HasPrefix(raw, "["):
+		if !strings.HasSuffix(raw, "]") {
+			return "", ConfigFileError.New("unterminated array")
+		}
+		var items []string
+		for _, item := range strings.Split(raw[1:len(raw)-1], ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			unquoted, err := strconv.Unquote(item)
+			if err != nil {
+				return "", ConfigFileError.New("arrays may only hold quoted strings")
+			}
+			items = append(items, unquoted)
+		}
+		return strings.Join(items, ","), nil
+	case raw == "true" || raw == "false":
+		return raw, nil
+	}
+	if _, err := strconv.ParseFloat(raw, 64); err != nil {
+		return "", ConfigFileError.New("strings must be quoted")
+	}
+	return raw, nil
+}
+
+// Overrides the flag defaults with the configuration file (if named) and
+// then the environment.  Flags given on the command line are in explicit,
+// and are left alone so they always win.
+func (c *configType) loadSources(file string, environ []string, explicit map[string]bool) error {
+	fields := make(map[string]configField)
+	for _, f := range c.fields() {
+		fields[f.name] = f
+	}
+
+	if file != "" {
+		fh, err := os.Open(file)
+		if err != nil {
+			return ConfigFileError.Wrap(err)
+		}
+		defer fh.Close()
+		values, err := parseConfigFile(fh)
+		if err != nil {
+			return err
+		}
+		for name, value := range values {
+			f, ok := fields[name]
+			if !ok {
+				return ConfigFileError.New("unknown setting %s", name)
+			} else if explicit[name] {
+				continue
+			}
+			if err := f.set(value); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, env := range environ {
+		eq := strings.Index(env, "=")
+		if eq < 0 || !strings.HasPrefix(env[:eq], configEnvPrefix) {
+			continue
+		}
+		name := strings.ToLower(strings.Replace(env[len(configEnvPrefix):eq], "_", ".", -1))
+		f, ok := fields[name]
+		if !ok {
+			// REGBACKEND_CONFIG names the file, anything else is a typo.
+			if name != "config" {
+				return ConfigError.New("Unknown setting in environment variable %s", env[:eq])
+			}
+			continue
+		} else if explicit[name] {
+			continue
+		}
+		if err := f.set(env[eq+1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Refuses configurations that can't work, and in production ones that are
+// still on their placeholder values.
+func (c *configType) Validate() error {
+	var problems []string
+	if c.Http.Listen == "" {
+		problems = append(problems, "http.listen is required")
+	}
+	if c.General.Database == "" {
+		problems = append(problems, "database is required")
+	}
+	if c.Documents.MaxSize <= 0 {
+		problems = append(problems, "documents.maxsize must be positive")
+	}
+	if c.Backup.Directory != "" && c.Backup.Interval <= 0 {
+		problems = append(problems, "backup.interval must be positive when backups are enabled")
+	}
+	if c.Auth.IdleTimeout <= 0 || c.Auth.SessionLifetime <= 0 {
+		problems = append(problems, "auth.idletimeout and auth.sessionlifetime must be positive")
+	}
+	if c.RateLimit.IPRequests < 0 || c.RateLimit.EmailRequests < 0 {
+		problems = append(problems, "ratelimit limits must not be negative")
+	}
+	if (c.RateLimit.IPRequests > 0 || c.RateLimit.EmailRequests > 0) && c.RateLimit.Window <= 0 {
+		problems = append(problems, "ratelimit.window must be positive when rate limits are enabled")
+	}
+	switch c.Challenge.Type {
+	case "":
+	case ChallengeHCaptcha, ChallengeReCaptcha:
+		if c.Challenge.SiteKey == "" || c.Challenge.Secret == "" {
+			problems = append(problems, "challenge.sitekey and challenge.secret are required for "+c.Challenge.Type)
+		}
+	case ChallengeProofOfWork:
+		if c.Challenge.Difficulty < 1 || c.Challenge.Difficulty > 32 {
+			problems = append(problems, "challenge.difficulty must be between 1 and 32")
+		}
+	case ChallengeFake:
+		if !(c.General.Integration || c.General.Develop) {
+			problems = append(problems, "challenge.type fake is only for development and integration binaries")
+		}
+	default:
+		problems = append(problems, "challenge.type must be one of "+strings.Join(challengeTypes, ", "))
+	}
+	if _, err := parseNetworks(c.RateLimit.TrustedProxies); err != nil {
+		problems = append(problems, "ratelimit.trustedproxies: "+errors.GetMessage(err))
+	}
+	if c.Backup.Retention < 0 {
+		problems = append(problems, "backup.retention must not be negative")
+	}
+	if c.Compliance.YouthPerLeader < 0 || c.Compliance.MinLeaders < 0 {
+		problems = append(problems, "compliance limits must not be negative")
+	}
+	if c.Email.ContactEmail != "" && !validEmailAddress(c.Email.ContactEmail) && !strings.HasSuffix(c.Email.ContactEmail, "@invalid") {
+		problems = append(problems, "email.contactemail is not a valid email address")
+	}
+
+	if !(c.General.Integration || c.General.Develop) {
+		// Local accounts are enough to log in with on their own.
+		if c.Auth.ClientID == "" && !c.Auth.LocalAccounts {
+			problems = append(problems, "auth.clientid is required in production")
+		}
+		if c.Auth.ClientSecret == "" && c.Auth.ClientID != "" {
+			problems = append(problems, "auth.clientsecret is required in production")
+		}
+		if c.Email.FromAddress == "" || strings.HasSuffix(c.Email.FromAddress, "@invalid") {
+			problems = append(problems, "email.fromaddress must be set to a real address in production")
+		}
+		if c.Email.ContactEmail == "" || strings.HasSuffix(c.Email.ContactEmail, "@invalid") {
+			problems = append(problems, "email.contactemail must be set to a real address in production")
+		}
+		if c.General.Domain == "" || c.General.Domain == "invalid" {
+			problems = append(problems, "domain must be set in production")
+		}
+	}
+
+	if len(problems) != 0 {
+		return ConfigInvalidError.New("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// The effective configuration, one flag per line, with secrets hidden.
+func (c *configType) redacted() string {
+	lines := []string{}
+	for _, f := range c.fields() {
+		value := f.String()
+		if f.secret && value != "" {
+			value = "<redacted>"
+		}
+		lines = append(lines, "  "+f.name+" = "+value)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+const testConfigFile = `# Settings for the test server
+domain = "registration.example.com"
+
+[email]
+fromAddress = "no-reply@example.com" # trailing comment
+contactEmail = "info#desk@example.com"
+
+[auth]
+clientId = "client"
+clientSecret = "hunter2"
+allowedEmails = ["a@example.com", "b@example.com"]
+
+[Backup]
+interval = "2h"
+retention = 7
+
+[general]
+enableWaitingList = true
+`
+
+func TestParseConfigFile(t *testing.T) {
+	Convey("Parsing a configuration file should give flag names and values", t, func() {
+		values, err := parseConfigFile(strings.NewReader(testConfigFile))
+		So(err, ShouldBeNil)
+		So(values, ShouldResemble, map[string]string{
+			"domain":             "registration.example.com",
+			"email.fromaddress":  "no-reply@example.com",
+			"email.contactemail": "info#desk@example.com",
+			"auth.clientid":      "client",
+			"auth.clientsecret":  "hunter2",
+			"auth.allowedemails": "a@example.com,b@example.com",
+			"backup.interval":    "2h",
+			"backup.retention":   "7",
+			"enablewaitinglist":  "true",
+		})
+	})
+	Convey("Bad lines should be reported with their line number", t, func() {
+		for _, file := range []string{
+			"[email\n",
+			"\ndomain\n",
+			"domain = registration.example.com\n",
+			"[auth]\nallowedEmails = [a@example.com]\n",
+			"domain = \"a\"\ndomain = \"b\"\n",
+		} {
+			_, err := parseConfigFile(strings.NewReader(file))
+			So(ConfigFileError.Contains(err), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, "line ")
+		}
+	})
+}
+
+func TestConfigLoadSources(t *testing.T) {
+	Convey("With a configuration file on disk", t, func() {
+		dir, err := ioutil.TempDir("", "config")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "regbackend.toml")
+		So(ioutil.WriteFile(file, []byte(testConfigFile), 0600), ShouldBeNil)
+		config := &configType{}
+		config.General.Domain = "invalid"
+		config.Backup.Retention = 28
+
+		Convey("Loading it should override the defaults", func() {
+			So(config.loadSources(file, nil, nil), ShouldBeNil)
+			So(config.General.Domain, ShouldEqual, "registration.example.com")
+			So(config.Auth.AllowedEmails, ShouldResemble, stringSliceConfig{"a@example.com", "b@example.com"})
+			So(config.Backup.Interval, ShouldEqual, 2*time.Hour)
+			So(config.Backup.Retention, ShouldEqual, 7)
+			So(config.General.EnableWaitingList, ShouldBeTrue)
+		})
+		Convey("The environment should override the file", func() {
+			So(config.loadSources(file, []string{"PATH=/bin", "REGBACKEND_BACKUP_RETENTION=3", "REGBACKEND_CONFIG=" + file}, nil), ShouldBeNil)
+			So(config.Backup.Retention, ShouldEqual, 3)
+			So(config.Auth.ClientID, ShouldEqual, "client")
+		})
+		Convey("Flags given on the command line should override both", func() {
+			config.Backup.Retention = 10
+			So(config.loadSources(file, []string{"REGBACKEND_BACKUP_RETENTION=3"}, map[string]bool{"backup.retention": true}), ShouldBeNil)
+			So(config.Backup.Retention, ShouldEqual, 10)
+		})
+		Convey("Unknown or badly typed settings should be refused", func() {
+			So(config.loadSources(file, []string{"REGBACKEND_EMAIL_CONTACT=x"}, nil), ShouldNotBeNil)
+			So(config.loadSources("", []string{"REGBACKEND_BACKUP_RETENTION=many"}, nil), ShouldNotBeNil)
+			So(ioutil.WriteFile(file, []byte("[email]\ncontact = \"x\"\n"), 0600), ShouldBeNil)
+			So(ConfigFileError.Contains(config.loadSources(file, nil, nil)), ShouldBeTrue)
+		})
+		Convey("The example file should load", func() {
+			So(config.loadSources("regbackend.example.toml", nil, nil), ShouldBeNil)
+			So(config.Email.ContactEmail, ShouldEqual, "info@example.com")
+		})
+		Convey("A missing file should be an error", func() {
+			So(ConfigFileError.Contains(config.loadSources(filepath.Join(dir, "missing.toml"), nil, nil)), ShouldBeTrue)
+		})
+	})
+}
+
+func TestConfigValidate(t *testing.T) {
+	Convey("With the default configuration", t, func() {
+		config := &configType{}
+		config.Http.Listen = ":8080"
+		config.Email.FromAddress = "no-reply@invalid"
+		config.Email.ContactEmail = "info@invalid"
+		config.General.Domain = "invalid"
+		config.General.Database = "records.bolt"
+		config.Documents.MaxSize = 5242880
+		config.Backup.Interval = 6 * time.Hour
+		config.Auth.IdleTimeout = 2 * time.Hour
+		config.Auth.SessionLifetime = 12 * time.Hour
+
+		Convey("Production should refuse to start", func() {
+			err := config.Validate()
+			So(ConfigInvalidError.Contains(err), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, "auth.clientid is required")
+			So(err.Error(), ShouldContainSubstring, "email.fromaddress must be set")
+		})
+		Convey("Development should be allowed to start", func() {
+			config.General.Develop = true
+			So(config.Validate(), ShouldBeNil)
+		})
+		Convey("The fake challenge should only be allowed in development", func() {
+			config.Challenge.Type = ChallengeFake
+			So(config.Validate().Error(), ShouldContainSubstring, "challenge.type fake")
+			config.General.Develop = true
+			So(config.Validate(), ShouldBeNil)
+		})
+		Convey("Filling in the production settings should be enough", func() {
+			config.Auth.ClientID = "client"
+			config.Auth.ClientSecret = "secret"
+			config.Email.FromAddress = "no-reply@example.com"
+			config.Email.ContactEmail = "info@example.com"
+			config.General.Domain = "registration.example.com"
+			So(config.Validate(), ShouldBeNil)
+		})
+		Convey("Local accounts should be enough to log in with in production", func() {
+			config.Auth.LocalAccounts = true
+			config.Email.FromAddress = "no-reply@example.com"
+			config.Email.ContactEmail = "info@example.com"
+			config.General.Domain = "registration.example.com"
+			So(config.Validate(), ShouldBeNil)
+			config.Auth.ClientID = "client"
+			So(config.Validate().Error(), ShouldContainSubstring, "auth.clientsecret is required")
+		})
+		Convey("Unusable values should be refused even in development", func() {
+			config.General.Develop = true
+			config.Documents.MaxSize = 0
+			config.Backup.Directory = "backups"
+			config.Backup.Interval = 0
+			config.Auth.IdleTimeout = 0
+			config.RateLimit.TrustedProxies = stringSliceConfig{"10.0.0.0/8", "proxy"}
+			config.Challenge.Type = ChallengeHCaptcha
+			err := config.Validate()
+			So(err.Error(), ShouldContainSubstring, "documents.maxsize")
+			So(err.Error(), ShouldContainSubstring, "backup.interval")
+			So(err.Error(), ShouldContainSubstring, "auth.idletimeout")
+			So(err.Error(), ShouldContainSubstring, "ratelimit.trustedproxies: proxy is not")
+			So(err.Error(), ShouldContainSubstring, "challenge.sitekey and challenge.secret are required")
+		})
+	})
+}
+
+func TestConfigRedacted(t *testing.T) {
+	Convey("Printing the configuration should hide secrets", t, func() {
+		config := &configType{}
+		config.Auth.ClientID = "client"
+		config.Auth.ClientSecret = "hunter2"
+		config.Auth.AllowedEmails = stringSliceConfig{"a@example.com", "b@example.com"}
+		config.Backup.Interval = 2 * time.Hour
+		printed := config.redacted()
+		So(printed, ShouldNotContainSubstring, "hunter2")
+		So(printed, ShouldContainSubstring, "auth.clientsecret = <redacted>")
+		So(printed, ShouldContainSubstring, "auth.clientid = client")
+		So(printed, ShouldContainSubstring, "auth.allowedemails = a@example.com,b@example.com")
+		So(printed, ShouldContainSubstring, "backup.interval = 2h0m0s")
+		So(printed, ShouldContainSubstring, "sessionsecret = \n")
+	})
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+	"github.com/spacemonkeygo/errors"
+	"github.com/spacemonkeygo/errors/errhttp"
+)
+
+var (
+	DirectoryImportError = errors.NewClass("Invalid directory import", errhttp.SetStatusCode(400))
+)
+
+var (
+	BOLT_DIRECTORYBUCKET = []byte("BUCKET_DIRECTORY")
+)
+
+var directoryKey = []byte("directory")
+
+// Council, group and pack names are compared ignoring case and runs of
+// whitespace, so "1st  Ottawa" and "1st ottawa" are the same group.
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+type DirectoryGroup struct {
+	Name string `json:"name"`
+	// Other spellings that mean this group, like "First Ottawa".
+	Aliases []string `json:"aliases"`
+}
+
+type DirectoryCouncil struct {
+	Name    string           `json:"name"`
+	Aliases []string         `json:"aliases"`
+	Groups  []DirectoryGroup `json:"groups"`
+}
+
+// The known councils and their groups.  Registrations naming one of them,
+// under any of its aliases, are stored under its canonical name.
+type Directory struct {
+	Councils []DirectoryCouncil `json:"councils"`
+
+	UpdatedBy string    `json:"updatedBy"`
+	Updated   time.Time `json:"updated"`
+}
+
+func nameMatches(name, canonical string, aliases []string) bool {
+	if normalizeName(canonical) == name {
+		return true
+	}
+	for _, alias := range aliases {
+		if normalizeName(alias) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Directory) findCouncil(name string) *DirectoryCouncil {
+	name = normalizeName(name)
+	for i := range d.Councils {
+		if nameMatches(name, d.Councils[i].Name, d.Councils[i].Aliases) {
+			return &d.Councils[i]
+		}
+	}
+	return nil
+}
+
+func (c *DirectoryCouncil) findGroup(name string) *DirectoryGroup {
+	name = normalizeName(name)
+	for i := range c.Groups {
+		if nameMatches(name, c.Groups[i].Name, c.Groups[i].Aliases) {
+			return &c.Groups[i]
+		}
+	}
+	return nil
+}
+
+// Replaces the record's council and group with their canonical names, if
+// the directory knows them.  Returns whether both were found.
+func (d *Directory) canonicalize(rec *GroupPreRegistration) bool {
+	council := d.findCouncil(rec.Council)
+	if council == nil {
+		return false
+	}
+	rec.Council = council.Name
+	group := council.findGroup(rec.GroupName)
+	if group == nil {
+		return false
+	}
+	rec.GroupName = group.Name
+	return true
+}
+
+// Replaces missing lists with empty ones, so they are sent as [] rather
+// than null.
+func (d *Directory) fillEmpty() {
+	if d.Councils == nil {
+		d.Councils = []DirectoryCouncil{}
+	}
+	for i := range d.Councils {
+		council := &d.Councils[i]
+		if council.Aliases == nil {
+			council.Aliases = []string{}
+		}
+		if council.Groups == nil {
+			council.Groups = []DirectoryGroup{}
+		}
+		for j := range council.Groups {
+			if council.Groups[j].Aliases == nil {
+				council.Groups[j].Aliases = []string{}
+			}
+		}
+	}
+}
+
+// Checks that every name is given, and that no name or alias could match
+// more than one council, or more than one group in the same council.
+func (d *Directory) Validate() error {
+	verr := &ValidationError{}
+	d.fillEmpty()
+	councilNames := make(map[string]string)
+	for i := range d.Councils {
+		council := &d.Councils[i]
+		field := "councils[" + strconv.Itoa(i) + "]"
+		validateDirectoryNames(verr, field, &council.Name, &council.Aliases, councilNames)
+		groupNames := make(map[string]string)
+		for j := range council.Groups {
+			group := &council.Groups[j]
+			validateDirectoryNames(verr, field+".groups["+strconv.Itoa(j)+"]", &group.Name, &group.Aliases, groupNames)
+		}
+	}
+	if len(verr.Errors) != 0 {
+		return verr
+	}
+	return nil
+}
+
+// Trims the name and its aliases, and records them in seen so later entries
+// can't reuse them.
+func validateDirectoryNames(verr *ValidationError, field string, name *string, aliases *[]string, seen map[string]string) {
+	validateText(verr, field+".name", name, true)
+	check := func(field, value string) {
+		if value == "" {
+			return
+		}
+		if other, ok := seen[normalizeName(value)]; ok {
+			verr.add(field, "is already used by %s", other)
+			return
+		}
+		seen[normalizeName(value)] = *name
+	}
+	check(field+".name", *name)
+	for i := range *aliases {
+		aliasField := field + ".aliases[" + strconv.Itoa(i) + "]"
+		validateText(verr, aliasField, &(*aliases)[i], true)
+		check(aliasField, (*aliases)[i])
+	}
+}
+
+// Suggests up to limit canonical names for what has been typed so far, those
+// with a word starting with it before those only containing it.  Councils
+// are suggested when council is empty, otherwise that council's groups.
+func (d *Directory) suggest(council, typed string, limit int) []string {
+	type candidate struct {
+		name    string
+		aliases []string
+	}
+	var candidates []candidate
+	if council == "" {
+		for _, c := range d.Councils {
+			candidates = append(candidates, candidate{c.Name, c.Aliases})
+		}
+	} else if c := d.findCouncil(council); c != nil {
+		for _, g := range c.Groups {
+			candidates = append(candidates, candidate{g.Name, g.Aliases})
+		}
+	}
+
+	typed = normalizeName(typed)
+	var prefixed, contained []string
+	for _, c := range candidates {
+		match := 0
+		for _, name := range append([]string{c.name}, c.aliases...) {
+			name = normalizeName(name)
+			if strings.HasPrefix(name, typed) || strings.Contains(name, " "+typed) {
+				match = 2
+				break
+			} else if strings.Contains(name, typed) {
+				match = 1
+			}
+		}
+		if match == 2 {
+			prefixed = append(prefixed, c.name)
+		} else if match == 1 {
+			contained = append(contained, c.name)
+		}
+	}
+	suggestions := append(prefixed, contained...)
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	if suggestions == nil {
+		suggestions = []string{}
+	}
+	return suggestions
+}
+
+// Reads a directory from CSV with council, group and aliases columns.
+// Aliases are separated by semicolons.  A row without a group gives the
+// council's aliases, and councils may be spread over several rows.
+func parseDirectoryImport(in io.Reader) (*Directory, error) {
+	reader := csv.NewReader(in)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, DirectoryImportError.New("Empty import")
+	} else if err != nil {
+		return nil, DirectoryImportError.New("Failed to read header: %s", err)
+	}
+	columns := map[string]int{"council": -1, "group": -1, "aliases": -1}
+	for i, name := range header {
+		if pos, ok := columns[name]; !ok {
+			return nil, DirectoryImportError.New("Unknown column %q", name)
+		} else if pos >= 0 {
+			return nil, DirectoryImportError.New("Duplicate column %q", name)
+		}
+		columns[name] = i
+	}
+	if columns["council"] < 0 {
+		return nil, DirectoryImportError.New("Missing required column %q", "council")
+	}
+
+	directory := &Directory{Councils: []DirectoryCouncil{}}
+	councils := make(map[string]int)
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, DirectoryImportError.New("Row %d: %s", row, err)
+		}
+		column := func(name string) string {
+			if columns[name] < 0 {
+				return ""
+			}
+			return strings.TrimSpace(record[columns[name]])
+		}
+		var aliases []string
+		for _, alias := range strings.Split(column("aliases"), ";") {
+			if alias = strings.TrimSpace(alias); alias != "" {
+				aliases = append(aliases, alias)
+			}
+		}
+		if column("council") == "" {
+			return nil, DirectoryImportError.New("Row %d: council is required", row)
+		}
+
+		pos, ok := councils[normalizeName(column("council"))]
+		if !ok {
+			pos = len(directory.Councils)
+			councils[normalizeName(column("council"))] = pos
+			directory.Councils = append(directory.Councils, DirectoryCouncil{Name: column("council"), Aliases: []string{}, Groups: []DirectoryGroup{}})
+		}
+		council := &directory.Councils[pos]
+		if column("group") == "" {
+			council.Aliases = append(council.Aliases, aliases...)
+		} else {
+			if aliases == nil {
+				aliases = []string{}
+			}
+			council.Groups = append(council.Groups, DirectoryGroup{Name: column("group"), Aliases: aliases})
+		}
+	}
+	return directory, nil
+}
+
+// A registration, as listed in the directory report.
+type DirectoryReportRecord struct {
+	SecurityKey        string `json:"securityKey"`
+	Council            string `json:"council"`
+	GroupName          string `json:"groupName"`
+	PackName           string `json:"packName"`
+	ContactLeaderEmail string `json:"contactLeaderEmail"`
+}
+
+type DirectoryReport struct {
+	// Registrations that are the same pack once their names are matched
+	// against the directory, in sets of two or more.
+	Duplicates [][]DirectoryReportRecord `json:"duplicates"`
+	// Registrations naming a council or group the directory doesn't know.
+	Unmatched []DirectoryReportRecord `json:"unmatched"`
+}
+
+func (d *Directory) report(recs []*GroupPreRegistration) *DirectoryReport {
+	report := &DirectoryReport{
+		Duplicates: [][]DirectoryReportRecord{},
+		Unmatched:  []DirectoryReportRecord{},
+	}
+	packs := make(map[string][]DirectoryReportRecord)
+	var order []string
+	for _, rec := range recs {
+		entry := DirectoryReportRecord{rec.SecurityKey, rec.Council, rec.GroupName, rec.PackName, rec.ContactLeaderEmail}
+		canonical := *rec
+		if !d.canonicalize(&canonical) {
+			report.Unmatched = append(report.Unmatched, entry)
+		}
+		key := canonical.OrganicKey()
+		if _, ok := packs[key]; !ok {
+			order = append(order, key)
+		}
+		packs[key] = append(packs[key], entry)
+	}
+	sort.Strings(order)
+	for _, key := range order {
+		if len(packs[key]) > 1 {
+			report.Duplicates = append(report.Duplicates, packs[key])
+		}
+	}
+	return report
+}
+
+type DirectoryDb interface {
+	GetDirectory() (*Directory, error)
+	SetDirectory(directory *Directory) error
+}
+
+type directoryDbBolt struct {
+	db boltorm.DB
+}
+
+func NewDirectoryDb(db boltorm.DB) (DirectoryDb, error) {
+	if err := db.Update(func(tx boltorm.Tx) error {
+		return tx.CreateBucketIfNotExists(BOLT_DIRECTORYBUCKET)
+	}); err != nil {
+		return nil, err
+	}
+	return &directoryDbBolt{db}, nil
+}
+
+// Reads the directory inside another transaction, for the preregistration
+// database to canonicalize names with.  Empty until an administrator sets one.
+func getDirectory(tx boltorm.Tx) (*Directory, error) {
+	directory := &Directory{}
+	if err := tx.Get(BOLT_DIRECTORYBUCKET, directoryKey, directory); err != nil && !boltorm.ErrKeyDoesNotExist.Contains(err) {
+		return nil, err
+	}
+	directory.fillEmpty()
+	return directory, nil
+}
+
+func (d *directoryDbBolt) GetDirectory() (directory *Directory, err error) {
+	return directory, d.db.View(func(tx boltorm.Tx) error {
+		directory, err = getDirectory(tx)
+		return err
+	})
+}
+
+// Earlier directories are kept as previous versions of the record.
+func (d *directoryDbBolt) SetDirectory(directory *Directory) error {
+	return d.db.Update(func(tx boltorm.Tx) error {
+		err := tx.Update(BOLT_DIRECTORYBUCKET, directoryKey, directory)
+		if boltorm.ErrKeyDoesNotExist.Contains(err) {
+			return tx.Insert(BOLT_DIRECTORYBUCKET, directoryKey, directory)
+		}
+		return err
+	})
+}
+
+const directorySuggestionLimit = 10
+
+type DirectoryHandler struct {
+	db          DirectoryDb
+	prdb        PreRegDb
+	authHandler *AuthenticationHandler
+}
+
+func (h *DirectoryHandler) Get(w http.ResponseWriter, r *http.Request) {
+	directory, err := h.db.GetDirectory()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, directory)
+}
+
+func (h *DirectoryHandler) store(w http.ResponseWriter, r *http.Request, directory *Directory) {
+	if err := directory.Validate(); err != nil {
+		writeValidationError(w, err.(*ValidationError))
+		return
+	}
+	directory.UpdatedBy = h.authHandler.sessionUser(r)
+	directory.Updated = time.Now()
+	if err := h.db.SetDirectory(directory); err != nil {
+		log.Printf("Failed to store directory!  Error: %s", err)
+		httpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, directory)
+}
+
+func (h *DirectoryHandler) Set(w http.ResponseWriter, r *http.Request) {
+	directory := &Directory{}
+	if err := json.NewDecoder(r.Body).Decode(directory); err != nil {
+		http.Error(w, "Invalid directory json given", http.StatusBadRequest)
+		return
+	}
+	h.store(w, r, directory)
+}
+
+// Replaces the whole directory with the one in a CSV body.
+func (h *DirectoryHandler) Import(w http.ResponseWriter, r *http.Request) {
+	directory, err := parseDirectoryImport(r.Body)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	h.store(w, r, directory)
+}
+
+func (h *DirectoryHandler) Autocomplete(w http.ResponseWriter, r *http.Request) {
+	directory, err := h.db.GetDirectory()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	query := r.URL.Query()
+	writeJSON(w, http.StatusOK, directory.suggest(query.Get("council"), query.Get("q"), directorySuggestionLimit))
+}
+
+func (h *DirectoryHandler) Report(w http.ResponseWriter, r *http.Request) {
+	directory, err := h.db.GetDirectory()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	recs, err := h.prdb.GetAll()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, directory.report(recs))
+}
+
+// Autocomplete is public for the registration form, everything else is for
+// administrators.
+func NewDirectoryHandler(r *mux.Router, db DirectoryDb, prdb PreRegDb, authHandler *AuthenticationHandler) *DirectoryHandler {
+	h := &DirectoryHandler{
+		db:          db,
+		prdb:        prdb,
+		authHandler: authHandler,
+	}
+
+	r.HandleFunc("/directory", authHandler.AdminFunc(h.Get)).Methods("GET")
+	r.HandleFunc("/directory", authHandler.RoleFunc(h.Set, RoleRegistrar)).Methods("PUT")
+	r.HandleFunc("/directory/import", authHandler.RoleFunc(h.Import, RoleRegistrar)).Methods("POST")
+	r.HandleFunc("/directory/report", authHandler.AdminFunc(h.Report)).Methods("GET")
+	r.HandleFunc("/directory/autocomplete", h.Autocomplete).Methods("GET")
+
+	return h
+}
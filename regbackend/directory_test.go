@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func testDirectory() *Directory {
+	return &Directory{Councils: []DirectoryCouncil{
+		{
+			Name:    "Voyageur",
+			Aliases: []string{"Voyageur Council"},
+			Groups: []DirectoryGroup{
+				{Name: "1st Ottawa", Aliases: []string{"First Ottawa"}},
+				{Name: "2nd Ottawa", Aliases: []string{}},
+			},
+		},
+		{
+			Name:    "Battle River",
+			Aliases: []string{},
+			Groups:  []DirectoryGroup{{Name: "1st Camrose", Aliases: []string{}}},
+		},
+	}}
+}
+
+const testDirectoryCSV = `council,group,aliases
+Voyageur,,Voyageur Council
+Voyageur,1st Ottawa,First Ottawa
+Battle River,1st Camrose,
+ voyageur ,2nd Ottawa,
+`
+
+func TestNormalizeName(t *testing.T) {
+	Convey("Names should be compared ignoring case and spacing", t, func() {
+		So(normalizeName("  1st   OTTAWA "), ShouldEqual, "1st ottawa")
+		So(GroupPreRegistration{Council: "Voyageur", GroupName: "1st  Ottawa"}.OrganicKey(), ShouldEqual, GroupPreRegistration{Council: "voyageur ", GroupName: "1st ottawa"}.OrganicKey())
+	})
+}
+
+func TestDirectory(t *testing.T) {
+	Convey("With a directory", t, func() {
+		directory := testDirectory()
+		So(directory.Validate(), ShouldBeNil)
+
+		Convey("Aliases and other spellings should be canonicalized", func() {
+			rec := &GroupPreRegistration{Council: "voyageur  council", GroupName: "FIRST OTTAWA", PackName: "Pack A"}
+			So(directory.canonicalize(rec), ShouldBeTrue)
+			So(rec.Council, ShouldEqual, "Voyageur")
+			So(rec.GroupName, ShouldEqual, "1st Ottawa")
+			So(rec.PackName, ShouldEqual, "Pack A")
+		})
+		Convey("Unknown groups should keep their names", func() {
+			rec := &GroupPreRegistration{Council: "Voyageur Council", GroupName: "3rd Ottawa"}
+			So(directory.canonicalize(rec), ShouldBeFalse)
+			So(rec.Council, ShouldEqual, "Voyageur")
+			So(rec.GroupName, ShouldEqual, "3rd Ottawa")
+		})
+		Convey("Suggestions should prefer names starting with what was typed", func() {
+			So(directory.suggest("", "", 10), ShouldResemble, []string{"Voyageur", "Battle River"})
+			So(directory.suggest("", "r", 10), ShouldResemble, []string{"Battle River", "Voyageur"})
+			So(directory.suggest("", "bat", 10), ShouldResemble, []string{"Battle River"})
+			So(directory.suggest("voyageur council", "ottawa", 10), ShouldResemble, []string{"1st Ottawa", "2nd Ottawa"})
+			So(directory.suggest("voyageur", "first", 10), ShouldResemble, []string{"1st Ottawa"})
+			So(directory.suggest("voyageur", "", 1), ShouldResemble, []string{"1st Ottawa"})
+			So(directory.suggest("Unknown", "", 10), ShouldResemble, []string{})
+		})
+		Convey("The report should find duplicates and unknown names", func() {
+			recs := []*GroupPreRegistration{
+				{SecurityKey: "A", Council: "Voyageur", GroupName: "1st Ottawa", PackName: "Pack A"},
+				{SecurityKey: "B", Council: "Voyageur Council", GroupName: "First  Ottawa", PackName: "pack a"},
+				{SecurityKey: "C", Council: "Voyageur", GroupName: "1st Ottawa", PackName: "Pack B"},
+				{SecurityKey: "D", Council: "Elsewhere", GroupName: "1st Nowhere"},
+				{SecurityKey: "E", Council: "elsewhere", GroupName: "1st nowhere"},
+			}
+			report := directory.report(recs)
+			So(len(report.Duplicates), ShouldEqual, 2)
+			So(report.Duplicates[0][0].SecurityKey, ShouldEqual, "D")
+			So(report.Duplicates[0][1].SecurityKey, ShouldEqual, "E")
+			So(report.Duplicates[1][0].SecurityKey, ShouldEqual, "A")
+			So(report.Duplicates[1][1].SecurityKey, ShouldEqual, "B")
+			So(report.Duplicates[1][1].GroupName, ShouldEqual, "First  Ottawa")
+			So(len(report.Unmatched), ShouldEqual, 2)
+			So(report.Unmatched[0].SecurityKey, ShouldEqual, "D")
+		})
+	})
+	Convey("Names used twice should be refused", t, func() {
+		directory := testDirectory()
+		directory.Councils[1].Aliases = []string{"voyageur"}
+		directory.Councils[0].Groups[1].Aliases = []string{"First  Ottawa"}
+		directory.Councils[0].Groups = append(directory.Councils[0].Groups, DirectoryGroup{})
+		fields := fieldsOf(directory.Validate())
+		So(fields["councils[1].aliases[0]"], ShouldEqual, "is already used by Voyageur")
+		So(fields["councils[0].groups[1].aliases[0]"], ShouldEqual, "is already used by 1st Ottawa")
+		So(fields["councils[0].groups[2].name"], ShouldEqual, "is required")
+		So(len(fields), ShouldEqual, 3)
+	})
+	Convey("Groups may share names across councils", t, func() {
+		directory := testDirectory()
+		directory.Councils[1].Groups[0].Name = "1st Ottawa"
+		So(directory.Validate(), ShouldBeNil)
+	})
+}
+
+func TestParseDirectoryImport(t *testing.T) {
+	Convey("Importing a directory from CSV should merge rows by council", t, func() {
+		directory, err := parseDirectoryImport(strings.NewReader(testDirectoryCSV))
+		So(err, ShouldBeNil)
+		So(directory.Validate(), ShouldBeNil)
+		So(directory.Councils, ShouldResemble, testDirectory().Councils)
+	})
+	Convey("Bad imports should be refused", t, func() {
+		for _, in := range []string{
+			"",
+			"council,troop\n",
+			"council,council\n",
+			"group\n",
+			"council,group\n,1st Ottawa\n",
+			"council,group\nVoyageur\n",
+		} {
+			_, err := parseDirectoryImport(strings.NewReader(in))
+			So(DirectoryImportError.Contains(err), ShouldBeTrue)
+		}
+	})
+}
+
+func TestDirectoryRegistrations(t *testing.T) {
+	Convey("With a directory stored next to the registrations", t, func() {
+		db := boltorm.NewMemoryDB()
+		prdb, err := NewPreRegBoltDb(db, &configType{}, nil)
+		So(err, ShouldBeNil)
+		directoryDb, err := NewDirectoryDb(db)
+		So(err, ShouldBeNil)
+		So(directoryDb.SetDirectory(testDirectory()), ShouldBeNil)
+
+		rec := &GroupPreRegistration{
+			PackName:           "Pack A",
+			GroupName:          "First Ottawa",
+			Council:            "Voyageur Council",
+			ContactLeaderEmail: "first@example.com",
+		}
+		So(prdb.CreateRecord(rec), ShouldBeNil)
+
+		Convey("New registrations should be stored under the canonical names", func() {
+			stored, err := prdb.GetRecord(rec.SecurityKey)
+			So(err, ShouldBeNil)
+			So(stored.Council, ShouldEqual, "Voyageur")
+			So(stored.GroupName, ShouldEqual, "1st Ottawa")
+		})
+		Convey("Registering the same pack under another spelling should fail", func() {
+			err := prdb.CreateRecord(&GroupPreRegistration{
+				PackName:           " pack  a",
+				GroupName:          "1st ottawa",
+				Council:            "VOYAGEUR",
+				ContactLeaderEmail: "second@example.com",
+			})
+			So(GroupAlreadyCreated.Contains(err), ShouldBeTrue)
+		})
+		Convey("Importing the same pack under another spelling should fail", func() {
+			rowErrs, err := prdb.ImportRecords([]*GroupPreRegistration{{
+				PackName:           "Pack A",
+				GroupName:          "first ottawa",
+				Council:            "Voyageur",
+				ContactLeaderEmail: "second@example.com",
+			}}, false)
+			So(err, ShouldBeNil)
+			So(GroupAlreadyCreated.Contains(rowErrs[0]), ShouldBeTrue)
+		})
+	})
+	Convey("With registrations indexed before names were normalized", t, func() {
+		file, err := ioutil.TempFile("", "")
+		So(err, ShouldBeNil)
+		defer os.Remove(file.Name())
+		file.Close()
+		db, err := bolt.Open(file.Name(), 0600, nil)
+		So(err, ShouldBeNil)
+		defer db.Close()
+
+		prdb, err := NewPreRegBoltDb(boltorm.NewBoltDB(db), &configType{}, nil)
+		So(err, ShouldBeNil)
+		rec := &GroupPreRegistration{PackName: "Pack A", GroupName: "1st Ottawa", Council: "Voyageur", ContactLeaderEmail: "first@example.com"}
+		So(prdb.CreateRecord(rec), ShouldBeNil)
+		legacyKey := []byte("Voyageur-1st Ottawa-Pack A")
+		So(db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(BOLT_GROUPNAMEMAPBUCKET)
+			if err := bucket.Delete([]byte(rec.OrganicKey())); err != nil {
+				return err
+			}
+			return bucket.Put(legacyKey, rec.Key())
+		}), ShouldBeNil)
+
+		Convey("Starting up should move them to the normalized key", func() {
+			prdb, err := NewPreRegBoltDb(boltorm.NewBoltDB(db), &configType{}, nil)
+			So(err, ShouldBeNil)
+			So(db.View(func(tx *bolt.Tx) error {
+				So(tx.Bucket(BOLT_GROUPNAMEMAPBUCKET).Get(legacyKey), ShouldBeNil)
+				So(tx.Bucket(BOLT_GROUPNAMEMAPBUCKET).Get([]byte(rec.OrganicKey())), ShouldResemble, rec.Key())
+				return nil
+			}), ShouldBeNil)
+			err = prdb.CreateRecord(&GroupPreRegistration{PackName: "pack a", GroupName: "1st ottawa", Council: "voyageur", ContactLeaderEmail: "second@example.com"})
+			So(GroupAlreadyCreated.Contains(err), ShouldBeTrue)
+		})
+	})
+}
+
+func TestDirectoryHandler(t *testing.T) {
+	Convey("With a directory handler", t, func() {
+		db := boltorm.NewMemoryDB()
+		prdb, err := NewPreRegBoltDb(db, &configType{}, nil)
+		So(err, ShouldBeNil)
+		directoryDb, err := NewDirectoryDb(db)
+		So(err, ShouldBeNil)
+		config := &configType{}
+		config.Auth.AllowedEmails = stringSliceConfig{"admin@example.com"}
+		store := sessions.NewCookieStore([]byte("A"))
+		router := mux.NewRouter()
+		NewDirectoryHandler(router, directoryDb, prdb, newTestAuthHandler(config, store))
+
+		loggedInCookie := loggedInAs(store, "admin@example.com")
+
+		Convey("Changing the directory should require an administrator", func() {
+			body, err := json.Marshal(testDirectory())
+			So(err, ShouldBeNil)
+			So(testRequest(router, "PUT", "/directory", body, nil).Code, ShouldEqual, http.StatusForbidden)
+			So(testRequest(router, "POST", "/directory/import", []byte(testDirectoryCSV), nil).Code, ShouldEqual, http.StatusForbidden)
+			So(testRequest(router, "GET", "/directory/report", nil, nil).Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("An invalid directory should be refused", func() {
+			So(testRequest(router, "PUT", "/directory", []byte(`{"councils": [{"name": ""}]}`), loggedInCookie).Code, ShouldEqual, http.StatusUnprocessableEntity)
+			So(testRequest(router, "POST", "/directory/import", []byte("troop\n"), loggedInCookie).Code, ShouldEqual, http.StatusBadRequest)
+		})
+		Convey("Importing a directory", func() {
+			So(testRequest(router, "POST", "/directory/import", []byte(testDirectoryCSV), loggedInCookie).Code, ShouldEqual, http.StatusOK)
+			directory, err := directoryDb.GetDirectory()
+			So(err, ShouldBeNil)
+			Convey("Should store it", func() {
+				So(directory.Councils, ShouldResemble, testDirectory().Councils)
+				So(directory.UpdatedBy, ShouldEqual, "admin@example.com")
+			})
+			Convey("Should offer its names to anyone", func() {
+				w := testRequest(router, "GET", "/directory/autocomplete?council=Voyageur&q=2", nil, nil)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				suggestions := []string{}
+				So(json.Unmarshal(w.Body.Bytes(), &suggestions), ShouldBeNil)
+				So(suggestions, ShouldResemble, []string{"2nd Ottawa"})
+			})
+			Convey("And editing it should replace it", func() {
+				directory.Councils = directory.Councils[1:]
+				body, err := json.Marshal(directory)
+				So(err, ShouldBeNil)
+				So(testRequest(router, "PUT", "/directory", body, loggedInCookie).Code, ShouldEqual, http.StatusOK)
+				w := testRequest(router, "GET", "/directory", nil, loggedInCookie)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				stored := &Directory{}
+				So(json.Unmarshal(w.Body.Bytes(), stored), ShouldBeNil)
+				So(len(stored.Councils), ShouldEqual, 1)
+				So(stored.Councils[0].Name, ShouldEqual, "Battle River")
+			})
+			Convey("And the report should cover the registrations", func() {
+				So(prdb.CreateRecord(&GroupPreRegistration{GroupName: "1st Nowhere", Council: "Elsewhere", ContactLeaderEmail: "a@example.com"}), ShouldBeNil)
+				w := testRequest(router, "GET", "/directory/report", nil, loggedInCookie)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				report := &DirectoryReport{}
+				So(json.Unmarshal(w.Body.Bytes(), report), ShouldBeNil)
+				So(len(report.Duplicates), ShouldEqual, 0)
+				So(len(report.Unmatched), ShouldEqual, 1)
+				So(report.Unmatched[0].Council, ShouldEqual, "Elsewhere")
+			})
+		})
+	})
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+	"github.com/spacemonkeygo/errors"
+	"github.com/spacemonkeygo/errors/errhttp"
+)
+
+const (
+	DocumentMedical = "medical"
+	DocumentConsent = "consent"
+)
+
+var documentTypes = map[string]bool{
+	"application/pdf": true,
+	"image/jpeg":      true,
+	"image/png":       true,
+}
+
+const documentKeySize = 32
+
+var (
+	DocumentError     = errors.NewClass("Document storage error")
+	DocumentNotFound  = DocumentError.NewClass("Document does not exist", errhttp.SetStatusCode(404))
+	DocumentCorrupted = DocumentError.NewClass("Stored document is corrupted or was tampered with")
+	DocumentKeyError  = DocumentError.NewClass("Invalid document encryption key")
+)
+
+var (
+	// Contents of every stored document, keyed by id, unless they are kept in a directory.
+	BOLT_DOCUMENTDATABUCKET = []byte("BUCKET_DOCUMENTDATA")
+	// Medical and consent forms of a group, keyed by group.
+	BOLT_DOCUMENTBUCKET = []byte("BUCKET_DOCUMENTS")
+	// Maps a form's id to the group it belongs to.
+	BOLT_DOCUMENTINDEXBUCKET = []byte("BUCKET_DOCUMENTINDEX")
+)
+
+// Holds the contents of uploaded documents, encrypted with AES-GCM and
+// checked against the SHA-256 of the original on the way out.  Callers keep
+// track of what a document is and who it belongs to.
+type DocumentStore struct {
+	aead cipher.AEAD
+	// Stores contents as files in this directory rather than in the database.
+	directory string
+	MaxSize   int
+}
+
+type documentData struct {
+	Sealed []byte
+}
+
+func NewDocumentStore(db boltorm.DB, directory string, key []byte, maxSize int) (*DocumentStore, error) {
+	if len(key) != documentKeySize {
+		return nil, DocumentKeyError.New("Document keys must be %d bytes, got %d", documentKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, DocumentKeyError.Wrap(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, DocumentKeyError.Wrap(err)
+	}
+	if directory != "" {
+		if err := os.MkdirAll(directory, 0700); err != nil {
+			return nil, DocumentError.New("Failed to create document directory %s: %s", directory, err)
+		}
+	}
+	if err := db.Update(func(tx boltorm.Tx) error {
+		return tx.CreateBucketIfNotExists(BOLT_DOCUMENTDATABUCKET)
+	}); err != nil {
+		return nil, err
+	}
+	return &DocumentStore{aead, directory, maxSize}, nil
+}
+
+// Decodes the configured key, only making one up for development and
+// integration binaries, as anything stored with it is lost on restart.
+func loadDocumentKey(config *configType) ([]byte, error) {
+	if config.Documents.EncryptionKey == "" {
+		if !(config.General.Integration || config.General.Develop) {
+			return nil, DocumentKeyError.New("documents.encryptionKey must be set")
+		}
+		key := make([]byte, documentKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, DocumentKeyError.New("Failed to generate a document key")
+		}
+		log.Print("No document encryption key configured, using a random one")
+		return key, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(config.Documents.EncryptionKey)
+	if err != nil {
+		return nil, DocumentKeyError.New("documents.encryptionKey is not valid base64: %s", err)
+	}
+	return key, nil
+}
+
+func documentKey(id uint64) []byte {
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[:], id)
+	return key[:]
+}
+
+func (s *DocumentStore) path(id uint64) string {
+	return filepath.Join(s.directory, strconv.FormatUint(id, 10)+".doc")
+}
+
+// Stores data under a new id, returning the id and checksum the caller needs to get it back.
+func (s *DocumentStore) put(tx boltorm.Tx, data []byte) (id uint64, checksum string, err error) {
+	id, err = tx.NextSequenceForBucket(BOLT_DOCUMENTDATABUCKET)
+	if err != nil {
+		return 0, "", err
+	}
+	sum := sha256.Sum256(data)
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, "", DocumentError.New("Failed to generate a nonce")
+	}
+	// Binding the id keeps contents from being swapped between documents.
+	sealed := s.aead.Seal(nonce, nonce, data, documentKey(id))
+
+	if s.directory == "" {
+		return id, hex.EncodeToString(sum[:]), tx.Insert(BOLT_DOCUMENTDATABUCKET, documentKey(id), &documentData{sealed})
+	}
+	// A failed transaction rolls the sequence back along with everything
+	// else, so the file it leaves behind is replaced by the next document
+	// given the same id, and is never read before then.
+	f, err := ioutil.TempFile(s.directory, "upload")
+	if err != nil {
+		return 0, "", DocumentError.New("Failed to create document file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(sealed); err != nil {
+		f.Close()
+		return 0, "", DocumentError.New("Failed to write document file: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return 0, "", DocumentError.New("Failed to write document file: %s", err)
+	}
+	if err := os.Rename(f.Name(), s.path(id)); err != nil {
+		return 0, "", DocumentError.New("Failed to store document file: %s", err)
+	}
+	return id, hex.EncodeToString(sum[:]), nil
+}
+
+func (s *DocumentStore) get(tx boltorm.Tx, id uint64, checksum string) ([]byte, error) {
+	var sealed []byte
+	if s.directory == "" {
+		stored := &documentData{}
+		if err := tx.Get(BOLT_DOCUMENTDATABUCKET, documentKey(id), stored); err != nil {
+			if boltorm.ErrKeyDoesNotExist.Contains(err) {
+				return nil, DocumentNotFound.New("No contents for document %d", id)
+			}
+			return nil, err
+		}
+		sealed = stored.Sealed
+	} else {
+		var err error
+		if sealed, err = ioutil.ReadFile(s.path(id)); os.IsNotExist(err) {
+			return nil, DocumentNotFound.New("No file for document %d", id)
+		} else if err != nil {
+			return nil, DocumentError.New("Failed to read document %d: %s", id, err)
+		}
+	}
+	nonceSize := s.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, DocumentCorrupted.New("Document %d is truncated", id)
+	}
+	data, err := s.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], documentKey(id))
+	if err != nil {
+		return nil, DocumentCorrupted.New("Failed to decrypt document %d", id)
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != checksum {
+		return nil, DocumentCorrupted.New("Checksum mismatch for document %d", id)
+	}
+	return data, nil
+}
+
+// Removes the contents of a document kept in the database.  Files are left
+// for removeFiles once the transaction has committed, as a rollback would
+// otherwise leave documents without their contents.
+func (s *DocumentStore) delete(tx boltorm.Tx, id uint64) error {
+	if s.directory != "" {
+		return nil
+	}
+	if err := tx.Delete(BOLT_DOCUMENTDATABUCKET, documentKey(id)); err != nil && !boltorm.ErrKeyDoesNotExist.Contains(err) {
+		return err
+	}
+	return nil
+}
+
+// Removes the files of deleted documents, if they are kept in a directory.
+func (s *DocumentStore) removeFiles(ids []uint64) {
+	if s.directory == "" {
+		return
+	}
+	for _, id := range ids {
+		if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove document %d, err: %s", id, err)
+		}
+	}
+}
+
+// Reads an uploaded document from the request body.  Writes an error and
+// returns false if it is empty, too large or not an accepted type.
+func (s *DocumentStore) readUpload(w http.ResponseWriter, r *http.Request) (data []byte, contentType string, ok bool) {
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(s.MaxSize)+1))
+	if err != nil {
+		http.Error(w, "Failed to read document", http.StatusBadRequest)
+		return nil, "", false
+	} else if len(data) > s.MaxSize {
+		http.Error(w, "Document is too large", http.StatusRequestEntityTooLarge)
+		return nil, "", false
+	} else if len(data) == 0 {
+		http.Error(w, "Document is empty", http.StatusBadRequest)
+		return nil, "", false
+	}
+	// Go by the contents, not whatever the browser claims.
+	contentType = http.DetectContentType(data)
+	if !documentTypes[contentType] {
+		http.Error(w, "Documents must be PDF, JPEG or PNG files", http.StatusUnsupportedMediaType)
+		return nil, "", false
+	}
+	return data, contentType, true
+}
+
+func uploadName(r *http.Request) string {
+	if name := strings.TrimSpace(r.URL.Query().Get("name")); name != "" {
+		return name
+	}
+	return "document"
+}
+
+// Sends a stored document as a download, never letting the browser render it inline.
+func writeDocument(w http.ResponseWriter, name, contentType string, data []byte) {
+	w.Header()["Content-Type"] = []string{contentType}
+	w.Header().Set("Content-Disposition", `attachment; filename="`+strings.Replace(name, `"`, "", -1)+`"`)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// A signed medical or consent form, for either a whole group or one of its participants.
+type Document struct {
+	ID uint64 `json:"id"`
+	// Zero for forms covering the whole group.
+	ParticipantID uint64    `json:"participantId"`
+	Kind          string    `json:"kind"`
+	Name          string    `json:"name"`
+	ContentType   string    `json:"contentType"`
+	Size          int       `json:"size"`
+	Checksum      string    `json:"checksum"`
+	Uploaded      time.Time `json:"uploaded"`
+}
+
+type documentFolder struct {
+	SecurityKey string
+	Documents   []*Document
+}
+
+type DocumentDb interface {
+	GetDocuments(securityKey string) ([]*Document, error)
+	AddDocument(securityKey string, doc *Document, data []byte) error
+	GetDocument(securityKey string, id uint64) (*Document, []byte, error)
+	// For administrators, who can look a form up without the group's security key.
+	GetDocumentByID(id uint64) (*Document, []byte, error)
+}
+
+type documentDbBolt struct {
+	db    boltorm.DB
+	store *DocumentStore
+}
+
+func NewDocumentDb(db boltorm.DB, store *DocumentStore) (DocumentDb, error) {
+	if err := db.Update(func(tx boltorm.Tx) error {
+		if err := tx.CreateBucketIfNotExists(BOLT_DOCUMENTBUCKET); err != nil {
+			return err
+		}
+		return tx.CreateBucketIfNotExists(BOLT_DOCUMENTINDEXBUCKET)
+	}); err != nil {
+		return nil, err
+	}
+	return &documentDbBolt{db, store}, nil
+}
+
+func getDocumentFolder(tx boltorm.Tx, gpr *GroupPreRegistration) (folder *documentFolder, exists bool, err error) {
+	folder = &documentFolder{}
+	if err := tx.Get(BOLT_DOCUMENTBUCKET, gpr.Key(), folder); err != nil {
+		if boltorm.ErrKeyDoesNotExist.Contains(err) {
+			return &documentFolder{SecurityKey: gpr.SecurityKey, Documents: []*Document{}}, false, nil
+		}
+		return nil, false, err
+	}
+	if folder.Documents == nil {
+		folder.Documents = []*Document{}
+	}
+	return folder, true, nil
+}
+
+func (f *documentFolder) find(id uint64) *Document {
+	for _, doc := range f.Documents {
+		if doc.ID == id {
+			return doc
+		}
+	}
+	return nil
+}
+
+func (d *documentDbBolt) GetDocuments(securityKey string) (docs []*Document, err error) {
+	return docs, d.db.View(func(tx boltorm.Tx) error {
+		gpr, err := getPreRegRecord(tx, securityKey)
+		if err != nil {
+			return err
+		}
+		folder, _, err := getDocumentFolder(tx, gpr)
+		if err != nil {
+			return err
+		}
+		docs = folder.Documents
+		return nil
+	})
+}
+
+func (d *documentDbBolt) AddDocument(securityKey string, doc *Document, data []byte) error {
+	return d.db.Update(func(tx boltorm.Tx) error {
+		gpr, err := getPreRegRecord(tx, securityKey)
+		if err != nil {
+			return err
+		}
+		if doc.ParticipantID != 0 {
+			roster, _, err := getRoster(tx, gpr)
+			if err != nil {
+				return err
+			}
+			if roster.find(doc.ParticipantID) < 0 {
+				return ParticipantDoesNotExist.New("No participant %d in group %s", doc.ParticipantID, securityKey)
+			}
+		}
+		folder, exists, err := getDocumentFolder(tx, gpr)
+		if err != nil {
+			return err
+		}
+		if doc.ID, doc.Checksum, err = d.store.put(tx, data); err != nil {
+			return err
+		}
+		doc.Size = len(data)
+		doc.Uploaded = time.Now()
+		if err := tx.AddIndex(BOLT_DOCUMENTINDEXBUCKET, documentKey(doc.ID), gpr.Key()); err != nil {
+			return err
+		}
+		folder.Documents = append(folder.Documents, doc)
+		if exists {
+			return tx.Update(BOLT_DOCUMENTBUCKET, gpr.Key(), folder)
+		}
+		return tx.Insert(BOLT_DOCUMENTBUCKET, gpr.Key(), folder)
+	})
+}
+
+func (d *documentDbBolt) GetDocument(securityKey string, id uint64) (doc *Document, data []byte, err error) {
+	return doc, data, d.db.View(func(tx boltorm.Tx) error {
+		gpr, err := getPreRegRecord(tx, securityKey)
+		if err != nil {
+			return err
+		}
+		folder, _, err := getDocumentFolder(tx, gpr)
+		if err != nil {
+			return err
+		}
+		if doc = folder.find(id); doc == nil {
+			return DocumentNotFound.New("No document %d in group %s", id, securityKey)
+		}
+		data, err = d.store.get(tx, doc.ID, doc.Checksum)
+		return err
+	})
+}
+
+func (d *documentDbBolt) GetDocumentByID(id uint64) (doc *Document, data []byte, err error) {
+	return doc, data, d.db.View(func(tx boltorm.Tx) error {
+		folder := &documentFolder{}
+		if err := tx.GetByIndex(BOLT_DOCUMENTINDEXBUCKET, BOLT_DOCUMENTBUCKET, documentKey(id), folder); err != nil {
+			if boltorm.ErrKeyDoesNotExist.Contains(err) {
+				return DocumentNotFound.New("No document %d", id)
+			}
+			return err
+		}
+		if doc = folder.find(id); doc == nil {
+			return DocumentNotFound.New("No document %d", id)
+		}
+		data, err = d.store.get(tx, doc.ID, doc.Checksum)
+		return err
+	})
+}
+
+type DocumentHandler struct {
+	db    DocumentDb
+	store *DocumentStore
+}
+
+func documentID(w http.ResponseWriter, r *http.Request) (uint64, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["DocumentID"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid document id", 404)
+		return 0, false
+	}
+	return id, true
+}
+
+func (h *DocumentHandler) List(w http.ResponseWriter, r *http.Request) {
+	docs, err := h.db.GetDocuments(mux.Vars(r)["SecurityKey"])
+	if err != nil {
+		participantError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, docs)
+}
+
+// Accepts the raw form as the body.  The kind and name parameters describe
+// it, and participant ties it to one participant instead of the whole group.
+func (h *DocumentHandler) Upload(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	verr := &ValidationError{}
+	doc := &Document{
+		Kind: query.Get("kind"),
+		Name: uploadName(r),
+	}
+	if doc.Kind != DocumentMedical && doc.Kind != DocumentConsent {
+		verr.add("kind", "must be %s or %s", DocumentMedical, DocumentConsent)
+	}
+	if participant := query.Get("participant"); participant != "" {
+		var err error
+		if doc.ParticipantID, err = strconv.ParseUint(participant, 10, 64); err != nil || doc.ParticipantID == 0 {
+			verr.add("participant", "is not a valid participant id")
+		}
+	}
+	if len(verr.Errors) != 0 {
+		writeValidationError(w, verr)
+		return
+	}
+	data, contentType, ok := h.store.readUpload(w, r)
+	if !ok {
+		return
+	}
+	doc.ContentType = contentType
+
+	if err := h.db.AddDocument(mux.Vars(r)["SecurityKey"], doc, data); err != nil {
+		log.Printf("Failed to store document!  Error: %s", err)
+		participantError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, doc)
+}
+
+func (h *DocumentHandler) Get(w http.ResponseWriter, r *http.Request) {
+	id, ok := documentID(w, r)
+	if !ok {
+		return
+	}
+	doc, data, err := h.db.GetDocument(mux.Vars(r)["SecurityKey"], id)
+	if err != nil {
+		log.Printf("Failed to get document %d!  Error: %s", id, err)
+		participantError(w, err)
+		return
+	}
+	writeDocument(w, doc.Name, doc.ContentType, data)
+}
+
+func (h *DocumentHandler) AdminGet(w http.ResponseWriter, r *http.Request) {
+	id, ok := documentID(w, r)
+	if !ok {
+		return
+	}
+	doc, data, err := h.db.GetDocumentByID(id)
+	if err != nil {
+		log.Printf("Failed to get document %d!  Error: %s", id, err)
+		httpError(w, err)
+		return
+	}
+	writeDocument(w, doc.Name, doc.ContentType, data)
+}
+
+// Forms are handled by whoever holds the group's security key, while
+// administrators can also fetch them directly by id.
+func NewDocumentHandler(r *mux.Router, db DocumentDb, store *DocumentStore, authHandler *AuthenticationHandler) *DocumentHandler {
+	h := &DocumentHandler{
+		db:    db,
+		store: store,
+	}
+
+	r.HandleFunc("/preregistration/{SecurityKey:[a-zA-Z0-9-_]+}/documents", h.List).Methods("GET")
+	r.HandleFunc("/preregistration/{SecurityKey:[a-zA-Z0-9-_]+}/documents", h.Upload).Methods("POST")
+	r.HandleFunc("/preregistration/{SecurityKey:[a-zA-Z0-9-_]+}/documents/{DocumentID:[0-9]+}", h.Get).Methods("GET")
+	r.HandleFunc("/documents/{DocumentID:[0-9]+}", authHandler.RoleFunc(h.AdminGet, RoleRegistrar)).Methods("GET")
+
+	return h
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+var testDocumentKey = bytes.Repeat([]byte{7}, documentKeySize)
+
+func newTestDocumentStore(db boltorm.DB) *DocumentStore {
+	store, err := NewDocumentStore(db, "", testDocumentKey, 5<<20)
+	So(err, ShouldBeNil)
+	return store
+}
+
+func TestDocumentStore(t *testing.T) {
+	Convey("With a document store", t, func() {
+		db := boltorm.NewMemoryDB()
+		put := func(store *DocumentStore, data []byte) (id uint64, checksum string) {
+			So(db.Update(func(tx boltorm.Tx) (err error) {
+				id, checksum, err = store.put(tx, data)
+				return err
+			}), ShouldBeNil)
+			return id, checksum
+		}
+		get := func(store *DocumentStore, id uint64, checksum string) (data []byte, err error) {
+			db.View(func(tx boltorm.Tx) error {
+				data, err = store.get(tx, id, checksum)
+				return nil
+			})
+			return data, err
+		}
+
+		Convey("Keys of the wrong size should be refused", func() {
+			_, err := NewDocumentStore(db, "", testDocumentKey[:16], 100)
+			So(DocumentKeyError.Contains(err), ShouldBeTrue)
+		})
+
+		Convey("Kept in the database", func() {
+			store := newTestDocumentStore(db)
+			id, checksum := put(store, testPNG)
+			Convey("Should give back what was stored", func() {
+				data, err := get(store, id, checksum)
+				So(err, ShouldBeNil)
+				So(data, ShouldResemble, testPNG)
+			})
+			Convey("Should hand out new ids", func() {
+				other, _ := put(store, testPNG)
+				So(other, ShouldNotEqual, id)
+			})
+			Convey("Should refuse a mismatched checksum", func() {
+				_, err := get(store, id, "00")
+				So(DocumentCorrupted.Contains(err), ShouldBeTrue)
+			})
+			Convey("Should not be readable with another key", func() {
+				other, err := NewDocumentStore(db, "", bytes.Repeat([]byte{8}, documentKeySize), 100)
+				So(err, ShouldBeNil)
+				_, err = get(other, id, checksum)
+				So(DocumentCorrupted.Contains(err), ShouldBeTrue)
+			})
+			Convey("Should report unknown ids as missing", func() {
+				_, err := get(store, id+10, checksum)
+				So(DocumentNotFound.Contains(err), ShouldBeTrue)
+			})
+		})
+
+		Convey("Kept in a directory", func() {
+			dir, err := ioutil.TempDir("", "documents")
+			So(err, ShouldBeNil)
+			Reset(func() {
+				So(os.RemoveAll(dir), ShouldBeNil)
+			})
+			store, err := NewDocumentStore(db, filepath.Join(dir, "docs"), testDocumentKey, 100)
+			So(err, ShouldBeNil)
+			id, checksum := put(store, testPNG)
+
+			Convey("Should give back what was stored", func() {
+				data, err := get(store, id, checksum)
+				So(err, ShouldBeNil)
+				So(data, ShouldResemble, testPNG)
+			})
+			Convey("Should only write encrypted contents to disk", func() {
+				files, err := ioutil.ReadDir(filepath.Join(dir, "docs"))
+				So(err, ShouldBeNil)
+				So(len(files), ShouldEqual, 1)
+				onDisk, err := ioutil.ReadFile(store.path(id))
+				So(err, ShouldBeNil)
+				So(bytes.Contains(onDisk, testPNG[:8]), ShouldBeFalse)
+
+				Convey("And notice tampering", func() {
+					onDisk[len(onDisk)-1] ^= 1
+					So(ioutil.WriteFile(store.path(id), onDisk, 0600), ShouldBeNil)
+					_, err := get(store, id, checksum)
+					So(DocumentCorrupted.Contains(err), ShouldBeTrue)
+				})
+				Convey("And notice contents moved between documents", func() {
+					other, _ := put(store, testPNG)
+					So(os.Rename(store.path(id), store.path(other)), ShouldBeNil)
+					_, err := get(store, other, checksum)
+					So(DocumentCorrupted.Contains(err), ShouldBeTrue)
+				})
+			})
+			Convey("Should replace the file a failed transaction left behind", func() {
+				var failedID uint64
+				failure := DocumentError.New("Failing on purpose")
+				So(db.Update(func(tx boltorm.Tx) (err error) {
+					if failedID, _, err = store.put(tx, []byte("left behind")); err != nil {
+						return err
+					}
+					return failure
+				}), ShouldEqual, failure)
+				other, otherChecksum := put(store, testPNG)
+				So(other, ShouldEqual, failedID)
+				data, err := get(store, other, otherChecksum)
+				So(err, ShouldBeNil)
+				So(data, ShouldResemble, testPNG)
+			})
+		})
+	})
+}
+
+func TestDocumentHandler(t *testing.T) {
+	Convey("Starting with two groups, one with a participant", t, func() {
+		db := boltorm.NewMemoryDB()
+		invDb, err := NewInvoiceDb(db)
+		So(err, ShouldBeNil)
+		config := &configType{}
+		config.Auth.AllowedEmails = stringSliceConfig{"admin@example.com"}
+		prdb, err := NewPreRegBoltDb(db, config, invDb)
+		So(err, ShouldBeNil)
+		docs := newTestDocumentStore(db)
+		docs.MaxSize = 1024
+		participantDb, err := NewParticipantDb(db, docs)
+		So(err, ShouldBeNil)
+		documentDb, err := NewDocumentDb(db, docs)
+		So(err, ShouldBeNil)
+		store := sessions.NewCookieStore([]byte("A"))
+		router := mux.NewRouter()
+		NewDocumentHandler(router, documentDb, docs, newTestAuthHandler(config, store))
+
+		loggedInCookie := loggedInAs(store, "admin@example.com")
+
+		group := &GroupPreRegistration{
+			GroupName:          "1st Testingway",
+			Council:            "Council rock",
+			ContactLeaderEmail: "testemail@example.com",
+		}
+		So(prdb.CreateRecord(group), ShouldBeNil)
+		other := &GroupPreRegistration{
+			GroupName:          "2nd Testingway",
+			Council:            "Council rock",
+			ContactLeaderEmail: "testemail2@example.com",
+		}
+		So(prdb.CreateRecord(other), ShouldBeNil)
+		youth := &Participant{Type: ParticipantYouth, FirstName: "Sam", LastName: "Cub"}
+		So(participantDb.AddParticipant(group.SecurityKey, youth), ShouldBeNil)
+
+		groupPath := func(gpr *GroupPreRegistration) string {
+			return "/preregistration/" + gpr.SecurityKey + "/documents"
+		}
+		list := func(gpr *GroupPreRegistration) []*Document {
+			w := testRequest(router, "GET", groupPath(gpr), nil, nil)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			docs := []*Document{}
+			So(json.Unmarshal(w.Body.Bytes(), &docs), ShouldBeNil)
+			return docs
+		}
+
+		Convey("A new group should have no documents", func() {
+			So(list(group), ShouldResemble, []*Document{})
+		})
+		Convey("Uploading without a valid kind should fail", func() {
+			w := testRequest(router, "POST", groupPath(group)+"?kind=permission", testPNG, nil)
+			So(w.Code, ShouldEqual, http.StatusUnprocessableEntity)
+		})
+		Convey("Uploading for a participant that doesn't exist should 404", func() {
+			w := testRequest(router, "POST", groupPath(group)+"?kind=medical&participant=7", testPNG, nil)
+			So(w.Code, ShouldEqual, http.StatusNotFound)
+			So(list(group), ShouldResemble, []*Document{})
+		})
+		Convey("Uploading something too large should fail", func() {
+			w := testRequest(router, "POST", groupPath(group)+"?kind=consent", append(testPNG, make([]byte, 1024)...), nil)
+			So(w.Code, ShouldEqual, http.StatusRequestEntityTooLarge)
+		})
+		Convey("Uploading something that isn't an accepted type should fail", func() {
+			w := testRequest(router, "POST", groupPath(group)+"?kind=consent", []byte("<html></html>"), nil)
+			So(w.Code, ShouldEqual, http.StatusUnsupportedMediaType)
+		})
+
+		Convey("Uploading a group consent form and a participant's medical form", func() {
+			w := testRequest(router, "POST", groupPath(group)+"?kind=consent&name=consent.png", testPNG, nil)
+			So(w.Code, ShouldEqual, http.StatusCreated)
+			consent := &Document{}
+			So(json.Unmarshal(w.Body.Bytes(), consent), ShouldBeNil)
+			w = testRequest(router, "POST", groupPath(group)+"?kind=medical&name=medical.png&participant="+strconv.FormatUint(youth.ID, 10), testPNG, nil)
+			So(w.Code, ShouldEqual, http.StatusCreated)
+			medical := &Document{}
+			So(json.Unmarshal(w.Body.Bytes(), medical), ShouldBeNil)
+
+			Convey("Should describe them", func() {
+				So(consent.Kind, ShouldEqual, DocumentConsent)
+				So(consent.ParticipantID, ShouldEqual, 0)
+				So(medical.ParticipantID, ShouldEqual, youth.ID)
+				So(medical.ContentType, ShouldEqual, "image/png")
+				So(medical.Size, ShouldEqual, len(testPNG))
+				So(len(medical.Checksum), ShouldEqual, 64)
+			})
+			Convey("Should only list them for that group", func() {
+				So(list(group), ShouldResemble, []*Document{consent, medical})
+				So(list(other), ShouldResemble, []*Document{})
+			})
+			Convey("Should let the group download them", func() {
+				w := testRequest(router, "GET", groupPath(group)+"/"+strconv.FormatUint(medical.ID, 10), nil, nil)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.HeaderMap.Get("Content-Type"), ShouldEqual, "image/png")
+				So(w.HeaderMap.Get("Content-Disposition"), ShouldEqual, `attachment; filename="medical.png"`)
+				So(w.Body.Bytes(), ShouldResemble, testPNG)
+			})
+			Convey("Should not let another group download them", func() {
+				w := testRequest(router, "GET", groupPath(other)+"/"+strconv.FormatUint(medical.ID, 10), nil, nil)
+				So(w.Code, ShouldEqual, http.StatusNotFound)
+			})
+			Convey("Should let administrators download them by id alone", func() {
+				w := testRequest(router, "GET", "/documents/"+strconv.FormatUint(consent.ID, 10), nil, loggedInCookie)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Body.Bytes(), ShouldResemble, testPNG)
+				So(testRequest(router, "GET", "/documents/"+strconv.FormatUint(consent.ID, 10), nil, nil).Code, ShouldEqual, http.StatusForbidden)
+				So(testRequest(router, "GET", "/documents/999", nil, loggedInCookie).Code, ShouldEqual, http.StatusNotFound)
+			})
+		})
+	})
+}
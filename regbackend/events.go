@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+	"github.com/spacemonkeygo/errors"
+	"github.com/spacemonkeygo/errors/errhttp"
+)
+
+var (
+	EventError         = errors.NewClass("Event error")
+	EventNotFound      = EventError.NewClass("Event does not exist", errhttp.SetStatusCode(404))
+	EventAlreadyExists = EventError.NewClass("Event already exists", errhttp.SetStatusCode(400))
+)
+
+var (
+	BOLT_EVENTBUCKET = []byte("BUCKET_EVENT")
+)
+
+// The event configured by the flags, kept in the original unprefixed buckets.
+// Visiting /e/default/ switches a browser back to it.
+const defaultEventID = "default"
+
+// Remembers the event picked through /e/<id>/ for sites without their own
+// host name, so the frontend can keep using absolute paths.
+const eventCookieName = "EVENT"
+
+var eventIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// An additional event hosted alongside the default one.  Each event has its
+// own set of buckets, and with them its own registrations, schedule, form and
+// settings.
+type Event struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Hosts       []string `json:"hosts"`
+	AdminEmails []string `json:"adminEmails"`
+	// In cents, like invoices.
+	DepositPrice int `json:"depositPrice"`
+	// Replaces the built in confirmation email when set.  See send_email.go
+	// for the fields available to it.
+	ConfirmationEmail string `json:"confirmationEmail"`
+}
+
+func (e *Event) Validate() error {
+	verr := &ValidationError{}
+	e.ID = strings.TrimSpace(e.ID)
+	if !eventIDPattern.MatchString(e.ID) {
+		verr.add("id", "must be lower case letters, digits and dashes")
+	} else if e.ID == defaultEventID {
+		verr.add("id", "is reserved")
+	}
+	validateText(verr, "name", &e.Name, true)
+
+	hosts := make(map[string]bool)
+	for i := range e.Hosts {
+		e.Hosts[i] = strings.ToLower(strings.TrimSpace(e.Hosts[i]))
+		if e.Hosts[i] == "" || strings.ContainsAny(e.Hosts[i], "/: ") {
+			verr.add("hosts["+strconv.Itoa(i)+"]", "must be a host name, without a port")
+		} else if hosts[e.Hosts[i]] {
+			verr.add("hosts["+strconv.Itoa(i)+"]", "is listed more than once")
+		}
+		hosts[e.Hosts[i]] = true
+	}
+	for i := range e.AdminEmails {
+		e.AdminEmails[i] = strings.TrimSpace(e.AdminEmails[i])
+		if !validEmailAddress(e.AdminEmails[i]) {
+			verr.add("adminEmails["+strconv.Itoa(i)+"]", "is not a valid email address")
+		}
+	}
+	if e.DepositPrice < 0 {
+		verr.add("depositPrice", "must not be negative")
+	}
+	if e.ConfirmationEmail != "" {
+		if _, err := e.confirmationTemplate(); err != nil {
+			verr.add("confirmationEmail", "is not a valid template: %s", err)
+		}
+	}
+
+	if len(verr.Errors) != 0 {
+		return verr
+	}
+	return nil
+}
+
+func (e *Event) bucketPrefix() []byte {
+	return []byte("EVENT_" + e.ID + "_")
+}
+
+// Returns the built in template if the event doesn't have its own.
+func (e *Event) confirmationTemplate() (*template.Template, error) {
+	if e == nil || e.ConfirmationEmail == "" {
+		return emailTemplate, nil
+	}
+	return template.New("email").Parse(e.ConfirmationEmail)
+}
+
+// Gives the configuration for the event, based on the server's.  Emails
+// link to the event's first host name, if it has one.
+func (e *Event) config(base *configType) *configType {
+	config := base.current()
+	config.General.EventName = e.Name
+	config.General.DepositPrice = e.DepositPrice
+	if len(e.Hosts) != 0 {
+		config.General.Domain = e.Hosts[0]
+	}
+	return &config
+}
+
+type EventDb interface {
+	GetEvents() ([]*Event, error)
+	GetEvent(id string) (*Event, error)
+	CreateEvent(e *Event) error
+	UpdateEvent(e *Event) error
+}
+
+type eventDbBolt struct {
+	db boltorm.DB
+}
+
+func NewEventDb(db boltorm.DB) (EventDb, error) {
+	if err := db.Update(func(tx boltorm.Tx) error {
+		return tx.CreateBucketIfNotExists(BOLT_EVENTBUCKET)
+	}); err != nil {
+		return nil, err
+	}
+	return &eventDbBolt{db}, nil
+}
+
+func (d *eventDbBolt) GetEvents() (events []*Event, err error) {
+	return events, d.db.View(func(tx boltorm.Tx) error {
+		res, err := tx.GetAll(BOLT_EVENTBUCKET, &Event{})
+		if err != nil {
+			return err
+		}
+		events = res.([]*Event)
+		return nil
+	})
+}
+
+func (d *eventDbBolt) GetEvent(id string) (event *Event, err error) {
+	return event, d.db.View(func(tx boltorm.Tx) error {
+		event = &Event{}
+		if err := tx.Get(BOLT_EVENTBUCKET, []byte(id), event); boltorm.ErrKeyDoesNotExist.Contains(err) {
+			return EventNotFound.New("No event %s", id)
+		} else {
+			return err
+		}
+	})
+}
+
+// Host names can only belong to one event.
+func checkEventHosts(tx boltorm.Tx, e *Event) error {
+	res, err := tx.GetAll(BOLT_EVENTBUCKET, &Event{})
+	if err != nil {
+		return err
+	}
+	verr := &ValidationError{}
+	for _, other := range res.([]*Event) {
+		if other.ID == e.ID {
+			continue
+		}
+		for i, host := range e.Hosts {
+			for _, otherHost := range other.Hosts {
+				if host == otherHost {
+					verr.add("hosts["+strconv.Itoa(i)+"]", "is already used by %s", other.ID)
+				}
+			}
+		}
+	}
+	if len(verr.Errors) != 0 {
+		return verr
+	}
+	return nil
+}
+
+func (d *eventDbBolt) CreateEvent(e *Event) error {
+	return d.db.Update(func(tx boltorm.Tx) error {
+		if err := checkEventHosts(tx, e); err != nil {
+			return err
+		}
+		err := tx.Insert(BOLT_EVENTBUCKET, []byte(e.ID), e)
+		if boltorm.ErrKeyAlreadyExists.Contains(err) {
+			return EventAlreadyExists.New("Event %s already exists", e.ID)
+		}
+		return err
+	})
+}
+
+func (d *eventDbBolt) UpdateEvent(e *Event) error {
+	return d.db.Update(func(tx boltorm.Tx) error {
+		if err := checkEventHosts(tx, e); err != nil {
+			return err
+		}
+		err := tx.Update(BOLT_EVENTBUCKET, []byte(e.ID), e)
+		if boltorm.ErrKeyDoesNotExist.Contains(err) {
+			return EventNotFound.New("No event %s", e.ID)
+		}
+		return err
+	})
+}
+
+// Sends each request to the handlers of the event it is for, picked by host
+// name, then by the event cookie, and otherwise the default event.
+type eventRouter struct {
+	build          func(event *Event) (http.Handler, error)
+	defaultHandler http.Handler
+
+	lock     sync.RWMutex
+	events   map[string]*Event
+	handlers map[string]http.Handler
+	hosts    map[string]string
+}
+
+func newEventRouter(build func(event *Event) (http.Handler, error)) *eventRouter {
+	return &eventRouter{
+		build:    build,
+		events:   make(map[string]*Event),
+		handlers: make(map[string]http.Handler),
+		hosts:    make(map[string]string),
+	}
+}
+
+// Builds the default event's handlers, and those of every stored event.
+func (e *eventRouter) load(eventDb EventDb) error {
+	var err error
+	if e.defaultHandler, err = e.build(nil); err != nil {
+		return err
+	}
+	events, err := eventDb.GetEvents()
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		if err := e.set(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Starts serving the event, replacing its handlers if it was already served.
+func (e *eventRouter) set(event *Event) error {
+	handler, err := e.build(event)
+	if err != nil {
+		return err
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for host, id := range e.hosts {
+		if id == event.ID {
+			delete(e.hosts, host)
+		}
+	}
+	for _, host := range event.Hosts {
+		e.hosts[host] = event.ID
+	}
+	e.events[event.ID] = event
+	e.handlers[event.ID] = handler
+	return nil
+}
+
+func (e *eventRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/e/") {
+		e.switchEvent(w, r, strings.SplitN(r.URL.Path[len("/e/"):], "/", 2)[0])
+		return
+	}
+
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	e.lock.RLock()
+	handler := e.handlers[e.hosts[host]]
+	if handler == nil {
+		if cookie, err := r.Cookie(eventCookieName); err == nil {
+			handler = e.handlers[cookie.Value]
+		}
+	}
+	e.lock.RUnlock()
+	if handler == nil {
+		handler = e.defaultHandler
+	}
+	handler.ServeHTTP(w, r)
+}
+
+func (e *eventRouter) switchEvent(w http.ResponseWriter, r *http.Request, id string) {
+	cookie := &http.Cookie{
+		Name:     eventCookieName,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+	}
+	if id == defaultEventID {
+		cookie.Value = ""
+		cookie.MaxAge = -1
+	} else {
+		e.lock.RLock()
+		_, ok := e.events[id]
+		e.lock.RUnlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+type EventHandler struct {
+	db     EventDb
+	router *eventRouter
+}
+
+func (h *EventHandler) GetAll(w http.ResponseWriter, r *http.Request) {
+	events, err := h.db.GetEvents()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if events == nil {
+		events = []*Event{}
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+func (h *EventHandler) decode(w http.ResponseWriter, r *http.Request) *Event {
+	event := &Event{}
+	if err := json.NewDecoder(r.Body).Decode(event); err != nil {
+		http.Error(w, "Invalid event json given", http.StatusBadRequest)
+		return nil
+	}
+	if event.Hosts == nil {
+		event.Hosts = []string{}
+	}
+	if event.AdminEmails == nil {
+		event.AdminEmails = []string{}
+	}
+	return event
+}
+
+// Stores the event and starts serving it straight away.
+func (h *EventHandler) save(w http.ResponseWriter, event *Event, store func(e *Event) error, status int) {
+	if err := event.Validate(); err != nil {
+		writeValidationError(w, err.(*ValidationError))
+		return
+	}
+	if err := store(event); err != nil {
+		if verr, ok := err.(*ValidationError); ok {
+			writeValidationError(w, verr)
+		} else {
+			httpError(w, err)
+		}
+		return
+	}
+	if err := h.router.set(event); err != nil {
+		log.Printf("Failed to start serving event %s!  Error: %s", event.ID, err)
+		httpError(w, err)
+		return
+	}
+	writeJSON(w, status, event)
+}
+
+func (h *EventHandler) Create(w http.ResponseWriter, r *http.Request) {
+	if event := h.decode(w, r); event != nil {
+		h.save(w, event, h.db.CreateEvent, http.StatusCreated)
+	}
+}
+
+func (h *EventHandler) Update(w http.ResponseWriter, r *http.Request) {
+	if event := h.decode(w, r); event != nil {
+		event.ID = mux.Vars(r)["EventID"]
+		h.save(w, event, h.db.UpdateEvent, http.StatusOK)
+	}
+}
+
+func NewEventHandler(r *mux.Router, db EventDb, router *eventRouter, authHandler *AuthenticationHandler) *EventHandler {
+	h := &EventHandler{
+		db:     db,
+		router: router,
+	}
+
+	r.HandleFunc("/events", authHandler.RoleFunc(h.GetAll, RoleSuperadmin)).Methods("GET")
+	r.HandleFunc("/events", authHandler.RoleFunc(h.Create, RoleSuperadmin)).Methods("POST")
+	r.HandleFunc("/events/{EventID}", authHandler.RoleFunc(h.Update, RoleSuperadmin)).Methods("PUT")
+
+	return h
+}
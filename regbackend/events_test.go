@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func testEvent() *Event {
+	return &Event{
+		ID:           "regional",
+		Name:         "Regional Camp",
+		Hosts:        []string{" Regional.Example.com "},
+		AdminEmails:  []string{"regional@example.com"},
+		DepositPrice: 5000,
+	}
+}
+
+func TestEventValidate(t *testing.T) {
+	Convey("A complete event should validate", t, func() {
+		event := testEvent()
+		So(event.Validate(), ShouldBeNil)
+		So(event.Hosts, ShouldResemble, []string{"regional.example.com"})
+	})
+	Convey("Bad events should list each problem", t, func() {
+		event := &Event{
+			ID:                "Regional Camp",
+			Hosts:             []string{"a.example.com", "a.example.com", "b.example.com:8080"},
+			AdminEmails:       []string{"not an email"},
+			DepositPrice:      -1,
+			ConfirmationEmail: "{{.EventName",
+		}
+		fields := fieldsOf(event.Validate())
+		So(fields["id"], ShouldEqual, "must be lower case letters, digits and dashes")
+		So(fields["name"], ShouldEqual, "is required")
+		So(fields["hosts[1]"], ShouldEqual, "is listed more than once")
+		So(fields["hosts[2]"], ShouldEqual, "must be a host name, without a port")
+		So(fields["adminEmails[0]"], ShouldEqual, "is not a valid email address")
+		So(fields["depositPrice"], ShouldEqual, "must not be negative")
+		So(fields["confirmationEmail"], ShouldStartWith, "is not a valid template")
+		So(len(fields), ShouldEqual, 7)
+	})
+	Convey("The default event's id should be reserved", t, func() {
+		event := testEvent()
+		event.ID = defaultEventID
+		So(fieldsOf(event.Validate())["id"], ShouldEqual, "is reserved")
+	})
+}
+
+func TestEventDb(t *testing.T) {
+	Convey("With an event database holding an event", t, func() {
+		eventDb, err := NewEventDb(boltorm.NewMemoryDB())
+		So(err, ShouldBeNil)
+		event := testEvent()
+		So(event.Validate(), ShouldBeNil)
+		So(eventDb.CreateEvent(event), ShouldBeNil)
+
+		Convey("It should be fetchable", func() {
+			fetched, err := eventDb.GetEvent("regional")
+			So(err, ShouldBeNil)
+			So(fetched, ShouldResemble, event)
+			_, err = eventDb.GetEvent("other")
+			So(EventNotFound.Contains(err), ShouldBeTrue)
+		})
+		Convey("Creating it again should fail", func() {
+			So(EventAlreadyExists.Contains(eventDb.CreateEvent(testEvent())), ShouldBeTrue)
+		})
+		Convey("Another event can't take its host name", func() {
+			other := &Event{ID: "other", Name: "Other", Hosts: []string{"regional.example.com"}}
+			So(fieldsOf(eventDb.CreateEvent(other)), ShouldContainKey, "hosts[0]")
+		})
+		Convey("Updating it should keep its own host name", func() {
+			event.Name = "Regional Camp 2016"
+			So(eventDb.UpdateEvent(event), ShouldBeNil)
+			events, err := eventDb.GetEvents()
+			So(err, ShouldBeNil)
+			So(len(events), ShouldEqual, 1)
+			So(events[0].Name, ShouldEqual, "Regional Camp 2016")
+		})
+		Convey("Updating a missing event should fail", func() {
+			So(EventNotFound.Contains(eventDb.UpdateEvent(&Event{ID: "other", Name: "Other"})), ShouldBeTrue)
+		})
+	})
+}
+
+func TestEventRouter(t *testing.T) {
+	Convey("With an event router serving one event", t, func() {
+		events := newEventRouter(func(event *Event) (http.Handler, error) {
+			name := "default"
+			if event != nil {
+				name = event.Name
+			}
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(name))
+			}), nil
+		})
+		eventDb, err := NewEventDb(boltorm.NewMemoryDB())
+		So(err, ShouldBeNil)
+		event := testEvent()
+		So(event.Validate(), ShouldBeNil)
+		So(eventDb.CreateEvent(event), ShouldBeNil)
+		So(events.load(eventDb), ShouldBeNil)
+
+		get := func(url string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			r, err := http.NewRequest("GET", url, nil)
+			So(err, ShouldBeNil)
+			if cookie != nil {
+				r.AddCookie(cookie)
+			}
+			w := httptest.NewRecorder()
+			events.ServeHTTP(w, r)
+			return w
+		}
+
+		Convey("Requests for other hosts should go to the default event", func() {
+			So(get("http://localhost:8080/config", nil).Body.String(), ShouldEqual, "default")
+		})
+		Convey("Requests for the event's host should go to it, ignoring the port", func() {
+			So(get("http://regional.example.com:8080/config", nil).Body.String(), ShouldEqual, "Regional Camp")
+		})
+		Convey("Visiting the event's prefix should remember it in a cookie", func() {
+			w := get("http://localhost:8080/e/regional/", nil)
+			So(w.Code, ShouldEqual, http.StatusSeeOther)
+			So(w.HeaderMap.Get("Location"), ShouldEqual, "/")
+			So(w.HeaderMap.Get("Set-Cookie"), ShouldStartWith, eventCookieName+"=regional;")
+			So(get("http://localhost:8080/config", &http.Cookie{Name: eventCookieName, Value: "regional"}).Body.String(), ShouldEqual, "Regional Camp")
+		})
+		Convey("Visiting the default prefix should clear the cookie", func() {
+			w := get("http://localhost:8080/e/default/", nil)
+			So(w.Code, ShouldEqual, http.StatusSeeOther)
+			So(w.HeaderMap.Get("Set-Cookie"), ShouldContainSubstring, "Max-Age=0")
+		})
+		Convey("Visiting an unknown event should not be found", func() {
+			So(get("http://localhost:8080/e/other/", nil).Code, ShouldEqual, http.StatusNotFound)
+			So(get("http://localhost:8080/config", &http.Cookie{Name: eventCookieName, Value: "other"}).Body.String(), ShouldEqual, "default")
+		})
+		Convey("Changing the event's hosts should move it", func() {
+			event.Hosts = []string{"camp.example.com"}
+			So(events.set(event), ShouldBeNil)
+			So(get("http://regional.example.com/config", nil).Body.String(), ShouldEqual, "default")
+			So(get("http://camp.example.com/config", nil).Body.String(), ShouldEqual, "Regional Camp")
+		})
+	})
+}
+
+func TestEventHandler(t *testing.T) {
+	Convey("With an event handler", t, func() {
+		config := &configType{}
+		config.Auth.AllowedEmails = stringSliceConfig{"admin@example.com"}
+		store := sessions.NewCookieStore([]byte("A"))
+		authHandler := newTestAuthHandler(config, store)
+		eventDb, err := NewEventDb(boltorm.NewMemoryDB())
+		So(err, ShouldBeNil)
+		events := newEventRouter(func(event *Event) (http.Handler, error) {
+			return http.NotFoundHandler(), nil
+		})
+		So(events.load(eventDb), ShouldBeNil)
+		router := mux.NewRouter()
+		NewEventHandler(router, eventDb, events, authHandler)
+
+		loggedInCookie := loggedInAs(store, "admin@example.com")
+
+		Convey("Creating an event should require an administrator", func() {
+			So(testRequest(router, "POST", "/events", testEvent(), nil).Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("Creating an invalid event should be refused", func() {
+			So(testRequest(router, "POST", "/events", &Event{ID: "x"}, loggedInCookie).Code, ShouldEqual, http.StatusUnprocessableEntity)
+		})
+		Convey("Creating an event", func() {
+			So(testRequest(router, "POST", "/events", testEvent(), loggedInCookie).Code, ShouldEqual, http.StatusCreated)
+			Convey("Should store it", func() {
+				event, err := eventDb.GetEvent("regional")
+				So(err, ShouldBeNil)
+				So(event.Hosts, ShouldResemble, []string{"regional.example.com"})
+			})
+			Convey("Should start serving it", func() {
+				So(events.events, ShouldContainKey, "regional")
+				So(events.hosts["regional.example.com"], ShouldEqual, "regional")
+			})
+			Convey("Should list it", func() {
+				w := testRequest(router, "GET", "/events", nil, loggedInCookie)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				list := []*Event{}
+				So(json.Unmarshal(w.Body.Bytes(), &list), ShouldBeNil)
+				So(len(list), ShouldEqual, 1)
+			})
+			Convey("And updating it should use the id from the path", func() {
+				event := testEvent()
+				event.ID = "ignored"
+				event.DepositPrice = 7500
+				So(testRequest(router, "PUT", "/events/regional", event, loggedInCookie).Code, ShouldEqual, http.StatusOK)
+				stored, err := eventDb.GetEvent("regional")
+				So(err, ShouldBeNil)
+				So(stored.DepositPrice, ShouldEqual, 7500)
+			})
+		})
+		Convey("Updating a missing event should not be found", func() {
+			So(testRequest(router, "PUT", "/events/regional", testEvent(), loggedInCookie).Code, ShouldEqual, http.StatusNotFound)
+		})
+	})
+}
+
+func TestEventAuthentication(t *testing.T) {
+	Convey("With a default and an event authentication handler", t, func() {
+		config := &configType{}
+		config.Auth.AllowedEmails = stringSliceConfig{"admin@example.com"}
+		store := sessions.NewCookieStore([]byte("A"))
+		defaultAuth := newTestAuthHandler(config, store)
+		eventAuth := &AuthenticationHandler{config: config, store: store, event: testEvent()}
+		loggedIn := func(auth *AuthenticationHandler, email, eventID string) bool {
+			r, err := http.NewRequest("GET", "http://localhost:8080/api/authentication/isLoggedIn", nil)
+			So(err, ShouldBeNil)
+			sess, err := sessions.GetRegistry(r).Get(store, globalSessionName)
+			So(err, ShouldBeNil)
+			sess.Values[authStatusLoggedIn] = true
+			sess.Values[authUserEmail] = email
+			sess.Values[authEventID] = eventID
+			return auth.sessionIsLoggedin(r)
+		}
+
+		Convey("Event administrators should only be allowed to log in to their event", func() {
+			So(eventAuth.allowedAdmin("regional@example.com"), ShouldBeTrue)
+			So(defaultAuth.allowedAdmin("regional@example.com"), ShouldBeFalse)
+			So(eventAuth.allowedAdmin("someone@example.com"), ShouldBeFalse)
+		})
+		Convey("Their sessions should only count for their event", func() {
+			So(loggedIn(eventAuth, "regional@example.com", "regional"), ShouldBeTrue)
+			So(loggedIn(defaultAuth, "regional@example.com", "regional"), ShouldBeFalse)
+		})
+		Convey("Administrators from the flags should be logged in to every event", func() {
+			So(eventAuth.allowedAdmin("admin@example.com"), ShouldBeTrue)
+			So(loggedIn(eventAuth, "admin@example.com", ""), ShouldBeTrue)
+			So(loggedIn(defaultAuth, "admin@example.com", "regional"), ShouldBeTrue)
+		})
+	})
+}
+
+func TestEventSites(t *testing.T) {
+	Convey("With a server hosting a second event", t, func() {
+		dir, err := ioutil.TempDir("", "events")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		db, err := bolt.Open(filepath.Join(dir, "records.bolt"), 0600, &bolt.Options{Timeout: time.Second})
+		So(err, ShouldBeNil)
+		defer db.Close()
+
+		eventDb, err := NewEventDb(boltorm.NewBoltDB(db))
+		So(err, ShouldBeNil)
+		event := testEvent()
+		So(event.Validate(), ShouldBeNil)
+		So(eventDb.CreateEvent(event), ShouldBeNil)
+
+		config := &configType{}
+		config.General.Develop = true
+		config.General.EventName = "CCJ16"
+		config.General.EnableGroupReg = true
+		config.Documents.MaxSize = 1024
+		handler, quitC, doneC, err := setupStandardHandlers(http.NewServeMux(), config, db)
+		So(err, ShouldBeNil)
+		So(quitC, ShouldNotBeNil)
+		So(doneC, ShouldNotBeNil)
+
+		getConfig := func(host string) map[string]interface{} {
+			r, err := http.NewRequest("GET", "http://"+host+"/config", nil)
+			So(err, ShouldBeNil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			output := make(map[string]interface{})
+			So(json.Unmarshal(w.Body.Bytes(), &output), ShouldBeNil)
+			return output
+		}
+
+		Convey("Each event should be served under its own name", func() {
+			So(getConfig("localhost:8080")["eventName"], ShouldEqual, "CCJ16")
+			So(getConfig("regional.example.com")["eventName"], ShouldEqual, "Regional Camp")
+		})
+		Convey("Each event should keep its own schedule", func() {
+			prdb, err := NewPreRegBoltDb(boltorm.NewPrefixedDB(boltorm.NewBoltDB(db), event.bucketPrefix()), event.config(config), nil)
+			So(err, ShouldBeNil)
+			So(prdb.SetSchedule(&RegistrationSchedule{TimeZone: "UTC", Windows: []RegistrationWindow{{PhaseOpen, "2000-01-01T00:00", "2000-01-02T00:00"}}}), ShouldBeNil)
+			So(getConfig("regional.example.com")["registrationPhase"], ShouldEqual, PhaseClosed)
+			So(getConfig("localhost:8080")["registrationPhase"], ShouldEqual, PhaseOpen)
+		})
+		Convey("The event's configuration should carry its price", func() {
+			So(event.config(config).General.DepositPrice, ShouldEqual, 5000)
+			So(config.General.DepositPrice, ShouldEqual, 0)
+		})
+		Convey("The event's confirmation emails should link to its own host", func() {
+			config.General.Domain = "ccj16.example.com"
+			eventConfig := event.config(config)
+			So(eventConfig.General.Domain, ShouldEqual, "regional.example.com")
+			prdb, err := NewPreRegBoltDb(boltorm.NewPrefixedDB(boltorm.NewBoltDB(db), event.bucketPrefix()), eventConfig, nil)
+			So(err, ShouldBeNil)
+			gpr := &GroupPreRegistration{GroupName: "1st Testingway", Council: "Council rock", ContactLeaderEmail: "leader@example.com"}
+			So(prdb.CreateRecord(gpr), ShouldBeNil)
+			emailSender := &testEmailSender{}
+			ces := NewConfirmationEmailService(eventConfig.General.Domain, "no-reply@example.com", "no-reply", "info@example.com", emailSender, prdb)
+			So(ces.RequestEmailConfirmation(gpr), ShouldBeNil)
+			So(len(emailSender.Emails), ShouldEqual, 1)
+			So(string(emailSender.Emails[0].Msg), ShouldContainSubstring, "https://regional.example.com/confirmpreregistration?")
+			So(string(emailSender.Emails[0].Msg), ShouldNotContainSubstring, "ccj16.example.com")
+		})
+		Convey("Events without a host should keep the server's domain", func() {
+			config.General.Domain = "ccj16.example.com"
+			So((&Event{ID: "nohost"}).config(config).General.Domain, ShouldEqual, "ccj16.example.com")
+		})
+	})
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/spacemonkeygo/errors"
+)
+
+var (
+	ExportError          = errors.NewClass("Export error")
+	ExportKeyError       = ExportError.NewClass("Invalid export key")
+	ExportCorruptedError = ExportError.NewClass("Encrypted export is corrupted or was tampered with")
+)
+
+// Encrypted exports are laid out as the magic, the wrapped key length
+// (uint16), the RSA-OAEP wrapped AES and HMAC keys, the IV, the AES-256-CTR
+// ciphertext and finally an HMAC-SHA256 of everything before it.
+var exportMagic = []byte("CCJ16EX1")
+
+const (
+	exportAESKeySize = 32
+	exportMACKeySize = 32
+)
+
+type exportEncrypter struct {
+	w      io.Writer
+	stream cipher.Stream
+	mac    hash.Hash
+	buf    []byte
+}
+
+func newExportEncrypter(w io.Writer, publicKey *rsa.PublicKey) (io.WriteCloser, error) {
+	var keys [exportAESKeySize + exportMACKeySize]byte
+	if _, err := rand.Read(keys[:]); err != nil {
+		return nil, ExportError.New("Failed to generate export key")
+	}
+	wrappedKeys, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, keys[:], nil)
+	if err != nil {
+		return nil, ExportKeyError.New("Failed to wrap export key: %s", err)
+	}
+	var iv [aes.BlockSize]byte
+	if _, err := rand.Read(iv[:]); err != nil {
+		return nil, ExportError.New("Failed to generate export IV")
+	}
+	block, err := aes.NewCipher(keys[:exportAESKeySize])
+	if err != nil {
+		return nil, err
+	}
+
+	e := &exportEncrypter{
+		w:      w,
+		stream: cipher.NewCTR(block, iv[:]),
+		mac:    hmac.New(sha256.New, keys[exportAESKeySize:]),
+	}
+	header := &bytes.Buffer{}
+	header.Write(exportMagic)
+	binary.Write(header, binary.BigEndian, uint16(len(wrappedKeys)))
+	header.Write(wrappedKeys)
+	header.Write(iv[:])
+	e.mac.Write(header.Bytes())
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *exportEncrypter) Write(p []byte) (int, error) {
+	if cap(e.buf) < len(p) {
+		e.buf = make([]byte, len(p))
+	}
+	out := e.buf[:len(p)]
+	e.stream.XORKeyStream(out, p)
+	e.mac.Write(out)
+	return e.w.Write(out)
+}
+
+// Writes the trailing MAC, it does not close the underlying writer.
+func (e *exportEncrypter) Close() error {
+	_, err := e.w.Write(e.mac.Sum(nil))
+	return err
+}
+
+// Verifies the MAC of an encrypted export of the given size, returning a
+// reader for the decrypted contents.
+func decryptExport(in io.ReadSeeker, size int64, privateKey *rsa.PrivateKey) (io.Reader, error) {
+	headerLen := int64(len(exportMagic) + 2)
+	if size < headerLen {
+		return nil, ExportCorruptedError.New("Export is too short")
+	}
+	var header [10]byte
+	if _, err := io.ReadFull(in, header[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(exportMagic)], exportMagic) {
+		return nil, ExportCorruptedError.New("Not an encrypted export")
+	}
+	wrappedLen := int64(binary.BigEndian.Uint16(header[len(exportMagic):]))
+	ciphertextStart := headerLen + wrappedLen + aes.BlockSize
+	ciphertextLen := size - ciphertextStart - sha256.Size
+	if ciphertextLen < 0 {
+		return nil, ExportCorruptedError.New("Export is too short")
+	}
+	wrappedKeys := make([]byte, wrappedLen)
+	if _, err := io.ReadFull(in, wrappedKeys); err != nil {
+		return nil, err
+	}
+	var iv [aes.BlockSize]byte
+	if _, err := io.ReadFull(in, iv[:]); err != nil {
+		return nil, err
+	}
+	keys, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, wrappedKeys, nil)
+	if err != nil || len(keys) != exportAESKeySize+exportMACKeySize {
+		return nil, ExportKeyError.New("Failed to unwrap export key, is this the right private key?")
+	}
+
+	mac := hmac.New(sha256.New, keys[exportAESKeySize:])
+	if _, err := in.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(mac, in, size-sha256.Size); err != nil {
+		return nil, err
+	}
+	var expectedMAC [sha256.Size]byte
+	if _, err := io.ReadFull(in, expectedMAC[:]); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac.Sum(nil), expectedMAC[:]) {
+		return nil, ExportCorruptedError.New("MAC mismatch")
+	}
+
+	block, err := aes.NewCipher(keys[:exportAESKeySize])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := in.Seek(ciphertextStart, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+	return cipher.StreamReader{S: cipher.NewCTR(block, iv[:]), R: io.LimitReader(in, ciphertextLen)}, nil
+}
+
+func readPEMBlock(path string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, ExportKeyError.New("Failed to read key file %s: %s", path, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ExportKeyError.New("No PEM data found in %s", path)
+	}
+	return block, nil
+}
+
+func loadExportPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEMBlock(path)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err != nil {
+			return nil, ExportKeyError.New("Failed to parse %s: %s", path, err)
+		} else {
+			return key, nil
+		}
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, ExportKeyError.New("Failed to parse %s: %s", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, ExportKeyError.New("Key in %s is not an RSA key", path)
+	}
+	return rsaKey, nil
+}
+
+func loadExportPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEMBlock(path)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, ExportKeyError.New("Failed to parse %s: %s", path, err)
+		} else {
+			return key, nil
+		}
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, ExportKeyError.New("Failed to parse %s: %s", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, ExportKeyError.New("Key in %s is not an RSA key", path)
+	}
+	return rsaKey, nil
+}
+
+type DatabaseExportHandler struct {
+	db          *bolt.DB
+	publicKey   *rsa.PublicKey
+	auditLog    AuditLog
+	authHandler *AuthenticationHandler
+}
+
+// Streams a gzip compressed copy of the database, encrypted if a public key is configured.
+func (h *DatabaseExportHandler) Export(w http.ResponseWriter, r *http.Request) {
+	filename := "records-" + time.Now().UTC().Format("20060102T150405Z") + ".bolt.gz"
+	detail := "unencrypted"
+	// Either way it is compressed already, so isn't compressed again.
+	contentType := "application/gzip"
+	if h.publicKey != nil {
+		filename += ".enc"
+		detail = "encrypted"
+		contentType = "application/octet-stream"
+	}
+	// Refuse to export anything that can't be accounted for.
+	if err := h.auditLog.Record(newAuditEntry(r, h.authHandler, "export-database", detail)); err != nil {
+		log.Print("Failed to record database export in the audit log, err: ", err)
+		httpError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	err := h.db.View(func(tx *bolt.Tx) error {
+		var out io.Writer = w
+		var encrypter io.WriteCloser
+		if h.publicKey != nil {
+			var err error
+			if encrypter, err = newExportEncrypter(w, h.publicKey); err != nil {
+				return err
+			}
+			out = encrypter
+		}
+		gz := gzip.NewWriter(out)
+		if _, err := tx.WriteTo(gz); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		if encrypter != nil {
+			return encrypter.Close()
+		}
+		return nil
+	})
+	if err != nil {
+		// Headers have most likely been sent already, so all that can be done is cutting the stream short.
+		log.Print("Failed while exporting database, err: ", err)
+	}
+}
+
+func NewDatabaseExportHandler(r *mux.Router, db *bolt.DB, publicKey *rsa.PublicKey, auditLog AuditLog, authHandler *AuthenticationHandler) *DatabaseExportHandler {
+	h := &DatabaseExportHandler{
+		db:          db,
+		publicKey:   publicKey,
+		auditLog:    auditLog,
+		authHandler: authHandler,
+	}
+
+	r.HandleFunc("/export/database", authHandler.RoleFunc(h.Export, RoleSuperadmin)).Methods("GET")
+
+	return h
+}
+
+func decryptExportCommand(config *configType, args []string) error {
+	if len(args) != 3 {
+		return CommandError.New("Usage: decrypt-export <private key> <export> <output>")
+	}
+	privateKey, err := loadExportPrivateKey(args[0])
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(args[1])
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	decrypted, err := decryptExport(in, info.Size(), privateKey)
+	if err != nil {
+		return err
+	}
+	gz, err := gzip.NewReader(decrypted)
+	if err != nil {
+		return ExportCorruptedError.New("Decrypted export is not compressed: %s", err)
+	}
+	out, err := os.OpenFile(args[2], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, gz); err != nil {
+		out.Close()
+		os.Remove(args[2])
+		return err
+	}
+	log.Printf("Decrypted %s into %s", args[1], args[2])
+	return out.Close()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	Convey("With an audit log", t, func() {
+		auditLog, err := NewAuditLog(boltorm.NewMemoryDB())
+		So(err, ShouldBeNil)
+
+		Convey("Recording two entries", func() {
+			So(auditLog.Record(&AuditEntry{User: "a@example.com", Action: "first"}), ShouldBeNil)
+			So(auditLog.Record(&AuditEntry{User: "b@example.com", Action: "second"}), ShouldBeNil)
+			Convey("Should return them in order with ids and times", func() {
+				entries, err := auditLog.GetAll()
+				So(err, ShouldBeNil)
+				So(len(entries), ShouldEqual, 2)
+				So(entries[0].ID, ShouldEqual, 1)
+				So(entries[0].Action, ShouldEqual, "first")
+				So(entries[0].Time, ShouldHappenWithin, time.Second, time.Now())
+				So(entries[1].ID, ShouldEqual, 2)
+				So(entries[1].User, ShouldEqual, "b@example.com")
+			})
+		})
+	})
+}
+
+func TestDatabaseExport(t *testing.T) {
+	Convey("With a database export handler", t, func() {
+		dir, err := ioutil.TempDir("", "export")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			So(os.RemoveAll(dir), ShouldBeNil)
+		})
+		db, err := bolt.Open(filepath.Join(dir, "records.bolt"), 0600, &bolt.Options{Timeout: time.Second})
+		So(err, ShouldBeNil)
+		Reset(func() {
+			db.Close()
+		})
+		So(ensureSchemaVersion(db), ShouldBeNil)
+		ormDb := boltorm.NewBoltDB(db)
+		auditLog, err := NewAuditLog(ormDb)
+		So(err, ShouldBeNil)
+		invDb, err := NewInvoiceDb(ormDb)
+		So(err, ShouldBeNil)
+		config := &configType{}
+		config.Auth.AllowedEmails = stringSliceConfig{"admin@example.com"}
+		_, err = NewPreRegBoltDb(ormDb, config, invDb)
+		So(err, ShouldBeNil)
+
+		store := sessions.NewCookieStore([]byte("A"))
+		authHandler := newTestAuthHandler(config, store)
+
+		loggedInCookie := loggedInAs(store, "admin@example.com")
+
+		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		So(err, ShouldBeNil)
+
+		export := func(publicKey *rsa.PublicKey, loggedIn bool) *httptest.ResponseRecorder {
+			router := mux.NewRouter()
+			NewDatabaseExportHandler(router, db, publicKey, auditLog, authHandler)
+			if loggedIn {
+				return testRequest(router, "GET", "/export/database", nil, loggedInCookie)
+			}
+			return testRequest(router, "GET", "/export/database", nil, nil)
+		}
+		verifyDatabase := func(data []byte) {
+			gz, err := gzip.NewReader(bytes.NewReader(data))
+			So(err, ShouldBeNil)
+			exported, err := ioutil.ReadAll(gz)
+			So(err, ShouldBeNil)
+			exportPath := filepath.Join(dir, "exported.bolt")
+			So(ioutil.WriteFile(exportPath, exported, 0600), ShouldBeNil)
+			exportedDb, err := bolt.Open(exportPath, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+			So(err, ShouldBeNil)
+			defer exportedDb.Close()
+			So(exportedDb.View(checkSchema), ShouldBeNil)
+		}
+
+		Convey("Exporting while not logged in should be forbidden", func() {
+			w := export(nil, false)
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+			Convey("And not be audited", func() {
+				entries, err := auditLog.GetAll()
+				So(err, ShouldBeNil)
+				So(len(entries), ShouldEqual, 0)
+			})
+		})
+
+		Convey("Exporting without a public key", func() {
+			w := export(nil, true)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.HeaderMap.Get("Content-Disposition"), ShouldEndWith, `.bolt.gz"`)
+			Convey("Should give a compressed copy of the database", func() {
+				verifyDatabase(w.Body.Bytes())
+			})
+			Convey("Should record the export in the audit log", func() {
+				entries, err := auditLog.GetAll()
+				So(err, ShouldBeNil)
+				So(len(entries), ShouldEqual, 1)
+				So(entries[0].User, ShouldEqual, "admin@example.com")
+				So(entries[0].Action, ShouldEqual, "export-database")
+				So(entries[0].Detail, ShouldEqual, "unencrypted")
+			})
+		})
+
+		Convey("Exporting with a public key", func() {
+			w := export(&privateKey.PublicKey, true)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.HeaderMap.Get("Content-Disposition"), ShouldEndWith, `.bolt.gz.enc"`)
+			encrypted := w.Body.Bytes()
+			Convey("Should not contain a readable database", func() {
+				_, err := gzip.NewReader(bytes.NewReader(encrypted))
+				So(err, ShouldNotBeNil)
+			})
+			Convey("Should decrypt with the private key to a compressed copy of the database", func() {
+				decrypted, err := decryptExport(bytes.NewReader(encrypted), int64(len(encrypted)), privateKey)
+				So(err, ShouldBeNil)
+				data, err := ioutil.ReadAll(decrypted)
+				So(err, ShouldBeNil)
+				verifyDatabase(data)
+			})
+			Convey("Should fail to decrypt with a different private key", func() {
+				otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+				So(err, ShouldBeNil)
+				_, err = decryptExport(bytes.NewReader(encrypted), int64(len(encrypted)), otherKey)
+				So(ExportKeyError.Contains(err), ShouldBeTrue)
+			})
+			Convey("Should fail to decrypt if modified", func() {
+				encrypted[len(encrypted)/2] ^= 1
+				_, err := decryptExport(bytes.NewReader(encrypted), int64(len(encrypted)), privateKey)
+				So(ExportCorruptedError.Contains(err), ShouldBeTrue)
+			})
+			Convey("Should be decryptable by the decrypt-export command", func() {
+				keyPath := filepath.Join(dir, "key.pem")
+				So(ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}), 0600), ShouldBeNil)
+				encryptedPath := filepath.Join(dir, "export.enc")
+				So(ioutil.WriteFile(encryptedPath, encrypted, 0600), ShouldBeNil)
+				outputPath := filepath.Join(dir, "decrypted.bolt")
+				So(runCommand(config, []string{"decrypt-export", keyPath, encryptedPath, outputPath}), ShouldBeNil)
+				decryptedDb, err := bolt.Open(outputPath, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+				So(err, ShouldBeNil)
+				defer decryptedDb.Close()
+				So(decryptedDb.View(checkSchema), ShouldBeNil)
+			})
+		})
+
+		Convey("Loading a PKIX encoded public key should work", func() {
+			keyBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+			So(err, ShouldBeNil)
+			keyPath := filepath.Join(dir, "key.pub")
+			So(ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: keyBytes}), 0600), ShouldBeNil)
+			publicKey, err := loadExportPublicKey(keyPath)
+			So(err, ShouldBeNil)
+			So(publicKey.N, ShouldResemble, privateKey.PublicKey.N)
+		})
+	})
+}
+
+func TestCompressHandler(t *testing.T) {
+	Convey("With responses compressed", t, func() {
+		h := newCompressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if contentType := r.URL.Query().Get("type"); contentType != "" {
+				w.Header().Set("Content-Type", contentType)
+			}
+			w.Write([]byte("data"))
+		}))
+		request := func(path string) *httptest.ResponseRecorder {
+			r, err := http.NewRequest("GET", "http://localhost:8080"+path, nil)
+			So(err, ShouldBeNil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			return w
+		}
+
+		Convey("Other responses should be compressed", func() {
+			w := request("/api/preregistration")
+			So(w.Header().Get("Content-Encoding"), ShouldEqual, "gzip")
+			So(w.Header().Get("Content-Type"), ShouldStartWith, "text/plain")
+			gz, err := gzip.NewReader(w.Body)
+			So(err, ShouldBeNil)
+			data, err := ioutil.ReadAll(gz)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "data")
+		})
+		Convey("Responses that are compressed already should be sent as they are", func() {
+			for _, contentType := range []string{"application/gzip", "application/octet-stream"} {
+				w := request("/api/export/database?type=" + contentType)
+				So(w.Header().Get("Content-Encoding"), ShouldEqual, "")
+				So(w.Body.String(), ShouldEqual, "data")
+			}
+		})
+	})
+}
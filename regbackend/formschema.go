@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+)
+
+const (
+	FormFieldText    = "text"
+	FormFieldNumber  = "number"
+	FormFieldChoice  = "choice"
+	FormFieldBoolean = "boolean"
+	FormFieldDate    = "date"
+)
+
+// An extra question asked on the registration form.  Answers are keyed by
+// Name in GroupPreRegistration.CustomFields.
+type FormField struct {
+	Name     string `json:"name"`
+	Label    string `json:"label"`
+	Type     string `json:"type"`
+	Required bool   `json:"required"`
+
+	// Only for choice fields.
+	Choices []string `json:"choices,omitempty"`
+	// Only for text fields, MaxLength defaults to maxTextFieldLength.
+	MaxLength int    `json:"maxLength,omitempty"`
+	Pattern   string `json:"pattern,omitempty"`
+	// Only for number fields.
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+	// Only for date fields, as YYYY-MM-DD.
+	MinDate string `json:"minDate,omitempty"`
+	MaxDate string `json:"maxDate,omitempty"`
+}
+
+type FormSchema struct {
+	Fields []FormField `json:"fields"`
+
+	UpdatedBy string    `json:"updatedBy"`
+	Updated   time.Time `json:"updated"`
+
+	// The text questions' patterns, compiled to match whole answers, by
+	// question name.  Nil until compile is called, and nil for any pattern
+	// that doesn't compile.
+	patterns map[string]*regexp.Regexp
+}
+
+var formFieldNameRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*$`)
+
+// Checks a schema given by an administrator, so that every answer can be
+// checked against it later.
+func (s *FormSchema) Validate() error {
+	verr := &ValidationError{}
+	names := make(map[string]bool)
+	for i := range s.Fields {
+		field := &s.Fields[i]
+		prefix := "fields[" + strconv.Itoa(i) + "]."
+		if !formFieldNameRegexp.MatchString(field.Name) {
+			verr.add(prefix+"name", "must start with a letter and only contain letters, digits and underscores")
+		} else if names[field.Name] {
+			verr.add(prefix+"name", "is already used by another field")
+		}
+		names[field.Name] = true
+		validateText(verr, prefix+"label", &field.Label, true)
+
+		switch field.Type {
+		case FormFieldText:
+			if field.MaxLength < 0 || field.MaxLength > maxTextFieldLength {
+				verr.add(prefix+"maxLength", "must be between 0 and %d", maxTextFieldLength)
+			}
+			if _, err := compileFormPattern(field.Pattern); err != nil {
+				verr.add(prefix+"pattern", "is not a valid regular expression")
+			}
+		case FormFieldNumber:
+			if field.Min != nil && field.Max != nil && *field.Min > *field.Max {
+				verr.add(prefix+"max", "must not be less than min")
+			}
+		case FormFieldChoice:
+			if len(field.Choices) == 0 {
+				verr.add(prefix+"choices", "must list at least one choice")
+			}
+			for j := range field.Choices {
+				validateText(verr, prefix+"choices["+strconv.Itoa(j)+"]", &field.Choices[j], true)
+			}
+		case FormFieldBoolean:
+		case FormFieldDate:
+			validateDate(verr, prefix+"minDate", field.MinDate)
+			validateDate(verr, prefix+"maxDate", field.MaxDate)
+			if field.MinDate != "" && field.MaxDate != "" && field.MinDate > field.MaxDate {
+				verr.add(prefix+"maxDate", "must not be before minDate")
+			}
+		default:
+			verr.add(prefix+"type", "must be %s, %s, %s, %s or %s", FormFieldText, FormFieldNumber, FormFieldChoice, FormFieldBoolean, FormFieldDate)
+		}
+	}
+
+	if len(verr.Errors) != 0 {
+		return verr
+	}
+	return nil
+}
+
+func compileFormPattern(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// Compiles the patterns once when the schema is loaded, rather than for
+// every answer checked against it.
+func (s *FormSchema) compile() {
+	s.patterns = make(map[string]*regexp.Regexp)
+	for _, field := range s.Fields {
+		if field.Type == FormFieldText && field.Pattern != "" {
+			s.patterns[field.Name], _ = compileFormPattern(field.Pattern)
+		}
+	}
+}
+
+// Normalizes a single answer, returning a message for the problem if there
+// is one.  pattern is the field's compiled Pattern.
+func (field *FormField) checkAnswer(answer string, pattern *regexp.Regexp) (string, string) {
+	switch field.Type {
+	case FormFieldText:
+		maxLength := field.MaxLength
+		if maxLength == 0 {
+			maxLength = maxTextFieldLength
+		}
+		if utf8.RuneCountInString(answer) > maxLength {
+			return "", "must be at most " + strconv.Itoa(maxLength) + " characters"
+		}
+		if field.Pattern != "" && (pattern == nil || !pattern.MatchString(answer)) {
+			return "", "is not in the expected format"
+		}
+	case FormFieldNumber:
+		n, err := strconv.ParseFloat(answer, 64)
+		if err != nil {
+			return "", "must be a number"
+		} else if field.Min != nil && n < *field.Min {
+			return "", "must be at least " + strconv.FormatFloat(*field.Min, 'f', -1, 64)
+		} else if field.Max != nil && n > *field.Max {
+			return "", "must be at most " + strconv.FormatFloat(*field.Max, 'f', -1, 64)
+		}
+		answer = strconv.FormatFloat(n, 'f', -1, 64)
+	case FormFieldChoice:
+		for _, choice := range field.Choices {
+			if answer == choice {
+				return answer, ""
+			}
+		}
+		return "", "must be one of " + strings.Join(field.Choices, ", ")
+	case FormFieldBoolean:
+		b, err := strconv.ParseBool(answer)
+		if err != nil {
+			return "", "must be true or false"
+		}
+		answer = strconv.FormatBool(b)
+	case FormFieldDate:
+		if _, err := time.Parse(birthDateLayout, answer); err != nil {
+			return "", "must be a date, like 2016-07-01"
+		} else if field.MinDate != "" && answer < field.MinDate {
+			return "", "must not be before " + field.MinDate
+		} else if field.MaxDate != "" && answer > field.MaxDate {
+			return "", "must not be after " + field.MaxDate
+		}
+	}
+	return answer, ""
+}
+
+// Checks the answers to the schema's questions, returning them normalized.
+// Unanswered optional questions are left out, leaving nil if nothing was answered.
+func (s *FormSchema) checkAnswers(verr *ValidationError, answers map[string]string) map[string]string {
+	if s.patterns == nil {
+		s.compile()
+	}
+	var checked map[string]string
+	fields := make(map[string]bool)
+	for i := range s.Fields {
+		field := &s.Fields[i]
+		fields[field.Name] = true
+		answer := strings.TrimSpace(answers[field.Name])
+		if answer == "" {
+			if field.Required {
+				verr.add("customFields."+field.Name, "is required")
+			}
+			continue
+		}
+		if normalized, problem := field.checkAnswer(answer, s.patterns[field.Name]); problem != "" {
+			verr.add("customFields."+field.Name, "%s", problem)
+		} else {
+			if checked == nil {
+				checked = make(map[string]string)
+			}
+			checked[field.Name] = normalized
+		}
+	}
+	for name := range answers {
+		if !fields[name] {
+			verr.add("customFields."+name, "is not a question on this form")
+		}
+	}
+	return checked
+}
+
+var (
+	BOLT_FORMSCHEMABUCKET = []byte("BUCKET_FORMSCHEMA")
+)
+
+var formSchemaKey = []byte("schema")
+
+type FormSchemaDb interface {
+	GetFormSchema() (*FormSchema, error)
+	SetFormSchema(schema *FormSchema) error
+}
+
+type formSchemaDbBolt struct {
+	db boltorm.DB
+}
+
+func NewFormSchemaDb(db boltorm.DB) (FormSchemaDb, error) {
+	if err := db.Update(func(tx boltorm.Tx) error {
+		return tx.CreateBucketIfNotExists(BOLT_FORMSCHEMABUCKET)
+	}); err != nil {
+		return nil, err
+	}
+	return &formSchemaDbBolt{db}, nil
+}
+
+// Returns an empty schema until an administrator sets one.
+func (d *formSchemaDbBolt) GetFormSchema() (schema *FormSchema, err error) {
+	return schema, d.db.View(func(tx boltorm.Tx) error {
+		schema = &FormSchema{}
+		if err := tx.Get(BOLT_FORMSCHEMABUCKET, formSchemaKey, schema); err != nil && !boltorm.ErrKeyDoesNotExist.Contains(err) {
+			return err
+		}
+		if schema.Fields == nil {
+			schema.Fields = []FormField{}
+		}
+		schema.compile()
+		return nil
+	})
+}
+
+// Earlier schemas are kept as previous versions of the record.
+func (d *formSchemaDbBolt) SetFormSchema(schema *FormSchema) error {
+	return d.db.Update(func(tx boltorm.Tx) error {
+		err := tx.Update(BOLT_FORMSCHEMABUCKET, formSchemaKey, schema)
+		if boltorm.ErrKeyDoesNotExist.Contains(err) {
+			return tx.Insert(BOLT_FORMSCHEMABUCKET, formSchemaKey, schema)
+		}
+		return err
+	})
+}
+
+type FormSchemaHandler struct {
+	db          FormSchemaDb
+	authHandler *AuthenticationHandler
+}
+
+func (h *FormSchemaHandler) Get(w http.ResponseWriter, r *http.Request) {
+	schema, err := h.db.GetFormSchema()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, schema)
+}
+
+func (h *FormSchemaHandler) Set(w http.ResponseWriter, r *http.Request) {
+	schema := &FormSchema{}
+	if err := json.NewDecoder(r.Body).Decode(schema); err != nil {
+		http.Error(w, "Invalid form schema json given", 400)
+		return
+	}
+	if err := schema.Validate(); err != nil {
+		writeValidationError(w, err.(*ValidationError))
+		return
+	}
+	schema.UpdatedBy = h.authHandler.sessionUser(r)
+	schema.Updated = time.Now()
+	if err := h.db.SetFormSchema(schema); err != nil {
+		log.Printf("Failed to store form schema!  Error: %s", err)
+		httpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, schema)
+}
+
+// The schema is public through /config, only administrators may change it.
+func NewFormSchemaHandler(r *mux.Router, db FormSchemaDb, authHandler *AuthenticationHandler) *FormSchemaHandler {
+	h := &FormSchemaHandler{
+		db:          db,
+		authHandler: authHandler,
+	}
+
+	r.HandleFunc("/formschema", authHandler.AdminFunc(h.Get)).Methods("GET")
+	r.HandleFunc("/formschema", authHandler.RoleFunc(h.Set, RoleSuperadmin)).Methods("PUT")
+
+	return h
+}
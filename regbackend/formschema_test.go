@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func newTestFormSchemaDb(db boltorm.DB) FormSchemaDb {
+	formSchemaDb, err := NewFormSchemaDb(db)
+	So(err, ShouldBeNil)
+	return formSchemaDb
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+func testFormSchema() *FormSchema {
+	return &FormSchema{Fields: []FormField{
+		{Name: "sponsor", Label: "Sponsor", Type: FormFieldText, Pattern: "[A-Z].*"},
+		{Name: "campsites", Label: "Campsites needed", Type: FormFieldNumber, Required: true, Min: floatPtr(1), Max: floatPtr(4)},
+		{Name: "tshirtSize", Label: "Leader shirt size", Type: FormFieldChoice, Choices: []string{"S", "M", "L"}},
+		{Name: "firstCamp", Label: "First time at camp", Type: FormFieldBoolean},
+		{Name: "arrival", Label: "Arrival date", Type: FormFieldDate, MinDate: "2016-07-01", MaxDate: "2016-07-03"},
+	}}
+}
+
+func TestFormSchemaValidate(t *testing.T) {
+	Convey("A schema using every type of field should validate", t, func() {
+		So(testFormSchema().Validate(), ShouldBeNil)
+	})
+	Convey("A schema with bad fields should list each problem", t, func() {
+		schema := &FormSchema{Fields: []FormField{
+			{Name: "1st", Label: "Bad name", Type: FormFieldText},
+			{Name: "size", Label: "", Type: FormFieldChoice},
+			{Name: "size", Label: "Again", Type: "colour"},
+			{Name: "count", Label: "Count", Type: FormFieldNumber, Min: floatPtr(5), Max: floatPtr(1)},
+			{Name: "code", Label: "Code", Type: FormFieldText, Pattern: "("},
+			{Name: "when", Label: "When", Type: FormFieldDate, MinDate: "2016-07-03", MaxDate: "2016-07-01"},
+		}}
+		fields := fieldsOf(schema.Validate())
+		So(len(fields), ShouldEqual, 8)
+		So(fields, ShouldContainKey, "fields[0].name")
+		So(fields, ShouldContainKey, "fields[1].label")
+		So(fields, ShouldContainKey, "fields[1].choices")
+		So(fields["fields[2].name"], ShouldEqual, "is already used by another field")
+		So(fields, ShouldContainKey, "fields[2].type")
+		So(fields, ShouldContainKey, "fields[3].max")
+		So(fields, ShouldContainKey, "fields[4].pattern")
+		So(fields, ShouldContainKey, "fields[5].maxDate")
+	})
+}
+
+func TestFormSchemaAnswers(t *testing.T) {
+	Convey("With a schema", t, func() {
+		schema := testFormSchema()
+		check := func(answers map[string]string) (map[string]string, map[string]string) {
+			verr := &ValidationError{}
+			checked := schema.checkAnswers(verr, answers)
+			return checked, fieldsOf(verr)
+		}
+
+		Convey("Good answers should be normalized", func() {
+			checked, fields := check(map[string]string{
+				"sponsor":    " Rotary ",
+				"campsites":  "2.0",
+				"tshirtSize": "M",
+				"firstCamp":  "1",
+				"arrival":    "2016-07-02",
+			})
+			So(fields, ShouldBeEmpty)
+			So(checked, ShouldResemble, map[string]string{
+				"sponsor":    "Rotary",
+				"campsites":  "2",
+				"tshirtSize": "M",
+				"firstCamp":  "true",
+				"arrival":    "2016-07-02",
+			})
+		})
+		Convey("Unanswered optional questions should be left out", func() {
+			checked, fields := check(map[string]string{"campsites": "1", "sponsor": " "})
+			So(fields, ShouldBeEmpty)
+			So(checked, ShouldResemble, map[string]string{"campsites": "1"})
+		})
+		Convey("Bad answers should each be reported", func() {
+			_, fields := check(map[string]string{
+				"sponsor":    "rotary",
+				"campsites":  "5",
+				"tshirtSize": "XL",
+				"firstCamp":  "maybe",
+				"arrival":    "2016-07-04",
+				"favourite":  "blue",
+			})
+			So(fields, ShouldResemble, map[string]string{
+				"customFields.sponsor":    "is not in the expected format",
+				"customFields.campsites":  "must be at most 4",
+				"customFields.tshirtSize": "must be one of S, M, L",
+				"customFields.firstCamp":  "must be true or false",
+				"customFields.arrival":    "must not be after 2016-07-03",
+				"customFields.favourite":  "is not a question on this form",
+			})
+		})
+		Convey("Missing required answers should be reported", func() {
+			_, fields := check(nil)
+			So(fields, ShouldResemble, map[string]string{"customFields.campsites": "is required"})
+		})
+	})
+}
+
+func TestFormSchemaHandler(t *testing.T) {
+	Convey("With a form schema handler", t, func() {
+		db := boltorm.NewMemoryDB()
+		formSchemaDb := newTestFormSchemaDb(db)
+		config := &configType{}
+		config.Auth.AllowedEmails = stringSliceConfig{"admin@example.com"}
+		store := sessions.NewCookieStore([]byte("A"))
+		router := mux.NewRouter()
+		NewFormSchemaHandler(router, formSchemaDb, newTestAuthHandler(config, store))
+
+		loggedInCookie := loggedInAs(store, "admin@example.com")
+
+		Convey("There should be no fields to start with", func() {
+			schema, err := formSchemaDb.GetFormSchema()
+			So(err, ShouldBeNil)
+			So(schema.Fields, ShouldResemble, []FormField{})
+		})
+		Convey("Changing the schema should require an administrator", func() {
+			So(testRequest(router, "PUT", "/formschema", testFormSchema(), nil).Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("An invalid schema should be refused", func() {
+			So(testRequest(router, "PUT", "/formschema", &FormSchema{Fields: []FormField{{Name: "x", Type: "colour"}}}, loggedInCookie).Code, ShouldEqual, http.StatusUnprocessableEntity)
+			schema, err := formSchemaDb.GetFormSchema()
+			So(err, ShouldBeNil)
+			So(len(schema.Fields), ShouldEqual, 0)
+		})
+		Convey("Setting a schema", func() {
+			So(testRequest(router, "PUT", "/formschema", testFormSchema(), loggedInCookie).Code, ShouldEqual, http.StatusOK)
+			schema, err := formSchemaDb.GetFormSchema()
+			So(err, ShouldBeNil)
+			Convey("Should store it", func() {
+				So(schema.Fields, ShouldResemble, testFormSchema().Fields)
+				So(schema.UpdatedBy, ShouldEqual, "admin@example.com")
+			})
+			Convey("Should compile its patterns once loaded", func() {
+				So(schema.patterns, ShouldContainKey, "sponsor")
+				So(schema.patterns["sponsor"].MatchString("Council"), ShouldBeTrue)
+				So(schema.patterns["sponsor"].MatchString("council"), ShouldBeFalse)
+			})
+			Convey("And replacing it should only keep the new fields", func() {
+				So(testRequest(router, "PUT", "/formschema", &FormSchema{Fields: []FormField{{Name: "troop", Label: "Troop", Type: FormFieldText}}}, loggedInCookie).Code, ShouldEqual, http.StatusOK)
+				schema, err := formSchemaDb.GetFormSchema()
+				So(err, ShouldBeNil)
+				So(len(schema.Fields), ShouldEqual, 1)
+				So(schema.Fields[0].Name, ShouldEqual, "troop")
+			})
+			Convey("Should serve the fields through the config", func() {
+				w := httptest.NewRecorder()
+				r, err := http.NewRequest("GET", "http://localhost:8080/config", nil)
+				So(err, ShouldBeNil)
+				(&configHandler{config, nil, formSchemaDb, nil}).ServeHTTP(w, r)
+				output := struct {
+					FormFields []FormField `json:"formFields"`
+				}{}
+				So(json.Unmarshal(w.Body.Bytes(), &output), ShouldBeNil)
+				So(output.FormFields, ShouldResemble, testFormSchema().Fields)
+			})
+		})
+	})
+}
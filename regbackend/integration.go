@@ -15,7 +15,6 @@ import (
 	"time"
 
 	"github.com/boltdb/bolt"
-	"github.com/gorilla/handlers"
 	"github.com/yosssi/boltstore/reaper"
 )
 
@@ -58,7 +57,7 @@ func main() {
 		log.Fatalf("Failed to open tcp port, err %s", err)
 	}
 	server := http.Server{
-		Handler:      handlers.CompressHandler(&requestLogger{mux}),
+		Handler:      newCompressHandler(&requestLogger{mux}),
 		ReadTimeout:  time.Second * 60,
 		WriteTimeout: time.Second * 60,
 		ConnState:    ConnectionAccounting,
@@ -201,6 +200,8 @@ func (c *configChange) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	wg.Wait()
 	wg.Add(1)
 
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
 	if r.Method == "DELETE" {
 		*c.config = *config
 		w.WriteHeader(http.StatusOK)
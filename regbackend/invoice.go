@@ -12,6 +12,7 @@ type Invoice struct {
 	To        string        `json:"to"`
 	LineItems []InvoiceItem `json:"lineItems"`
 	Created   time.Time     `json:"created"`
+	Payments  []Payment     `json:"payments"`
 }
 
 type InvoiceItem struct {
@@ -20,9 +21,54 @@ type InvoiceItem struct {
 	Count       int64  `json:"count"`
 }
 
+// Returns the sum of all line items on the invoice, in cents.
+func (inv *Invoice) Total() int64 {
+	var total int64
+	for _, item := range inv.LineItems {
+		total += item.UnitPrice * item.Count
+	}
+	return total
+}
+
+// A payment received towards an invoice, as recorded by the finance team.
+type Payment struct {
+	// In cents, like the line items.
+	Amount int64 `json:"amount"`
+	// How it was paid, such as cheque or e-transfer.
+	Method string `json:"method"`
+	// A cheque number, transfer confirmation or the like.
+	Reference string `json:"reference"`
+
+	RecordedBy string    `json:"recordedBy"`
+	Recorded   time.Time `json:"recorded"`
+}
+
+func (p *Payment) Validate() error {
+	verr := &ValidationError{}
+	if p.Amount <= 0 {
+		verr.add("amount", "must be positive")
+	}
+	validateText(verr, "method", &p.Method, true)
+	validateText(verr, "reference", &p.Reference, false)
+	if len(verr.Errors) != 0 {
+		return verr
+	}
+	return nil
+}
+
+// Returns the sum of the payments made towards the invoice, in cents.
+func (inv *Invoice) Paid() int64 {
+	var paid int64
+	for _, payment := range inv.Payments {
+		paid += payment.Amount
+	}
+	return paid
+}
+
 type InvoiceDb interface {
 	NewInvoice(in *Invoice, tx boltorm.Tx) error
 	GetInvoice(invoiceID uint64, tx boltorm.Tx) (*Invoice, error)
+	AddPayment(invoiceID uint64, payment *Payment, tx boltorm.Tx) (*Invoice, error)
 }
 
 type invoiceDb struct {
@@ -51,16 +97,19 @@ func (i *invoiceDb) NewInvoice(in *Invoice, tx boltorm.Tx) error {
 		in.ID = id
 	}
 	in.Created = time.Now()
-	var idBytes [8]byte
-	binary.BigEndian.PutUint64(idBytes[:], in.ID)
-	return tx.Insert(BOLT_INVOICEBUCKET, idBytes[:], in)
+	return tx.Insert(BOLT_INVOICEBUCKET, invoiceKey(in.ID), in)
 }
 
-func (i *invoiceDb) GetInvoice(invoiceID uint64, tx boltorm.Tx) (inv *Invoice, err error) {
-	inv = &Invoice{}
+func invoiceKey(invoiceID uint64) []byte {
 	var key [8]byte
 	binary.BigEndian.PutUint64(key[:], invoiceID)
-	if err = tx.Get(BOLT_INVOICEBUCKET, key[:], inv); err != nil {
+	return key[:]
+}
+
+func (i *invoiceDb) GetInvoice(invoiceID uint64, tx boltorm.Tx) (inv *Invoice, err error) {
+	inv = &Invoice{}
+	key := invoiceKey(invoiceID)
+	if err = tx.Get(BOLT_INVOICEBUCKET, key, inv); err != nil {
 		if boltorm.ErrKeyDoesNotExist.Contains(err) {
 			return nil, RecordDoesNotExist.New("Could not find invoice")
 		} else {
@@ -69,3 +118,16 @@ func (i *invoiceDb) GetInvoice(invoiceID uint64, tx boltorm.Tx) (inv *Invoice, e
 	}
 	return inv, nil
 }
+
+// The invoice as it was before each payment is kept as a previous version.
+func (i *invoiceDb) AddPayment(invoiceID uint64, payment *Payment, tx boltorm.Tx) (*Invoice, error) {
+	inv, err := i.GetInvoice(invoiceID, tx)
+	if err != nil {
+		return nil, err
+	}
+	inv.Payments = append(inv.Payments, *payment)
+	if err := tx.Update(BOLT_INVOICEBUCKET, invoiceKey(invoiceID), inv); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
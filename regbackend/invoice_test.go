@@ -49,6 +49,21 @@ func TestInvoiceStorage(t *testing.T) {
 					So(*dbInv, ShouldResemble, invoice)
 				})
 			})
+			Convey("Payments should add up towards it", func() {
+				var paid *Invoice
+				err := db.Update(func(tx boltorm.Tx) error {
+					if _, err := invDb.AddPayment(invoice.ID, &Payment{Amount: 1000, Method: "cheque"}, tx); err != nil {
+						return err
+					}
+					var err error
+					paid, err = invDb.AddPayment(invoice.ID, &Payment{Amount: 500, Method: "cash"}, tx)
+					return err
+				})
+				So(err, ShouldBeNil)
+				So(len(paid.Payments), ShouldEqual, 2)
+				So(paid.Paid(), ShouldEqual, 1500)
+				So(paid.Total()-paid.Paid(), ShouldEqual, 61602)
+			})
 		})
 	})
 }
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/spacemonkeygo/errors"
+	"github.com/spacemonkeygo/errors/errhttp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	LocalAccountError    = errors.NewClass("Local account error")
+	LocalAccountExists   = LocalAccountError.NewClass("Account already exists", errhttp.SetStatusCode(400))
+	LocalAccountNotFound = LocalAccountError.NewClass("Account does not exist", errhttp.SetStatusCode(404))
+	LocalLoginFailed     = LocalAccountError.NewClass("Wrong email address, password or code", errhttp.SetStatusCode(401))
+	LocalCodeRequired    = LocalAccountError.NewClass("Two-factor code required", errhttp.SetStatusCode(401))
+	LocalAccountLocked   = LocalAccountError.NewClass("Account locked after too many failed logins, try again later", errhttp.SetStatusCode(429))
+)
+
+var (
+	BOLT_LOCALACCOUNTBUCKET = []byte("BUCKET_LOCALACCOUNT")
+)
+
+const (
+	localMinPasswordLength = 10
+	// Failed logins in a row before the account is locked, and for how long.
+	localMaxFailures = 5
+	localLockout     = 15 * time.Minute
+	// TOTP codes as generated by authenticator apps: six digits from a new
+	// 30 second step, with a step either way allowed for clock drift.
+	totpStep   = 30
+	totpDigits = 6
+	totpSkew   = 1
+)
+
+// An administrator logging in with a password instead of through the
+// OpenID Connect provider.  What they may do still comes from their role.
+type LocalAccount struct {
+	Email        string
+	PasswordHash []byte
+	// Base32 encoded, as shown to authenticator apps.  TOTPSecret is only
+	// used once the administrator has proven their app works with
+	// PendingTOTPSecret.
+	TOTPSecret        string
+	PendingTOTPSecret string
+	// Codes can't be used twice, so this is the last step one was used for.
+	LastTOTPStep int64
+
+	FailedLogins int
+	LockedUntil  time.Time
+
+	CreatedBy string
+	Created   time.Time
+}
+
+// Counts a failed login, locking the account after too many in a row.
+func (account *LocalAccount) noteFailure(now time.Time) {
+	account.FailedLogins++
+	if account.FailedLogins >= localMaxFailures {
+		log.Printf("Locking local account %s after %d failed logins", account.Email, account.FailedLogins)
+		account.FailedLogins = 0
+		account.LockedUntil = now.Add(localLockout)
+	}
+}
+
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return "", LocalAccountError.Wrap(err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// Returns the step the code is for, or 0 if it isn't valid around now.
+func totpMatch(secret, code string, now time.Time) int64 {
+	current := now.Unix() / totpStep
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCode(secret, step)
+		if err == nil && hmac.Equal([]byte(expected), []byte(strings.TrimSpace(code))) {
+			return step
+		}
+	}
+	return 0
+}
+
+func newTOTPSecret() (string, error) {
+	var secret [20]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return "", LocalAccountError.Wrap(err)
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret[:]), nil
+}
+
+// Compared against when the account doesn't exist, so logging in takes as
+// long either way.
+var localDummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+type LocalAccountDb interface {
+	CreateAccount(email, password, createdBy string) error
+	HasAccount(email string) (bool, error)
+	// Checks the password, and the code once two-factor is set up, keeping
+	// track of failures to lock the account.
+	Login(email, password, code string, now time.Time) error
+	// Starts setting up two-factor, returning the new secret.  Replacing a
+	// secret that is already set up needs a code from it or the password,
+	// so a stolen session can't take over the account's two-factor.
+	StartTOTP(email, password, code string, now time.Time) (string, error)
+	ConfirmTOTP(email, code string, now time.Time) error
+}
+
+type localAccountDbBolt struct {
+	db boltorm.DB
+}
+
+func NewLocalAccountDb(db boltorm.DB) (LocalAccountDb, error) {
+	if err := db.Update(func(tx boltorm.Tx) error {
+		return tx.CreateBucketIfNotExists(BOLT_LOCALACCOUNTBUCKET)
+	}); err != nil {
+		return nil, err
+	}
+	return &localAccountDbBolt{db}, nil
+}
+
+func validateLocalAccount(email, password string) error {
+	verr := &ValidationError{}
+	if !validEmailAddress(email) {
+		verr.add("email", "is not a valid email address")
+	}
+	if len(password) < localMinPasswordLength {
+		verr.add("password", "must be at least %d characters long", localMinPasswordLength)
+	}
+	if len(verr.Errors) != 0 {
+		return verr
+	}
+	return nil
+}
+
+func (d *localAccountDbBolt) CreateAccount(email, password, createdBy string) error {
+	email = normalizeEmail(email)
+	if err := validateLocalAccount(email, password); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return LocalAccountError.Wrap(err)
+	}
+	account := &LocalAccount{
+		Email:        email,
+		PasswordHash: hash,
+		CreatedBy:    createdBy,
+		Created:      time.Now(),
+	}
+	return d.db.Update(func(tx boltorm.Tx) error {
+		err := tx.Insert(BOLT_LOCALACCOUNTBUCKET, []byte(email), account)
+		if boltorm.ErrKeyAlreadyExists.Contains(err) {
+			return LocalAccountExists.New("%s", email)
+		}
+		return err
+	})
+}
+
+func getLocalAccount(tx boltorm.Tx, email string) (*LocalAccount, error) {
+	account := &LocalAccount{}
+	if err := tx.Get(BOLT_LOCALACCOUNTBUCKET, []byte(normalizeEmail(email)), account); err != nil {
+		if boltorm.ErrKeyDoesNotExist.Contains(err) {
+			return nil, LocalAccountNotFound.New("%s", email)
+		}
+		return nil, err
+	}
+	return account, nil
+}
+
+func (d *localAccountDbBolt) HasAccount(email string) (exists bool, err error) {
+	return exists, d.db.View(func(tx boltorm.Tx) error {
+		_, err := getLocalAccount(tx, email)
+		if LocalAccountNotFound.Contains(err) {
+			return nil
+		}
+		exists = err == nil
+		return err
+	})
+}
+
+func (d *localAccountDbBolt) Login(email, password, code string, now time.Time) error {
+	var loginErr error
+	// Failures are stored, so they come back through loginErr rather than
+	// rolling the transaction back.
+	err := d.db.Update(func(tx boltorm.Tx) error {
+		account, err := getLocalAccount(tx, email)
+		if LocalAccountNotFound.Contains(err) {
+			bcrypt.CompareHashAndPassword(localDummyHash, []byte(password))
+			loginErr = LocalLoginFailed.New("%s", email)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if now.Before(account.LockedUntil) {
+			loginErr = LocalAccountLocked.New("%s", email)
+			return nil
+		}
+
+		failed := bcrypt.CompareHashAndPassword(account.PasswordHash, []byte(password)) != nil
+		if !failed && account.TOTPSecret != "" {
+			if code == "" {
+				loginErr = LocalCodeRequired.New("%s", email)
+				return nil
+			}
+			step := totpMatch(account.TOTPSecret, code, now)
+			if step == 0 || step <= account.LastTOTPStep {
+				failed = true
+			} else {
+				account.LastTOTPStep = step
+			}
+		}
+		if failed {
+			loginErr = LocalLoginFailed.New("%s", email)
+			account.noteFailure(now)
+		} else {
+			account.FailedLogins = 0
+		}
+		return tx.Update(BOLT_LOCALACCOUNTBUCKET, []byte(account.Email), account)
+	})
+	if err != nil {
+		return err
+	}
+	return loginErr
+}
+
+func (d *localAccountDbBolt) StartTOTP(email, password, code string, now time.Time) (secret string, err error) {
+	if secret, err = newTOTPSecret(); err != nil {
+		return "", err
+	}
+	var checkErr error
+	// As with logging in, failures are stored rather than rolled back.
+	err = d.db.Update(func(tx boltorm.Tx) error {
+		account, err := getLocalAccount(tx, email)
+		if err != nil {
+			return err
+		}
+		if account.TOTPSecret != "" {
+			if now.Before(account.LockedUntil) {
+				checkErr = LocalAccountLocked.New("%s", email)
+				return nil
+			}
+			if step := totpMatch(account.TOTPSecret, code, now); step != 0 && step > account.LastTOTPStep {
+				account.LastTOTPStep = step
+			} else if password == "" || bcrypt.CompareHashAndPassword(account.PasswordHash, []byte(password)) != nil {
+				checkErr = LocalLoginFailed.New("%s", email)
+				account.noteFailure(now)
+				return tx.Update(BOLT_LOCALACCOUNTBUCKET, []byte(account.Email), account)
+			}
+			account.FailedLogins = 0
+		}
+		account.PendingTOTPSecret = secret
+		return tx.Update(BOLT_LOCALACCOUNTBUCKET, []byte(account.Email), account)
+	})
+	if err == nil {
+		err = checkErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+func (d *localAccountDbBolt) ConfirmTOTP(email, code string, now time.Time) error {
+	return d.db.Update(func(tx boltorm.Tx) error {
+		account, err := getLocalAccount(tx, email)
+		if err != nil {
+			return err
+		}
+		step := int64(0)
+		if account.PendingTOTPSecret != "" {
+			step = totpMatch(account.PendingTOTPSecret, code, now)
+		}
+		if step == 0 {
+			return LocalLoginFailed.New("%s", email)
+		}
+		account.TOTPSecret = account.PendingTOTPSecret
+		account.PendingTOTPSecret = ""
+		account.LastTOTPStep = step
+		return tx.Update(BOLT_LOCALACCOUNTBUCKET, []byte(account.Email), account)
+	})
+}
+
+type LocalAccountHandler struct {
+	config      *configType
+	db          LocalAccountDb
+	authHandler *AuthenticationHandler
+}
+
+func (h *LocalAccountHandler) Login(w http.ResponseWriter, r *http.Request) {
+	input := struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid login json given", http.StatusBadRequest)
+		return
+	}
+	if err := h.db.Login(input.Email, input.Password, input.Code, time.Now()); err != nil {
+		if LocalCodeRequired.Contains(err) {
+			writeJSON(w, http.StatusUnauthorized, map[string]bool{"codeRequired": true})
+		} else {
+			if !LocalLoginFailed.Contains(err) && !LocalAccountLocked.Contains(err) {
+				log.Printf("Failed to check local login for %s!  Error: %s", input.Email, err)
+			}
+			httpError(w, err)
+		}
+		return
+	}
+	email := normalizeEmail(input.Email)
+	role, err := h.authHandler.role(email)
+	if err != nil {
+		log.Print("Failed to look up the user's role, err ", err)
+		http.Error(w, "Failed to check user's role!", http.StatusInternalServerError)
+		return
+	} else if role == "" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := h.authHandler.logIn(r, email); err != nil {
+		log.Print("Failed to record the login, err ", err)
+		http.Error(w, "Failed to log in!", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, sessionStatus{LoggedIn: true, Email: email, Role: role})
+}
+
+// Only administrators with a local account can set up two-factor for it.
+func (h *LocalAccountHandler) accountFunc(f http.HandlerFunc) http.HandlerFunc {
+	return h.authHandler.AdminFunc(func(w http.ResponseWriter, r *http.Request) {
+		if exists, err := h.db.HasAccount(h.authHandler.sessionUser(r)); err != nil {
+			httpError(w, err)
+		} else if !exists {
+			http.Error(w, "Not logged in with a local account", http.StatusBadRequest)
+		} else {
+			f(w, r)
+		}
+	})
+}
+
+// Starts setting up two-factor, returning the secret both on its own and as
+// a URL to show as a QR code.  It only takes effect once confirmed.  Setting
+// it up again needs a current code or the password.
+func (h *LocalAccountHandler) StartTOTP(w http.ResponseWriter, r *http.Request) {
+	input := struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil && err != io.EOF {
+		http.Error(w, "Invalid two-factor json given", http.StatusBadRequest)
+		return
+	}
+	email := h.authHandler.sessionUser(r)
+	secret, err := h.db.StartTOTP(email, input.Password, input.Code, time.Now())
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	issuer := h.config.General.EventName
+	if h.authHandler.event != nil {
+		issuer = h.authHandler.event.Name
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"secret": secret,
+		"url": "otpauth://totp/" + url.PathEscape(issuer+":"+email) + "?" + url.Values{
+			"secret": {secret},
+			"issuer": {issuer},
+		}.Encode(),
+	})
+}
+
+func (h *LocalAccountHandler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	input := struct {
+		Code string `json:"code"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid code json given", http.StatusBadRequest)
+		return
+	}
+	if err := h.db.ConfirmTOTP(h.authHandler.sessionUser(r), input.Code, time.Now()); err != nil {
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Creates another local account.  It still needs a role before it can log in.
+func (h *LocalAccountHandler) Create(w http.ResponseWriter, r *http.Request) {
+	input := struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid account json given", http.StatusBadRequest)
+		return
+	}
+	if err := h.db.CreateAccount(input.Email, input.Password, h.authHandler.sessionUser(r)); err != nil {
+		if verr, ok := err.(*ValidationError); ok {
+			writeValidationError(w, verr)
+		} else {
+			httpError(w, err)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func NewLocalAccountHandler(r *mux.Router, config *configType, db LocalAccountDb, authHandler *AuthenticationHandler) *LocalAccountHandler {
+	h := &LocalAccountHandler{
+		config:      config,
+		db:          db,
+		authHandler: authHandler,
+	}
+
+	r.HandleFunc("/authentication/local/login", h.Login).Methods("POST")
+	r.HandleFunc("/authentication/local/totp", h.accountFunc(h.StartTOTP)).Methods("POST")
+	r.HandleFunc("/authentication/local/totp", h.accountFunc(h.ConfirmTOTP)).Methods("PUT")
+	r.HandleFunc("/authentication/local/accounts", authHandler.RoleFunc(h.Create, RoleSuperadmin)).Methods("POST")
+
+	return h
+}
+
+// Read from by create-admin, so tests can give it a password.
+var commandInput io.Reader = os.Stdin
+
+// Makes the account a superadmin of the default event, which keeps its
+// accounts and roles in the unprefixed buckets, unless --event names
+// another.
+func createAdminCommand(config *configType, args []string) error {
+	flags := flag.NewFlagSet("create-admin", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	eventID := flags.String("event", defaultEventID, "")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return CommandError.New("Usage: create-admin [--event <id>] <email>")
+	}
+	email := flags.Arg(0)
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(commandInput).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	password = strings.TrimRight(password, "\r\n")
+
+	db, err := bolt.Open(config.General.Database, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ormDb := boltorm.NewBoltDB(db)
+	if *eventID != defaultEventID {
+		eventDb, err := NewEventDb(ormDb)
+		if err != nil {
+			return err
+		}
+		event, err := eventDb.GetEvent(*eventID)
+		if err != nil {
+			return err
+		}
+		ormDb = boltorm.NewPrefixedDB(ormDb, event.bucketPrefix())
+	}
+	accounts, err := NewLocalAccountDb(ormDb)
+	if err != nil {
+		return err
+	}
+	roles, err := NewRoleDb(ormDb)
+	if err != nil {
+		return err
+	}
+	if err := accounts.CreateAccount(email, password, "create-admin"); err != nil {
+		return err
+	}
+	if err := roles.SetRole(&RoleAssignment{
+		Email:     email,
+		Role:      RoleSuperadmin,
+		UpdatedBy: "create-admin",
+		Updated:   time.Now(),
+	}); err != nil {
+		return err
+	}
+	log.Printf("Created local superadmin account %s for event %s", normalizeEmail(email), *eventID)
+	return nil
+}
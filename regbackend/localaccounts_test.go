@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestTOTPCode(t *testing.T) {
+	Convey("Codes should match the RFC 6238 test vectors", t, func() {
+		secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+		for _, vector := range []struct {
+			time int64
+			code string
+		}{{59, "287082"}, {1111111109, "081804"}, {1234567890, "005924"}, {2000000000, "279037"}} {
+			code, err := totpCode(secret, vector.time/totpStep)
+			So(err, ShouldBeNil)
+			So(code, ShouldEqual, vector.code)
+		}
+	})
+	Convey("Codes from the next or previous step should be accepted", t, func() {
+		secret, err := newTOTPSecret()
+		So(err, ShouldBeNil)
+		now := time.Unix(1500000000, 0)
+		code, err := totpCode(secret, now.Unix()/totpStep+1)
+		So(err, ShouldBeNil)
+		So(totpMatch(secret, code, now), ShouldEqual, now.Unix()/totpStep+1)
+		So(totpMatch(secret, code, now.Add(3*totpStep*time.Second)), ShouldEqual, 0)
+	})
+}
+
+func TestLocalAccountDb(t *testing.T) {
+	Convey("With a local account", t, func() {
+		accounts, err := NewLocalAccountDb(boltorm.NewMemoryDB())
+		So(err, ShouldBeNil)
+		So(accounts.CreateAccount(" Admin@Example.com", "correct horse", "test"), ShouldBeNil)
+		now := time.Unix(1500000000, 0)
+
+		Convey("Creating it again should fail", func() {
+			So(LocalAccountExists.Contains(accounts.CreateAccount("admin@example.com", "battery staple", "test")), ShouldBeTrue)
+		})
+		Convey("Bad accounts should be refused", func() {
+			fields := fieldsOf(accounts.CreateAccount("someone", "short", "test"))
+			So(fields["email"], ShouldEqual, "is not a valid email address")
+			So(fields["password"], ShouldEqual, "must be at least 10 characters long")
+		})
+		Convey("Logging in should check the password", func() {
+			So(accounts.Login("admin@example.com", "correct horse", "", now), ShouldBeNil)
+			So(LocalLoginFailed.Contains(accounts.Login("admin@example.com", "wrong horse", "", now)), ShouldBeTrue)
+			So(LocalLoginFailed.Contains(accounts.Login("nobody@example.com", "correct horse", "", now)), ShouldBeTrue)
+		})
+		Convey("Repeated failures should lock the account", func() {
+			for i := 0; i < localMaxFailures; i++ {
+				So(LocalLoginFailed.Contains(accounts.Login("admin@example.com", "wrong horse", "", now)), ShouldBeTrue)
+			}
+			So(LocalAccountLocked.Contains(accounts.Login("admin@example.com", "correct horse", "", now)), ShouldBeTrue)
+			So(LocalAccountLocked.Contains(accounts.Login("admin@example.com", "correct horse", "", now.Add(localLockout-time.Second))), ShouldBeTrue)
+			So(accounts.Login("admin@example.com", "correct horse", "", now.Add(localLockout)), ShouldBeNil)
+		})
+		Convey("A successful login should reset the failures", func() {
+			for i := 0; i < localMaxFailures-1; i++ {
+				So(LocalLoginFailed.Contains(accounts.Login("admin@example.com", "wrong horse", "", now)), ShouldBeTrue)
+			}
+			So(accounts.Login("admin@example.com", "correct horse", "", now), ShouldBeNil)
+			So(LocalLoginFailed.Contains(accounts.Login("admin@example.com", "wrong horse", "", now)), ShouldBeTrue)
+			So(accounts.Login("admin@example.com", "correct horse", "", now), ShouldBeNil)
+		})
+		Convey("Setting up two-factor", func() {
+			secret, err := accounts.StartTOTP("admin@example.com", "", "", now)
+			So(err, ShouldBeNil)
+			code, err := totpCode(secret, now.Unix()/totpStep)
+			So(err, ShouldBeNil)
+
+			Convey("Should not need a code until it is confirmed", func() {
+				So(accounts.Login("admin@example.com", "correct horse", "", now), ShouldBeNil)
+				So(LocalLoginFailed.Contains(accounts.ConfirmTOTP("admin@example.com", "000000", now)), ShouldBeTrue)
+				So(accounts.Login("admin@example.com", "correct horse", "", now), ShouldBeNil)
+			})
+			Convey("Once confirmed", func() {
+				So(accounts.ConfirmTOTP("admin@example.com", code, now), ShouldBeNil)
+				later := now.Add(totpStep * time.Second)
+				laterCode, err := totpCode(secret, later.Unix()/totpStep)
+				So(err, ShouldBeNil)
+
+				Convey("Logging in should ask for a code", func() {
+					So(LocalCodeRequired.Contains(accounts.Login("admin@example.com", "correct horse", "", later)), ShouldBeTrue)
+					So(LocalLoginFailed.Contains(accounts.Login("admin@example.com", "wrong horse", "", later)), ShouldBeTrue)
+				})
+				Convey("Logging in should check the code", func() {
+					So(LocalLoginFailed.Contains(accounts.Login("admin@example.com", "correct horse", "000000", later)), ShouldBeTrue)
+					So(accounts.Login("admin@example.com", "correct horse", laterCode, later), ShouldBeNil)
+				})
+				Convey("Codes should only work once", func() {
+					So(LocalLoginFailed.Contains(accounts.Login("admin@example.com", "correct horse", code, now)), ShouldBeTrue)
+					So(accounts.Login("admin@example.com", "correct horse", laterCode, later), ShouldBeNil)
+					So(LocalLoginFailed.Contains(accounts.Login("admin@example.com", "correct horse", laterCode, later)), ShouldBeTrue)
+				})
+				Convey("Setting it up again should need a code or the password", func() {
+					_, err := accounts.StartTOTP("admin@example.com", "", "", later)
+					So(LocalLoginFailed.Contains(err), ShouldBeTrue)
+					_, err = accounts.StartTOTP("admin@example.com", "wrong horse", code, later)
+					So(LocalLoginFailed.Contains(err), ShouldBeTrue)
+					_, err = accounts.StartTOTP("admin@example.com", "", laterCode, later)
+					So(err, ShouldBeNil)
+					_, err = accounts.StartTOTP("admin@example.com", "correct horse", "", later)
+					So(err, ShouldBeNil)
+				})
+				Convey("Repeatedly failing to set it up again should lock the account", func() {
+					for i := 0; i < localMaxFailures; i++ {
+						_, err := accounts.StartTOTP("admin@example.com", "wrong horse", "", later)
+						So(LocalLoginFailed.Contains(err), ShouldBeTrue)
+					}
+					_, err := accounts.StartTOTP("admin@example.com", "correct horse", "", later)
+					So(LocalAccountLocked.Contains(err), ShouldBeTrue)
+				})
+			})
+		})
+	})
+}
+
+func TestLocalAccountHandler(t *testing.T) {
+	Convey("With a local account handler", t, func() {
+		db := boltorm.NewMemoryDB()
+		config := &configType{}
+		config.General.EventName = "CCJ16"
+		config.Auth.AllowedEmails = stringSliceConfig{"admin@example.com"}
+		accounts, err := NewLocalAccountDb(db)
+		So(err, ShouldBeNil)
+		roleDb, err := NewRoleDb(db)
+		So(err, ShouldBeNil)
+		store := sessions.NewCookieStore([]byte("A"))
+		authHandler := NewAuthenticationHandler(mux.NewRouter(), config, store, nil, roleDb, nil, nil)
+		h := NewLocalAccountHandler(mux.NewRouter(), config, accounts, authHandler)
+		// Sessions are kept per request, and mux passes its handlers a copy
+		// of it, so route without it for the session to be saved.
+		router := http.NewServeMux()
+		router.HandleFunc("/authentication/isLoggedIn", authHandler.VerifySession)
+		router.HandleFunc("/authentication/local/login", h.Login)
+		router.HandleFunc("/authentication/local/totp", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "POST" {
+				h.accountFunc(h.StartTOTP)(w, r)
+			} else {
+				h.accountFunc(h.ConfirmTOTP)(w, r)
+			}
+		})
+		router.HandleFunc("/authentication/local/accounts", authHandler.RoleFunc(h.Create, RoleSuperadmin))
+		site := &sessionSaver{router}
+
+		request := func(method, path string, body interface{}, cookies []string) *httptest.ResponseRecorder {
+			data, err := json.Marshal(body)
+			So(err, ShouldBeNil)
+			r, err := http.NewRequest(method, "http://localhost:8080"+path, bytes.NewReader(data))
+			So(err, ShouldBeNil)
+			r.Header["Cookie"] = cookies
+			w := httptest.NewRecorder()
+			site.ServeHTTP(w, r)
+			return w
+		}
+		login := func(email, password, code string) *httptest.ResponseRecorder {
+			return request("POST", "/authentication/local/login", map[string]string{"email": email, "password": password, "code": code}, nil)
+		}
+		So(accounts.CreateAccount("registrar@example.com", "correct horse", "test"), ShouldBeNil)
+
+		Convey("Accounts without a role should not be logged in", func() {
+			So(login("registrar@example.com", "correct horse", "").Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("A wrong password should be refused", func() {
+			So(roleDb.SetRole(&RoleAssignment{Email: "registrar@example.com", Role: RoleRegistrar}), ShouldBeNil)
+			So(login("registrar@example.com", "wrong horse", "").Code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("Logging in should move the session to a new id", func() {
+			So(roleDb.SetRole(&RoleAssignment{Email: "registrar@example.com", Role: RoleRegistrar}), ShouldBeNil)
+			r, err := http.NewRequest("POST", "http://localhost:8080/authentication/local/login", bytes.NewReader([]byte(`{"email": "registrar@example.com", "password": "correct horse"}`)))
+			So(err, ShouldBeNil)
+			sess, err := sessions.GetRegistry(r).Get(store, globalSessionName)
+			So(err, ShouldBeNil)
+			sess.ID = "planted"
+			w := httptest.NewRecorder()
+			site.ServeHTTP(w, r)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(sess.ID, ShouldNotEqual, "planted")
+		})
+		Convey("Logging in with a role", func() {
+			So(roleDb.SetRole(&RoleAssignment{Email: "registrar@example.com", Role: RoleRegistrar}), ShouldBeNil)
+			w := login("Registrar@example.com", "correct horse", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			cookies := w.Header()["Set-Cookie"]
+			status := &sessionStatus{}
+			So(json.Unmarshal(request("GET", "/authentication/isLoggedIn", nil, cookies).Body.Bytes(), status), ShouldBeNil)
+			So(*status, ShouldResemble, sessionStatus{LoggedIn: true, Email: "registrar@example.com", Role: RoleRegistrar})
+
+			Convey("Should let them set up two-factor", func() {
+				w := request("POST", "/authentication/local/totp", nil, cookies)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				enrollment := map[string]string{}
+				So(json.Unmarshal(w.Body.Bytes(), &enrollment), ShouldBeNil)
+				So(enrollment["url"], ShouldStartWith, "otpauth://totp/CCJ16:registrar@example.com?")
+				So(enrollment["url"], ShouldContainSubstring, "secret="+enrollment["secret"])
+
+				So(request("PUT", "/authentication/local/totp", map[string]string{"code": "000000"}, cookies).Code, ShouldEqual, http.StatusUnauthorized)
+				code, err := totpCode(enrollment["secret"], time.Now().Unix()/totpStep)
+				So(err, ShouldBeNil)
+				So(request("PUT", "/authentication/local/totp", map[string]string{"code": code}, cookies).Code, ShouldEqual, http.StatusNoContent)
+
+				w = login("registrar@example.com", "correct horse", "")
+				So(w.Code, ShouldEqual, http.StatusUnauthorized)
+				So(w.Body.String(), ShouldEqual, `{"codeRequired":true}`+"\n")
+
+				So(request("POST", "/authentication/local/totp", nil, cookies).Code, ShouldEqual, http.StatusUnauthorized)
+				So(request("POST", "/authentication/local/totp", map[string]string{"password": "correct horse"}, cookies).Code, ShouldEqual, http.StatusOK)
+			})
+			Convey("Should not let them create accounts", func() {
+				So(request("POST", "/authentication/local/accounts", map[string]string{"email": "new@example.com", "password": "correct horse"}, cookies).Code, ShouldEqual, http.StatusForbidden)
+			})
+		})
+		Convey("Superadmins should be able to create accounts", func() {
+			So(accounts.CreateAccount("admin@example.com", "correct horse", "test"), ShouldBeNil)
+			cookies := login("admin@example.com", "correct horse", "").Header()["Set-Cookie"]
+			So(request("POST", "/authentication/local/accounts", map[string]string{"email": "new@example.com", "password": "correct horse"}, cookies).Code, ShouldEqual, http.StatusCreated)
+			So(request("POST", "/authentication/local/accounts", map[string]string{"email": "new@example.com", "password": "correct horse"}, cookies).Code, ShouldEqual, http.StatusBadRequest)
+			So(request("POST", "/authentication/local/accounts", map[string]string{"email": "other@example.com", "password": "short"}, cookies).Code, ShouldEqual, http.StatusUnprocessableEntity)
+			So(request("POST", "/authentication/local/totp", nil, cookies).Code, ShouldEqual, http.StatusOK)
+		})
+		Convey("Administrators without a local account can't set up two-factor", func() {
+			r := &http.Request{}
+			sess, err := store.New(r, globalSessionName)
+			So(err, ShouldBeNil)
+			sess.Values[authStatusLoggedIn] = true
+			sess.Values[authUserEmail] = "admin@example.com"
+			w := httptest.NewRecorder()
+			store.Save(r, w, sess)
+			So(request("POST", "/authentication/local/totp", nil, w.Header()["Set-Cookie"]).Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
+
+func TestCreateAdminCommand(t *testing.T) {
+	Convey("Creating the first administrator from the command line", t, func() {
+		file, err := ioutil.TempFile("", "")
+		So(err, ShouldBeNil)
+		defer os.Remove(file.Name())
+		file.Close()
+		config := &configType{}
+		config.General.Database = file.Name()
+		defer func() { commandInput = os.Stdin }()
+
+		commandInput = strings.NewReader("correct horse\n")
+		So(runCommand(config, []string{"create-admin", "first@example.com"}), ShouldBeNil)
+
+		commandInput = strings.NewReader("correct horse\n")
+		So(LocalAccountExists.Contains(runCommand(config, []string{"create-admin", "first@example.com"})), ShouldBeTrue)
+
+		db, err := bolt.Open(file.Name(), 0600, nil)
+		So(err, ShouldBeNil)
+		defer db.Close()
+		accounts, err := NewLocalAccountDb(boltorm.NewBoltDB(db))
+		So(err, ShouldBeNil)
+		So(accounts.Login("first@example.com", "correct horse", "", time.Now()), ShouldBeNil)
+		roleDb, err := NewRoleDb(boltorm.NewBoltDB(db))
+		So(err, ShouldBeNil)
+		role, err := roleDb.GetRole("first@example.com")
+		So(err, ShouldBeNil)
+		So(role, ShouldEqual, RoleSuperadmin)
+	})
+	Convey("Creating an administrator for another event", t, func() {
+		file, err := ioutil.TempFile("", "")
+		So(err, ShouldBeNil)
+		defer os.Remove(file.Name())
+		file.Close()
+		config := &configType{}
+		config.General.Database = file.Name()
+		defer func() { commandInput = os.Stdin }()
+
+		db, err := bolt.Open(file.Name(), 0600, nil)
+		So(err, ShouldBeNil)
+		eventDb, err := NewEventDb(boltorm.NewBoltDB(db))
+		So(err, ShouldBeNil)
+		event := testEvent()
+		So(event.Validate(), ShouldBeNil)
+		So(eventDb.CreateEvent(event), ShouldBeNil)
+		So(db.Close(), ShouldBeNil)
+
+		commandInput = strings.NewReader("correct horse\n")
+		So(EventNotFound.Contains(runCommand(config, []string{"create-admin", "--event", "missing", "first@example.com"})), ShouldBeTrue)
+		commandInput = strings.NewReader("correct horse\n")
+		So(CommandError.Contains(runCommand(config, []string{"create-admin", "--event", "regional"})), ShouldBeTrue)
+		commandInput = strings.NewReader("correct horse\n")
+		So(runCommand(config, []string{"create-admin", "--event", "regional", "first@example.com"}), ShouldBeNil)
+
+		db, err = bolt.Open(file.Name(), 0600, nil)
+		So(err, ShouldBeNil)
+		defer db.Close()
+		defaultAccounts, err := NewLocalAccountDb(boltorm.NewBoltDB(db))
+		So(err, ShouldBeNil)
+		exists, err := defaultAccounts.HasAccount("first@example.com")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeFalse)
+		eventOrmDb := boltorm.NewPrefixedDB(boltorm.NewBoltDB(db), event.bucketPrefix())
+		eventAccounts, err := NewLocalAccountDb(eventOrmDb)
+		So(err, ShouldBeNil)
+		So(eventAccounts.Login("first@example.com", "correct horse", "", time.Now()), ShouldBeNil)
+		roleDb, err := NewRoleDb(eventOrmDb)
+		So(err, ShouldBeNil)
+		role, err := roleDb.GetRole("first@example.com")
+		So(err, ShouldBeNil)
+		So(role, ShouldEqual, RoleSuperadmin)
+	})
+}
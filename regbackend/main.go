@@ -1,14 +1,19 @@
 package main
 
 import (
+	"compress/gzip"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/subtle"
 	"encoding/base64"
 	"encoding/gob"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -41,26 +46,70 @@ type configType struct {
 	Email struct {
 		FromAddress  string `default:"no-reply@invalid" usage:"From address for use in emails"`
 		FromName     string `usage:"From name for use in emails"`
-		ContactEmail string `default:"info@invalid" "usage:"Contact email address for use in emails"`
+		ContactEmail string `default:"info@invalid" usage:"Contact email address for use in emails"`
 		Server       string `default:"localhost:25" usage:"Server to use for sending messages"`
 	}
 
 	Auth struct {
-		ClientID      string            `default:"" usage:"Client id for use with Google OAuth"`
-		ClientSecret  string            `default:"" usage:"Client secret for use with Google OAuth"`
-		AllowedEmails stringSliceConfig `usage:"Allowed email addresses, comma separated."`
+		Issuer          string            `default:"https://accounts.google.com" usage:"OpenID Connect provider administrators log in with"`
+		ClientID        string            `default:"" usage:"Client id registered with the OpenID Connect provider"`
+		ClientSecret    string            `default:"" usage:"Client secret registered with the OpenID Connect provider" secret:"true"`
+		AllowedEmails   stringSliceConfig `usage:"Allowed email addresses, comma separated."`
+		LocalAccounts   bool              `default:"false" usage:"Also let administrators log in with local accounts and passwords"`
+		IdleTimeout     time.Duration     `default:"2h" usage:"How long administrators stay logged in without using the site"`
+		SessionLifetime time.Duration     `default:"12h" usage:"How long administrators stay logged in at most"`
 	}
 
 	General struct {
 		Domain              string `default:"invalid" usage:"Domain for use in emails, etc to link people to"`
+		EventName           string `default:"CCJ16" usage:"Name of the event, as shown in emails"`
+		DepositPrice        int    `default:"25000" usage:"Pre-registration deposit, in cents"`
 		Database            string `default:"records.bolt" usage:"Location to store the database"`
 		EnableWaitingList   bool   `default:"false" usage:"Set to put people into a waiting list instead of registering"`
 		EnableGroupReg      bool   `default:"true" usage:"Enable any registration, including onto the waiting list"`
-		AccessToken         string `usage:"Token to access database.  Generated randomly and printed if not set"`
+		SessionSecret       string `usage:"Secret used to authenticate session cookies.  Generated randomly if not set, logging everyone out on restart" secret:"true"`
+		AccessToken         string `usage:"Deprecated and ignored, database exports are made by a logged in superadmin" secret:"true"`
 		StaticFilesLocation string `default:"../app" usage:"Location of static files for the site"`
 		Integration         bool   `default:"false" usage:"Set when running an integration binary for testing."`
 		Develop             bool   `default:"false" usage:"Set when running a binary for development."`
 	}
+
+	Export struct {
+		PublicKey string `default:"" usage:"PEM file with an RSA public key to encrypt database exports to.  Exports are unencrypted if empty"`
+	}
+
+	Documents struct {
+		Directory     string `default:"" usage:"Directory to keep uploaded documents in.  They are kept in the database if empty"`
+		EncryptionKey string `default:"" usage:"Base64 encoded 32 byte key to encrypt uploaded documents with.  Only optional for development and integration binaries" secret:"true"`
+		MaxSize       int    `default:"5242880" usage:"Largest document that may be uploaded, in bytes"`
+	}
+
+	Compliance struct {
+		YouthPerLeader       int               `default:"6" usage:"Most youth allowed per leader in a group.  0 disables the check"`
+		MinLeaders           int               `default:"2" usage:"Fewest leaders a group may bring"`
+		RequiredCertificates stringSliceConfig `usage:"Certificates every leader needs, comma separated.  For example woodBadge,safety"`
+	}
+
+	Backup struct {
+		Directory string        `default:"" usage:"Directory to store periodic database snapshots in.  Snapshots are disabled if empty"`
+		Interval  time.Duration `default:"6h" usage:"Time between database snapshots"`
+		Retention int           `default:"28" usage:"Number of snapshots to keep, older ones are removed.  0 keeps all snapshots"`
+	}
+
+	RateLimit struct {
+		IPRequests     int               `default:"100" usage:"Requests each client address may make to public endpoints per window.  0 disables the limit"`
+		EmailRequests  int               `default:"5" usage:"Registrations, verifications and emails each email address may have per window.  0 disables the limit"`
+		Window         time.Duration     `default:"10m" usage:"Time over which the rate limits apply"`
+		TrustedProxies stringSliceConfig `usage:"Addresses or ranges of reverse proxies whose X-Forwarded-For is trusted, comma separated"`
+	}
+
+	Challenge struct {
+		Type       string `default:"" usage:"Challenge group registrations must pass: hcaptcha, recaptcha, proofofwork, or fake for testing.  None if empty"`
+		SiteKey    string `default:"" usage:"Site key from the CAPTCHA provider"`
+		Secret     string `default:"" usage:"Secret from the CAPTCHA provider" secret:"true"`
+		VerifyURL  string `default:"" usage:"Where to check CAPTCHA answers, if not the provider's usual address"`
+		Difficulty int    `default:"16" usage:"Leading zero bits proof of work answers need.  Each one doubles the work"`
+	}
 }
 
 type stringSliceConfig []string
@@ -74,14 +123,30 @@ func (s stringSliceConfig) String() string {
 	return fmt.Sprintf("\"%s\"", strings.Join(s, ","))
 }
 
+// Settings are taken from the flag defaults, then the configuration file,
+// then REGBACKEND_ environment variables, and finally the command line.
 func getConfig() *configType {
 	config := &configType{}
-	goflagutils.Setup("http", &config.Http)
-	goflagutils.Setup("email", &config.Email)
-	goflagutils.Setup("auth", &config.Auth)
-	goflagutils.Setup("", &config.General)
+	for _, s := range configSections {
+		goflagutils.Setup(s.prefix, s.section(config))
+	}
+	configFile := flag.String("config", os.Getenv(configEnvPrefix+"CONFIG"), "TOML file to read settings from.  Environment variables and flags override it")
 
 	flagfile.Load()
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	if err := config.loadSources(*configFile, os.Environ(), explicit); err != nil {
+		log.Fatalf("Failed to load configuration, err: %s", err)
+	}
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Refusing to start, err: %s", err)
+	}
+	if config.General.AccessToken != "" {
+		log.Print("The accesstoken setting is deprecated and ignored, use the database export as a superadmin instead")
+	}
+	log.Print("Effective configuration:\n", config.redacted())
 	return config
 }
 
@@ -110,18 +175,69 @@ func (h *requestLogger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Handled request for url %s, code %v, took %s seconds", r.URL, wrappedW.code, duration)
 }
 
-type grabDb struct {
-	db *bolt.DB
+// Content types that are compressed already, and are sent as they are.
+var compressedContentTypes = map[string]bool{
+	"application/gzip":         true,
+	"application/octet-stream": true,
 }
 
-func (h *grabDb) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	err := h.db.View(func(tx *bolt.Tx) error {
-		w.Header()["Content-Length"] = []string{fmt.Sprint(tx.Size())}
-		return tx.Copy(w)
-	})
-	if err != nil {
-		log.Panicf("Got error while copying database %s", err)
+// Compresses responses for clients that accept it, unless their handler
+// gives them a content type that is compressed already.
+type compressHandler struct {
+	h http.Handler
+}
+
+func newCompressHandler(h http.Handler) *compressHandler {
+	return &compressHandler{h}
+}
+
+func (h *compressHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		h.h.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	cw := &compressWriter{ResponseWriter: w}
+	h.h.ServeHTTP(cw, r)
+	if cw.gz != nil {
+		cw.gz.Close()
+	}
+}
+
+// Decides whether to compress once the handler has set its headers.
+type compressWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	header := w.Header()
+	contentType := strings.TrimSpace(strings.SplitN(header.Get("Content-Type"), ";", 2)[0])
+	if header.Get("Content-Encoding") == "" && !compressedContentTypes[contentType] && code != http.StatusNoContent && code != http.StatusNotModified {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		// Sniffed from what is written, not what it compresses to.
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
 	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
 }
 
 type sessionSaver struct {
@@ -227,9 +343,19 @@ func (h *xsrfTokenCreator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 type xsrfVerifierHandler struct {
 	creator *xsrfTokenCreator
 	Handler http.Handler
+	// Checks API keys, nil if they aren't accepted.
+	authHandler *AuthenticationHandler
 }
 
 func (h *xsrfVerifierHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Browsers can't be made to send the header cross site, so requests with a valid key can't be forged.
+	// The key is passed on with the request for the handlers to act as.
+	if token, ok := bearerToken(r); ok && h.authHandler != nil {
+		if key := h.authHandler.apiKey(token); key != nil {
+			h.Handler.ServeHTTP(w, withAPIKey(r, key))
+			return
+		}
+	}
 	var tokenHeader, tokenSession string
 	// Empty tokenHeaders are considered invalid.  So unless this matches my expectations, I can ignore it.
 	tokenHeader = r.Header.Get("X-Xsrf-Token")
@@ -248,7 +374,10 @@ func (h *xsrfVerifierHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 }
 
 type configHandler struct {
-	config *configType
+	config       *configType
+	prdb         PreRegDb
+	formSchemaDb FormSchemaDb
+	challenge    ChallengeVerifier
 }
 
 func (c *configHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -257,12 +386,54 @@ func (c *configHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	phase := configPhase(c.config)
+	general := c.config.current().General
+	open, onWaitingList := general.EnableGroupReg, general.EnableWaitingList
+	var phaseChangesAt *time.Time
+	if c.prdb != nil {
+		var changesAt time.Time
+		var err error
+		if phase, changesAt, err = c.prdb.CurrentPhase(time.Now()); err != nil {
+			httpError(w, err)
+			return
+		} else if !changesAt.IsZero() {
+			phaseChangesAt = &changesAt
+		}
+		open, onWaitingList = phase == PhaseOpen || phase == PhaseWaitingList, phase == PhaseWaitingList
+	}
 	config := struct {
-		RegistrationOpen          bool `json:"registrationOpen"`
-		RegistrationOnWaitingList bool `json:"registrationOnWaitingList"`
+		EventName                 string      `json:"eventName"`
+		RegistrationOpen          bool        `json:"registrationOpen"`
+		RegistrationOnWaitingList bool        `json:"registrationOnWaitingList"`
+		RegistrationPhase         string      `json:"registrationPhase"`
+		PhaseChangesAt            *time.Time  `json:"phaseChangesAt,omitempty"`
+		FormFields                []FormField `json:"formFields"`
+		// Which ways administrators can log in.
+		ProviderLogin bool `json:"providerLogin"`
+		LocalLogin    bool `json:"localLogin"`
+		// What registrations must pass, if anything.
+		Challenge *ChallengeConfig `json:"challenge,omitempty"`
 	}{
-		RegistrationOpen:          c.config.General.EnableGroupReg,
-		RegistrationOnWaitingList: c.config.General.EnableWaitingList,
+		EventName:                 general.EventName,
+		RegistrationOpen:          open,
+		RegistrationOnWaitingList: onWaitingList,
+		RegistrationPhase:         phase,
+		PhaseChangesAt:            phaseChangesAt,
+		FormFields:                []FormField{},
+		ProviderLogin:             c.config.Auth.ClientID != "",
+		LocalLogin:                c.config.Auth.LocalAccounts,
+	}
+	if c.formSchemaDb != nil {
+		schema, err := c.formSchemaDb.GetFormSchema()
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		config.FormFields = schema.Fields
+	}
+	if c.challenge != nil {
+		challenge := c.challenge.Config()
+		config.Challenge = &challenge
 	}
 
 	e := json.NewEncoder(w)
@@ -285,19 +456,32 @@ type httpRouter interface {
 }
 
 func setupStandardHandlers(globalRouter httpRouter, config *configType, db *bolt.DB) (http.Handler, chan<- struct{}, <-chan struct{}, error) {
-	key := config.General.AccessToken
+	if err := ensureSchemaVersion(db); err != nil {
+		return nil, nil, nil, err
+	}
+
+	key := config.General.SessionSecret
 	if key == "" {
 		var random [32]byte
 		if _, err := rand.Read(random[:]); err != nil {
 			return nil, nil, nil, SetupErrors.New("During startup, failed to get entropy", err)
 		}
 		key = base64.URLEncoding.EncodeToString(random[:])
-		log.Print("DB Token: ", key)
+		log.Print("No session secret configured, using a random one")
+	}
+	var exportKey *rsa.PublicKey
+	if config.Export.PublicKey != "" {
+		var err error
+		if exportKey, err = loadExportPublicKey(config.Export.PublicKey); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	docKey, err := loadDocumentKey(config)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
-	r := mux.NewRouter()
 	ormDb := boltorm.NewBoltDB(db)
-	apiR := r.PathPrefix("/api/").Subrouter()
 	boltStore, err := store.New(db, store.Config{
 		SessionOptions: sessions.Options{
 			Path:     "/",
@@ -313,37 +497,188 @@ func setupStandardHandlers(globalRouter httpRouter, config *configType, db *bolt
 		return nil, nil, nil, SetupErrors.New("Failed to setup session data")
 	}
 
+	adminSessions, err := NewAdminSessionDb(ormDb)
+	if err != nil {
+		return nil, nil, nil, SetupErrors.New("Failed to get admin session database started")
+	}
+
+	eventDb, err := NewEventDb(ormDb)
+	if err != nil {
+		return nil, nil, nil, SetupErrors.New("Failed to get event database started")
+	}
+	// One verifier for every event, as proof of work verifiers each have
+	// their own key and remember the answers they took.  Events' sites are
+	// rebuilt when they change, which would otherwise forget them.
+	challenge, err := NewChallengeVerifier(config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var events *eventRouter
+	events = newEventRouter(func(event *Event) (http.Handler, error) {
+		if event == nil {
+			return setupEventHandlers(&eventSetup{config, ormDb, config.Documents.Directory, docKey, boltStore, adminSessions, challenge, nil}, func(apiR *mux.Router, authHandler *AuthenticationHandler) error {
+				auditLog, err := NewAuditLog(ormDb)
+				if err != nil {
+					return SetupErrors.New("Failed to get audit log started")
+				}
+				NewAuditHandler(apiR, auditLog, authHandler)
+				NewDatabaseExportHandler(apiR, db, exportKey, auditLog, authHandler)
+				NewEventHandler(apiR, eventDb, events, authHandler)
+				return nil
+			})
+		}
+		docDirectory := config.Documents.Directory
+		if docDirectory != "" {
+			docDirectory = filepath.Join(docDirectory, event.ID)
+		}
+		return setupEventHandlers(&eventSetup{event.config(config), boltorm.NewPrefixedDB(ormDb, event.bucketPrefix()), docDirectory, docKey, boltStore, adminSessions, challenge, event}, nil)
+	})
+	if err := events.load(eventDb); err != nil {
+		return nil, nil, nil, SetupErrors.New("Failed to start serving events: %s", err)
+	}
+
+	globalRouter.Handle("/", events)
+	globalRouter.Handle(cspReportPath, cspReportHandler{})
+	trustedProxies, err := parseNetworks(config.RateLimit.TrustedProxies)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var site http.Handler = globalRouter
+	// Integration tests register far more groups than any real client.
+	if !config.General.Integration {
+		site = newRateLimitHandler(config, site)
+	}
+	quitC, doneC := reaper.Run(db, reaper.Options{BucketName: []byte("SESSIONS_BUCKET")})
+	// Outside the session saver, as it hands on a new request for the nonce.
+	return &securityHeadersHandler{config, &sessionSaver{&forwardedForHandler{trustedProxies, site}}}, quitC, doneC, nil
+}
+
+// What one event's handlers are built from.
+type eventSetup struct {
+	config       *configType
+	ormDb        boltorm.DB
+	docDirectory string
+	docKey       []byte
+	store        sessions.Store
+	// Shared by every event.
+	adminSessions AdminSessionDb
+	challenge     ChallengeVerifier
+	// Nil for the default event.
+	event *Event
+}
+
+// Builds the site for a single event.  extra adds any api handlers only the
+// default event has.
+func setupEventHandlers(s *eventSetup, extra func(apiR *mux.Router, authHandler *AuthenticationHandler) error) (http.Handler, error) {
+	config, ormDb := s.config, s.ormDb
+	siteRouter := http.NewServeMux()
+	r := mux.NewRouter()
+	apiR := r.PathPrefix("/api/").Subrouter()
+
+	settings, err := NewSettingsStore(ormDb, config)
+	if err != nil {
+		return nil, SetupErrors.New("Failed to load stored settings: %s", err)
+	}
+
 	invDb, err := NewInvoiceDb(ormDb)
 	if err != nil {
-		return nil, nil, nil, SetupErrors.New("Failed to get invoice database started")
+		return nil, SetupErrors.New("Failed to get invoice database started")
 	}
 
 	gprdb, err := NewPreRegBoltDb(ormDb, config, invDb)
 	if err != nil {
-		return nil, nil, nil, SetupErrors.New("Failed to get group preregistration database started", err)
+		return nil, SetupErrors.New("Failed to get group preregistration database started", err)
 	}
 
-	ces := NewConfirmationEmailService(config.General.Domain, config.Email.FromAddress, config.Email.FromName, config.Email.ContactEmail, NewLocalMailder(config.Email.Server), gprdb)
+	documentStore, err := NewDocumentStore(ormDb, s.docDirectory, s.docKey, config.Documents.MaxSize)
+	if err != nil {
+		return nil, SetupErrors.New("Failed to get document storage started: %s", err)
+	}
 
-	authHandler := NewAuthenticationHandler(apiR, config, boltStore)
-	NewGroupPreRegistrationHandler(apiR, config, gprdb, authHandler, ces)
+	documentDb, err := NewDocumentDb(ormDb, documentStore)
+	if err != nil {
+		return nil, SetupErrors.New("Failed to get document database started")
+	}
+
+	formSchemaDb, err := NewFormSchemaDb(ormDb)
+	if err != nil {
+		return nil, SetupErrors.New("Failed to get form schema database started")
+	}
+
+	directoryDb, err := NewDirectoryDb(ormDb)
+	if err != nil {
+		return nil, SetupErrors.New("Failed to get directory database started")
+	}
 
-	NewSummaryHandler(apiR, gprdb)
+	participantDb, err := NewParticipantDb(ormDb, documentStore)
+	if err != nil {
+		return nil, SetupErrors.New("Failed to get participant database started")
+	}
 
-	apiR.Handle("/grabdb", &grabDb{db}).Headers("X-My-Auth-Token", key).Methods("GET").Queries("key", key)
-	globalRouter.Handle("/config", disableCacheHandler{&configHandler{config}})
+	confirmationTemplate, err := s.event.confirmationTemplate()
+	if err != nil {
+		return nil, SetupErrors.New("Failed to parse the confirmation email template: %s", err)
+	}
+	ces := NewConfirmationEmailService(config.General.Domain, config.Email.FromAddress, config.Email.FromName, config.Email.ContactEmail, NewLocalMailder(config.Email.Server, config.General.Domain), gprdb)
+	ces.useEvent(config.General.EventName, confirmationTemplate)
+	settings.OnApply(func(config configType) {
+		ces.setNames(config.Email.FromName, config.Email.ContactEmail)
+	})
 
-	globalRouter.Handle("/api/", disableCacheHandler{&xsrfVerifierHandler{&xsrfTokenCreator{nil, config, boltStore}, apiR}})
+	roleDb, err := NewRoleDb(ormDb)
+	if err != nil {
+		return nil, SetupErrors.New("Failed to get role database started")
+	}
+
+	apiKeyDb, err := NewAPIKeyDb(ormDb)
+	if err != nil {
+		return nil, SetupErrors.New("Failed to get API key database started")
+	}
+
+	authHandler := NewAuthenticationHandler(apiR, config, s.store, s.event, roleDb, s.adminSessions, apiKeyDb)
+	NewAdminSessionHandler(apiR, s.adminSessions, authHandler)
+	NewAPIKeyHandler(apiR, apiKeyDb, authHandler)
+	NewRoleHandler(apiR, roleDb, authHandler)
+	if config.Auth.LocalAccounts {
+		localAccountDb, err := NewLocalAccountDb(ormDb)
+		if err != nil {
+			return nil, SetupErrors.New("Failed to get local account database started")
+		}
+		NewLocalAccountHandler(apiR, config, localAccountDb, authHandler)
+	}
+	NewChallengeHandler(apiR, s.challenge)
+	NewGroupPreRegistrationHandler(apiR, config, gprdb, formSchemaDb, authHandler, ces, s.challenge)
+	NewFormSchemaHandler(apiR, formSchemaDb, authHandler)
+	NewScheduleHandler(apiR, gprdb, authHandler)
+	NewDirectoryHandler(apiR, directoryDb, gprdb, authHandler)
+	NewCouncilQuotaHandler(apiR, gprdb, authHandler)
+
+	NewParticipantHandler(apiR, participantDb, documentStore, authHandler)
+	NewDocumentHandler(apiR, documentDb, documentStore, authHandler)
+	NewComplianceHandler(apiR, config, gprdb, participantDb, authHandler)
+
+	NewSummaryHandler(apiR, gprdb, participantDb)
+
+	NewSettingsHandler(apiR, settings, authHandler)
+	if extra != nil {
+		if err := extra(apiR, authHandler); err != nil {
+			return nil, err
+		}
+	}
+
+	siteRouter.Handle("/config", disableCacheHandler{&configHandler{config, gprdb, formSchemaDb, s.challenge}})
+
+	authHandler.handleOIDC(siteRouter)
+	siteRouter.Handle("/api/", disableCacheHandler{&xsrfVerifierHandler{&xsrfTokenCreator{nil, config, s.store}, apiR, authHandler}})
 	otherFiles := http.FileServer(http.Dir(config.General.StaticFilesLocation))
-	globalRouter.Handle("/app/", otherFiles)
-	globalRouter.Handle("/components/", otherFiles)
-	globalRouter.Handle("/views/", otherFiles)
-	globalRouter.Handle("/images/", otherFiles)
-	globalRouter.Handle("/bower_components/", otherFiles)
+	siteRouter.Handle("/app/", otherFiles)
+	siteRouter.Handle("/components/", otherFiles)
+	siteRouter.Handle("/views/", otherFiles)
+	siteRouter.Handle("/images/", otherFiles)
+	siteRouter.Handle("/bower_components/", otherFiles)
 	indexLocation := config.General.StaticFilesLocation + "/index.html"
-	globalRouter.Handle("/", &xsrfTokenCreator{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, indexLocation)
-	}), config, boltStore})
-	quitC, doneC := reaper.Run(db, reaper.Options{BucketName: []byte("SESSIONS_BUCKET")})
-	return &sessionSaver{globalRouter}, quitC, doneC, nil
+	siteRouter.Handle("/", &xsrfTokenCreator{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveIndex(w, r, indexLocation)
+	}), config, s.store})
+	return siteRouter, nil
 }
@@ -102,7 +102,7 @@ func TestXsrfVerifications(t *testing.T) {
 				So(err, ShouldBeNil)
 				session.Values[xsrfSessionToken] = sessionValue
 				w := httptest.NewRecorder()
-				xsrfHandler := &xsrfVerifierHandler{&xsrfTokenCreator{nil, &configType{}, store}, testHttpHandler{}}
+				xsrfHandler := &xsrfVerifierHandler{&xsrfTokenCreator{nil, &configType{}, store}, testHttpHandler{}, nil}
 				xsrfHandler.ServeHTTP(w, r)
 				w.Flush()
 				if succeed {
@@ -162,7 +162,7 @@ func TestConfigHandler(t *testing.T) {
 				c := &configType{}
 				c.General.EnableWaitingList = wait
 				c.General.EnableGroupReg = open
-				handler := configHandler{c}
+				handler := configHandler{c, nil, nil, nil}
 				handler.ServeHTTP(w, r)
 				w.Flush()
 				So(w.Code, ShouldEqual, 200)
@@ -196,7 +196,7 @@ func TestDisableCacheHandler(t *testing.T) {
 		r, err := http.NewRequest("GET", "http://localhost:8080/config", nil)
 		So(err, ShouldBeNil)
 		w := httptest.NewRecorder()
-		handler := disableCacheHandler{&configHandler{&configType{}}}
+		handler := disableCacheHandler{&configHandler{&configType{}, nil, nil, nil}}
 		handler.ServeHTTP(w, r)
 		w.Flush()
 		So(w.Code, ShouldEqual, 200)
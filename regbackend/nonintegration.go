@@ -3,11 +3,11 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net/http"
 
 	"github.com/boltdb/bolt"
-	"github.com/gorilla/handlers"
 )
 
 func main() {
@@ -19,6 +19,12 @@ func main() {
 	if config.General.Develop != develop {
 		log.Panic("Mismatch in development vs production build and configuration!")
 	}
+	if flag.NArg() > 0 {
+		if err := runCommand(config, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	db, err := bolt.Open(config.General.Database, 0600, &bolt.Options{Timeout: 1})
 	if err != nil {
 		log.Fatalf("Failed to open bolt database, err: %s", err)
@@ -28,5 +34,12 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to setup basic routing, err: %s", err)
 	}
-	panic(http.ListenAndServe(config.Http.Listen, handlers.CompressHandler(&requestLogger{realMux})))
+	if config.Backup.Directory != "" {
+		backups, err := NewBackupService(db, config.Backup.Directory, config.Backup.Interval, config.Backup.Retention)
+		if err != nil {
+			log.Fatalf("Failed to setup database backups, err: %s", err)
+		}
+		backups.Run()
+	}
+	panic(http.ListenAndServe(config.Http.Listen, newCompressHandler(&requestLogger{realMux})))
 }
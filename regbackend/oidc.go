@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spacemonkeygo/errors"
+)
+
+var (
+	OIDCError        = errors.NewClass("OpenID Connect error")
+	OIDCInvalidToken = OIDCError.NewClass("Invalid ID token")
+)
+
+// How far the provider's clock may be ahead of or behind ours.
+const oidcClockSkew = time.Minute
+
+// How long the provider gets to answer, so a stuck provider doesn't hold
+// up logins forever.
+const oidcTimeout = 10 * time.Second
+
+// The parts of the provider's discovery document logging in needs.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcJWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type oidcAudience []string
+
+// The audience can be a single string or a list of them.
+func (a *oidcAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = oidcAudience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = oidcAudience(list)
+	return nil
+}
+
+type oidcClaims struct {
+	Issuer          string       `json:"iss"`
+	Subject         string       `json:"sub"`
+	Audience        oidcAudience `json:"aud"`
+	AuthorizedParty string       `json:"azp"`
+	Expiry          int64        `json:"exp"`
+	IssuedAt        int64        `json:"iat"`
+	Nonce           string       `json:"nonce"`
+	Email           string       `json:"email"`
+	// Some providers send this as a string.
+	EmailVerified interface{} `json:"email_verified"`
+}
+
+// An OpenID Connect provider, such as Google, Microsoft or Keycloak.  The
+// discovery document and signing keys are fetched on first use, and the keys
+// again whenever a token is signed by one we haven't seen.
+type oidcProvider struct {
+	issuer string
+	client *http.Client
+
+	lock      sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+func newOIDCProvider(issuer string, client *http.Client) *oidcProvider {
+	return &oidcProvider{
+		issuer: strings.TrimSuffix(issuer, "/"),
+		client: client,
+	}
+}
+
+func (p *oidcProvider) getJSON(url string, out interface{}) error {
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return OIDCError.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return OIDCError.New("%s returned status %d", url, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return OIDCError.New("%s returned invalid json: %s", url, err)
+	}
+	return nil
+}
+
+func (p *oidcProvider) endpoints() (*oidcDiscovery, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	discovery := &oidcDiscovery{}
+	if err := p.getJSON(p.issuer+"/.well-known/openid-configuration", discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != p.issuer {
+		return nil, OIDCError.New("discovery document is for issuer %s, not %s", discovery.Issuer, p.issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, OIDCError.New("discovery document is missing endpoints")
+	}
+	p.discovery = discovery
+	return discovery, nil
+}
+
+func (p *oidcProvider) fetchKeys() error {
+	discovery, err := p.endpoints()
+	if err != nil {
+		return err
+	}
+	set := struct {
+		Keys []oidcJWK `json:"keys"`
+	}{}
+	if err := p.getJSON(discovery.JWKSURI, &set); err != nil {
+		return err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return OIDCError.New("key %s has an invalid modulus", jwk.Kid)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return OIDCError.New("key %s has an invalid exponent", jwk.Kid)
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	p.lock.Lock()
+	p.keys = keys
+	p.lock.Unlock()
+	return nil
+}
+
+func (p *oidcProvider) key(kid string) (*rsa.PublicKey, error) {
+	p.lock.Lock()
+	key := p.keys[kid]
+	p.lock.Unlock()
+	if key != nil {
+		return key, nil
+	}
+	if err := p.fetchKeys(); err != nil {
+		return nil, err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if key = p.keys[kid]; key == nil {
+		return nil, OIDCInvalidToken.New("signed by unknown key %s", kid)
+	}
+	return key, nil
+}
+
+// Checks the ID token's signature, that it was issued by this provider for
+// clientID in response to the login that used nonce, and that it carries a
+// verified email address.
+func (p *oidcProvider) verify(rawToken, clientID, nonce string, now time.Time) (*oidcClaims, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, OIDCInvalidToken.New("not a signed JWT")
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, OIDCInvalidToken.New("unsupported signing algorithm %q", header.Alg)
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, OIDCInvalidToken.New("invalid signature encoding")
+	}
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature); err != nil {
+		return nil, OIDCInvalidToken.New("bad signature")
+	}
+
+	claims := &oidcClaims{}
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(claims.Issuer, "/") != p.issuer {
+		return nil, OIDCInvalidToken.New("issued by %s", claims.Issuer)
+	}
+	if indexOf([]string(claims.Audience), clientID) < 0 {
+		return nil, OIDCInvalidToken.New("issued for another client")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != clientID {
+		return nil, OIDCInvalidToken.New("authorized for another client")
+	}
+	if now.After(time.Unix(claims.Expiry, 0).Add(oidcClockSkew)) {
+		return nil, OIDCInvalidToken.New("expired")
+	}
+	if claims.IssuedAt != 0 && now.Add(oidcClockSkew).Before(time.Unix(claims.IssuedAt, 0)) {
+		return nil, OIDCInvalidToken.New("issued in the future")
+	}
+	if nonce == "" || claims.Nonce != nonce {
+		return nil, OIDCInvalidToken.New("nonce does not match the login")
+	}
+	if claims.Email == "" || (claims.EmailVerified != true && claims.EmailVerified != "true") {
+		return nil, OIDCInvalidToken.New("email address is not verified")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, out interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return OIDCInvalidToken.New("invalid encoding")
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return OIDCInvalidToken.New("invalid json: %s", err)
+	}
+	return nil
+}
+
+// A random value for the login's state and nonce.
+func oidcRandom() (string, error) {
+	var random [32]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return "", OIDCError.Wrap(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(random[:]), nil
+}
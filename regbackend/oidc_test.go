@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+// A local OpenID Connect provider, handing out ID tokens for codes the test
+// has registered.
+type fakeOIDCProvider struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+	tokens map[string]string
+}
+
+func newFakeOIDCProvider() *fakeOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	So(err, ShouldBeNil)
+	p := &fakeOIDCProvider{key: key, kid: "key1", tokens: make(map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&oidcDiscovery{
+			Issuer:                p.URL,
+			AuthorizationEndpoint: p.URL + "/authorize",
+			TokenEndpoint:         p.URL + "/token",
+			JWKSURI:               p.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]oidcJWK{"keys": {{
+			Kty: "RSA",
+			Use: "sig",
+			Kid: p.kid,
+			N:   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		idToken, ok := p.tokens[r.FormValue("code")]
+		if !ok {
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+func (p *fakeOIDCProvider) claims(nonce string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            p.URL,
+		"sub":            "1234",
+		"aud":            "client",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          nonce,
+		"email":          "admin@example.com",
+		"email_verified": true,
+	}
+}
+
+func (p *fakeOIDCProvider) sign(alg string, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": p.kid})
+	So(err, ShouldBeNil)
+	body, err := json.Marshal(claims)
+	So(err, ShouldBeNil)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	hashed := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, hashed[:])
+	So(err, ShouldBeNil)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	Convey("With a fake provider", t, func() {
+		fake := newFakeOIDCProvider()
+		defer fake.Close()
+		provider := newOIDCProvider(fake.URL+"/", http.DefaultClient)
+		verify := func(token string) error {
+			_, err := provider.verify(token, "client", "nonce", time.Now())
+			return err
+		}
+
+		Convey("A good token should be accepted", func() {
+			claims, err := provider.verify(fake.sign("RS256", fake.claims("nonce")), "client", "nonce", time.Now())
+			So(err, ShouldBeNil)
+			So(claims.Email, ShouldEqual, "admin@example.com")
+		})
+		Convey("Email verification sent as a string should be accepted", func() {
+			claims := fake.claims("nonce")
+			claims["email_verified"] = "true"
+			So(verify(fake.sign("RS256", claims)), ShouldBeNil)
+		})
+		Convey("Tokens for several audiences should name us as the authorized party", func() {
+			claims := fake.claims("nonce")
+			claims["aud"] = []string{"other", "client"}
+			So(OIDCInvalidToken.Contains(verify(fake.sign("RS256", claims))), ShouldBeTrue)
+			claims["azp"] = "client"
+			So(verify(fake.sign("RS256", claims)), ShouldBeNil)
+		})
+		Convey("Bad tokens should be refused", func() {
+			for field, value := range map[string]interface{}{
+				"iss":            "https://elsewhere.example.com",
+				"aud":            "other",
+				"exp":            time.Now().Add(-time.Hour).Unix(),
+				"iat":            time.Now().Add(time.Hour).Unix(),
+				"nonce":          "replayed",
+				"email_verified": false,
+				"email":          "",
+			} {
+				claims := fake.claims("nonce")
+				claims[field] = value
+				So(OIDCInvalidToken.Contains(verify(fake.sign("RS256", claims))), ShouldBeTrue)
+			}
+		})
+		Convey("Tokens without a usable signature should be refused", func() {
+			token := fake.sign("RS256", fake.claims("nonce"))
+			parts := strings.Split(token, ".")
+			So(OIDCInvalidToken.Contains(verify(parts[0]+"."+parts[1]+".")), ShouldBeTrue)
+			So(OIDCInvalidToken.Contains(verify(parts[0]+"."+parts[1])), ShouldBeTrue)
+
+			other := fake.claims("nonce")
+			other["email"] = "other@example.com"
+			tampered := strings.Split(fake.sign("RS256", other), ".")
+			So(OIDCInvalidToken.Contains(verify(parts[0]+"."+tampered[1]+"."+parts[2])), ShouldBeTrue)
+
+			So(OIDCInvalidToken.Contains(verify(fake.sign("HS256", fake.claims("nonce")))), ShouldBeTrue)
+		})
+		Convey("Tokens signed by an unknown key should be refused", func() {
+			fake.kid = "key2"
+			token := fake.sign("RS256", fake.claims("nonce"))
+			fake.kid = "key1"
+			So(OIDCInvalidToken.Contains(verify(token)), ShouldBeTrue)
+		})
+		Convey("A provider claiming to be another issuer should be refused", func() {
+			_, err := newOIDCProvider(fake.URL+"/other", http.DefaultClient).endpoints()
+			So(OIDCError.Contains(err), ShouldBeTrue)
+		})
+	})
+}
+
+func TestOIDCLogin(t *testing.T) {
+	Convey("With an authentication handler using a fake provider", t, func() {
+		fake := newFakeOIDCProvider()
+		defer fake.Close()
+		config := &configType{}
+		config.Auth.Issuer = fake.URL
+		config.Auth.ClientID = "client"
+		config.Auth.ClientSecret = "secret"
+		config.Auth.AllowedEmails = stringSliceConfig{"admin@example.com"}
+		store := sessions.NewCookieStore([]byte("A"))
+		authHandler := NewAuthenticationHandler(mux.NewRouter(), config, store, nil, nil, nil, nil)
+		// Sessions are kept per request, and mux passes its handlers a copy
+		// of it, so route without it for the session to be saved.
+		router := http.NewServeMux()
+		router.HandleFunc("/authentication/isLoggedIn", authHandler.VerifySession)
+		authHandler.handleOIDC(router)
+		site := &sessionSaver{router}
+
+		get := func(path string, cookies []string) *httptest.ResponseRecorder {
+			r, err := http.NewRequest("GET", "http://localhost:8080"+path, nil)
+			So(err, ShouldBeNil)
+			r.Header["Cookie"] = cookies
+			w := httptest.NewRecorder()
+			site.ServeHTTP(w, r)
+			return w
+		}
+
+		w := get("/api/authentication/oidc/login", nil)
+		So(w.Code, ShouldEqual, http.StatusFound)
+		loginCookie := w.Header()["Set-Cookie"]
+		location, err := url.Parse(w.Header().Get("Location"))
+		So(err, ShouldBeNil)
+		So(location.Path, ShouldEqual, "/authorize")
+		query := location.Query()
+		So(query.Get("client_id"), ShouldEqual, "client")
+		So(query.Get("scope"), ShouldEqual, "openid email")
+		So(query.Get("redirect_uri"), ShouldEqual, "https://localhost:8080/api/authentication/oidc/callback")
+		state, nonce := query.Get("state"), query.Get("nonce")
+		So(state, ShouldNotEqual, "")
+		So(nonce, ShouldNotEqual, "")
+
+		loggedIn := func(cookies []string) bool {
+			status := &sessionStatus{}
+			So(json.Unmarshal(get("/authentication/isLoggedIn", cookies).Body.Bytes(), status), ShouldBeNil)
+			return status.LoggedIn
+		}
+		callback := func(code, state string) *httptest.ResponseRecorder {
+			return get("/api/authentication/oidc/callback?code="+code+"&state="+url.QueryEscape(state), loginCookie)
+		}
+
+		Convey("Coming back with a good code should log the administrator in", func() {
+			fake.tokens["good"] = fake.sign("RS256", fake.claims(nonce))
+			w := callback("good", state)
+			So(w.Code, ShouldEqual, http.StatusFound)
+			So(w.Header().Get("Location"), ShouldEqual, "/admin/")
+			So(loggedIn(w.Header()["Set-Cookie"]), ShouldBeTrue)
+
+			Convey("And the login can't be finished again", func() {
+				w := get("/api/authentication/oidc/callback?code=good&state="+url.QueryEscape(state), w.Header()["Set-Cookie"])
+				So(w.Header().Get("Location"), ShouldEqual, "/login?error=state")
+			})
+		})
+		Convey("Logging in should move the session to a new id", func() {
+			fake.tokens["good"] = fake.sign("RS256", fake.claims(nonce))
+			r, err := http.NewRequest("GET", "http://localhost:8080/api/authentication/oidc/callback?code=good&state="+url.QueryEscape(state), nil)
+			So(err, ShouldBeNil)
+			r.Header["Cookie"] = loginCookie
+			sess, err := sessions.GetRegistry(r).Get(store, globalSessionName)
+			So(err, ShouldBeNil)
+			sess.ID = "planted"
+			site.ServeHTTP(httptest.NewRecorder(), r)
+			So(sess.Values[authStatusLoggedIn], ShouldEqual, true)
+			So(sess.ID, ShouldNotEqual, "planted")
+		})
+		Convey("A mismatched state should be refused", func() {
+			fake.tokens["good"] = fake.sign("RS256", fake.claims(nonce))
+			w := callback("good", "forged")
+			So(w.Header().Get("Location"), ShouldEqual, "/login?error=state")
+			So(loggedIn(w.Header()["Set-Cookie"]), ShouldBeFalse)
+		})
+		Convey("A token for another login should be refused", func() {
+			fake.tokens["good"] = fake.sign("RS256", fake.claims("other nonce"))
+			w := callback("good", state)
+			So(w.Header().Get("Location"), ShouldEqual, "/login?error=token")
+			So(loggedIn(w.Header()["Set-Cookie"]), ShouldBeFalse)
+		})
+		Convey("A bad code should be refused", func() {
+			So(callback("bad", state).Header().Get("Location"), ShouldEqual, "/login?error=provider")
+		})
+		Convey("Accounts without a role should be refused", func() {
+			claims := fake.claims(nonce)
+			claims["email"] = "someone@example.com"
+			fake.tokens["good"] = fake.sign("RS256", claims)
+			w := callback("good", state)
+			So(w.Header().Get("Location"), ShouldEqual, "/login?error=refused")
+			So(loggedIn(w.Header()["Set-Cookie"]), ShouldBeFalse)
+		})
+		Convey("Cancelling at the provider should go back to the login page", func() {
+			w := get("/api/authentication/oidc/callback?error=access_denied&state="+url.QueryEscape(state), loginCookie)
+			So(w.Header().Get("Location"), ShouldEqual, "/login?error=cancelled")
+		})
+	})
+}
+
+func TestOIDCSite(t *testing.T) {
+	Convey("With a server logging in through a fake provider", t, func() {
+		fake := newFakeOIDCProvider()
+		defer fake.Close()
+		dir, err := ioutil.TempDir("", "oidc")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		db, err := bolt.Open(filepath.Join(dir, "records.bolt"), 0600, &bolt.Options{Timeout: time.Second})
+		So(err, ShouldBeNil)
+		defer db.Close()
+
+		config := &configType{}
+		config.General.Develop = true
+		config.Auth.Issuer = fake.URL
+		config.Auth.ClientID = "client"
+		config.Auth.ClientSecret = "secret"
+		config.Auth.AllowedEmails = stringSliceConfig{"admin@example.com"}
+		handler, _, _, err := setupStandardHandlers(http.NewServeMux(), config, db)
+		So(err, ShouldBeNil)
+
+		get := func(path string, cookies []string) *httptest.ResponseRecorder {
+			r, err := http.NewRequest("GET", "http://localhost:8080"+path, nil)
+			So(err, ShouldBeNil)
+			r.Header["Cookie"] = cookies
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			return w
+		}
+
+		Convey("Logging in should work without an XSRF token", func() {
+			w := get("/api/authentication/oidc/login", nil)
+			So(w.Code, ShouldEqual, http.StatusFound)
+			So(w.Header().Get("Cache-Control"), ShouldContainSubstring, "no-cache")
+			location, err := url.Parse(w.Header().Get("Location"))
+			So(err, ShouldBeNil)
+			query := location.Query()
+			fake.tokens["good"] = fake.sign("RS256", fake.claims(query.Get("nonce")))
+
+			w = get("/api/authentication/oidc/callback?code=good&state="+url.QueryEscape(query.Get("state")), w.Header()["Set-Cookie"])
+			So(w.Code, ShouldEqual, http.StatusFound)
+			So(w.Header().Get("Location"), ShouldEqual, "/admin/")
+		})
+		Convey("Other api requests should still need one", func() {
+			So(get("/api/authentication/isLoggedIn", nil).Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
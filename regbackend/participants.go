@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+	"github.com/spacemonkeygo/errors/errhttp"
+)
+
+const (
+	ParticipantYouth  = "youth"
+	ParticipantLeader = "leader"
+)
+
+type EmergencyContact struct {
+	Name         string      `json:"name"`
+	Relationship string      `json:"relationship"`
+	PhoneNumber  PhoneNumber `json:"phoneNumber"`
+}
+
+type Participant struct {
+	ID   uint64 `json:"id"`
+	Type string `json:"type"`
+
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	// As YYYY-MM-DD, to avoid any time zone surprises.
+	BirthDate string `json:"birthDate"`
+	Role      string `json:"role"`
+
+	EmergencyContact EmergencyContact `json:"emergencyContact"`
+
+	DietaryNotes string `json:"dietaryNotes"`
+	MedicalNotes string `json:"medicalNotes"`
+
+	// Only kept for leaders, see screening.go.
+	Certificates []Certificate       `json:"certificates"`
+	Screening    LeaderScreening     `json:"screening"`
+	Documents    []ScreeningDocument `json:"documents"`
+}
+
+// All participants of a group, stored as a single record keyed the same as
+// the group so that every change is kept as a new version.
+type ParticipantRoster struct {
+	SecurityKey  string         `json:"securityKey"`
+	Participants []*Participant `json:"participants"`
+	LastID       uint64         `json:"-"`
+}
+
+func (r *ParticipantRoster) Counts() (youth, leaders int) {
+	for _, p := range r.Participants {
+		if p.Type == ParticipantLeader {
+			leaders++
+		} else {
+			youth++
+		}
+	}
+	return youth, leaders
+}
+
+func (r *ParticipantRoster) find(id uint64) int {
+	for i, p := range r.Participants {
+		if p.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+const birthDateLayout = "2006-01-02"
+
+// Checks a participant, normalizing it in place.  Any problems are returned
+// together as a *ValidationError.
+func (p *Participant) Validate() error {
+	verr := &ValidationError{}
+
+	p.Type = strings.ToLower(strings.TrimSpace(p.Type))
+	if p.Type != ParticipantYouth && p.Type != ParticipantLeader {
+		verr.add("type", "must be %s or %s", ParticipantYouth, ParticipantLeader)
+	}
+	validateText(verr, "firstName", &p.FirstName, true)
+	validateText(verr, "lastName", &p.LastName, true)
+	validateText(verr, "role", &p.Role, false)
+
+	p.BirthDate = strings.TrimSpace(p.BirthDate)
+	if p.BirthDate == "" {
+		verr.add("birthDate", "is required")
+	} else if birthDate, err := time.Parse(birthDateLayout, p.BirthDate); err != nil {
+		verr.add("birthDate", "must be a date like 2006-01-02")
+	} else if birthDate.After(time.Now()) {
+		verr.add("birthDate", "must not be in the future")
+	}
+
+	contact := &p.EmergencyContact
+	validateText(verr, "emergencyContact.name", &contact.Name, true)
+	validateText(verr, "emergencyContact.relationship", &contact.Relationship, false)
+	if strings.TrimSpace(string(contact.PhoneNumber)) == "" {
+		verr.add("emergencyContact.phoneNumber", "is required")
+	} else if phone, ok := normalizePhoneNumber(contact.PhoneNumber); ok {
+		contact.PhoneNumber = phone
+	} else {
+		verr.add("emergencyContact.phoneNumber", "must be a 10 digit phone number, like 613-555-0123")
+	}
+
+	p.DietaryNotes = strings.TrimSpace(p.DietaryNotes)
+	p.MedicalNotes = strings.TrimSpace(p.MedicalNotes)
+
+	if p.Type == ParticipantLeader {
+		validateCertificates(verr, p.Certificates)
+	} else if len(p.Certificates) != 0 {
+		verr.add("certificates", "are only tracked for leaders")
+	}
+
+	if len(verr.Errors) != 0 {
+		return verr
+	}
+	return nil
+}
+
+var (
+	ParticipantDoesNotExist     = DBError.NewClass("Participant does not exist", errhttp.SetStatusCode(404))
+	NoParticipantsOnWaitingList = DBError.NewClass("Participants can't be registered while on the waiting list", errhttp.SetStatusCode(400))
+)
+
+var (
+	BOLT_PARTICIPANTBUCKET = []byte("BUCKET_PARTICIPANTS")
+)
+
+type ParticipantDb interface {
+	GetRoster(securityKey string) (*ParticipantRoster, error)
+	GetAllRosters() ([]*ParticipantRoster, error)
+	AddParticipant(securityKey string, p *Participant) error
+	UpdateParticipant(securityKey string, p *Participant) error
+	DeleteParticipant(securityKey string, id uint64) error
+
+	SetScreening(securityKey string, id uint64, screening LeaderScreening) error
+	AddDocument(securityKey string, id uint64, doc *ScreeningDocument, data []byte) error
+	GetDocument(securityKey string, id, docID uint64) (*ScreeningDocument, []byte, error)
+}
+
+type participantDbBolt struct {
+	db   boltorm.DB
+	docs *DocumentStore
+}
+
+func NewParticipantDb(db boltorm.DB, docs *DocumentStore) (ParticipantDb, error) {
+	if err := db.Update(func(tx boltorm.Tx) error {
+		if err := tx.CreateBucketIfNotExists(BOLT_PARTICIPANTBUCKET); err != nil {
+			return err
+		}
+		return moveLegacyScreeningDocuments(tx, docs)
+	}); err != nil {
+		return nil, err
+	}
+	return &participantDbBolt{db, docs}, nil
+}
+
+// Returns the roster of a group, or an empty one if nothing has been added yet.
+func getRoster(tx boltorm.Tx, gpr *GroupPreRegistration) (roster *ParticipantRoster, exists bool, err error) {
+	roster = &ParticipantRoster{}
+	if err := tx.Get(BOLT_PARTICIPANTBUCKET, gpr.Key(), roster); err != nil {
+		if boltorm.ErrKeyDoesNotExist.Contains(err) {
+			return &ParticipantRoster{SecurityKey: gpr.SecurityKey, Participants: []*Participant{}}, false, nil
+		}
+		return nil, false, err
+	}
+	if roster.Participants == nil {
+		// Gob doesn't keep empty slices apart from nil ones.
+		roster.Participants = []*Participant{}
+	}
+	return roster, true, nil
+}
+
+func (d *participantDbBolt) GetRoster(securityKey string) (roster *ParticipantRoster, err error) {
+	return roster, d.db.View(func(tx boltorm.Tx) error {
+		gpr, err := getPreRegRecord(tx, securityKey)
+		if err != nil {
+			return err
+		}
+		roster, _, err = getRoster(tx, gpr)
+		return err
+	})
+}
+
+func (d *participantDbBolt) GetAllRosters() (rosters []*ParticipantRoster, err error) {
+	return rosters, d.db.View(func(tx boltorm.Tx) error {
+		if res, err := tx.GetAll(BOLT_PARTICIPANTBUCKET, &ParticipantRoster{}); err != nil {
+			return err
+		} else {
+			rosters = res.([]*ParticipantRoster)
+		}
+		return nil
+	})
+}
+
+// Loads the roster of a group, lets fn change it and then stores the result.
+func (d *participantDbBolt) updateRoster(securityKey string, fn func(tx boltorm.Tx, gpr *GroupPreRegistration, roster *ParticipantRoster) error) error {
+	return d.db.Update(func(tx boltorm.Tx) error {
+		gpr, err := getPreRegRecord(tx, securityKey)
+		if err != nil {
+			return err
+		}
+		roster, exists, err := getRoster(tx, gpr)
+		if err != nil {
+			return err
+		}
+		if err := fn(tx, gpr, roster); err != nil {
+			return err
+		}
+		if exists {
+			return tx.Update(BOLT_PARTICIPANTBUCKET, gpr.Key(), roster)
+		}
+		return tx.Insert(BOLT_PARTICIPANTBUCKET, gpr.Key(), roster)
+	})
+}
+
+func (d *participantDbBolt) AddParticipant(securityKey string, p *Participant) error {
+	return d.updateRoster(securityKey, func(tx boltorm.Tx, gpr *GroupPreRegistration, roster *ParticipantRoster) error {
+		if gpr.IsOnWaitingList {
+			return NoParticipantsOnWaitingList.New("Group %s is on the waiting list", securityKey)
+		}
+		// Screening is only ever changed through its own endpoints.
+		p.Screening = LeaderScreening{}
+		p.Documents = nil
+		roster.LastID++
+		p.ID = roster.LastID
+		roster.Participants = append(roster.Participants, p)
+		return nil
+	})
+}
+
+func (d *participantDbBolt) UpdateParticipant(securityKey string, p *Participant) error {
+	return d.updateRoster(securityKey, func(tx boltorm.Tx, gpr *GroupPreRegistration, roster *ParticipantRoster) error {
+		i := roster.find(p.ID)
+		if i < 0 {
+			return ParticipantDoesNotExist.New("No participant %d in group %s", p.ID, securityKey)
+		}
+		p.Screening = roster.Participants[i].Screening
+		p.Documents = roster.Participants[i].Documents
+		roster.Participants[i] = p
+		return nil
+	})
+}
+
+// Screening documents go along with the participant.
+func (d *participantDbBolt) DeleteParticipant(securityKey string, id uint64) error {
+	var docIDs []uint64
+	err := d.updateRoster(securityKey, func(tx boltorm.Tx, gpr *GroupPreRegistration, roster *ParticipantRoster) error {
+		i := roster.find(id)
+		if i < 0 {
+			return ParticipantDoesNotExist.New("No participant %d in group %s", id, securityKey)
+		}
+		for _, doc := range roster.Participants[i].Documents {
+			if err := d.docs.delete(tx, doc.ID); err != nil {
+				return err
+			}
+			docIDs = append(docIDs, doc.ID)
+		}
+		roster.Participants = append(roster.Participants[:i], roster.Participants[i+1:]...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	d.docs.removeFiles(docIDs)
+	return nil
+}
+
+type ParticipantHandler struct {
+	db          ParticipantDb
+	docs        *DocumentStore
+	authHandler *AuthenticationHandler
+	getHandler  *mux.Route
+}
+
+// Turns a missing group into a 404 rather than a generic failure.
+func participantError(w http.ResponseWriter, err error) {
+	if RecordDoesNotExist.Contains(err) {
+		http.Error(w, "No such group", http.StatusNotFound)
+	} else if _, ok := err.(base64.CorruptInputError); ok {
+		http.Error(w, "No such group", http.StatusNotFound)
+	} else {
+		httpError(w, err)
+	}
+}
+
+func (h *ParticipantHandler) decodeParticipant(w http.ResponseWriter, r *http.Request) (*Participant, bool) {
+	p := &Participant{}
+	if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+		log.Printf("Got error while decoding json: %s", err)
+		http.Error(w, "Invalid participant json given", 400)
+		return nil, false
+	}
+	if err := p.Validate(); err != nil {
+		writeValidationError(w, err.(*ValidationError))
+		return nil, false
+	}
+	return p, true
+}
+
+func participantID(w http.ResponseWriter, r *http.Request) (uint64, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["ID"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid participant id", 404)
+		return 0, false
+	}
+	return id, true
+}
+
+func (h *ParticipantHandler) List(w http.ResponseWriter, r *http.Request) {
+	roster, err := h.db.GetRoster(mux.Vars(r)["SecurityKey"])
+	if err != nil {
+		participantError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, roster.Participants)
+}
+
+func (h *ParticipantHandler) Create(w http.ResponseWriter, r *http.Request) {
+	securityKey := mux.Vars(r)["SecurityKey"]
+	p, ok := h.decodeParticipant(w, r)
+	if !ok {
+		return
+	}
+	if err := h.db.AddParticipant(securityKey, p); err != nil {
+		log.Printf("Failed to add participant!  Error: %s", err)
+		participantError(w, err)
+		return
+	}
+	url, err := h.getHandler.URLPath("SecurityKey", securityKey, "ID", strconv.FormatUint(p.ID, 10))
+	if err != nil {
+		http.Error(w, "Failed to add participant", 500)
+		return
+	}
+	w.Header()["Location"] = []string{url.Path}
+	writeJSON(w, http.StatusCreated, p)
+}
+
+func (h *ParticipantHandler) Get(w http.ResponseWriter, r *http.Request) {
+	id, ok := participantID(w, r)
+	if !ok {
+		return
+	}
+	roster, err := h.db.GetRoster(mux.Vars(r)["SecurityKey"])
+	if err != nil {
+		participantError(w, err)
+		return
+	}
+	i := roster.find(id)
+	if i < 0 {
+		http.Error(w, "No such participant", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, roster.Participants[i])
+}
+
+func (h *ParticipantHandler) Update(w http.ResponseWriter, r *http.Request) {
+	id, ok := participantID(w, r)
+	if !ok {
+		return
+	}
+	p, ok := h.decodeParticipant(w, r)
+	if !ok {
+		return
+	}
+	p.ID = id
+	if err := h.db.UpdateParticipant(mux.Vars(r)["SecurityKey"], p); err != nil {
+		participantError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (h *ParticipantHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	id, ok := participantID(w, r)
+	if !ok {
+		return
+	}
+	if err := h.db.DeleteParticipant(mux.Vars(r)["SecurityKey"], id); err != nil {
+		participantError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Participants are managed by whoever holds the group's security key, the
+// same as the group itself.  Reviewing screening is left to administrators.
+func NewParticipantHandler(r *mux.Router, db ParticipantDb, docs *DocumentStore, authHandler *AuthenticationHandler) *ParticipantHandler {
+	h := &ParticipantHandler{
+		db:          db,
+		docs:        docs,
+		authHandler: authHandler,
+	}
+
+	r.HandleFunc("/preregistration/{SecurityKey:[a-zA-Z0-9-_]+}/participants", h.List).Methods("GET")
+	r.HandleFunc("/preregistration/{SecurityKey:[a-zA-Z0-9-_]+}/participants", h.Create).Methods("POST")
+	h.getHandler = r.HandleFunc("/preregistration/{SecurityKey:[a-zA-Z0-9-_]+}/participants/{ID:[0-9]+}", h.Get).Methods("GET")
+	r.HandleFunc("/preregistration/{SecurityKey:[a-zA-Z0-9-_]+}/participants/{ID:[0-9]+}", h.Update).Methods("PUT")
+	r.HandleFunc("/preregistration/{SecurityKey:[a-zA-Z0-9-_]+}/participants/{ID:[0-9]+}", h.Delete).Methods("DELETE")
+	r.HandleFunc("/preregistration/{SecurityKey:[a-zA-Z0-9-_]+}/participants/{ID:[0-9]+}/screening", authHandler.RoleFunc(h.SetScreening, RoleRegistrar)).Methods("PUT")
+	r.HandleFunc("/preregistration/{SecurityKey:[a-zA-Z0-9-_]+}/participants/{ID:[0-9]+}/documents", h.UploadDocument).Methods("POST")
+	r.HandleFunc("/preregistration/{SecurityKey:[a-zA-Z0-9-_]+}/participants/{ID:[0-9]+}/documents/{DocumentID:[0-9]+}", authHandler.RoleFunc(h.GetDocument, RoleRegistrar)).Methods("GET")
+
+	return h
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestParticipantHandler(t *testing.T) {
+	Convey("Starting with a registered group and a group on the waiting list", t, func() {
+		db := boltorm.NewMemoryDB()
+		invDb, err := NewInvoiceDb(db)
+		So(err, ShouldBeNil)
+		config := &configType{}
+		prdb, err := NewPreRegBoltDb(db, config, invDb)
+		So(err, ShouldBeNil)
+		docs := newTestDocumentStore(db)
+		participantDb, err := NewParticipantDb(db, docs)
+		So(err, ShouldBeNil)
+		router := mux.NewRouter()
+		NewParticipantHandler(router, participantDb, docs, nil)
+
+		group := &GroupPreRegistration{
+			GroupName:          "1st Testingway",
+			Council:            "Council rock",
+			ContactLeaderEmail: "testemail@example.com",
+		}
+		So(prdb.CreateRecord(group), ShouldBeNil)
+		config.General.EnableWaitingList = true
+		waiting := &GroupPreRegistration{
+			GroupName:          "2nd Testingway",
+			Council:            "Council rock",
+			ContactLeaderEmail: "testemail2@example.com",
+		}
+		So(prdb.CreateRecord(waiting), ShouldBeNil)
+		config.General.EnableWaitingList = false
+
+		participant := Participant{
+			Type:      "Youth",
+			FirstName: "Sam",
+			LastName:  "Cub",
+			BirthDate: "2007-05-04",
+			EmergencyContact: EmergencyContact{
+				Name:         "Pat Cub",
+				Relationship: "Parent",
+				PhoneNumber:  "(613) 555-0199",
+			},
+			DietaryNotes: "Vegetarian ",
+		}
+
+		request := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+			var buf bytes.Buffer
+			if body != nil {
+				So(json.NewEncoder(&buf).Encode(body), ShouldBeNil)
+			}
+			r, err := http.NewRequest(method, "http://localhost:8080/preregistration/"+path, &buf)
+			So(err, ShouldBeNil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			return w
+		}
+		list := func(securityKey string) []*Participant {
+			w := request("GET", securityKey+"/participants", nil)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			participants := []*Participant{}
+			So(json.Unmarshal(w.Body.Bytes(), &participants), ShouldBeNil)
+			return participants
+		}
+
+		Convey("A new group should have an empty roster", func() {
+			So(list(group.SecurityKey), ShouldResemble, []*Participant{})
+		})
+
+		Convey("Listing participants of an unknown group should 404", func() {
+			w := request("GET", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA/participants", nil)
+			So(w.Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Adding an invalid participant should list the bad fields", func() {
+			w := request("POST", group.SecurityKey+"/participants", Participant{Type: "camper", BirthDate: time.Now().AddDate(0, 0, 2).Format(birthDateLayout)})
+			So(w.Code, ShouldEqual, http.StatusUnprocessableEntity)
+			verr := &ValidationError{}
+			So(json.Unmarshal(w.Body.Bytes(), verr), ShouldBeNil)
+			fields := fieldsOf(verr)
+			So(fields, ShouldContainKey, "type")
+			So(fields, ShouldContainKey, "firstName")
+			So(fields["birthDate"], ShouldEqual, "must not be in the future")
+			So(fields, ShouldContainKey, "emergencyContact.name")
+			So(fields, ShouldContainKey, "emergencyContact.phoneNumber")
+		})
+
+		Convey("Adding a participant to a group on the waiting list should fail", func() {
+			w := request("POST", waiting.SecurityKey+"/participants", participant)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(list(waiting.SecurityKey), ShouldResemble, []*Participant{})
+		})
+
+		Convey("Adding a participant", func() {
+			w := request("POST", group.SecurityKey+"/participants", participant)
+			So(w.Code, ShouldEqual, http.StatusCreated)
+			created := &Participant{}
+			So(json.Unmarshal(w.Body.Bytes(), created), ShouldBeNil)
+
+			Convey("Should assign an id and give its location", func() {
+				So(created.ID, ShouldEqual, 1)
+				So(w.HeaderMap.Get("Location"), ShouldEqual, "/preregistration/"+group.SecurityKey+"/participants/1")
+			})
+			Convey("Should normalize the input", func() {
+				So(created.Type, ShouldEqual, ParticipantYouth)
+				So(created.EmergencyContact.PhoneNumber, ShouldEqual, PhoneNumber("613-555-0199"))
+				So(created.DietaryNotes, ShouldEqual, "Vegetarian")
+			})
+			Convey("Should be fetchable from its location", func() {
+				w := request("GET", group.SecurityKey+"/participants/1", nil)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				fetched := &Participant{}
+				So(json.Unmarshal(w.Body.Bytes(), fetched), ShouldBeNil)
+				So(fetched, ShouldResemble, created)
+			})
+			Convey("Should only show up on that group's roster", func() {
+				So(list(group.SecurityKey), ShouldResemble, []*Participant{created})
+				So(list(waiting.SecurityKey), ShouldResemble, []*Participant{})
+			})
+
+			Convey("And a leader", func() {
+				leader := participant
+				leader.Type = ParticipantLeader
+				leader.FirstName = "Akela"
+				w := request("POST", group.SecurityKey+"/participants", leader)
+				So(w.Code, ShouldEqual, http.StatusCreated)
+
+				Convey("Should be counted as such", func() {
+					roster, err := participantDb.GetRoster(group.SecurityKey)
+					So(err, ShouldBeNil)
+					youth, leaders := roster.Counts()
+					So(youth, ShouldEqual, 1)
+					So(leaders, ShouldEqual, 1)
+				})
+
+				Convey("Deleting the first participant", func() {
+					w := request("DELETE", group.SecurityKey+"/participants/1", nil)
+					So(w.Code, ShouldEqual, http.StatusNoContent)
+					Convey("Should only leave the leader", func() {
+						participants := list(group.SecurityKey)
+						So(len(participants), ShouldEqual, 1)
+						So(participants[0].FirstName, ShouldEqual, "Akela")
+					})
+					Convey("Should not reuse its id", func() {
+						w := request("POST", group.SecurityKey+"/participants", participant)
+						So(w.Code, ShouldEqual, http.StatusCreated)
+						So(w.HeaderMap.Get("Location"), ShouldEndWith, "/participants/3")
+					})
+					Convey("Should make it unfetchable", func() {
+						So(request("GET", group.SecurityKey+"/participants/1", nil).Code, ShouldEqual, http.StatusNotFound)
+						So(request("DELETE", group.SecurityKey+"/participants/1", nil).Code, ShouldEqual, http.StatusNotFound)
+					})
+				})
+			})
+
+			Convey("Updating the participant", func() {
+				updated := participant
+				updated.MedicalNotes = "Allergic to bees"
+				w := request("PUT", group.SecurityKey+"/participants/1", updated)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				Convey("Should change the stored participant", func() {
+					participants := list(group.SecurityKey)
+					So(len(participants), ShouldEqual, 1)
+					So(participants[0].ID, ShouldEqual, 1)
+					So(participants[0].MedicalNotes, ShouldEqual, "Allergic to bees")
+				})
+			})
+
+			Convey("Updating a participant that doesn't exist should 404", func() {
+				w := request("PUT", group.SecurityKey+"/participants/7", participant)
+				So(w.Code, ShouldEqual, http.StatusNotFound)
+			})
+		})
+	})
+}
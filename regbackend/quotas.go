@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+	"github.com/spacemonkeygo/errors/errhttp"
+)
+
+// The spots allocated to a council.  Groups from a council without a quota
+// are only limited by the schedule.
+type CouncilQuota struct {
+	Council string `json:"council"`
+	Youth   int    `json:"youth"`
+	Leaders int    `json:"leaders"`
+}
+
+type CouncilQuotas struct {
+	Quotas []CouncilQuota `json:"quotas"`
+
+	UpdatedBy string    `json:"updatedBy"`
+	Updated   time.Time `json:"updated"`
+}
+
+var (
+	BOLT_COUNCILQUOTABUCKET = []byte("BUCKET_COUNCILQUOTA")
+)
+
+var councilQuotasKey = []byte("quotas")
+
+// Imports are refused past a quota rather than put on the council's waiting
+// list.
+var CouncilQuotaExceeded = DBError.NewClass("Council quota exceeded", errhttp.SetStatusCode(400))
+
+func (q *CouncilQuotas) Validate() error {
+	verr := &ValidationError{}
+	if q.Quotas == nil {
+		q.Quotas = []CouncilQuota{}
+	}
+	councils := make(map[string]bool)
+	for i := range q.Quotas {
+		quota := &q.Quotas[i]
+		prefix := "quotas[" + strconv.Itoa(i) + "]."
+		validateText(verr, prefix+"council", &quota.Council, true)
+		if councils[normalizeName(quota.Council)] {
+			verr.add(prefix+"council", "already has a quota")
+		}
+		councils[normalizeName(quota.Council)] = true
+		if quota.Youth < 0 {
+			verr.add(prefix+"youth", "must not be negative")
+		}
+		if quota.Leaders < 0 {
+			verr.add(prefix+"leaders", "must not be negative")
+		}
+	}
+	if len(verr.Errors) != 0 {
+		return verr
+	}
+	return nil
+}
+
+// Councils are matched ignoring case and spacing, like the directory does.
+func (q *CouncilQuotas) find(council string) *CouncilQuota {
+	council = normalizeName(council)
+	for i := range q.Quotas {
+		if normalizeName(q.Quotas[i].Council) == council {
+			return &q.Quotas[i]
+		}
+	}
+	return nil
+}
+
+// The spots a group takes up, counted from its roster once it has one and
+// from its estimates until then.  roster is nil for groups without one.
+func groupSpots(rec *GroupPreRegistration, roster *ParticipantRoster) (youth, leaders int) {
+	if roster != nil {
+		return roster.Counts()
+	}
+	return rec.EstimatedYouth, rec.EstimatedLeaders
+}
+
+func getCouncilQuotas(tx boltorm.Tx) (*CouncilQuotas, error) {
+	quotas := &CouncilQuotas{}
+	if err := tx.Get(BOLT_COUNCILQUOTABUCKET, councilQuotasKey, quotas); err != nil && !boltorm.ErrKeyDoesNotExist.Contains(err) {
+		return nil, err
+	}
+	if quotas.Quotas == nil {
+		quotas.Quotas = []CouncilQuota{}
+	}
+	return quotas, nil
+}
+
+// Whether registering the group would take its council past its quota, in
+// which case it waits for a spot on the council's waiting list.
+func (d *preRegDbBolt) overCouncilQuota(tx boltorm.Tx, in *GroupPreRegistration) (bool, error) {
+	quotas, err := getCouncilQuotas(tx)
+	if err != nil {
+		return false, err
+	}
+	quota := quotas.find(in.Council)
+	if quota == nil {
+		return false, nil
+	}
+	res, err := tx.GetAll(BOLT_GROUPBUCKET, &GroupPreRegistration{})
+	if err != nil {
+		return false, err
+	}
+	youth, leaders := in.EstimatedYouth, in.EstimatedLeaders
+	for _, rec := range res.([]*GroupPreRegistration) {
+		if rec.IsOnWaitingList || normalizeName(rec.Council) != normalizeName(in.Council) {
+			continue
+		}
+		roster, exists, err := getRoster(tx, rec)
+		if err != nil {
+			return false, err
+		} else if !exists {
+			roster = nil
+		}
+		recYouth, recLeaders := groupSpots(rec, roster)
+		youth += recYouth
+		leaders += recLeaders
+	}
+	return youth > quota.Youth || leaders > quota.Leaders, nil
+}
+
+func (d *preRegDbBolt) GetCouncilQuotas() (quotas *CouncilQuotas, err error) {
+	return quotas, d.db.View(func(tx boltorm.Tx) error {
+		quotas, err = getCouncilQuotas(tx)
+		return err
+	})
+}
+
+// Earlier quotas are kept as previous versions of the record.  Groups
+// already registered keep their spots when a quota is lowered.
+func (d *preRegDbBolt) SetCouncilQuotas(quotas *CouncilQuotas) error {
+	return d.db.Update(func(tx boltorm.Tx) error {
+		err := tx.Update(BOLT_COUNCILQUOTABUCKET, councilQuotasKey, quotas)
+		if boltorm.ErrKeyDoesNotExist.Contains(err) {
+			return tx.Insert(BOLT_COUNCILQUOTABUCKET, councilQuotasKey, quotas)
+		}
+		return err
+	})
+}
+
+type CouncilQuotaHandler struct {
+	db          PreRegDb
+	authHandler *AuthenticationHandler
+}
+
+func (h *CouncilQuotaHandler) Get(w http.ResponseWriter, r *http.Request) {
+	quotas, err := h.db.GetCouncilQuotas()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, quotas)
+}
+
+func (h *CouncilQuotaHandler) Set(w http.ResponseWriter, r *http.Request) {
+	quotas := &CouncilQuotas{}
+	if err := json.NewDecoder(r.Body).Decode(quotas); err != nil {
+		http.Error(w, "Invalid quotas json given", http.StatusBadRequest)
+		return
+	}
+	if err := quotas.Validate(); err != nil {
+		writeValidationError(w, err.(*ValidationError))
+		return
+	}
+	quotas.UpdatedBy = h.authHandler.sessionUser(r)
+	quotas.Updated = time.Now()
+	if err := h.db.SetCouncilQuotas(quotas); err != nil {
+		log.Printf("Failed to store council quotas!  Error: %s", err)
+		httpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, quotas)
+}
+
+func NewCouncilQuotaHandler(r *mux.Router, db PreRegDb, authHandler *AuthenticationHandler) *CouncilQuotaHandler {
+	h := &CouncilQuotaHandler{
+		db:          db,
+		authHandler: authHandler,
+	}
+
+	r.HandleFunc("/quotas", authHandler.AdminFunc(h.Get)).Methods("GET")
+	r.HandleFunc("/quotas", authHandler.RoleFunc(h.Set, RoleSuperadmin)).Methods("PUT")
+
+	return h
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestCouncilQuotasValidate(t *testing.T) {
+	Convey("Quotas should validate", t, func() {
+		quotas := &CouncilQuotas{Quotas: []CouncilQuota{{" Voyageur ", 20, 5}, {"Battle River", 0, 0}}}
+		So(quotas.Validate(), ShouldBeNil)
+		So(quotas.Quotas[0].Council, ShouldEqual, "Voyageur")
+		So(quotas.find("VOYAGEUR").Youth, ShouldEqual, 20)
+		So(quotas.find("Elsewhere"), ShouldBeNil)
+	})
+	Convey("Bad quotas should list each problem", t, func() {
+		quotas := &CouncilQuotas{Quotas: []CouncilQuota{{"Voyageur", -1, 5}, {"voyageur", 1, -5}, {"", 0, 0}}}
+		So(fieldsOf(quotas.Validate()), ShouldResemble, map[string]string{
+			"quotas[0].youth":   "must not be negative",
+			"quotas[1].council": "already has a quota",
+			"quotas[1].leaders": "must not be negative",
+			"quotas[2].council": "is required",
+		})
+	})
+}
+
+func TestCouncilQuotaRegistrations(t *testing.T) {
+	Convey("With a council quota of 10 youth and 4 leaders", t, func() {
+		db := boltorm.NewMemoryDB()
+		invDb, err := NewInvoiceDb(db)
+		So(err, ShouldBeNil)
+		prdb, err := NewPreRegBoltDb(db, &configType{}, invDb)
+		So(err, ShouldBeNil)
+		participantDb, err := NewParticipantDb(db, newTestDocumentStore(db))
+		So(err, ShouldBeNil)
+		So(prdb.SetCouncilQuotas(&CouncilQuotas{Quotas: []CouncilQuota{{"Voyageur", 10, 4}}}), ShouldBeNil)
+
+		register := func(pack, council string, youth, leaders int) *GroupPreRegistration {
+			rec := &GroupPreRegistration{
+				PackName:           pack,
+				GroupName:          "1st Ottawa",
+				Council:            council,
+				ContactLeaderEmail: pack + "@example.com",
+				EstimatedYouth:     youth,
+				EstimatedLeaders:   leaders,
+			}
+			So(prdb.CreateRecord(rec), ShouldBeNil)
+			return rec
+		}
+		first := register("a", "Voyageur", 6, 2)
+
+		Convey("Groups fitting in the quota should register", func() {
+			rec := register("b", "voyageur", 4, 2)
+			So(rec.IsOnWaitingList, ShouldBeFalse)
+			So(rec.OnCouncilWaitingList, ShouldBeFalse)
+		})
+		Convey("Groups going over the quota should wait for their council", func() {
+			rec := register("b", "Voyageur", 5, 1)
+			So(rec.IsOnWaitingList, ShouldBeTrue)
+			So(rec.OnCouncilWaitingList, ShouldBeTrue)
+
+			Convey("And be promotable by an administrator", func() {
+				So(prdb.Promote(rec.SecurityKey), ShouldBeNil)
+				stored, err := prdb.GetRecord(rec.SecurityKey)
+				So(err, ShouldBeNil)
+				So(stored.IsOnWaitingList, ShouldBeFalse)
+				So(stored.OnCouncilWaitingList, ShouldBeFalse)
+			})
+		})
+		Convey("Leaders should have their own quota", func() {
+			So(register("b", "Voyageur", 0, 3).OnCouncilWaitingList, ShouldBeTrue)
+		})
+		Convey("Rosters should count instead of estimates", func() {
+			So(participantDb.AddParticipant(first.SecurityKey, &Participant{Type: ParticipantYouth}), ShouldBeNil)
+			So(register("b", "Voyageur", 9, 2).OnCouncilWaitingList, ShouldBeFalse)
+		})
+		Convey("Other councils should be unlimited", func() {
+			So(register("b", "Battle River", 50, 20).IsOnWaitingList, ShouldBeFalse)
+		})
+		Convey("Groups on the general waiting list shouldn't use up the quota", func() {
+			config := &configType{}
+			config.General.EnableWaitingList = true
+			waitingPrdb, err := NewPreRegBoltDb(db, config, invDb)
+			So(err, ShouldBeNil)
+			rec := &GroupPreRegistration{GroupName: "2nd Ottawa", Council: "Voyageur", ContactLeaderEmail: "w@example.com", EstimatedYouth: 4}
+			So(waitingPrdb.CreateRecord(rec), ShouldBeNil)
+			So(rec.IsOnWaitingList, ShouldBeTrue)
+			So(rec.OnCouncilWaitingList, ShouldBeFalse)
+			So(register("b", "Voyageur", 4, 2).IsOnWaitingList, ShouldBeFalse)
+		})
+		Convey("Imports going over the quota should report the rows", func() {
+			rowErrs, err := prdb.ImportRecords([]*GroupPreRegistration{
+				{PackName: "b", GroupName: "1st Ottawa", Council: "Voyageur", ContactLeaderEmail: "b@example.com", EstimatedYouth: 3, EstimatedLeaders: 1},
+				{PackName: "c", GroupName: "1st Ottawa", Council: "Voyageur", ContactLeaderEmail: "c@example.com", EstimatedYouth: 2},
+				{PackName: "d", GroupName: "1st Ottawa", Council: "Voyageur", ContactLeaderEmail: "d@example.com", EstimatedYouth: 1, EstimatedLeaders: 1},
+			}, false)
+			So(err, ShouldBeNil)
+			So(rowErrs[0], ShouldBeNil)
+			So(CouncilQuotaExceeded.Contains(rowErrs[1]), ShouldBeTrue)
+			So(rowErrs[1].Error(), ShouldContainSubstring, "Voyageur")
+			So(rowErrs[2], ShouldBeNil)
+			recs, err := prdb.GetAll()
+			So(err, ShouldBeNil)
+			So(len(recs), ShouldEqual, 3)
+			for _, rec := range recs {
+				So(rec.IsOnWaitingList, ShouldBeFalse)
+			}
+		})
+	})
+}
+
+func TestCouncilQuotaHandler(t *testing.T) {
+	Convey("With a council quota handler", t, func() {
+		db := boltorm.NewMemoryDB()
+		invDb, err := NewInvoiceDb(db)
+		So(err, ShouldBeNil)
+		config := &configType{}
+		config.Auth.AllowedEmails = stringSliceConfig{"admin@example.com"}
+		prdb, err := NewPreRegBoltDb(db, config, invDb)
+		So(err, ShouldBeNil)
+		store := sessions.NewCookieStore([]byte("A"))
+		router := mux.NewRouter()
+		authHandler := newTestAuthHandler(config, store)
+		NewCouncilQuotaHandler(router, prdb, authHandler)
+		newTestPreRegHandler(router, config, prdb, newTestFormSchemaDb(db), authHandler, nil)
+
+		loggedInCookie := loggedInAs(store, "admin@example.com")
+
+		body, err := json.Marshal(&CouncilQuotas{Quotas: []CouncilQuota{{"Voyageur", 5, 2}}})
+		So(err, ShouldBeNil)
+
+		Convey("Changing the quotas should require an administrator", func() {
+			So(testRequest(router, "PUT", "/quotas", body, nil).Code, ShouldEqual, http.StatusForbidden)
+			So(testRequest(router, "GET", "/quotas", nil, nil).Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("Invalid quotas should be refused", func() {
+			So(testRequest(router, "PUT", "/quotas", []byte(`{"quotas": [{"council": "", "youth": -1}]}`), loggedInCookie).Code, ShouldEqual, http.StatusUnprocessableEntity)
+		})
+		Convey("Setting the quotas", func() {
+			So(testRequest(router, "PUT", "/quotas", body, loggedInCookie).Code, ShouldEqual, http.StatusOK)
+			Convey("Should store them", func() {
+				w := testRequest(router, "GET", "/quotas", nil, loggedInCookie)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				quotas := &CouncilQuotas{}
+				So(json.Unmarshal(w.Body.Bytes(), quotas), ShouldBeNil)
+				So(quotas.Quotas, ShouldResemble, []CouncilQuota{{"Voyageur", 5, 2}})
+				So(quotas.UpdatedBy, ShouldEqual, "admin@example.com")
+			})
+			Convey("Should give the council its own waiting list", func() {
+				for _, pack := range []struct{ name, council string }{{"A", "Voyageur"}, {"B", "Voyageur"}, {"C", "Battle River"}, {"D", "voyageur"}} {
+					rec := &GroupPreRegistration{GroupName: "Group", PackName: pack.name, Council: pack.council, ContactLeaderEmail: pack.name + "@example.com", EstimatedYouth: 4}
+					So(prdb.CreateRecord(rec), ShouldBeNil)
+				}
+				config.General.EnableWaitingList = true
+				So(prdb.CreateRecord(&GroupPreRegistration{GroupName: "Group", PackName: "E", Council: "Voyageur", ContactLeaderEmail: "e@example.com"}), ShouldBeNil)
+
+				w := testRequest(router, "GET", "/preregistration?select=waiting&council=VOYAGEUR", nil, loggedInCookie)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				recs := []*GroupPreRegistrationInWaitingList{}
+				So(json.Unmarshal(w.Body.Bytes(), &recs), ShouldBeNil)
+				So(len(recs), ShouldEqual, 2)
+				So(recs[0].PackName, ShouldEqual, "B")
+				So(recs[0].WaitingListPos, ShouldEqual, 1)
+				So(recs[1].PackName, ShouldEqual, "D")
+				So(recs[1].WaitingListPos, ShouldEqual, 2)
+
+				w = testRequest(router, "GET", "/preregistration?select=waiting", nil, loggedInCookie)
+				So(json.Unmarshal(w.Body.Bytes(), &recs), ShouldBeNil)
+				So(len(recs), ShouldEqual, 3)
+			})
+		})
+	})
+}
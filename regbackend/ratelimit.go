@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Largest body read to find the email address a request is for.  Public
+// requests are far smaller.
+const maxRateLimitedBody = 1 << 20
+
+// Token buckets, one per key, each holding up to capacity requests and
+// refilling completely over the window.
+type rateLimiter struct {
+	capacity float64
+	window   time.Duration
+
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Returns nil, which allows everything, if requests is not positive.
+func newRateLimiter(requests int, window time.Duration) *rateLimiter {
+	if requests <= 0 || window <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		capacity: float64(requests),
+		window:   window,
+		buckets:  make(map[string]*tokenBucket),
+	}
+}
+
+// Takes a token for the key, returning how long until one is available if
+// there are none left.
+func (l *rateLimiter) take(key string, now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// Buckets untouched for a whole window are full again, so are the same
+	// as having none.
+	if now.Sub(l.lastSweep) > l.window {
+		for k, b := range l.buckets {
+			if now.Sub(b.updated) > l.window {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	perSecond := l.capacity / l.window.Seconds()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.capacity, updated: now}
+		l.buckets[key] = b
+	} else if now.After(b.updated) {
+		b.tokens = math.Min(l.capacity, b.tokens+now.Sub(b.updated).Seconds()*perSecond)
+		b.updated = now
+	}
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+// Parses addresses and CIDR ranges, as given for trusted proxies.
+func parseNetworks(addresses []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, address := range addresses {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		if !strings.Contains(address, "/") {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				return nil, SetupErrors.New("%s is not an address or range", address)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, SetupErrors.New("%s is not an address or range", address)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func inNetworks(networks []*net.IPNet, address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces the address of requests from trusted proxies with the client's,
+// from X-Forwarded-For, so everything after sees where requests came from.
+type forwardedForHandler struct {
+	trusted []*net.IPNet
+	h       http.Handler
+}
+
+func (h *forwardedForHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if client := forwardedClient(r, h.trusted); client != "" {
+		r.RemoteAddr = net.JoinHostPort(client, "0")
+	}
+	h.h.ServeHTTP(w, r)
+}
+
+// Returns the nearest address in X-Forwarded-For that isn't one of the
+// trusted proxies, if the request came through one.  Anything further along
+// could have been made up by the client.
+func forwardedClient(r *http.Request, trusted []*net.IPNet) string {
+	if len(trusted) == 0 || !inNetworks(trusted, requestIP(r)) {
+		return ""
+	}
+	var hops []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			return ""
+		} else if !inNetworks(trusted, hop) {
+			return hop
+		}
+	}
+	return ""
+}
+
+// Throttles the endpoints anyone can reach without logging in, by client
+// address and, for those that send email, by the address they send to.
+type rateLimitHandler struct {
+	byIP    *rateLimiter
+	byEmail *rateLimiter
+	h       http.Handler
+}
+
+func newRateLimitHandler(config *configType, h http.Handler) *rateLimitHandler {
+	return &rateLimitHandler{
+		byIP:    newRateLimiter(config.RateLimit.IPRequests, config.RateLimit.Window),
+		byEmail: newRateLimiter(config.RateLimit.EmailRequests, config.RateLimit.Window),
+		h:       h,
+	}
+}
+
+// Whether the request is to a public endpoint, and if it names an email
+// address in its body.
+func rateLimited(r *http.Request) (limited, hasEmail bool) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case r.Method == "POST" && path == "/api/preregistration":
+		return true, true
+	case r.Method == "PUT" && path == "/api/confirmpreregistration":
+		return true, true
+	case r.Method == "POST" && (path == "/api/confirmpreregistration/resend" || path == "/api/preregistration/recover"):
+		return true, true
+	case r.Method == "POST" && path == cspReportPath:
+		return true, false
+	case strings.HasPrefix(path, "/api/preregistration/"):
+		// Everything under a security key shows whether it is valid, only
+		// the admin routes beside them are left alone.
+		key := strings.SplitN(path[len("/api/preregistration/"):], "/", 2)[0]
+		return key != "export" && key != "import", false
+	}
+	return false, false
+}
+
+// Reads the email address the request is for, leaving the body to be read
+// again.
+func requestEmail(w http.ResponseWriter, r *http.Request) (string, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRateLimitedBody))
+	r.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	input := struct {
+		Email              string `json:"email"`
+		ContactLeaderEmail string `json:"contactLeaderEmail"`
+	}{}
+	// Malformed bodies are left for the handler to refuse.
+	json.Unmarshal(body, &input)
+	if input.ContactLeaderEmail != "" {
+		return normalizeEmail(input.ContactLeaderEmail), nil
+	}
+	return normalizeEmail(input.Email), nil
+}
+
+func (h *rateLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	limited, hasEmail := rateLimited(r)
+	if !limited {
+		h.h.ServeHTTP(w, r)
+		return
+	}
+
+	now := time.Now()
+	wait := h.byIP.take(requestIP(r), now)
+	if wait == 0 && hasEmail && h.byEmail != nil {
+		email, err := requestEmail(w, r)
+		if err != nil {
+			http.Error(w, "Failed to read request", http.StatusBadRequest)
+			return
+		}
+		if email != "" {
+			wait = h.byEmail.take(email, now)
+		}
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too many requests, please try again later", http.StatusTooManyRequests)
+		return
+	}
+	h.h.ServeHTTP(w, r)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestRateLimiter(t *testing.T) {
+	Convey("With a limit of 2 requests a minute", t, func() {
+		limiter := newRateLimiter(2, time.Minute)
+		now := time.Date(2016, 7, 1, 9, 0, 0, 0, time.UTC)
+
+		Convey("The first two should be allowed", func() {
+			So(limiter.take("a", now), ShouldEqual, 0)
+			So(limiter.take("a", now), ShouldEqual, 0)
+
+			Convey("But not a third, until half a minute has passed", func() {
+				So(limiter.take("a", now), ShouldEqual, 30*time.Second)
+				So(limiter.take("a", now.Add(29*time.Second)), ShouldBeGreaterThan, 0)
+				So(limiter.take("a", now.Add(30*time.Second)), ShouldEqual, 0)
+			})
+			Convey("While other keys have their own", func() {
+				So(limiter.take("b", now), ShouldEqual, 0)
+			})
+			Convey("And idle buckets should be cleared out", func() {
+				limiter.take("b", now.Add(2*time.Minute))
+				So(len(limiter.buckets), ShouldEqual, 1)
+			})
+		})
+	})
+	Convey("Without a limit everything should be allowed", t, func() {
+		var limiter *rateLimiter = newRateLimiter(0, time.Minute)
+		So(limiter, ShouldBeNil)
+		So(limiter.take("a", time.Now()), ShouldEqual, 0)
+	})
+}
+
+func TestForwardedClient(t *testing.T) {
+	Convey("With a trusted proxy", t, func() {
+		trusted, err := parseNetworks([]string{"10.0.0.0/8", "192.168.1.1"})
+		So(err, ShouldBeNil)
+		client := func(remoteAddr string, forwardedFor ...string) string {
+			r, err := http.NewRequest("GET", "http://localhost/", nil)
+			So(err, ShouldBeNil)
+			r.RemoteAddr = remoteAddr
+			r.Header["X-Forwarded-For"] = forwardedFor
+			return forwardedClient(r, trusted)
+		}
+
+		Convey("Requests through it should come from the nearest untrusted address", func() {
+			So(client("192.168.1.1:4000", "203.0.113.9"), ShouldEqual, "203.0.113.9")
+			So(client("10.0.0.1:4000", "198.51.100.1, 203.0.113.9, 10.0.0.2"), ShouldEqual, "203.0.113.9")
+			So(client("10.0.0.1:4000", "198.51.100.1", "203.0.113.9"), ShouldEqual, "203.0.113.9")
+		})
+		Convey("Requests from anywhere else should keep their own address", func() {
+			So(client("203.0.113.9:4000", "198.51.100.1"), ShouldEqual, "")
+			So(client("10.0.0.1:4000", "nonsense"), ShouldEqual, "")
+		})
+	})
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	Convey("With public endpoints limited", t, func() {
+		config := &configType{}
+		config.RateLimit.IPRequests = 3
+		config.RateLimit.EmailRequests = 1
+		config.RateLimit.Window = time.Hour
+		var bodies []string
+		h := newRateLimitHandler(config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(body))
+		}))
+		request := func(method, path, ip, body string) *httptest.ResponseRecorder {
+			r, err := http.NewRequest(method, "http://localhost"+path, bytes.NewReader([]byte(body)))
+			So(err, ShouldBeNil)
+			r.RemoteAddr = ip + ":4000"
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			return w
+		}
+
+		Convey("Each address should only get its share", func() {
+			for i := 0; i < 3; i++ {
+				So(request("GET", "/api/preregistration/key", "203.0.113.9", "").Code, ShouldEqual, http.StatusOK)
+			}
+			w := request("GET", "/api/preregistration/key", "203.0.113.9", "")
+			So(w.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(w.Header().Get("Retry-After"), ShouldEqual, "1200")
+			So(request("GET", "/api/preregistration/key", "203.0.113.10", "").Code, ShouldEqual, http.StatusOK)
+		})
+		Convey("Each email address should only get its share, from anywhere", func() {
+			body := `{"contactLeaderEmail": "leader@example.com"}`
+			So(request("POST", "/api/preregistration", "203.0.113.9", body).Code, ShouldEqual, http.StatusOK)
+			So(bodies, ShouldResemble, []string{body})
+			So(request("POST", "/api/confirmpreregistration/resend", "203.0.113.10", `{"email": " Leader@example.com"}`).Code, ShouldEqual, http.StatusTooManyRequests)
+			So(request("PUT", "/api/confirmpreregistration", "203.0.113.10", `{"email": "other@example.com"}`).Code, ShouldEqual, http.StatusOK)
+		})
+		Convey("Violation reports should be limited by address", func() {
+			for i := 0; i < 3; i++ {
+				So(request("POST", cspReportPath, "203.0.113.9", "{}").Code, ShouldEqual, http.StatusOK)
+			}
+			So(request("POST", cspReportPath, "203.0.113.9", "{}").Code, ShouldEqual, http.StatusTooManyRequests)
+		})
+		Convey("Everything under a security key should share the address's share", func() {
+			So(request("GET", "/api/preregistration/key/invoice", "203.0.113.9", "").Code, ShouldEqual, http.StatusOK)
+			So(request("GET", "/api/preregistration/key/participants", "203.0.113.9", "").Code, ShouldEqual, http.StatusOK)
+			So(request("GET", "/api/preregistration/key/documents/1", "203.0.113.9", "").Code, ShouldEqual, http.StatusOK)
+			So(request("POST", "/api/preregistration/key/rotate", "203.0.113.9", "").Code, ShouldEqual, http.StatusTooManyRequests)
+		})
+		Convey("Other endpoints should not be limited", func() {
+			for i := 0; i < 5; i++ {
+				So(request("GET", "/api/preregistration/export", "203.0.113.9", "").Code, ShouldEqual, http.StatusOK)
+				So(request("POST", "/api/preregistration/import", "203.0.113.9", "").Code, ShouldEqual, http.StatusOK)
+				So(request("GET", "/api/config", "203.0.113.9", "").Code, ShouldEqual, http.StatusOK)
+			}
+		})
+	})
+}
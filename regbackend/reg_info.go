@@ -2,16 +2,16 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
-	"strings"
 
 	"encoding/binary"
 	"encoding/json"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/mux"
 
@@ -37,6 +37,11 @@ type Address struct {
 }
 
 type GroupPreRegistration struct {
+	// Where the record is stored, which never changes.  Records from before
+	// security keys could be rotated use their original security key.
+	RecordKey string `json:"-"`
+	// What the group's leader reaches the record with, which they can rotate
+	// if the link to it got out.
 	SecurityKey string `json:"securityKey"`
 
 	PackName  string `json:"packName"`
@@ -51,6 +56,10 @@ type GroupPreRegistration struct {
 	ContactLeaderEmail string    `json:"contactLeaderEmail"`
 	ValidatedOn        time.Time `json:"validatedOn"`
 	ValidationToken    string    `json:"-"`
+	// Records from before tokens expired have none, so need a new token.
+	ValidationTokenExpires time.Time `json:"-"`
+	// Wrong tokens given since the current one was issued.
+	VerificationFailures int `json:"-"`
 
 	EmailApprovalGivenAt time.Time `json:"emailApprovalGivenAt"`
 
@@ -59,10 +68,20 @@ type GroupPreRegistration struct {
 	EmailConfirmationSendErrors      int       `json:"-"`
 	EmailConfirmationSendAttempts    int       `json:"-"`
 
+	// When a link to the record was last emailed to the leader for them to
+	// get back into it.
+	RecoveryLastSent time.Time `json:"-"`
+
 	EstimatedYouth   int `json:"estimatedYouth"`
 	EstimatedLeaders int `json:"estimatedLeaders"`
 
+	// Answers to the questions in the FormSchema, by field name.
+	CustomFields map[string]string `json:"customFields"`
+
 	IsOnWaitingList bool `json:"isOnWaitingList"`
+	// Set for groups waiting because their council's quota was used up,
+	// rather than because of the registration phase.
+	OnCouncilWaitingList bool `json:"onCouncilWaitingList"`
 
 	InvoiceID uint64 `json:"invoiceId"`
 }
@@ -73,7 +92,7 @@ type GroupPreRegistrationInWaitingList struct {
 }
 
 func (gpr GroupPreRegistration) Key() []byte {
-	key, err := base64.URLEncoding.DecodeString(gpr.SecurityKey)
+	key, err := base64.URLEncoding.DecodeString(gpr.RecordKey)
 	if err != nil {
 		panic("Invalid key")
 	}
@@ -83,8 +102,9 @@ func (gpr GroupPreRegistration) Key() []byte {
 	return key
 }
 
+// Identifies the pack by name, so the same pack can't register twice.
 func (gpr GroupPreRegistration) OrganicKey() string {
-	return fmt.Sprintf("%s-%s-%s", strings.TrimSpace(gpr.Council), strings.TrimSpace(gpr.GroupName), strings.TrimSpace(gpr.PackName))
+	return fmt.Sprintf("%s-%s-%s", normalizeName(gpr.Council), normalizeName(gpr.GroupName), normalizeName(gpr.PackName))
 }
 
 func (gpr *GroupPreRegistration) PrepareForInsert() error {
@@ -94,45 +114,84 @@ func (gpr *GroupPreRegistration) PrepareForInsert() error {
 	if !gpr.ValidatedOn.Equal(time.Time{}) {
 		return RecordAlreadyPrepared.New("Email validation already given")
 	}
-	{
-		var random [keyLength]byte
-		if _, err := rand.Read(random[:]); err != nil {
-			return err
-		}
-		gpr.SecurityKey = base64.URLEncoding.EncodeToString(random[:])
+	var err error
+	if gpr.RecordKey, err = newRandomKey(); err != nil {
+		return err
 	}
-	{
-		var random [keyLength]byte
-		if _, err := rand.Read(random[:]); err != nil {
-			return err
-		}
-		gpr.ValidationToken = base64.URLEncoding.EncodeToString(random[:])
+	if gpr.SecurityKey, err = newRandomKey(); err != nil {
+		return err
 	}
+	return gpr.newValidationToken(time.Now())
+}
 
+// Replaces the email verification token, so only the new one works.
+func (gpr *GroupPreRegistration) newValidationToken(now time.Time) (err error) {
+	if gpr.ValidationToken, err = newRandomKey(); err != nil {
+		return err
+	}
+	// Without the monotonic clock reading, which isn't stored.
+	gpr.ValidationTokenExpires = now.Add(validationTokenLifetime).Round(0)
+	gpr.VerificationFailures = 0
 	return nil
 }
 
+func newRandomKey() (string, error) {
+	var random [keyLength]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(random[:]), nil
+}
+
 type PreRegDb interface {
 	CreateRecord(rec *GroupPreRegistration) error
+	ImportRecords(recs []*GroupPreRegistration, dryRun bool) (rowErrs []error, err error)
 	GetRecord(securityKey string) (rec *GroupPreRegistration, err error)
 	GetAll() (recs []*GroupPreRegistration, err error)
 	GetWaitingList() (recs []*GroupPreRegistrationInWaitingList, err error)
+	// Returns every record, the waiting list, and the records' invoices by
+	// ID, all as of the same moment.
+	GetAllWithInvoices() (recs []*GroupPreRegistration, waitingList []*GroupPreRegistrationInWaitingList, invoices map[uint64]*Invoice, err error)
 
 	NoteConfirmationEmailSent(rec *GroupPreRegistration) error
-	VerifyEmail(email, token string) error
+	VerifyEmail(email, token string, now time.Time) error
+	// Returns the record registered with the email address with a new
+	// verification token to send, noting that it was.  Returns nil if there is
+	// no such record, it is already verified, or a token was sent too recently.
+	NewValidationToken(email string, now time.Time) (rec *GroupPreRegistration, err error)
 	CreateInvoiceIfNotExists(rec *GroupPreRegistration) (inv *Invoice, err error)
+	GetInvoice(invoiceID uint64) (inv *Invoice, err error)
+	// Records a payment towards the record's invoice, returning the invoice
+	// with it.
+	RecordPayment(securityKey string, payment *Payment) (inv *Invoice, err error)
 	Promote(securityKey string) error
+	// Gives the record a new security key, so the old one stops working.
+	RotateSecurityKey(securityKey string) (rec *GroupPreRegistration, err error)
+	// Returns the record registered with the email address if a link to it
+	// can be sent, noting that it was.  Returns nil if there is no such
+	// record, or a link was sent too recently.
+	NoteRecoveryRequest(email string, now time.Time) (rec *GroupPreRegistration, err error)
+
+	CurrentPhase(now time.Time) (phase string, changesAt time.Time, err error)
+	GetSchedule() (*RegistrationSchedule, error)
+	SetSchedule(schedule *RegistrationSchedule) error
+
+	GetCouncilQuotas() (*CouncilQuotas, error)
+	SetCouncilQuotas(quotas *CouncilQuotas) error
 }
 
 var (
-	DBError                = errors.NewClass("Database Error")
-	DBGenericError         = DBError.NewClass("Database Error", errhttp.OverrideErrorBody("Please retry or contact site administrator"))
-	RecordAlreadyPrepared  = DBError.NewClass("Group preregistration is already prepared")
-	RecordDoesNotExist     = DBError.NewClass("Record does not exist")
-	GroupAlreadyCreated    = DBError.NewClass("Group already registered", errhttp.SetStatusCode(400))
-	BadVerificationToken   = DBError.NewClass("Bad email verification token")
-	NoInvoiceOnWaitingList = DBError.NewClass("No payments are collected on the waiting list", errhttp.SetStatusCode(400))
-	NotOnWaitingList       = DBError.NewClass("Record is already not on the waiting list", errhttp.SetStatusCode(400))
+	DBError               = errors.NewClass("Database Error")
+	DBGenericError        = DBError.NewClass("Database Error", errhttp.OverrideErrorBody("Please retry or contact site administrator"))
+	RecordAlreadyPrepared = DBError.NewClass("Group preregistration is already prepared")
+	RecordDoesNotExist    = DBError.NewClass("Record does not exist")
+	GroupAlreadyCreated   = DBError.NewClass("Group already registered", errhttp.SetStatusCode(400))
+	BadVerificationToken  = DBError.NewClass("Bad email verification token")
+	// The leader needs a new token sent to verify their email address.
+	VerificationTokenExpired = BadVerificationToken.NewClass("Email verification token expired", errhttp.SetStatusCode(410), errhttp.OverrideErrorBody("This verification link has expired, please ask for a new one"))
+	NoInvoiceOnWaitingList   = DBError.NewClass("No payments are collected on the waiting list", errhttp.SetStatusCode(400))
+	NotOnWaitingList         = DBError.NewClass("Record is already not on the waiting list", errhttp.SetStatusCode(400))
+	NoInvoiceToPay           = DBError.NewClass("No invoice has been issued to pay", errhttp.SetStatusCode(400))
 )
 
 var (
@@ -140,6 +199,18 @@ var (
 	BOLT_GROUPNAMEMAPBUCKET      = []byte("BUCKET_GROUPNAMEMAP")
 	BOLT_GROUPEMAILMAPBUCKET     = []byte("BUCKET_GROUPEMAILMAP")
 	BOLT_GROUPEWAITINGLISTBUCKET = []byte("BUCKET_GROUPEWAITINGLIST")
+	BOLT_GROUPSECURITYKEYBUCKET  = []byte("BUCKET_GROUPSECURITYKEY")
+)
+
+// Leaders can only have a link to their record, or a new verification
+// token, emailed this often.
+const recoveryInterval = 5 * time.Minute
+
+// How long leaders have to verify their email address, and how many wrong
+// tokens they can give before they need a new one.
+const (
+	validationTokenLifetime = 7 * 24 * time.Hour
+	maxVerificationFailures = 5
 )
 
 type preRegDbBolt struct {
@@ -164,52 +235,151 @@ func (d *preRegDbBolt) CreateRecord(in *GroupPreRegistration) error {
 	if err := in.PrepareForInsert(); err != nil {
 		return err
 	}
-	in.IsOnWaitingList = d.config.General.EnableWaitingList
 
 	err := d.db.Update(func(tx boltorm.Tx) error {
-		key := in.Key()
-		if err := tx.Insert(BOLT_GROUPBUCKET, key, in); err != nil {
+		directory, err := getDirectory(tx)
+		if err != nil {
 			return err
-		} else if err := tx.AddIndex(BOLT_GROUPNAMEMAPBUCKET, []byte(in.OrganicKey()), key); err != nil {
-			if boltorm.ErrKeyAlreadyExists.Contains(err) {
-				return GroupAlreadyCreated.New("Group %s of %s, with pack name %s already exists", in.GroupName, in.Council, in.PackName)
-			} else {
-				return err
-			}
-		} else if err := tx.AddIndex(BOLT_GROUPEMAILMAPBUCKET, []byte(in.ContactLeaderEmail), key); err != nil {
-			if boltorm.ErrKeyAlreadyExists.Contains(err) {
-				return GroupAlreadyCreated.New("A previous group already registered with contact email address %s", in.ContactLeaderEmail)
-			} else {
+		}
+		directory.canonicalize(in)
+		if in.IsOnWaitingList, err = d.newRecordOnWaitingList(tx, true); err != nil {
+			return err
+		}
+		if !in.IsOnWaitingList {
+			if in.OnCouncilWaitingList, err = d.overCouncilQuota(tx, in); err != nil {
 				return err
 			}
+			in.IsOnWaitingList = in.OnCouncilWaitingList
+		}
+		return d.createRecord(tx, in)
+	})
+	if boltorm.ErrKeyAlreadyExists.Contains(err) {
+		return GroupAlreadyCreated.New("Could not insert preregistration")
+	} else {
+		return err
+	}
+}
+
+func (d *preRegDbBolt) createRecord(tx boltorm.Tx, in *GroupPreRegistration) error {
+	key := in.Key()
+	if err := tx.Insert(BOLT_GROUPBUCKET, key, in); err != nil {
+		return err
+	} else if err := tx.AddIndex(BOLT_GROUPSECURITYKEYBUCKET, []byte(in.SecurityKey), key); err != nil {
+		return err
+	} else if err := tx.AddIndex(BOLT_GROUPNAMEMAPBUCKET, []byte(in.OrganicKey()), key); err != nil {
+		if boltorm.ErrKeyAlreadyExists.Contains(err) {
+			return GroupAlreadyCreated.New("Group %s of %s, with pack name %s already exists", in.GroupName, in.Council, in.PackName)
+		} else {
+			return err
+		}
+	} else if err := tx.AddIndex(BOLT_GROUPEMAILMAPBUCKET, []byte(normalizeEmail(in.ContactLeaderEmail)), key); err != nil {
+		if boltorm.ErrKeyAlreadyExists.Contains(err) {
+			return GroupAlreadyCreated.New("A previous group already registered with contact email address %s", in.ContactLeaderEmail)
+		} else {
+			return err
+		}
+	}
+
+	if in.IsOnWaitingList {
+		waitingListPos, err := tx.NextSequenceForBucket(BOLT_INVOICEBUCKET)
+		if err != nil {
+			return err
+		}
+		var waitingListPosBytes [8]byte
+		binary.BigEndian.PutUint64(waitingListPosBytes[:], waitingListPos)
+		if err := tx.AddIndex(BOLT_GROUPEWAITINGLISTBUCKET, waitingListPosBytes[:], key); err != nil {
+			return err
 		}
+	}
+
+	return nil
+}
 
-		if in.IsOnWaitingList {
-			waitingListPos, err := tx.NextSequenceForBucket(BOLT_INVOICEBUCKET)
+// Checks a record against the existing ones without touching anything, so
+// that a colliding record doesn't leave a partial insert behind in a shared
+// transaction.
+func (d *preRegDbBolt) checkNotRegistered(tx boltorm.Tx, in *GroupPreRegistration) error {
+	existing := &GroupPreRegistration{}
+	if err := tx.GetByIndex(BOLT_GROUPNAMEMAPBUCKET, BOLT_GROUPBUCKET, []byte(in.OrganicKey()), existing); err == nil {
+		return GroupAlreadyCreated.New("Group %s of %s, with pack name %s already exists", in.GroupName, in.Council, in.PackName)
+	} else if !boltorm.ErrKeyDoesNotExist.Contains(err) {
+		return err
+	}
+	if err := tx.GetByIndex(BOLT_GROUPEMAILMAPBUCKET, BOLT_GROUPBUCKET, []byte(normalizeEmail(in.ContactLeaderEmail)), existing); err == nil {
+		return GroupAlreadyCreated.New("A previous group already registered with contact email address %s", in.ContactLeaderEmail)
+	} else if !boltorm.ErrKeyDoesNotExist.Contains(err) {
+		return err
+	}
+	return nil
+}
+
+var errImportDryRun = errors.NewClass("Import dry run")
+
+// Creates every record that doesn't collide with an existing one (or an
+// earlier one in recs) in a single transaction.  The returned errors line up
+// with recs, and are nil for the records that were created.  A dry run
+// reports the same errors, but rolls everything back.
+func (d *preRegDbBolt) ImportRecords(recs []*GroupPreRegistration, dryRun bool) (rowErrs []error, err error) {
+	err = d.db.Update(func(tx boltorm.Tx) error {
+		directory, err := getDirectory(tx)
+		if err != nil {
+			return err
+		}
+		rowErrs = make([]error, len(recs))
+		for i, in := range recs {
+			if err := in.PrepareForInsert(); err != nil {
+				rowErrs[i] = err
+				continue
+			}
+			directory.canonicalize(in)
+			// Administrators may import outside of the registration windows.
+			onWaitingList, err := d.newRecordOnWaitingList(tx, false)
 			if err != nil {
 				return err
 			}
-			var waitingListPosBytes [8]byte
-			binary.BigEndian.PutUint64(waitingListPosBytes[:], waitingListPos)
-			if err := tx.AddIndex(BOLT_GROUPEWAITINGLISTBUCKET, waitingListPosBytes[:], key); err != nil {
+			in.IsOnWaitingList = onWaitingList
+			if err := d.checkNotRegistered(tx, in); err != nil {
+				if !GroupAlreadyCreated.Contains(err) {
+					return err
+				}
+				rowErrs[i] = err
+				continue
+			}
+			if !onWaitingList {
+				over, err := d.overCouncilQuota(tx, in)
+				if err != nil {
+					return err
+				} else if over {
+					rowErrs[i] = CouncilQuotaExceeded.New("%s has no room left for %d youth and %d leaders", in.Council, in.EstimatedYouth, in.EstimatedLeaders)
+					continue
+				}
+			}
+			if err := d.createRecord(tx, in); err != nil {
 				return err
 			}
 		}
-
+		if dryRun {
+			return errImportDryRun.New("Rolling back")
+		}
 		return nil
 	})
-	if boltorm.ErrKeyAlreadyExists.Contains(err) {
-		return GroupAlreadyCreated.New("Could not insert preregistration")
-	} else {
-		return err
+	if errImportDryRun.Contains(err) {
+		err = nil
+	}
+	if err != nil {
+		rowErrs = nil
 	}
+	return rowErrs, err
 }
 
 func (d *preRegDbBolt) getRecord(tx boltorm.Tx, securityKey string) (rec *GroupPreRegistration, err error) {
+	return getPreRegRecord(tx, securityKey)
+}
+
+// Fetches a preregistration inside another transaction, for the databases layered on top of it.
+func getPreRegRecord(tx boltorm.Tx, securityKey string) (rec *GroupPreRegistration, err error) {
 	rec = &GroupPreRegistration{}
-	if key, err := base64.URLEncoding.DecodeString(securityKey); err != nil {
-		return nil, err
-	} else if err = tx.Get(BOLT_GROUPBUCKET, key, rec); err != nil {
+	if err = tx.GetByIndex(BOLT_GROUPSECURITYKEYBUCKET, BOLT_GROUPBUCKET, []byte(securityKey), rec); err != nil {
 		if boltorm.ErrKeyDoesNotExist.Contains(err) {
 			return nil, RecordDoesNotExist.New("Could not find preregistration")
 		} else {
@@ -226,28 +396,57 @@ func (d *preRegDbBolt) GetRecord(securityKey string) (rec *GroupPreRegistration,
 	})
 }
 
+func (d *preRegDbBolt) getAll(tx boltorm.Tx) ([]*GroupPreRegistration, error) {
+	res, err := tx.GetAll(BOLT_GROUPBUCKET, &GroupPreRegistration{})
+	if err != nil {
+		return nil, err
+	}
+	return res.([]*GroupPreRegistration), nil
+}
+
 func (d *preRegDbBolt) GetAll() (recs []*GroupPreRegistration, err error) {
 	return recs, d.db.View(func(tx boltorm.Tx) error {
-		if res, err := tx.GetAll(BOLT_GROUPBUCKET, &GroupPreRegistration{}); err != nil {
-			return err
-		} else {
-			recs = res.([]*GroupPreRegistration)
-		}
-		return nil
+		recs, err = d.getAll(tx)
+		return err
 	})
 }
 
+func (d *preRegDbBolt) getWaitingList(tx boltorm.Tx) (recs []*GroupPreRegistrationInWaitingList, err error) {
+	res, err := tx.GetAllByIndex(BOLT_GROUPEWAITINGLISTBUCKET, BOLT_GROUPBUCKET, &GroupPreRegistration{})
+	if err != nil {
+		return nil, err
+	}
+	for i, rec := range res.([]*GroupPreRegistration) {
+		recs = append(recs, &GroupPreRegistrationInWaitingList{
+			rec,
+			i + 1,
+		})
+	}
+	return recs, nil
+}
+
 func (d *preRegDbBolt) GetWaitingList() (recs []*GroupPreRegistrationInWaitingList, err error) {
 	return recs, d.db.View(func(tx boltorm.Tx) error {
-		if res, err := tx.GetAllByIndex(BOLT_GROUPEWAITINGLISTBUCKET, BOLT_GROUPBUCKET, &GroupPreRegistration{}); err != nil {
+		recs, err = d.getWaitingList(tx)
+		return err
+	})
+}
+
+func (d *preRegDbBolt) GetAllWithInvoices() (recs []*GroupPreRegistration, waitingList []*GroupPreRegistrationInWaitingList, invoices map[uint64]*Invoice, err error) {
+	invoices = make(map[uint64]*Invoice)
+	return recs, waitingList, invoices, d.db.View(func(tx boltorm.Tx) error {
+		if recs, err = d.getAll(tx); err != nil {
 			return err
-		} else {
-			rawRecs := res.([]*GroupPreRegistration)
-			for i, rec := range rawRecs {
-				recs = append(recs, &GroupPreRegistrationInWaitingList{
-					rec,
-					i + 1,
-				})
+		}
+		if waitingList, err = d.getWaitingList(tx); err != nil {
+			return err
+		}
+		for _, rec := range recs {
+			if rec.InvoiceID == 0 {
+				continue
+			}
+			if invoices[rec.InvoiceID], err = d.invDb.GetInvoice(rec.InvoiceID, tx); err != nil {
+				return err
 			}
 		}
 		return nil
@@ -256,8 +455,10 @@ func (d *preRegDbBolt) GetWaitingList() (recs []*GroupPreRegistrationInWaitingLi
 
 func (d *preRegDbBolt) NoteConfirmationEmailSent(gpr *GroupPreRegistration) error {
 	err := d.db.Update(func(tx boltorm.Tx) error {
-		rec := &GroupPreRegistration{}
-		if err := tx.Get(BOLT_GROUPBUCKET, gpr.Key(), rec); err != nil {
+		// Callers may only have the record as the leader sees it, without
+		// where it is stored.
+		rec, err := d.getRecord(tx, gpr.SecurityKey)
+		if err != nil {
 			return err
 		}
 
@@ -272,30 +473,75 @@ func (d *preRegDbBolt) NoteConfirmationEmailSent(gpr *GroupPreRegistration) erro
 	return err
 }
 
-func (d *preRegDbBolt) VerifyEmail(email, token string) error {
-	return d.db.Update(func(tx boltorm.Tx) error {
+func (d *preRegDbBolt) VerifyEmail(email, token string, now time.Time) error {
+	// Failed attempts have to be stored, so the transaction only fails on
+	// database errors.
+	var verifyErr error
+	err := d.db.Update(func(tx boltorm.Tx) error {
 		rec := &GroupPreRegistration{}
-		if err := tx.GetByIndex(BOLT_GROUPEMAILMAPBUCKET, BOLT_GROUPBUCKET, []byte(email), rec); err != nil {
-			return BadVerificationToken.New("Failed to verify token")
-		}
-
-		if token != rec.ValidationToken {
-			return BadVerificationToken.New("Failed to verify token")
+		if err := tx.GetByIndex(BOLT_GROUPEMAILMAPBUCKET, BOLT_GROUPBUCKET, []byte(normalizeEmail(email)), rec); err != nil {
+			verifyErr = BadVerificationToken.New("Failed to verify token")
+			return nil
 		}
 
+		matches := subtle.ConstantTimeCompare([]byte(token), []byte(rec.ValidationToken)) == 1
 		if !rec.ValidatedOn.Equal(time.Time{}) {
+			if !matches {
+				verifyErr = BadVerificationToken.New("Failed to verify token")
+			}
 			return nil // Early return, avoid creating extra records.
 		}
 
-		rec.ValidatedOn = time.Now()
+		if rec.VerificationFailures >= maxVerificationFailures {
+			verifyErr = VerificationTokenExpired.New("Too many failed attempts for %s", email)
+			return nil
+		} else if !matches {
+			rec.VerificationFailures++
+			if rec.VerificationFailures >= maxVerificationFailures {
+				verifyErr = VerificationTokenExpired.New("Too many failed attempts for %s", email)
+			} else {
+				verifyErr = BadVerificationToken.New("Failed to verify token")
+			}
+			return tx.Update(BOLT_GROUPBUCKET, rec.Key(), rec)
+		} else if !now.Before(rec.ValidationTokenExpires) {
+			verifyErr = VerificationTokenExpired.New("Token for %s expired", email)
+			return nil
+		}
+
+		rec.ValidatedOn = now
 		return tx.Update(BOLT_GROUPBUCKET, rec.Key(), rec)
 	})
+	if err != nil {
+		return err
+	}
+	return verifyErr
+}
+
+func (d *preRegDbBolt) NewValidationToken(email string, now time.Time) (rec *GroupPreRegistration, err error) {
+	return rec, d.db.Update(func(tx boltorm.Tx) error {
+		found := &GroupPreRegistration{}
+		if err := tx.GetByIndex(BOLT_GROUPEMAILMAPBUCKET, BOLT_GROUPBUCKET, []byte(normalizeEmail(email)), found); err != nil {
+			if boltorm.ErrKeyDoesNotExist.Contains(err) {
+				return nil
+			}
+			return err
+		}
+		if !found.ValidatedOn.Equal(time.Time{}) || now.Sub(found.EmailConfirmationLastSendRequest) < recoveryInterval {
+			return nil
+		}
+		if err := found.newValidationToken(now); err != nil {
+			return err
+		}
+		found.EmailConfirmationLastSendRequest = now
+		rec = found
+		return tx.Update(BOLT_GROUPBUCKET, found.Key(), found)
+	})
 }
 
 func (d *preRegDbBolt) CreateInvoiceIfNotExists(gpr *GroupPreRegistration) (inv *Invoice, err error) {
 	err = d.db.Update(func(tx boltorm.Tx) error {
-		rec := &GroupPreRegistration{}
-		if err := tx.Get(BOLT_GROUPBUCKET, gpr.Key(), rec); err != nil {
+		rec, err := d.getRecord(tx, gpr.SecurityKey)
+		if err != nil {
 			return err
 		}
 
@@ -319,7 +565,7 @@ func (d *preRegDbBolt) CreateInvoiceIfNotExists(gpr *GroupPreRegistration) (inv
 		}
 		inv = &Invoice{
 			To:        toLine,
-			LineItems: []InvoiceItem{{"Pre-registration deposit", 25000, 1}},
+			LineItems: []InvoiceItem{{"Pre-registration deposit", int64(d.config.current().General.DepositPrice), 1}},
 		}
 		if err := d.invDb.NewInvoice(inv, tx); err != nil {
 			return err
@@ -331,6 +577,27 @@ func (d *preRegDbBolt) CreateInvoiceIfNotExists(gpr *GroupPreRegistration) (inv
 	return inv, err
 }
 
+func (d *preRegDbBolt) GetInvoice(invoiceID uint64) (inv *Invoice, err error) {
+	return inv, d.db.View(func(tx boltorm.Tx) error {
+		inv, err = d.invDb.GetInvoice(invoiceID, tx)
+		return err
+	})
+}
+
+func (d *preRegDbBolt) RecordPayment(securityKey string, payment *Payment) (inv *Invoice, err error) {
+	return inv, d.db.Update(func(tx boltorm.Tx) error {
+		rec, err := d.getRecord(tx, securityKey)
+		if err != nil {
+			return err
+		}
+		if rec.InvoiceID == 0 {
+			return NoInvoiceToPay.New("No invoice has been issued to %s yet", rec.GroupName)
+		}
+		inv, err = d.invDb.AddPayment(rec.InvoiceID, payment, tx)
+		return err
+	})
+}
+
 func (d *preRegDbBolt) Promote(securityKey string) error {
 	return d.db.Update(func(tx boltorm.Tx) error {
 		rec, err := d.getRecord(tx, securityKey)
@@ -344,6 +611,7 @@ func (d *preRegDbBolt) Promote(securityKey string) error {
 
 		// Ok, this record is ready to move.  Change its flag and remove from the index.
 		rec.IsOnWaitingList = false
+		rec.OnCouncilWaitingList = false
 		if err := tx.RemoveKeyFromIndex(BOLT_GROUPEWAITINGLISTBUCKET, rec.Key()); err != nil {
 			return err
 		}
@@ -354,6 +622,60 @@ func (d *preRegDbBolt) Promote(securityKey string) error {
 	})
 }
 
+func (d *preRegDbBolt) RotateSecurityKey(securityKey string) (rec *GroupPreRegistration, err error) {
+	return rec, d.db.Update(func(tx boltorm.Tx) error {
+		if rec, err = d.getRecord(tx, securityKey); err != nil {
+			return err
+		}
+		if rec.SecurityKey, err = newRandomKey(); err != nil {
+			return err
+		}
+		if err := tx.RemoveKeyFromIndex(BOLT_GROUPSECURITYKEYBUCKET, rec.Key()); err != nil {
+			return err
+		}
+		if err := tx.AddIndex(BOLT_GROUPSECURITYKEYBUCKET, []byte(rec.SecurityKey), rec.Key()); err != nil {
+			return err
+		}
+		if err := tx.Update(BOLT_GROUPBUCKET, rec.Key(), rec); err != nil {
+			return err
+		}
+		// Reports match rosters to their group by security key.
+		roster, exists, err := getRoster(tx, rec)
+		if err != nil {
+			return err
+		} else if exists {
+			roster.SecurityKey = rec.SecurityKey
+			if err := tx.Update(BOLT_PARTICIPANTBUCKET, rec.Key(), roster); err != nil {
+				return err
+			}
+		}
+		folder, exists, err := getDocumentFolder(tx, rec)
+		if err != nil || !exists {
+			return err
+		}
+		folder.SecurityKey = rec.SecurityKey
+		return tx.Update(BOLT_DOCUMENTBUCKET, rec.Key(), folder)
+	})
+}
+
+func (d *preRegDbBolt) NoteRecoveryRequest(email string, now time.Time) (rec *GroupPreRegistration, err error) {
+	return rec, d.db.Update(func(tx boltorm.Tx) error {
+		found := &GroupPreRegistration{}
+		if err := tx.GetByIndex(BOLT_GROUPEMAILMAPBUCKET, BOLT_GROUPBUCKET, []byte(normalizeEmail(email)), found); err != nil {
+			if boltorm.ErrKeyDoesNotExist.Contains(err) {
+				return nil
+			}
+			return err
+		}
+		if now.Sub(found.RecoveryLastSent) < recoveryInterval {
+			return nil
+		}
+		found.RecoveryLastSent = now
+		rec = found
+		return tx.Update(BOLT_GROUPBUCKET, found.Key(), found)
+	})
+}
+
 func (d *preRegDbBolt) init() error {
 	return d.db.Update(func(tx boltorm.Tx) error {
 		if err := tx.CreateBucketIfNotExists(BOLT_GROUPBUCKET); err != nil {
@@ -368,19 +690,151 @@ func (d *preRegDbBolt) init() error {
 		if err := tx.CreateBucketIfNotExists(BOLT_GROUPEWAITINGLISTBUCKET); err != nil {
 			return err
 		}
+		if err := tx.CreateBucketIfNotExists(BOLT_GROUPSECURITYKEYBUCKET); err != nil {
+			return err
+		}
+		if err := tx.CreateBucketIfNotExists(BOLT_SCHEDULEBUCKET); err != nil {
+			return err
+		}
+		if err := tx.CreateBucketIfNotExists(BOLT_DIRECTORYBUCKET); err != nil {
+			return err
+		}
+		if err := tx.CreateBucketIfNotExists(BOLT_COUNCILQUOTABUCKET); err != nil {
+			return err
+		}
+		// Rosters count towards council quotas.
+		if err := tx.CreateBucketIfNotExists(BOLT_PARTICIPANTBUCKET); err != nil {
+			return err
+		}
+		// Document folders follow their group's security key.
+		if err := tx.CreateBucketIfNotExists(BOLT_DOCUMENTBUCKET); err != nil {
+			return err
+		}
+		for _, migrate := range groupMigrations {
+			if err := migrate(tx); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 }
 
+// Records from before security keys could be rotated were stored under their
+// security key.  They keep being stored there, and get indexed by it like
+// the newer ones.
+func indexSecurityKeys(tx boltorm.Tx) error {
+	res, err := tx.GetAll(BOLT_GROUPBUCKET, &GroupPreRegistration{})
+	if err != nil {
+		return err
+	}
+	for _, rec := range res.([]*GroupPreRegistration) {
+		if rec.RecordKey != "" {
+			continue
+		}
+		rec.RecordKey = rec.SecurityKey
+		if err := tx.AddIndex(BOLT_GROUPSECURITYKEYBUCKET, []byte(rec.SecurityKey), rec.Key()); err != nil {
+			return err
+		}
+		if err := tx.Update(BOLT_GROUPBUCKET, rec.Key(), rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Moves records indexed under an older form of their organic key, from
+// before names were normalized, to the current one.  Records that now
+// collide keep their old entry, the directory report lists them.
+func reindexGroupNames(tx boltorm.Tx) error {
+	res, err := tx.GetAll(BOLT_GROUPBUCKET, &GroupPreRegistration{})
+	if err != nil {
+		return err
+	}
+	for _, rec := range res.([]*GroupPreRegistration) {
+		existing := &GroupPreRegistration{}
+		if err := tx.GetByIndex(BOLT_GROUPNAMEMAPBUCKET, BOLT_GROUPBUCKET, []byte(rec.OrganicKey()), existing); err == nil {
+			continue
+		} else if !boltorm.ErrKeyDoesNotExist.Contains(err) {
+			return err
+		}
+		if err := tx.RemoveKeyFromIndex(BOLT_GROUPNAMEMAPBUCKET, rec.Key()); err != nil {
+			return err
+		}
+		if err := tx.AddIndex(BOLT_GROUPNAMEMAPBUCKET, []byte(rec.OrganicKey()), rec.Key()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tokens sent before they expired never would have, so give the groups
+// still to verify their email the usual time from now.
+func expireValidationTokens(tx boltorm.Tx) error {
+	res, err := tx.GetAll(BOLT_GROUPBUCKET, &GroupPreRegistration{})
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, rec := range res.([]*GroupPreRegistration) {
+		if !rec.ValidatedOn.IsZero() || !rec.ValidationTokenExpires.IsZero() {
+			continue
+		}
+		rec.ValidationTokenExpires = now.Add(validationTokenLifetime).Round(0)
+		if err := tx.Update(BOLT_GROUPBUCKET, rec.Key(), rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Moves records indexed under their email address as it was entered to its
+// normalized form, which lookups use.  Records that now collide keep their
+// old entry.
+func reindexGroupEmails(tx boltorm.Tx) error {
+	res, err := tx.GetAll(BOLT_GROUPBUCKET, &GroupPreRegistration{})
+	if err != nil {
+		return err
+	}
+	for _, rec := range res.([]*GroupPreRegistration) {
+		email := normalizeEmail(rec.ContactLeaderEmail)
+		if email == rec.ContactLeaderEmail {
+			continue
+		}
+		existing := &GroupPreRegistration{}
+		if err := tx.GetByIndex(BOLT_GROUPEMAILMAPBUCKET, BOLT_GROUPBUCKET, []byte(email), existing); err == nil {
+			continue
+		} else if !boltorm.ErrKeyDoesNotExist.Contains(err) {
+			return err
+		}
+		if err := tx.RemoveKeyFromIndex(BOLT_GROUPEMAILMAPBUCKET, rec.Key()); err != nil {
+			return err
+		}
+		if err := tx.AddIndex(BOLT_GROUPEMAILMAPBUCKET, []byte(email), rec.Key()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type PreRegHandler struct {
 	db                       PreRegDb
+	formSchemaDb             FormSchemaDb
 	config                   *configType
 	confirmationEmailService *ConfirmationEmailService
-	getHandler               *mux.Route
+	authHandler              *AuthenticationHandler
+	// Nil if registrations don't need to pass a challenge.
+	challenge  ChallengeVerifier
+	getHandler *mux.Route
 }
 
 func (h *PreRegHandler) Create(w http.ResponseWriter, r *http.Request) {
-	if !h.config.General.EnableGroupReg {
+	if phase, _, err := h.db.CurrentPhase(time.Now()); err != nil {
+		httpError(w, err)
+		return
+	} else if phase == PhaseNotYetOpen {
+		http.Error(w, "Group registrations are not open yet", http.StatusForbidden)
+		return
+	} else if phase == PhaseClosed {
 		http.Error(w, "Group registrations are closed", http.StatusForbidden)
 		return
 	}
@@ -392,6 +846,30 @@ func (h *PreRegHandler) Create(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid group json given", 400)
 		return
 	}
+	schema, err := h.formSchemaDb.GetFormSchema()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	verr := &ValidationError{}
+	if err := input.Validate(); err != nil {
+		verr = err.(*ValidationError)
+	}
+	input.CustomFields = schema.checkAnswers(verr, input.CustomFields)
+	if len(verr.Errors) != 0 {
+		writeValidationError(w, verr)
+		return
+	}
+	// Checked last, as answers can only be used once.
+	if h.challenge != nil {
+		if err := h.challenge.Verify(r.Header.Get("X-Challenge-Response"), requestIP(r), time.Now()); err != nil {
+			if !ChallengeFailed.Contains(err) {
+				log.Printf("Failed to check registration challenge!  Error: %s", err)
+			}
+			httpError(w, err)
+			return
+		}
+	}
 
 	if err := h.db.CreateRecord(&input); err != nil {
 		log.Printf("Failed to insert record!  Error: %s", err)
@@ -441,18 +919,24 @@ func (h *PreRegHandler) Get(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h *PreRegHandler) GetList(w http.ResponseWriter, r *http.Request) {
-	const (
-		allRegs        = "all"
-		registeredRegs = "registered"
-		waitingRegs    = "waiting"
-	)
+const (
+	allRegs        = "all"
+	registeredRegs = "registered"
+	waitingRegs    = "waiting"
+)
 
+// Returns which registrations a listing request selected with its select parameter.
+func registrationSelection(r *http.Request) string {
 	selectValue := r.URL.Query().Get("select")
 	// Only all/registered/waiting are valid selections, if that isn't passed assume all.
 	if selectValue != allRegs && selectValue != registeredRegs && selectValue != waitingRegs {
 		selectValue = allRegs
 	}
+	return selectValue
+}
+
+func (h *PreRegHandler) GetList(w http.ResponseWriter, r *http.Request) {
+	selectValue := registrationSelection(r)
 
 	var output interface{}
 	if selectValue == allRegs || selectValue == registeredRegs {
@@ -461,7 +945,7 @@ func (h *PreRegHandler) GetList(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Failed to get records", 500)
 			return
 		} else {
-			if selectValue == "all" {
+			if selectValue == allRegs {
 				output = recs
 			} else {
 				filteredRecs := []*GroupPreRegistration{}
@@ -478,6 +962,15 @@ func (h *PreRegHandler) GetList(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			http.Error(w, "Failed to get records", 500)
 			return
+		} else if council := r.URL.Query().Get("council"); council != "" {
+			// A council's own waiting list, numbered from its first group.
+			filteredRecs := []*GroupPreRegistrationInWaitingList{}
+			for _, rec := range recs {
+				if rec.OnCouncilWaitingList && normalizeName(rec.Council) == normalizeName(council) {
+					filteredRecs = append(filteredRecs, &GroupPreRegistrationInWaitingList{rec.GroupPreRegistration, len(filteredRecs) + 1})
+				}
+			}
+			output = filteredRecs
 		} else {
 			output = recs
 		}
@@ -493,21 +986,48 @@ func (h *PreRegHandler) GetList(w http.ResponseWriter, r *http.Request) {
 	io.Copy(w, buf)
 }
 
+// Verifies the email address and token in the body, kept out of the URL so
+// they don't end up in logs.  Expired tokens get their own status, so the
+// leader can be offered a new one.
 func (h *PreRegHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	email, ok := vars["email"]
-	if !ok {
-		http.Error(w, "No email given", 404)
+	input := struct {
+		Email string `json:"email"`
+		Token string `json:"token"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid verification json given", http.StatusBadRequest)
 		return
 	}
-	if tokenBytes, err := ioutil.ReadAll(r.Body); err != nil {
-		http.Error(w, "Failed to read token", http.StatusInternalServerError)
-	} else {
-		token := string(tokenBytes)
-		if err = h.db.VerifyEmail(email, token); err != nil {
-			http.Error(w, "Failed to verify token", http.StatusBadRequest)
+	if err := h.db.VerifyEmail(strings.TrimSpace(input.Email), input.Token, time.Now()); VerificationTokenExpired.Contains(err) {
+		httpError(w, err)
+	} else if err != nil {
+		http.Error(w, "Failed to verify token", http.StatusBadRequest)
+	}
+}
+
+// Sends the leader registered with the email address in the body a new
+// verification token.  Like recovery requests, the response doesn't say
+// whether anyone registered with it.
+func (h *PreRegHandler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	input := struct {
+		Email string `json:"email"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid verification json given", http.StatusBadRequest)
+		return
+	}
+	rec, err := h.db.NewValidationToken(strings.TrimSpace(input.Email), time.Now())
+	if err != nil {
+		log.Printf("Failed to create new verification token!  Error: %s", err)
+		httpError(w, err)
+		return
+	}
+	if rec != nil {
+		if err := h.confirmationEmailService.RequestEmailConfirmation(rec); err != nil {
+			log.Printf("Failed to resend email confirmation for key %s, error %s!", rec.SecurityKey, err)
 		}
 	}
+	w.WriteHeader(http.StatusAccepted)
 }
 
 func (h *PreRegHandler) GetInvoice(w http.ResponseWriter, r *http.Request) {
@@ -537,6 +1057,30 @@ func (h *PreRegHandler) GetInvoice(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (h *PreRegHandler) RecordPayment(w http.ResponseWriter, r *http.Request) {
+	payment := &Payment{}
+	if err := json.NewDecoder(r.Body).Decode(payment); err != nil {
+		http.Error(w, "Invalid payment json given", http.StatusBadRequest)
+		return
+	}
+	if err := payment.Validate(); err != nil {
+		writeValidationError(w, err.(*ValidationError))
+		return
+	}
+	payment.RecordedBy = h.authHandler.sessionUser(r)
+	payment.Recorded = time.Now()
+	inv, err := h.db.RecordPayment(mux.Vars(r)["SecurityKey"], payment)
+	if RecordDoesNotExist.Contains(err) {
+		http.Error(w, "No such record", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to record payment!  Error: %s", err)
+		httpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, inv)
+}
+
 func (h *PreRegHandler) PromoteToRegistration(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	securityKey, ok := vars["SecurityKey"]
@@ -551,19 +1095,82 @@ func (h *PreRegHandler) PromoteToRegistration(w http.ResponseWriter, r *http.Req
 	}
 }
 
-func NewGroupPreRegistrationHandler(r *mux.Router, config *configType, prdb PreRegDb, authHandler *AuthenticationHandler, confirmationEmailService *ConfirmationEmailService) *PreRegHandler {
+// Gives the record a new security key, for when the link to it got out.  The
+// old link stops working straight away.
+func (h *PreRegHandler) RotateSecurityKey(w http.ResponseWriter, r *http.Request) {
+	rec, err := h.db.RotateSecurityKey(mux.Vars(r)["SecurityKey"])
+	if RecordDoesNotExist.Contains(err) {
+		http.Error(w, "No such record", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to rotate security key!  Error: %s", err)
+		httpError(w, err)
+		return
+	}
+	url, err := h.getHandler.URLPath("SecurityKey", rec.SecurityKey)
+	if err != nil {
+		http.Error(w, "Failed to rotate security key", 500)
+		return
+	}
+	w.Header()["Location"] = []string{url.Path}
+	writeJSON(w, http.StatusOK, rec)
+}
+
+// Emails the leader registered with the address in the body a link to their
+// record.  The response is the same whether or not anyone registered with
+// it, so it can't be used to find out who did.
+func (h *PreRegHandler) RequestRecovery(w http.ResponseWriter, r *http.Request) {
+	input := struct {
+		Email string `json:"email"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid recovery json given", http.StatusBadRequest)
+		return
+	}
+	email := strings.TrimSpace(input.Email)
+	if !validEmailAddress(email) {
+		verr := &ValidationError{}
+		verr.add("email", "is not a valid email address")
+		writeValidationError(w, verr)
+		return
+	}
+	rec, err := h.db.NoteRecoveryRequest(email, time.Now())
+	if err != nil {
+		log.Printf("Failed to look up record for recovery!  Error: %s", err)
+		httpError(w, err)
+		return
+	}
+	if rec != nil {
+		if err := h.confirmationEmailService.SendRecoveryLink(rec); err != nil {
+			log.Printf("Failed to send recovery link for key %s, error %s!", rec.SecurityKey, err)
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func NewGroupPreRegistrationHandler(r *mux.Router, config *configType, prdb PreRegDb, formSchemaDb FormSchemaDb, authHandler *AuthenticationHandler, confirmationEmailService *ConfirmationEmailService, challenge ChallengeVerifier) *PreRegHandler {
 	preRegHandler := &PreRegHandler{
-		db:     prdb,
-		config: config,
+		db:           prdb,
+		formSchemaDb: formSchemaDb,
+		config:       config,
 		confirmationEmailService: confirmationEmailService,
+		authHandler:              authHandler,
+		challenge:                challenge,
 	}
 
 	r.HandleFunc("/preregistration", preRegHandler.Create).Methods("POST")
-	r.HandleFunc("/confirmpreregistration", preRegHandler.VerifyEmail).Queries("email", "{email:.*@.*}").Methods("PUT")
+	r.HandleFunc("/preregistration/recover", preRegHandler.RequestRecovery).Methods("POST")
+	r.HandleFunc("/confirmpreregistration", preRegHandler.VerifyEmail).Methods("PUT")
+	r.HandleFunc("/confirmpreregistration/resend", preRegHandler.ResendVerification).Methods("POST")
+	// Must come before the record route, as export is a valid security key.
+	r.HandleFunc("/preregistration/export", authHandler.RoleFunc(preRegHandler.Export, RoleRegistrar, RoleFinance)).Methods("GET")
+	r.HandleFunc("/preregistration/import", authHandler.RoleFunc(preRegHandler.Import, RoleRegistrar)).Methods("POST")
 	preRegHandler.getHandler = r.HandleFunc("/preregistration/{SecurityKey:[a-zA-Z0-9-_]+}", preRegHandler.Get).Methods("GET")
 	r.HandleFunc("/preregistration", authHandler.AdminFunc(preRegHandler.GetList)).Methods("Get")
 	r.HandleFunc("/preregistration/{SecurityKey:[a-zA-Z0-9-_]+}/invoice", preRegHandler.GetInvoice).Methods("GET")
-	r.HandleFunc("/preregistration/{SecurityKey:[a-zA-Z0-9-_]+}/promote", authHandler.AdminFunc(preRegHandler.PromoteToRegistration)).Methods("POST")
+	r.HandleFunc("/preregistration/{SecurityKey:[a-zA-Z0-9-_]+}/invoice/payments", authHandler.RoleFunc(preRegHandler.RecordPayment, RoleFinance)).Methods("POST")
+	r.HandleFunc("/preregistration/{SecurityKey:[a-zA-Z0-9-_]+}/rotate", preRegHandler.RotateSecurityKey).Methods("POST")
+	r.HandleFunc("/preregistration/{SecurityKey:[a-zA-Z0-9-_]+}/promote", authHandler.RoleFunc(preRegHandler.PromoteToRegistration, RoleRegistrar)).Methods("POST")
 
 	return preRegHandler
 }
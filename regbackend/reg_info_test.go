@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -22,6 +21,11 @@ import (
 	. "github.com/smartystreets/goconvey/convey"
 )
 
+// Registers the handlers without a registration challenge.
+func newTestPreRegHandler(r *mux.Router, config *configType, prdb PreRegDb, formSchemaDb FormSchemaDb, authHandler *AuthenticationHandler, ces *ConfirmationEmailService) *PreRegHandler {
+	return NewGroupPreRegistrationHandler(r, config, prdb, formSchemaDb, authHandler, ces, nil)
+}
+
 func TestPreRegCreateRequest(t *testing.T) {
 	Convey("Starting with a Group Pre Registration handler", t, func() {
 		goodRecord := GroupPreRegistration{
@@ -50,7 +54,7 @@ func TestPreRegCreateRequest(t *testing.T) {
 		router := mux.NewRouter()
 		testEmailSender := &testEmailSender{}
 		ces := NewConfirmationEmailService("examplesite.com", "no-reply@examplesender.com", "no-reply", "info@infoexample.com", testEmailSender, prdb)
-		prh := NewGroupPreRegistrationHandler(router, config, prdb, nil, ces)
+		prh := newTestPreRegHandler(router, config, prdb, newTestFormSchemaDb(db), nil, ces)
 
 		Convey("When given a good record", func() {
 			r, err := http.NewRequest("POST", "http://localhost:8080/preregistration", &goodRecordBody)
@@ -112,13 +116,15 @@ func TestPreRegCreateRequest(t *testing.T) {
 							So(newRec.ValidatedOn, ShouldHappenWithin, time.Second, dbRec.ValidatedOn)
 							dbRec.ValidatedOn = newRec.ValidatedOn
 							dbRec.ValidationToken = newRec.ValidationToken
+							dbRec.ValidationTokenExpires = newRec.ValidationTokenExpires
+							dbRec.RecordKey = newRec.RecordKey
 							dbRec.EmailConfirmationSent = newRec.EmailConfirmationSent
 
 							So(*dbRec, ShouldResemble, newRec)
 						})
 						Convey("And sending a request to confirm the correct email address with the correct code", func() {
-							buf := bytes.NewReader([]byte(dbRec.ValidationToken))
-							r, err := http.NewRequest("PUT", "http://localhost:8080/confirmpreregistration?email="+goodRecord.ContactLeaderEmail, buf)
+							buf := bytes.NewReader([]byte(`{"email": "` + goodRecord.ContactLeaderEmail + `", "token": "` + dbRec.ValidationToken + `"}`))
+							r, err := http.NewRequest("PUT", "http://localhost:8080/confirmpreregistration", buf)
 							So(err, ShouldBeNil)
 							w := httptest.NewRecorder()
 
@@ -133,8 +139,8 @@ func TestPreRegCreateRequest(t *testing.T) {
 							})
 						})
 						Convey("And sending a request to confirm the correct email address with the wrong code", func() {
-							buf := bytes.NewReader([]byte("BadToken"))
-							r, err := http.NewRequest("PUT", "http://localhost:8080/confirmpreregistration?email="+goodRecord.ContactLeaderEmail, buf)
+							buf := bytes.NewReader([]byte(`{"email": "` + goodRecord.ContactLeaderEmail + `", "token": "BadToken"}`))
+							r, err := http.NewRequest("PUT", "http://localhost:8080/confirmpreregistration", buf)
 							So(err, ShouldBeNil)
 							w := httptest.NewRecorder()
 
@@ -149,8 +155,8 @@ func TestPreRegCreateRequest(t *testing.T) {
 							})
 						})
 						Convey("And sending a request to confirm the wrong email address with a code", func() {
-							buf := bytes.NewReader([]byte("BadToken"))
-							r, err := http.NewRequest("PUT", "http://localhost:8080/confirmpreregistration?email=abademail@invalid", buf)
+							buf := bytes.NewReader([]byte(`{"email": "abademail@invalid", "token": "BadToken"}`))
+							r, err := http.NewRequest("PUT", "http://localhost:8080/confirmpreregistration", buf)
 							So(err, ShouldBeNil)
 							w := httptest.NewRecorder()
 
@@ -286,6 +292,8 @@ func CompareList(actual []*GroupPreRegistration, expected map[string]*GroupPreRe
 		So(gpr.ValidatedOn, ShouldHappenWithin, time.Second, expectedValue.ValidatedOn)
 		gpr.ValidatedOn = expectedValue.ValidatedOn
 		gpr.ValidationToken = expectedValue.ValidationToken
+		gpr.ValidationTokenExpires = expectedValue.ValidationTokenExpires
+		gpr.RecordKey = expectedValue.RecordKey
 		gpr.EmailConfirmationSent = expectedValue.EmailConfirmationSent
 
 		So(gpr, ShouldResemble, expectedValue)
@@ -300,23 +308,16 @@ func TestPreRegWaitingListHandler(t *testing.T) {
 		invDb, err := NewInvoiceDb(db)
 		So(err, ShouldBeNil)
 		config := &configType{}
+		config.Auth.AllowedEmails = stringSliceConfig{"admin@example.com"}
 		prdb, err := NewPreRegBoltDb(db, config, invDb)
 		So(err, ShouldBeNil)
 		router := mux.NewRouter()
 		testEmailSender := &testEmailSender{}
 		ces := NewConfirmationEmailService("examplesite.com", "no-reply@examplesender.com", "no-reply", "info@infoexample.com", testEmailSender, prdb)
 		store := sessions.NewCookieStore([]byte("A"))
-		prh := NewGroupPreRegistrationHandler(router, config, prdb, &AuthenticationHandler{config, store}, ces)
+		prh := newTestPreRegHandler(router, config, prdb, newTestFormSchemaDb(db), newTestAuthHandler(config, store), ces)
 
-		var loggedInCookie []string
-		r := &http.Request{}
-		sess, err := store.New(r, globalSessionName)
-		So(err, ShouldBeNil)
-		So(sess, ShouldNotBeNil)
-		sess.Values[authStatusLoggedIn] = true
-		w := httptest.NewRecorder()
-		store.Save(r, w, sess)
-		loggedInCookie = w.Header()["Set-Cookie"]
+		loggedInCookie := loggedInAs(store, "admin@example.com")
 
 		reg1 := &GroupPreRegistration{
 			PackName:           "Pack A",
@@ -463,6 +464,8 @@ func TestPreRegWaitingListHandler(t *testing.T) {
 									So(recs[0].GroupPreRegistration.ValidatedOn, ShouldHappenWithin, time.Second, wait1.ValidatedOn)
 									recs[0].GroupPreRegistration.ValidatedOn = wait1.ValidatedOn
 									recs[0].GroupPreRegistration.ValidationToken = wait1.ValidationToken
+									recs[0].GroupPreRegistration.ValidationTokenExpires = wait1.ValidationTokenExpires
+									recs[0].GroupPreRegistration.RecordKey = wait1.RecordKey
 									recs[0].GroupPreRegistration.EmailConfirmationSent = wait1.EmailConfirmationSent
 
 									So(recs[0].GroupPreRegistration, ShouldResemble, wait1)
@@ -478,6 +481,8 @@ func TestPreRegWaitingListHandler(t *testing.T) {
 									So(recs[1].GroupPreRegistration.ValidatedOn, ShouldHappenWithin, time.Second, wait2.ValidatedOn)
 									recs[1].GroupPreRegistration.ValidatedOn = wait2.ValidatedOn
 									recs[1].GroupPreRegistration.ValidationToken = wait2.ValidationToken
+									recs[1].GroupPreRegistration.ValidationTokenExpires = wait2.ValidationTokenExpires
+									recs[1].GroupPreRegistration.RecordKey = wait2.RecordKey
 									recs[1].GroupPreRegistration.EmailConfirmationSent = wait2.EmailConfirmationSent
 
 									So(recs[1].GroupPreRegistration, ShouldResemble, wait2)
@@ -493,6 +498,8 @@ func TestPreRegWaitingListHandler(t *testing.T) {
 									So(recs[2].GroupPreRegistration.ValidatedOn, ShouldHappenWithin, time.Second, wait3.ValidatedOn)
 									recs[2].GroupPreRegistration.ValidatedOn = wait3.ValidatedOn
 									recs[2].GroupPreRegistration.ValidationToken = wait3.ValidationToken
+									recs[2].GroupPreRegistration.ValidationTokenExpires = wait3.ValidationTokenExpires
+									recs[2].GroupPreRegistration.RecordKey = wait3.RecordKey
 									recs[2].GroupPreRegistration.EmailConfirmationSent = wait3.EmailConfirmationSent
 
 									So(recs[2].GroupPreRegistration, ShouldResemble, wait3)
@@ -584,6 +591,8 @@ func TestPreRegWaitingListHandler(t *testing.T) {
 												So(recs[0].GroupPreRegistration.ValidatedOn, ShouldHappenWithin, time.Second, wait1.ValidatedOn)
 												recs[0].GroupPreRegistration.ValidatedOn = wait1.ValidatedOn
 												recs[0].GroupPreRegistration.ValidationToken = wait1.ValidationToken
+												recs[0].GroupPreRegistration.ValidationTokenExpires = wait1.ValidationTokenExpires
+												recs[0].GroupPreRegistration.RecordKey = wait1.RecordKey
 												recs[0].GroupPreRegistration.EmailConfirmationSent = wait1.EmailConfirmationSent
 
 												So(recs[0].GroupPreRegistration, ShouldResemble, wait1)
@@ -599,6 +608,8 @@ func TestPreRegWaitingListHandler(t *testing.T) {
 												So(recs[1].GroupPreRegistration.ValidatedOn, ShouldHappenWithin, time.Second, wait3.ValidatedOn)
 												recs[1].GroupPreRegistration.ValidatedOn = wait3.ValidatedOn
 												recs[1].GroupPreRegistration.ValidationToken = wait3.ValidationToken
+												recs[1].GroupPreRegistration.ValidationTokenExpires = wait3.ValidationTokenExpires
+												recs[1].GroupPreRegistration.RecordKey = wait3.RecordKey
 												recs[1].GroupPreRegistration.EmailConfirmationSent = wait3.EmailConfirmationSent
 
 												So(recs[1].GroupPreRegistration, ShouldResemble, wait3)
@@ -661,6 +672,7 @@ func TestGroupPreRegDbInBolt(t *testing.T) {
 		})
 
 		config := &configType{}
+		config.General.DepositPrice = 25000
 		dbOrm := boltorm.NewBoltDB(db)
 		invDb, err := NewInvoiceDb(dbOrm)
 		So(err, ShouldBeNil)
@@ -744,6 +756,50 @@ func TestGroupPreRegDbInBolt(t *testing.T) {
 				So(GroupAlreadyCreated.Contains(prdb.CreateRecord(&duprec)), ShouldBeTrue)
 			})
 
+			Convey("Importing a batch with a collision", func() {
+				batch := []*GroupPreRegistration{
+					{GroupName: "2nd Testingway", Council: "Council rock", ContactLeaderEmail: "second@example.com"},
+					&duprec,
+					{GroupName: "3rd Testingway", Council: "Council rock", ContactLeaderEmail: "second@example.com"},
+					{GroupName: "4th Testingway", Council: "Council rock", ContactLeaderEmail: "fourth@example.com"},
+				}
+				Convey("As a dry run", func() {
+					rowErrs, err := prdb.ImportRecords(batch, true)
+					So(err, ShouldBeNil)
+					Convey("Should report the collisions with existing and earlier records", func() {
+						So(len(rowErrs), ShouldEqual, 4)
+						So(rowErrs[0], ShouldBeNil)
+						So(GroupAlreadyCreated.Contains(rowErrs[1]), ShouldBeTrue)
+						So(GroupAlreadyCreated.Contains(rowErrs[2]), ShouldBeTrue)
+						So(rowErrs[3], ShouldBeNil)
+					})
+					Convey("Should not create anything", func() {
+						recs, err := prdb.GetAll()
+						So(err, ShouldBeNil)
+						So(len(recs), ShouldEqual, 1)
+					})
+				})
+				Convey("For real", func() {
+					rowErrs, err := prdb.ImportRecords(batch, false)
+					So(err, ShouldBeNil)
+					So(rowErrs[0], ShouldBeNil)
+					So(GroupAlreadyCreated.Contains(rowErrs[1]), ShouldBeTrue)
+					So(GroupAlreadyCreated.Contains(rowErrs[2]), ShouldBeTrue)
+					So(rowErrs[3], ShouldBeNil)
+					Convey("Should create only the records without errors", func() {
+						recs, err := prdb.GetAll()
+						So(err, ShouldBeNil)
+						So(len(recs), ShouldEqual, 3)
+						fetched, err := prdb.GetRecord(batch[3].SecurityKey)
+						So(err, ShouldBeNil)
+						So(fetched.GroupName, ShouldEqual, "4th Testingway")
+					})
+					Convey("Should leave the collided email pointing at the first record", func() {
+						So(prdb.VerifyEmail("second@example.com", batch[0].ValidationToken, time.Now()), ShouldBeNil)
+					})
+				})
+			})
+
 			Convey("Noting a successful email conversion (with slightly modified data)", func() {
 				rec.ContactLeaderFirstName = "New Name"
 				err := prdb.NoteConfirmationEmailSent(&rec)
@@ -827,7 +883,7 @@ func TestGroupPreRegDbInBolt(t *testing.T) {
 			})
 
 			Convey("And verifying a valid token", func() {
-				err := prdb.VerifyEmail(rec.ContactLeaderEmail, rec.ValidationToken)
+				err := prdb.VerifyEmail(rec.ContactLeaderEmail, rec.ValidationToken, time.Now())
 				Convey("Should complete without error", func() {
 					So(err, ShouldBeNil)
 				})
@@ -854,7 +910,7 @@ func TestGroupPreRegDbInBolt(t *testing.T) {
 						So(record.ValidatedOn, ShouldHappenWithin, time.Second*5, time.Now())
 					})
 					Convey("And a retry of the operation is silently ignored", func() {
-						err := prdb.VerifyEmail(rec.ContactLeaderEmail, rec.ValidationToken)
+						err := prdb.VerifyEmail(rec.ContactLeaderEmail, rec.ValidationToken, time.Now())
 						Convey("Thus no error", func() {
 							So(err, ShouldBeNil)
 						})
@@ -877,14 +933,14 @@ func TestGroupPreRegDbInBolt(t *testing.T) {
 			})
 
 			Convey("And verifying an invalid token", func() {
-				err := prdb.VerifyEmail(rec.ContactLeaderEmail, "BadToken")
+				err := prdb.VerifyEmail(rec.ContactLeaderEmail, "BadToken", time.Now())
 				Convey("Should complete with appropriate error", func() {
 					So(BadVerificationToken.Contains(err), ShouldEqual, true)
 				})
 			})
 
 			Convey("And verifying an email not in the database", func() {
-				err := prdb.VerifyEmail("test@invalid", rec.ValidationToken)
+				err := prdb.VerifyEmail("test@invalid", rec.ValidationToken, time.Now())
 				Convey("Should complete with appropriate error (not revealing email error)", func() {
 					So(BadVerificationToken.Contains(err), ShouldEqual, true)
 				})
@@ -929,8 +985,7 @@ func TestGroupPreRegDbInBolt(t *testing.T) {
 				Convey("Should insert them set in the waiting list", func() {
 					So(rec.IsOnWaitingList, ShouldBeTrue)
 					Convey("And put them in the waiting list index", func() {
-						key, err := base64.URLEncoding.DecodeString(rec.SecurityKey)
-						So(err, ShouldBeNil)
+						key := rec.Key()
 
 						So(db.View(func(tx *bolt.Tx) error {
 							bucket := tx.Bucket(BOLT_GROUPEWAITINGLISTBUCKET)
@@ -951,10 +1006,7 @@ func TestGroupPreRegDbInBolt(t *testing.T) {
 					Convey("Should insert them set in the waiting list", func() {
 						So(rec.IsOnWaitingList, ShouldBeTrue)
 						Convey("And put them in the waiting list as the second group", func() {
-							key, err := base64.URLEncoding.DecodeString(rec.SecurityKey)
-							So(err, ShouldBeNil)
-							key2, err := base64.URLEncoding.DecodeString(rec2.SecurityKey)
-							So(err, ShouldBeNil)
+							key, key2 := rec.Key(), rec2.Key()
 
 							So(db.View(func(tx *bolt.Tx) error {
 								bucket := tx.Bucket(BOLT_GROUPEWAITINGLISTBUCKET)
@@ -989,3 +1041,302 @@ func TestGroupPreRegDbInBolt(t *testing.T) {
 		})
 	})
 }
+
+func TestSecurityKeyRotation(t *testing.T) {
+	Convey("With a group with participants", t, func() {
+		db := boltorm.NewMemoryDB()
+		invDb, err := NewInvoiceDb(db)
+		So(err, ShouldBeNil)
+		config := &configType{}
+		prdb, err := NewPreRegBoltDb(db, config, invDb)
+		So(err, ShouldBeNil)
+		docs := newTestDocumentStore(db)
+		participantDb, err := NewParticipantDb(db, docs)
+		So(err, ShouldBeNil)
+		documentDb, err := NewDocumentDb(db, docs)
+		So(err, ShouldBeNil)
+		router := mux.NewRouter()
+		ces := NewConfirmationEmailService("examplesite.com", "no-reply@examplesender.com", "no-reply", "info@infoexample.com", &testEmailSender{}, prdb)
+		newTestPreRegHandler(router, config, prdb, newTestFormSchemaDb(db), newTestAuthHandler(config, sessions.NewCookieStore([]byte("A"))), ces)
+
+		rec := &GroupPreRegistration{PackName: "Pack A", GroupName: "1st Testingway", Council: "Council rock", ContactLeaderEmail: "testemail@example.com"}
+		So(prdb.CreateRecord(rec), ShouldBeNil)
+		oldKey := rec.SecurityKey
+		So(participantDb.AddParticipant(oldKey, &Participant{Type: ParticipantLeader, FirstName: "Pat", LastName: "Leader"}), ShouldBeNil)
+		So(documentDb.AddDocument(oldKey, &Document{Kind: "consent", Name: "consent.png", ContentType: "image/png"}, testPNG), ShouldBeNil)
+
+		Convey("Rotating the key should move the group to a new link", func() {
+			w := testRequest(router, "POST", "/preregistration/"+oldKey+"/rotate", nil, nil)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			rotated := &GroupPreRegistration{}
+			So(json.Unmarshal(w.Body.Bytes(), rotated), ShouldBeNil)
+			So(rotated.SecurityKey, ShouldNotEqual, oldKey)
+			So(w.Header().Get("Location"), ShouldEqual, "/preregistration/"+rotated.SecurityKey)
+
+			Convey("And the old link should stop working", func() {
+				_, err := prdb.GetRecord(oldKey)
+				So(RecordDoesNotExist.Contains(err), ShouldBeTrue)
+				So(testRequest(router, "POST", "/preregistration/"+oldKey+"/rotate", nil, nil).Code, ShouldEqual, http.StatusNotFound)
+			})
+			Convey("And everything should stay with the group", func() {
+				dbRec, err := prdb.GetRecord(rotated.SecurityKey)
+				So(err, ShouldBeNil)
+				So(dbRec.Key(), ShouldResemble, rec.Key())
+				roster, err := participantDb.GetRoster(rotated.SecurityKey)
+				So(err, ShouldBeNil)
+				So(roster.SecurityKey, ShouldEqual, rotated.SecurityKey)
+				So(len(roster.Participants), ShouldEqual, 1)
+				rosters, err := participantDb.GetAllRosters()
+				So(err, ShouldBeNil)
+				So(rosters[0].SecurityKey, ShouldEqual, rotated.SecurityKey)
+				documents, err := documentDb.GetDocuments(rotated.SecurityKey)
+				So(err, ShouldBeNil)
+				So(len(documents), ShouldEqual, 1)
+				folder := &documentFolder{}
+				So(db.View(func(tx boltorm.Tx) error {
+					return tx.Get(BOLT_DOCUMENTBUCKET, rec.Key(), folder)
+				}), ShouldBeNil)
+				So(folder.SecurityKey, ShouldEqual, rotated.SecurityKey)
+			})
+		})
+	})
+}
+
+func TestRecoveryRequest(t *testing.T) {
+	Convey("With a registered group", t, func() {
+		db := boltorm.NewMemoryDB()
+		invDb, err := NewInvoiceDb(db)
+		So(err, ShouldBeNil)
+		config := &configType{}
+		prdb, err := NewPreRegBoltDb(db, config, invDb)
+		So(err, ShouldBeNil)
+		router := mux.NewRouter()
+		testEmailSender := &testEmailSender{}
+		ces := NewConfirmationEmailService("examplesite.com", "no-reply@examplesender.com", "no-reply", "info@infoexample.com", testEmailSender, prdb)
+		newTestPreRegHandler(router, config, prdb, newTestFormSchemaDb(db), newTestAuthHandler(config, sessions.NewCookieStore([]byte("A"))), ces)
+
+		rec := &GroupPreRegistration{PackName: "Pack A", GroupName: "1st Testingway", Council: "Council rock", ContactLeaderEmail: "testemail@example.com"}
+		So(prdb.CreateRecord(rec), ShouldBeNil)
+
+		requestLink := func(email string) int {
+			r, err := http.NewRequest("POST", "http://localhost:8080/preregistration/recover", bytes.NewReader([]byte(`{"email": "`+email+`"}`)))
+			So(err, ShouldBeNil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			return w.Code
+		}
+
+		Convey("Asking with the leader's email should send them the link", func() {
+			So(requestLink(" testemail@example.com "), ShouldEqual, http.StatusAccepted)
+			So(len(testEmailSender.Emails), ShouldEqual, 1)
+			So(testEmailSender.Emails[0].To, ShouldResemble, []string{"testemail@example.com"})
+			So(string(testEmailSender.Emails[0].Msg), ShouldContainSubstring, "https://examplesite.com/registration/"+rec.SecurityKey)
+
+			Convey("But not again straight away", func() {
+				So(requestLink("testemail@example.com"), ShouldEqual, http.StatusAccepted)
+				So(len(testEmailSender.Emails), ShouldEqual, 1)
+			})
+		})
+		Convey("Asking with the email in another case should still send the link", func() {
+			So(requestLink("TestEmail@Example.com"), ShouldEqual, http.StatusAccepted)
+			So(len(testEmailSender.Emails), ShouldEqual, 1)
+		})
+		Convey("Asking with another email should look the same, but send nothing", func() {
+			So(requestLink("someone@example.com"), ShouldEqual, http.StatusAccepted)
+			So(len(testEmailSender.Emails), ShouldEqual, 0)
+		})
+		Convey("Asking with something that isn't an email should be refused", func() {
+			So(requestLink("someone"), ShouldEqual, http.StatusUnprocessableEntity)
+		})
+		Convey("Links should be sent again after a while", func() {
+			rec, err := prdb.NoteRecoveryRequest("testemail@example.com", time.Now())
+			So(err, ShouldBeNil)
+			So(rec, ShouldNotBeNil)
+			rec, err = prdb.NoteRecoveryRequest("testemail@example.com", time.Now().Add(recoveryInterval-time.Second))
+			So(err, ShouldBeNil)
+			So(rec, ShouldBeNil)
+			rec, err = prdb.NoteRecoveryRequest("testemail@example.com", time.Now().Add(recoveryInterval+time.Second))
+			So(err, ShouldBeNil)
+			So(rec, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestVerificationTokens(t *testing.T) {
+	Convey("With a group waiting to verify their email", t, func() {
+		db := boltorm.NewMemoryDB()
+		invDb, err := NewInvoiceDb(db)
+		So(err, ShouldBeNil)
+		config := &configType{}
+		prdb, err := NewPreRegBoltDb(db, config, invDb)
+		So(err, ShouldBeNil)
+		router := mux.NewRouter()
+		testEmailSender := &testEmailSender{}
+		ces := NewConfirmationEmailService("examplesite.com", "no-reply@examplesender.com", "no-reply", "info@infoexample.com", testEmailSender, prdb)
+		newTestPreRegHandler(router, config, prdb, newTestFormSchemaDb(db), newTestAuthHandler(config, sessions.NewCookieStore([]byte("A"))), ces)
+
+		rec := &GroupPreRegistration{PackName: "Pack A", GroupName: "1st Testingway", Council: "Council rock", ContactLeaderEmail: "testemail@example.com"}
+		So(prdb.CreateRecord(rec), ShouldBeNil)
+		now := time.Now()
+		So(rec.ValidationTokenExpires, ShouldHappenWithin, time.Second, now.Add(validationTokenLifetime))
+
+		verify := func(email, token string) int {
+			r, err := http.NewRequest("PUT", "http://localhost:8080/confirmpreregistration", bytes.NewReader([]byte(`{"email": "`+email+`", "token": "`+token+`"}`)))
+			So(err, ShouldBeNil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			return w.Code
+		}
+		resend := func(email string) int {
+			r, err := http.NewRequest("POST", "http://localhost:8080/confirmpreregistration/resend", bytes.NewReader([]byte(`{"email": "`+email+`"}`)))
+			So(err, ShouldBeNil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			return w.Code
+		}
+
+		Convey("An expired token should be refused as expired", func() {
+			err := prdb.VerifyEmail(rec.ContactLeaderEmail, rec.ValidationToken, rec.ValidationTokenExpires)
+			So(VerificationTokenExpired.Contains(err), ShouldBeTrue)
+			dbRec, err := prdb.GetRecord(rec.SecurityKey)
+			So(err, ShouldBeNil)
+			So(dbRec.ValidatedOn.IsZero(), ShouldBeTrue)
+		})
+		Convey("Too many wrong tokens should expire the real one", func() {
+			for i := 1; i < maxVerificationFailures; i++ {
+				So(verify(rec.ContactLeaderEmail, "BadToken"), ShouldEqual, http.StatusBadRequest)
+			}
+			So(verify(rec.ContactLeaderEmail, "BadToken"), ShouldEqual, http.StatusGone)
+			So(verify(rec.ContactLeaderEmail, rec.ValidationToken), ShouldEqual, http.StatusGone)
+
+			Convey("Until a new one is sent", func() {
+				So(resend(rec.ContactLeaderEmail), ShouldEqual, http.StatusAccepted)
+				So(len(testEmailSender.Emails), ShouldEqual, 1)
+				dbRec, err := prdb.GetRecord(rec.SecurityKey)
+				So(err, ShouldBeNil)
+				So(dbRec.ValidationToken, ShouldNotEqual, rec.ValidationToken)
+				So(string(testEmailSender.Emails[0].Msg), ShouldContainSubstring, dbRec.ValidationToken)
+				So(verify(rec.ContactLeaderEmail, rec.ValidationToken), ShouldEqual, http.StatusBadRequest)
+				So(verify(rec.ContactLeaderEmail, dbRec.ValidationToken), ShouldEqual, http.StatusOK)
+			})
+		})
+		Convey("New tokens should not be sent too often", func() {
+			So(resend(rec.ContactLeaderEmail), ShouldEqual, http.StatusAccepted)
+			So(resend(rec.ContactLeaderEmail), ShouldEqual, http.StatusAccepted)
+			So(len(testEmailSender.Emails), ShouldEqual, 1)
+			again, err := prdb.NewValidationToken(rec.ContactLeaderEmail, time.Now().Add(recoveryInterval+time.Second))
+			So(err, ShouldBeNil)
+			So(again, ShouldNotBeNil)
+		})
+		Convey("New tokens should not be sent to others or once verified", func() {
+			So(resend("someone@example.com"), ShouldEqual, http.StatusAccepted)
+			So(prdb.VerifyEmail(rec.ContactLeaderEmail, rec.ValidationToken, now), ShouldBeNil)
+			So(resend(rec.ContactLeaderEmail), ShouldEqual, http.StatusAccepted)
+			So(len(testEmailSender.Emails), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestLegacyGroupEmails(t *testing.T) {
+	Convey("With a group indexed by its email as it was entered", t, func() {
+		db := boltorm.NewMemoryDB()
+		_, err := NewPreRegBoltDb(db, &configType{}, nil)
+		So(err, ShouldBeNil)
+		rec := &GroupPreRegistration{PackName: "Pack A", GroupName: "1st Testingway", Council: "Council rock", ContactLeaderEmail: "TestEmail@Example.com"}
+		So(rec.PrepareForInsert(), ShouldBeNil)
+		So(db.Update(func(tx boltorm.Tx) error {
+			if err := tx.Insert(BOLT_GROUPBUCKET, rec.Key(), rec); err != nil {
+				return err
+			}
+			return tx.AddIndex(BOLT_GROUPEMAILMAPBUCKET, []byte(rec.ContactLeaderEmail), rec.Key())
+		}), ShouldBeNil)
+
+		Convey("Starting up should index it by its normalized email", func() {
+			prdb, err := NewPreRegBoltDb(db, &configType{}, nil)
+			So(err, ShouldBeNil)
+			found, err := prdb.NoteRecoveryRequest("testemail@example.com", time.Now())
+			So(err, ShouldBeNil)
+			So(found, ShouldNotBeNil)
+			So(found.Key(), ShouldResemble, rec.Key())
+
+			Convey("And another group should not be able to take its email", func() {
+				other := &GroupPreRegistration{PackName: "Pack B", GroupName: "1st Testingway", Council: "Council rock", ContactLeaderEmail: "testemail@example.com"}
+				So(GroupAlreadyCreated.Contains(prdb.CreateRecord(other)), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestLegacyValidationTokens(t *testing.T) {
+	Convey("With a group verifying its email from before tokens expired", t, func() {
+		db := boltorm.NewMemoryDB()
+		_, err := NewPreRegBoltDb(db, &configType{}, nil)
+		So(err, ShouldBeNil)
+		rec := &GroupPreRegistration{PackName: "Pack A", GroupName: "1st Testingway", Council: "Council rock", ContactLeaderEmail: "testemail@example.com"}
+		So(rec.PrepareForInsert(), ShouldBeNil)
+		rec.ValidationTokenExpires = time.Time{}
+		validated := &GroupPreRegistration{PackName: "Pack B", GroupName: "1st Testingway", Council: "Council rock", ContactLeaderEmail: "testemail2@example.com"}
+		So(validated.PrepareForInsert(), ShouldBeNil)
+		validated.ValidationTokenExpires = time.Time{}
+		validated.ValidatedOn = time.Now().Round(0)
+		So(db.Update(func(tx boltorm.Tx) error {
+			if err := tx.Insert(BOLT_GROUPBUCKET, rec.Key(), rec); err != nil {
+				return err
+			}
+			return tx.Insert(BOLT_GROUPBUCKET, validated.Key(), validated)
+		}), ShouldBeNil)
+
+		Convey("Starting up should give its token the usual time to be used", func() {
+			before := time.Now()
+			_, err := NewPreRegBoltDb(db, &configType{}, nil)
+			So(err, ShouldBeNil)
+			dbRec := &GroupPreRegistration{}
+			So(db.View(func(tx boltorm.Tx) error {
+				return tx.Get(BOLT_GROUPBUCKET, rec.Key(), dbRec)
+			}), ShouldBeNil)
+			So(dbRec.ValidationTokenExpires, ShouldHappenOnOrBetween, before.Add(validationTokenLifetime).Round(0), time.Now().Add(validationTokenLifetime))
+
+			Convey("But leave verified groups alone", func() {
+				dbRec := &GroupPreRegistration{}
+				So(db.View(func(tx boltorm.Tx) error {
+					return tx.Get(BOLT_GROUPBUCKET, validated.Key(), dbRec)
+				}), ShouldBeNil)
+				So(dbRec.ValidationTokenExpires.IsZero(), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestLegacySecurityKeys(t *testing.T) {
+	Convey("With a group stored under its security key", t, func() {
+		db := boltorm.NewMemoryDB()
+		_, err := NewPreRegBoltDb(db, &configType{}, nil)
+		So(err, ShouldBeNil)
+		rec := &GroupPreRegistration{PackName: "Pack A", GroupName: "1st Testingway", Council: "Council rock", ContactLeaderEmail: "testemail@example.com"}
+		So(rec.PrepareForInsert(), ShouldBeNil)
+		rec.RecordKey = ""
+		So(db.Update(func(tx boltorm.Tx) error {
+			legacy := *rec
+			legacy.RecordKey = legacy.SecurityKey
+			return tx.Insert(BOLT_GROUPBUCKET, legacy.Key(), rec)
+		}), ShouldBeNil)
+
+		Convey("Starting up should index it by its security key, without moving it", func() {
+			prdb, err := NewPreRegBoltDb(db, &configType{}, nil)
+			So(err, ShouldBeNil)
+			dbRec, err := prdb.GetRecord(rec.SecurityKey)
+			So(err, ShouldBeNil)
+			So(dbRec.RecordKey, ShouldEqual, rec.SecurityKey)
+
+			Convey("And its key can then be rotated", func() {
+				rotated, err := prdb.RotateSecurityKey(rec.SecurityKey)
+				So(err, ShouldBeNil)
+				So(rotated.RecordKey, ShouldEqual, rec.SecurityKey)
+				_, err = prdb.GetRecord(rec.SecurityKey)
+				So(RecordDoesNotExist.Contains(err), ShouldBeTrue)
+				_, err = prdb.GetRecord(rotated.SecurityKey)
+				So(err, ShouldBeNil)
+			})
+		})
+	})
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A registration flattened into a single row for spreadsheets.
+type RegistrationExportRow struct {
+	SecurityKey string `json:"securityKey"`
+
+	PackName  string `json:"packName"`
+	GroupName string `json:"groupName"`
+	Council   string `json:"council"`
+
+	ContactLeaderFirstName   string      `json:"contactLeaderFirstName"`
+	ContactLeaderLastName    string      `json:"contactLeaderLastName"`
+	ContactLeaderPhoneNumber PhoneNumber `json:"contactLeaderPhoneNumber"`
+	ContactLeaderEmail       string      `json:"contactLeaderEmail"`
+	Address1                 string      `json:"address1"`
+	Address2                 string      `json:"address2"`
+	City                     string      `json:"city"`
+	Province                 string      `json:"province"`
+	PostalCode               string      `json:"postalCode"`
+
+	EstimatedYouth   int `json:"estimatedYouth"`
+	EstimatedLeaders int `json:"estimatedLeaders"`
+
+	IsOnWaitingList bool `json:"isOnWaitingList"`
+	WaitingListPos  int  `json:"waitingListPos"`
+
+	EmailValidated bool      `json:"emailValidated"`
+	ValidatedOn    time.Time `json:"validatedOn"`
+
+	InvoiceID uint64 `json:"invoiceId"`
+	// What the group has been invoiced, what it has paid, and what it still
+	// owes, in cents.
+	InvoiceTotal int64 `json:"invoiceTotal"`
+	Paid         int64 `json:"paid"`
+	Balance      int64 `json:"balance"`
+
+	CustomFields map[string]string `json:"customFields"`
+}
+
+type registrationExportColumn struct {
+	name    string
+	numeric bool
+	value   func(row *RegistrationExportRow) string
+}
+
+func formatExportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func formatCents(cents int64) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+var registrationExportColumns = []registrationExportColumn{
+	{"securityKey", false, func(row *RegistrationExportRow) string { return row.SecurityKey }},
+	{"packName", false, func(row *RegistrationExportRow) string { return row.PackName }},
+	{"groupName", false, func(row *RegistrationExportRow) string { return row.GroupName }},
+	{"council", false, func(row *RegistrationExportRow) string { return row.Council }},
+	{"contactLeaderFirstName", false, func(row *RegistrationExportRow) string { return row.ContactLeaderFirstName }},
+	{"contactLeaderLastName", false, func(row *RegistrationExportRow) string { return row.ContactLeaderLastName }},
+	{"contactLeaderPhoneNumber", false, func(row *RegistrationExportRow) string { return string(row.ContactLeaderPhoneNumber) }},
+	{"contactLeaderEmail", false, func(row *RegistrationExportRow) string { return row.ContactLeaderEmail }},
+	{"address1", false, func(row *RegistrationExportRow) string { return row.Address1 }},
+	{"address2", false, func(row *RegistrationExportRow) string { return row.Address2 }},
+	{"city", false, func(row *RegistrationExportRow) string { return row.City }},
+	{"province", false, func(row *RegistrationExportRow) string { return row.Province }},
+	{"postalCode", false, func(row *RegistrationExportRow) string { return row.PostalCode }},
+	{"estimatedYouth", true, func(row *RegistrationExportRow) string { return strconv.Itoa(row.EstimatedYouth) }},
+	{"estimatedLeaders", true, func(row *RegistrationExportRow) string { return strconv.Itoa(row.EstimatedLeaders) }},
+	{"isOnWaitingList", false, func(row *RegistrationExportRow) string { return strconv.FormatBool(row.IsOnWaitingList) }},
+	{"waitingListPos", true, func(row *RegistrationExportRow) string {
+		if row.WaitingListPos == 0 {
+			return ""
+		}
+		return strconv.Itoa(row.WaitingListPos)
+	}},
+	{"emailValidated", false, func(row *RegistrationExportRow) string { return strconv.FormatBool(row.EmailValidated) }},
+	{"validatedOn", false, func(row *RegistrationExportRow) string { return formatExportTime(row.ValidatedOn) }},
+	{"invoiceId", true, func(row *RegistrationExportRow) string {
+		if row.InvoiceID == 0 {
+			return ""
+		}
+		return strconv.FormatUint(row.InvoiceID, 10)
+	}},
+	{"invoiceTotal", true, func(row *RegistrationExportRow) string { return formatCents(row.InvoiceTotal) }},
+	{"paid", true, func(row *RegistrationExportRow) string { return formatCents(row.Paid) }},
+	{"balance", true, func(row *RegistrationExportRow) string { return formatCents(row.Balance) }},
+}
+
+// Answers to questions from the form schema follow the fixed columns, with
+// a prefix so they can't clash with them.
+const customFieldColumnPrefix = "custom."
+
+func customFieldExportColumn(field FormField) registrationExportColumn {
+	name := field.Name
+	return registrationExportColumn{customFieldColumnPrefix + name, field.Type == FormFieldNumber, func(row *RegistrationExportRow) string {
+		return row.CustomFields[name]
+	}}
+}
+
+func exportRow(rec *GroupPreRegistration, waitingListPos int, inv *Invoice) *RegistrationExportRow {
+	row := &RegistrationExportRow{
+		SecurityKey:              rec.SecurityKey,
+		PackName:                 rec.PackName,
+		GroupName:                rec.GroupName,
+		Council:                  rec.Council,
+		ContactLeaderFirstName:   rec.ContactLeaderFirstName,
+		ContactLeaderLastName:    rec.ContactLeaderLastName,
+		ContactLeaderPhoneNumber: rec.ContactLeaderPhoneNumber,
+		ContactLeaderEmail:       rec.ContactLeaderEmail,
+		Address1:                 rec.ContactLeaderAddress.Address1,
+		Address2:                 rec.ContactLeaderAddress.Address2,
+		City:                     rec.ContactLeaderAddress.City,
+		Province:                 rec.ContactLeaderAddress.Province,
+		PostalCode:               rec.ContactLeaderAddress.PostalCode,
+		EstimatedYouth:           rec.EstimatedYouth,
+		EstimatedLeaders:         rec.EstimatedLeaders,
+		IsOnWaitingList:          rec.IsOnWaitingList,
+		WaitingListPos:           waitingListPos,
+		EmailValidated:           !rec.ValidatedOn.IsZero(),
+		ValidatedOn:              rec.ValidatedOn,
+		InvoiceID:                rec.InvoiceID,
+		CustomFields:             rec.CustomFields,
+	}
+	if row.CustomFields == nil {
+		row.CustomFields = map[string]string{}
+	}
+	if inv != nil {
+		row.InvoiceTotal = inv.Total()
+		row.Paid = inv.Paid()
+		row.Balance = row.InvoiceTotal - row.Paid
+	}
+	return row
+}
+
+// Builds the export rows for the selected registrations, with waiting
+// list selections ordered by their position in the waiting list.
+func (h *PreRegHandler) exportRows(selectValue string) ([]*RegistrationExportRow, error) {
+	recs, waitingList, invoices, err := h.db.GetAllWithInvoices()
+	if err != nil {
+		return nil, err
+	}
+	rows := []*RegistrationExportRow{}
+	if selectValue == waitingRegs {
+		for _, rec := range waitingList {
+			rows = append(rows, exportRow(rec.GroupPreRegistration, rec.WaitingListPos, invoices[rec.InvoiceID]))
+		}
+		return rows, nil
+	}
+
+	positions := make(map[string]int)
+	for _, rec := range waitingList {
+		positions[rec.SecurityKey] = rec.WaitingListPos
+	}
+	for _, rec := range recs {
+		if selectValue == registeredRegs && rec.IsOnWaitingList {
+			continue
+		}
+		rows = append(rows, exportRow(rec, positions[rec.SecurityKey], invoices[rec.InvoiceID]))
+	}
+	return rows, nil
+}
+
+// Spreadsheets run cells starting with these as formulas when opening a
+// CSV file, which anyone registering could use to attack whoever opens it.
+const csvFormulaPrefixes = "=+-@\t\r"
+
+// Makes the cell show as text, unless it is a number in a numeric column.
+func escapeCSVCell(value string, numeric bool) string {
+	if value == "" || !strings.ContainsRune(csvFormulaPrefixes, rune(value[0])) {
+		return value
+	}
+	if _, err := strconv.ParseFloat(value, 64); numeric && err == nil {
+		return value
+	}
+	return "'" + value
+}
+
+func (h *PreRegHandler) Export(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" && format != "xlsx" {
+		http.Error(w, "Unknown export format, use csv, json or xlsx", http.StatusBadRequest)
+		return
+	}
+	selectValue := registrationSelection(r)
+
+	rows, err := h.exportRows(selectValue)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	schema, err := h.formSchemaDb.GetFormSchema()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	var contentType string
+	if format == "json" {
+		contentType = "application/json"
+		err = json.NewEncoder(buf).Encode(rows)
+	} else {
+		columns := append([]registrationExportColumn{}, registrationExportColumns...)
+		for _, field := range schema.Fields {
+			columns = append(columns, customFieldExportColumn(field))
+		}
+		table := make([][]string, 0, len(rows)+1)
+		header := make([]string, len(columns))
+		numeric := make([]bool, len(columns))
+		for i, column := range columns {
+			header[i] = column.name
+			numeric[i] = column.numeric
+		}
+		table = append(table, header)
+		for _, row := range rows {
+			record := make([]string, len(columns))
+			for i, column := range columns {
+				record[i] = column.value(row)
+			}
+			table = append(table, record)
+		}
+
+		if format == "csv" {
+			for _, record := range table[1:] {
+				for i := range record {
+					record[i] = escapeCSVCell(record[i], numeric[i])
+				}
+			}
+			contentType = "text/csv; charset=utf-8"
+			err = csv.NewWriter(buf).WriteAll(table)
+		} else {
+			// Inline strings are never run as formulas, so need no escaping.
+			contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+			err = writeXLSX(buf, "Registrations", table, numeric)
+		}
+	}
+	if err != nil {
+		http.Error(w, "Failed to export records", http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("registrations-%s-%s.%s", selectValue, time.Now().Format("20060102"), format)
+	w.Header()["Content-Type"] = []string{contentType}
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, buf)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestEscapeCSVCell(t *testing.T) {
+	Convey("Cells starting like formulas should be escaped", t, func() {
+		for _, value := range []string{"=1+2", "+1", "-1", "@SUM(A1)", "\tx", "\rx"} {
+			So(escapeCSVCell(value, false), ShouldEqual, "'"+value)
+		}
+	})
+	Convey("Other cells should be left alone", t, func() {
+		So(escapeCSVCell("", false), ShouldEqual, "")
+		So(escapeCSVCell("Pack A", false), ShouldEqual, "Pack A")
+		So(escapeCSVCell("a=b", false), ShouldEqual, "a=b")
+	})
+	Convey("Negative numbers should only be left alone in numeric columns", t, func() {
+		So(escapeCSVCell("-250.00", true), ShouldEqual, "-250.00")
+		So(escapeCSVCell("-250.00", false), ShouldEqual, "'-250.00")
+		So(escapeCSVCell("-1+1", true), ShouldEqual, "'-1+1")
+	})
+}
+
+func TestPreRegExport(t *testing.T) {
+	Convey("Starting with a handler with 2 groups registered (one invoiced) and 1 waiting", t, func() {
+		db := boltorm.NewMemoryDB()
+		invDb, err := NewInvoiceDb(db)
+		So(err, ShouldBeNil)
+		config := &configType{}
+		config.Auth.AllowedEmails = stringSliceConfig{"admin@example.com"}
+		config.General.DepositPrice = 25000
+		prdb, err := NewPreRegBoltDb(db, config, invDb)
+		So(err, ShouldBeNil)
+		router := mux.NewRouter()
+		ces := NewConfirmationEmailService("examplesite.com", "no-reply@examplesender.com", "no-reply", "info@infoexample.com", &testEmailSender{}, prdb)
+		store := sessions.NewCookieStore([]byte("A"))
+		formSchemaDb := newTestFormSchemaDb(db)
+		newTestPreRegHandler(router, config, prdb, formSchemaDb, newTestAuthHandler(config, store), ces)
+
+		loggedInCookie := loggedInAs(store, "admin@example.com")
+
+		reg1 := &GroupPreRegistration{
+			PackName:           "Pack A",
+			GroupName:          "1st Testingway",
+			Council:            "Council rock",
+			ContactLeaderEmail: "testemail@example.com",
+			ContactLeaderAddress: Address{
+				Address1:   "1 Test Street",
+				City:       "Ottawa",
+				Province:   "ON",
+				PostalCode: "K1A 0B1",
+			},
+			EstimatedYouth:   12,
+			EstimatedLeaders: 3,
+			CustomFields:     map[string]string{"campsites": "2"},
+		}
+		So(prdb.CreateRecord(reg1), ShouldBeNil)
+		inv, err := prdb.CreateInvoiceIfNotExists(reg1)
+		So(err, ShouldBeNil)
+		_, err = prdb.RecordPayment(reg1.SecurityKey, &Payment{Amount: 10000, Method: "cheque"})
+		So(err, ShouldBeNil)
+		So(prdb.VerifyEmail(reg1.ContactLeaderEmail, reg1.ValidationToken, time.Now()), ShouldBeNil)
+
+		reg2 := &GroupPreRegistration{
+			PackName:           "Pack B",
+			GroupName:          "1st Testingway",
+			Council:            "Council rock",
+			ContactLeaderEmail: "testemail2@example.com",
+		}
+		So(prdb.CreateRecord(reg2), ShouldBeNil)
+
+		config.General.EnableWaitingList = true
+		wait1 := &GroupPreRegistration{
+			PackName:           "Pack A",
+			GroupName:          "1st Testingway",
+			Council:            "Waiters rock",
+			ContactLeaderEmail: "testemail3@example.com",
+		}
+		So(prdb.CreateRecord(wait1), ShouldBeNil)
+		config.General.EnableWaitingList = false
+
+		export := func(query string) *httptest.ResponseRecorder {
+			return testRequest(router, "GET", "/preregistration/export"+query, nil, loggedInCookie)
+		}
+		rowFor := func(rows []RegistrationExportRow, securityKey string) RegistrationExportRow {
+			for _, row := range rows {
+				if row.SecurityKey == securityKey {
+					return row
+				}
+			}
+			return RegistrationExportRow{}
+		}
+		// Security keys can start with a "-", so are escaped like any other cell.
+		csvKey := func(record []string) string {
+			return strings.TrimPrefix(record[0], "'")
+		}
+
+		Convey("Exporting while not logged in should be forbidden", func() {
+			r, err := http.NewRequest("GET", "http://localhost:8080/preregistration/export", nil)
+			So(err, ShouldBeNil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("Exporting with an unknown format should fail", func() {
+			w := export("?format=pdf")
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("Exporting everything as json", func() {
+			w := export("?format=json")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.HeaderMap.Get("Content-Type"), ShouldEqual, "application/json")
+			rows := []RegistrationExportRow{}
+			So(json.Unmarshal(w.Body.Bytes(), &rows), ShouldBeNil)
+			Convey("Should include all three records", func() {
+				So(len(rows), ShouldEqual, 3)
+			})
+			Convey("Should flatten the address", func() {
+				row := rowFor(rows, reg1.SecurityKey)
+				So(row.Address1, ShouldEqual, "1 Test Street")
+				So(row.City, ShouldEqual, "Ottawa")
+				So(row.PostalCode, ShouldEqual, "K1A 0B1")
+			})
+			Convey("Should include the validation status", func() {
+				So(rowFor(rows, reg1.SecurityKey).EmailValidated, ShouldBeTrue)
+				So(rowFor(rows, reg2.SecurityKey).EmailValidated, ShouldBeFalse)
+			})
+			Convey("Should include the invoice, its total and what is left to pay", func() {
+				row := rowFor(rows, reg1.SecurityKey)
+				So(row.InvoiceID, ShouldEqual, inv.ID)
+				So(row.InvoiceTotal, ShouldEqual, 25000)
+				So(row.Paid, ShouldEqual, 10000)
+				So(row.Balance, ShouldEqual, 15000)
+				So(rowFor(rows, reg2.SecurityKey).InvoiceID, ShouldEqual, 0)
+			})
+			Convey("Should include the waiting list position", func() {
+				So(rowFor(rows, wait1.SecurityKey).WaitingListPos, ShouldEqual, 1)
+				So(rowFor(rows, reg1.SecurityKey).WaitingListPos, ShouldEqual, 0)
+			})
+		})
+
+		Convey("Exporting only the waiting list as json should only give waiting records", func() {
+			w := export("?format=json&select=waiting")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			rows := []RegistrationExportRow{}
+			So(json.Unmarshal(w.Body.Bytes(), &rows), ShouldBeNil)
+			So(len(rows), ShouldEqual, 1)
+			So(rows[0].SecurityKey, ShouldEqual, wait1.SecurityKey)
+		})
+
+		Convey("Exporting the registered records as csv", func() {
+			w := export("?format=csv&select=registered")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.HeaderMap.Get("Content-Disposition"), ShouldStartWith, `attachment; filename="registrations-registered-`)
+			records, err := csv.NewReader(w.Body).ReadAll()
+			So(err, ShouldBeNil)
+			Convey("Should have a header and the two registered records", func() {
+				So(len(records), ShouldEqual, 3)
+				So(records[0][0], ShouldEqual, "securityKey")
+				So(records[0][len(records[0])-3:], ShouldResemble, []string{"invoiceTotal", "paid", "balance"})
+			})
+			Convey("Should format the invoice amounts in dollars", func() {
+				for _, record := range records[1:] {
+					if csvKey(record) == reg1.SecurityKey {
+						So(record[len(record)-3:], ShouldResemble, []string{"250.00", "100.00", "150.00"})
+					} else {
+						So(record[len(record)-3:], ShouldResemble, []string{"0.00", "0.00", "0.00"})
+					}
+				}
+			})
+		})
+
+		Convey("Exporting a record with a formula in it as csv should keep it as text", func() {
+			reg3 := &GroupPreRegistration{
+				PackName:               "Pack C",
+				GroupName:              "1st Testingway",
+				Council:                "Council rock",
+				ContactLeaderFirstName: "=HYPERLINK(\"http://example.com\")",
+				ContactLeaderLastName:  "-2+3",
+				ContactLeaderEmail:     "testemail4@example.com",
+			}
+			config.General.EnableWaitingList = false
+			So(prdb.CreateRecord(reg3), ShouldBeNil)
+			w := export("?format=csv&select=registered")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			records, err := csv.NewReader(w.Body).ReadAll()
+			So(err, ShouldBeNil)
+			for _, record := range records[1:] {
+				if csvKey(record) == reg3.SecurityKey {
+					So(record[4], ShouldEqual, "'=HYPERLINK(\"http://example.com\")")
+					So(record[5], ShouldEqual, "'-2+3")
+				}
+			}
+		})
+
+		Convey("With a question on the form", func() {
+			So(formSchemaDb.SetFormSchema(&FormSchema{Fields: []FormField{{Name: "campsites", Label: "Campsites", Type: FormFieldNumber}}}), ShouldBeNil)
+			Convey("Exporting as json should include the answers", func() {
+				w := export("?format=json")
+				So(w.Code, ShouldEqual, http.StatusOK)
+				rows := []RegistrationExportRow{}
+				So(json.Unmarshal(w.Body.Bytes(), &rows), ShouldBeNil)
+				So(rowFor(rows, reg1.SecurityKey).CustomFields, ShouldResemble, map[string]string{"campsites": "2"})
+				So(rowFor(rows, reg2.SecurityKey).CustomFields, ShouldResemble, map[string]string{})
+			})
+			Convey("Exporting as csv should add a column for it", func() {
+				w := export("?format=csv&select=registered")
+				So(w.Code, ShouldEqual, http.StatusOK)
+				records, err := csv.NewReader(w.Body).ReadAll()
+				So(err, ShouldBeNil)
+				So(records[0][len(records[0])-1], ShouldEqual, "custom.campsites")
+				for _, record := range records[1:] {
+					if csvKey(record) == reg1.SecurityKey {
+						So(record[len(record)-1], ShouldEqual, "2")
+					} else {
+						So(record[len(record)-1], ShouldEqual, "")
+					}
+				}
+			})
+		})
+
+		Convey("Exporting as xlsx should give a spreadsheet", func() {
+			w := export("?format=xlsx")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			z, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+			So(err, ShouldBeNil)
+			var sheet string
+			for _, file := range z.File {
+				if file.Name == "xl/worksheets/sheet1.xml" {
+					f, err := file.Open()
+					So(err, ShouldBeNil)
+					data, err := ioutil.ReadAll(f)
+					So(err, ShouldBeNil)
+					sheet = string(data)
+				}
+			}
+			So(strings.Count(sheet, "<row "), ShouldEqual, 4)
+			So(sheet, ShouldContainSubstring, reg1.SecurityKey)
+			So(sheet, ShouldContainSubstring, `<c r="N2"><v>`)
+		})
+	})
+}
+
+func TestXLSXColumnName(t *testing.T) {
+	Convey("Column names should follow spreadsheet naming", t, func() {
+		So(xlsxColumnName(0), ShouldEqual, "A")
+		So(xlsxColumnName(25), ShouldEqual, "Z")
+		So(xlsxColumnName(26), ShouldEqual, "AA")
+		So(xlsxColumnName(27), ShouldEqual, "AB")
+		So(xlsxColumnName(702), ShouldEqual, "AAA")
+	})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/spacemonkeygo/errors"
+	"github.com/spacemonkeygo/errors/errhttp"
+)
+
+var (
+	ImportError       = errors.NewClass("Import error", errhttp.SetStatusCode(400))
+	ImportRowError    = ImportError.NewClass("Invalid row")
+	ImportHeaderError = ImportError.NewClass("Invalid header")
+)
+
+// Importable columns, named as in the export.
+var (
+	importColumns = []string{
+		"packName", "groupName", "council",
+		"contactLeaderFirstName", "contactLeaderLastName", "contactLeaderPhoneNumber", "contactLeaderEmail",
+		"address1", "address2", "city", "province", "postalCode",
+		"estimatedYouth", "estimatedLeaders",
+	}
+	importRequiredColumns = []string{"groupName", "council", "contactLeaderEmail"}
+)
+
+func setImportColumn(rec *GroupPreRegistration, column, value string) error {
+	switch column {
+	case "packName":
+		rec.PackName = value
+	case "groupName":
+		rec.GroupName = value
+	case "council":
+		rec.Council = value
+	case "contactLeaderFirstName":
+		rec.ContactLeaderFirstName = value
+	case "contactLeaderLastName":
+		rec.ContactLeaderLastName = value
+	case "contactLeaderPhoneNumber":
+		rec.ContactLeaderPhoneNumber = PhoneNumber(value)
+	case "contactLeaderEmail":
+		rec.ContactLeaderEmail = value
+	case "address1":
+		rec.ContactLeaderAddress.Address1 = value
+	case "address2":
+		rec.ContactLeaderAddress.Address2 = value
+	case "city":
+		rec.ContactLeaderAddress.City = value
+	case "province":
+		rec.ContactLeaderAddress.Province = value
+	case "postalCode":
+		rec.ContactLeaderAddress.PostalCode = value
+	case "estimatedYouth":
+		return parseImportCount(&rec.EstimatedYouth, column, value)
+	case "estimatedLeaders":
+		return parseImportCount(&rec.EstimatedLeaders, column, value)
+	}
+	return nil
+}
+
+func parseImportCount(out *int, column, value string) error {
+	if value == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return ImportRowError.New("%s must be a whole number, got %q", column, value)
+	}
+	*out = n
+	return nil
+}
+
+type RegistrationImportRow struct {
+	// Starting from 1 for the first row after the header.
+	Row         int    `json:"row"`
+	SecurityKey string `json:"securityKey,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type RegistrationImportResult struct {
+	DryRun   bool                    `json:"dryRun"`
+	Imported int                     `json:"imported"`
+	Failed   int                     `json:"failed"`
+	Rows     []RegistrationImportRow `json:"rows"`
+}
+
+// Parses an import CSV into records, using the same column names as the
+// export.  Answers to the schema's questions go in its custom columns, and
+// are checked as for a registration.  Rows that fail to parse or validate
+// get a nil record and an error.
+func parseRegistrationImport(in io.Reader, schema *FormSchema) (recs []*GroupPreRegistration, rowErrs []error, err error) {
+	reader := csv.NewReader(in)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil, ImportHeaderError.New("Empty import")
+	} else if err != nil {
+		return nil, nil, ImportHeaderError.New("Failed to read header: %s", err)
+	}
+	customColumns := make(map[string]bool)
+	for _, field := range schema.Fields {
+		customColumns[customFieldColumnPrefix+field.Name] = true
+	}
+	columns := make(map[string]bool)
+	for _, name := range header {
+		if indexOf(importColumns, name) < 0 && !customColumns[name] {
+			return nil, nil, ImportHeaderError.New("Unknown column %q", name)
+		}
+		if columns[name] {
+			return nil, nil, ImportHeaderError.New("Duplicate column %q", name)
+		}
+		columns[name] = true
+	}
+	for _, name := range importRequiredColumns {
+		if !columns[name] {
+			return nil, nil, ImportHeaderError.New("Missing required column %q", name)
+		}
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if _, ok := err.(*csv.ParseError); !ok {
+				return nil, nil, err
+			}
+			// The reader skips past the bad line, so carry on with the rest.
+			recs = append(recs, nil)
+			rowErrs = append(rowErrs, ImportRowError.New("%s", err))
+			continue
+		}
+		rec := &GroupPreRegistration{}
+		answers := make(map[string]string)
+		var rowErr error
+		for i, value := range record {
+			value = strings.TrimSpace(value)
+			if customColumns[header[i]] {
+				if value != "" {
+					answers[strings.TrimPrefix(header[i], customFieldColumnPrefix)] = value
+				}
+			} else if rowErr = setImportColumn(rec, header[i], value); rowErr != nil {
+				break
+			}
+		}
+		if rowErr == nil {
+			verr := &ValidationError{}
+			if err := rec.Validate(); err != nil {
+				verr = err.(*ValidationError)
+			}
+			rec.CustomFields = schema.checkAnswers(verr, answers)
+			if len(verr.Errors) != 0 {
+				rowErr = verr
+			}
+		}
+		if rowErr != nil {
+			rec = nil
+		}
+		recs = append(recs, rec)
+		rowErrs = append(rowErrs, rowErr)
+	}
+	return recs, rowErrs, nil
+}
+
+func indexOf(list []string, value string) int {
+	for i, elm := range list {
+		if elm == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// Imports registrations from a CSV body.  Every row is checked and reported
+// on, only the rows without errors are created.  Passing dryRun=true reports
+// what would happen without creating anything, and suppressEmails=true skips
+// sending the usual confirmation emails to the imported contacts.
+func (h *PreRegHandler) Import(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+	suppressEmails := r.URL.Query().Get("suppressEmails") == "true"
+
+	schema, err := h.formSchemaDb.GetFormSchema()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	recs, rowErrs, err := parseRegistrationImport(r.Body, schema)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	valid := []*GroupPreRegistration{}
+	validLines := []int{}
+	for i, rec := range recs {
+		if rec != nil {
+			valid = append(valid, rec)
+			validLines = append(validLines, i)
+		}
+	}
+	importErrs, err := h.db.ImportRecords(valid, dryRun)
+	if err != nil {
+		log.Printf("Failed to import records!  Error: %s", err)
+		httpError(w, err)
+		return
+	}
+	for i, line := range validLines {
+		rowErrs[line] = importErrs[i]
+	}
+
+	result := RegistrationImportResult{
+		DryRun: dryRun,
+		Rows:   make([]RegistrationImportRow, len(recs)),
+	}
+	for i, rec := range recs {
+		row := &result.Rows[i]
+		row.Row = i + 1
+		if rowErrs[i] != nil {
+			row.Error = rowErrs[i].Error()
+			result.Failed++
+		} else {
+			result.Imported++
+			if !dryRun {
+				row.SecurityKey = rec.SecurityKey
+			}
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := json.NewEncoder(buf).Encode(result); err != nil {
+		http.Error(w, "Failed to encode import result", 500)
+		return
+	}
+	w.Header()["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, buf)
+
+	if dryRun || suppressEmails {
+		return
+	}
+	for i, rec := range recs {
+		if rowErrs[i] != nil {
+			continue
+		}
+		if err := h.confirmationEmailService.RequestEmailConfirmation(rec); err != nil {
+			log.Printf("Failed to send initial email confirmation for imported key %s, error %s!", rec.SecurityKey, err)
+		}
+	}
+}
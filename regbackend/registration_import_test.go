@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestPreRegImport(t *testing.T) {
+	Convey("Starting with a handler with one group registered", t, func() {
+		db := boltorm.NewMemoryDB()
+		invDb, err := NewInvoiceDb(db)
+		So(err, ShouldBeNil)
+		config := &configType{}
+		config.Auth.AllowedEmails = stringSliceConfig{"admin@example.com"}
+		prdb, err := NewPreRegBoltDb(db, config, invDb)
+		So(err, ShouldBeNil)
+		router := mux.NewRouter()
+		emailSender := &testEmailSender{}
+		ces := NewConfirmationEmailService("examplesite.com", "no-reply@examplesender.com", "no-reply", "info@infoexample.com", emailSender, prdb)
+		store := sessions.NewCookieStore([]byte("A"))
+		formSchemaDb := newTestFormSchemaDb(db)
+		newTestPreRegHandler(router, config, prdb, formSchemaDb, newTestAuthHandler(config, store), ces)
+
+		loggedInCookie := loggedInAs(store, "admin@example.com")
+
+		So(prdb.CreateRecord(&GroupPreRegistration{
+			PackName:           "Pack A",
+			GroupName:          "1st Testingway",
+			Council:            "Council rock",
+			ContactLeaderEmail: "existing@example.com",
+		}), ShouldBeNil)
+
+		importCSV := func(query, body string) *httptest.ResponseRecorder {
+			return testRequest(router, "POST", "/preregistration/import"+query, body, loggedInCookie)
+		}
+		decodeResult := func(w *httptest.ResponseRecorder) RegistrationImportResult {
+			result := RegistrationImportResult{}
+			So(json.Unmarshal(w.Body.Bytes(), &result), ShouldBeNil)
+			return result
+		}
+		countRecords := func() int {
+			recs, err := prdb.GetAll()
+			So(err, ShouldBeNil)
+			return len(recs)
+		}
+
+		body := "packName,groupName,council,contactLeaderFirstName,contactLeaderEmail,estimatedYouth\n" +
+			"Pack A,2nd Testingway,Council rock,Alice,alice@example.com,12\n" +
+			"Pack A,1st Testingway,Council rock,Bob,bob@example.com,8\n" +
+			"Pack B,1st Testingway,Council rock,Carol,existing@example.com,3\n" +
+			"Pack B,2nd Testingway,Council rock,Dave,dave@example.com,lots\n" +
+			"Pack C,2nd Testingway,,Eve,eve@example.com,\n" +
+			"Pack C,3rd Testingway,Council rock,Frank,frank@example.com,\n"
+
+		Convey("Importing while not logged in should be forbidden", func() {
+			r, err := http.NewRequest("POST", "http://localhost:8080/preregistration/import", strings.NewReader(body))
+			So(err, ShouldBeNil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+			So(countRecords(), ShouldEqual, 1)
+		})
+
+		Convey("Importing with an unknown column should fail outright", func() {
+			w := importCSV("", "groupName,council,contactLeaderEmail,shoeSize\n1st A,Council,a@example.com,9\n")
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(w.Body.String(), ShouldContainSubstring, "shoeSize")
+			So(countRecords(), ShouldEqual, 1)
+		})
+
+		Convey("Importing without a required column should fail outright", func() {
+			w := importCSV("", "groupName,contactLeaderEmail\n1st A,a@example.com\n")
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(w.Body.String(), ShouldContainSubstring, "council")
+		})
+
+		Convey("A dry run import", func() {
+			w := importCSV("?dryRun=true", body)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			result := decodeResult(w)
+			Convey("Should report each row", func() {
+				So(result.DryRun, ShouldBeTrue)
+				So(result.Imported, ShouldEqual, 2)
+				So(result.Failed, ShouldEqual, 4)
+				So(len(result.Rows), ShouldEqual, 6)
+				So(result.Rows[0].Error, ShouldEqual, "")
+				So(result.Rows[1].Error, ShouldContainSubstring, "already exists")
+				So(result.Rows[2].Error, ShouldContainSubstring, "existing@example.com")
+				So(result.Rows[3].Error, ShouldContainSubstring, "estimatedYouth")
+				So(result.Rows[4].Error, ShouldContainSubstring, "council: is required")
+				So(result.Rows[5].Row, ShouldEqual, 6)
+			})
+			Convey("Should not hand out security keys", func() {
+				So(result.Rows[0].SecurityKey, ShouldEqual, "")
+			})
+			Convey("Should not create anything or send emails", func() {
+				So(countRecords(), ShouldEqual, 1)
+				So(len(emailSender.Emails), ShouldEqual, 0)
+			})
+		})
+
+		Convey("A real import", func() {
+			w := importCSV("", body)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			result := decodeResult(w)
+			So(result.DryRun, ShouldBeFalse)
+			So(result.Imported, ShouldEqual, 2)
+			Convey("Should create the valid rows", func() {
+				So(countRecords(), ShouldEqual, 3)
+				rec, err := prdb.GetRecord(result.Rows[0].SecurityKey)
+				So(err, ShouldBeNil)
+				So(rec.ContactLeaderFirstName, ShouldEqual, "Alice")
+				So(rec.EstimatedYouth, ShouldEqual, 12)
+			})
+			Convey("Should send confirmation emails to the imported contacts", func() {
+				So(len(emailSender.Emails), ShouldEqual, 2)
+				So(emailSender.Emails[0].To, ShouldResemble, []string{"alice@example.com"})
+				So(emailSender.Emails[1].To, ShouldResemble, []string{"frank@example.com"})
+			})
+		})
+
+		Convey("An import with emails suppressed should not send any", func() {
+			w := importCSV("?suppressEmails=true", body)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(countRecords(), ShouldEqual, 3)
+			So(len(emailSender.Emails), ShouldEqual, 0)
+		})
+
+		Convey("With a form schema", func() {
+			So(formSchemaDb.SetFormSchema(testFormSchema()), ShouldBeNil)
+			Convey("Answers should be imported from the custom columns and checked", func() {
+				w := importCSV("", "groupName,council,contactLeaderEmail,custom.campsites,custom.sponsor\n"+
+					"2nd Testingway,Council rock,alice@example.com,2,Rotary\n"+
+					"3rd Testingway,Council rock,bob@example.com,,Rotary\n"+
+					"4th Testingway,Council rock,carol@example.com,9,rotary\n")
+				So(w.Code, ShouldEqual, http.StatusOK)
+				result := decodeResult(w)
+				So(result.Imported, ShouldEqual, 1)
+				So(result.Rows[1].Error, ShouldContainSubstring, "customFields.campsites: is required")
+				So(result.Rows[2].Error, ShouldContainSubstring, "customFields.campsites")
+				So(result.Rows[2].Error, ShouldContainSubstring, "customFields.sponsor")
+				rec, err := prdb.GetRecord(result.Rows[0].SecurityKey)
+				So(err, ShouldBeNil)
+				So(rec.CustomFields, ShouldResemble, map[string]string{"campsites": "2", "sponsor": "Rotary"})
+			})
+			Convey("Rows missing a required answer should be refused", func() {
+				w := importCSV("", "groupName,council,contactLeaderEmail\n2nd Testingway,Council rock,alice@example.com\n")
+				So(w.Code, ShouldEqual, http.StatusOK)
+				result := decodeResult(w)
+				So(result.Imported, ShouldEqual, 0)
+				So(result.Rows[0].Error, ShouldContainSubstring, "customFields.campsites: is required")
+				So(countRecords(), ShouldEqual, 1)
+			})
+			Convey("Custom columns for unknown questions should fail outright", func() {
+				w := importCSV("", "groupName,council,contactLeaderEmail,custom.shoeSize\n1st A,Council,a@example.com,9\n")
+				So(w.Code, ShouldEqual, http.StatusBadRequest)
+				So(w.Body.String(), ShouldContainSubstring, "custom.shoeSize")
+			})
+		})
+	})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+)
+
+// What an administrator may do.  Viewers can see registrations and reports,
+// registrars can also change registrations, finance can also export them
+// for accounting and record payments, and superadmins can do everything
+// including configuring the event and assigning roles.
+const (
+	RoleViewer     = "viewer"
+	RoleRegistrar  = "registrar"
+	RoleFinance    = "finance"
+	RoleSuperadmin = "superadmin"
+)
+
+var adminRoles = []string{RoleViewer, RoleRegistrar, RoleFinance, RoleSuperadmin}
+
+var (
+	BOLT_ROLEBUCKET = []byte("BUCKET_ROLE")
+)
+
+type RoleAssignment struct {
+	Email string `json:"email"`
+	// Empty once the role has been taken away.
+	Role string `json:"role"`
+	// Administrators from the configuration are always superadmins, and
+	// can't be changed through the API.
+	FromConfig bool `json:"fromConfig"`
+
+	UpdatedBy string    `json:"updatedBy"`
+	Updated   time.Time `json:"updated"`
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+type RoleDb interface {
+	GetRole(email string) (string, error)
+	GetRoleAssignments() ([]*RoleAssignment, error)
+	SetRole(assignment *RoleAssignment) error
+}
+
+type roleDbBolt struct {
+	db boltorm.DB
+}
+
+func NewRoleDb(db boltorm.DB) (RoleDb, error) {
+	if err := db.Update(func(tx boltorm.Tx) error {
+		return tx.CreateBucketIfNotExists(BOLT_ROLEBUCKET)
+	}); err != nil {
+		return nil, err
+	}
+	return &roleDbBolt{db}, nil
+}
+
+// Returns the stored role, or an empty string if there is none.
+func (d *roleDbBolt) GetRole(email string) (role string, err error) {
+	return role, d.db.View(func(tx boltorm.Tx) error {
+		assignment := &RoleAssignment{}
+		if err := tx.Get(BOLT_ROLEBUCKET, []byte(normalizeEmail(email)), assignment); err != nil {
+			if boltorm.ErrKeyDoesNotExist.Contains(err) {
+				return nil
+			}
+			return err
+		}
+		role = assignment.Role
+		return nil
+	})
+}
+
+// Lists the current assignments, leaving out roles that were taken away.
+func (d *roleDbBolt) GetRoleAssignments() (assignments []*RoleAssignment, err error) {
+	return assignments, d.db.View(func(tx boltorm.Tx) error {
+		res, err := tx.GetAll(BOLT_ROLEBUCKET, &RoleAssignment{})
+		if err != nil {
+			return err
+		}
+		for _, assignment := range res.([]*RoleAssignment) {
+			if assignment.Role != "" {
+				assignments = append(assignments, assignment)
+			}
+		}
+		return nil
+	})
+}
+
+// Earlier assignments are kept as previous versions of the record.
+func (d *roleDbBolt) SetRole(assignment *RoleAssignment) error {
+	assignment.Email = normalizeEmail(assignment.Email)
+	return d.db.Update(func(tx boltorm.Tx) error {
+		err := tx.Update(BOLT_ROLEBUCKET, []byte(assignment.Email), assignment)
+		if boltorm.ErrKeyDoesNotExist.Contains(err) {
+			return tx.Insert(BOLT_ROLEBUCKET, []byte(assignment.Email), assignment)
+		}
+		return err
+	})
+}
+
+type RoleHandler struct {
+	db          RoleDb
+	authHandler *AuthenticationHandler
+}
+
+func (h *RoleHandler) GetAll(w http.ResponseWriter, r *http.Request) {
+	stored, err := h.db.GetRoleAssignments()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	assignments := []*RoleAssignment{}
+	for _, email := range h.authHandler.configuredAdmins() {
+		assignments = append(assignments, &RoleAssignment{Email: email, Role: RoleSuperadmin, FromConfig: true})
+	}
+	for _, assignment := range stored {
+		if !h.authHandler.allowedAdmin(assignment.Email) {
+			assignments = append(assignments, assignment)
+		}
+	}
+	writeJSON(w, http.StatusOK, assignments)
+}
+
+// Assigns the role in the body to the administrator in the path, or takes
+// their role away if it is empty.
+func (h *RoleHandler) Set(w http.ResponseWriter, r *http.Request) {
+	input := struct {
+		Role string `json:"role"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid role json given", http.StatusBadRequest)
+		return
+	}
+	email := normalizeEmail(mux.Vars(r)["Email"])
+
+	verr := &ValidationError{}
+	if !validEmailAddress(email) {
+		verr.add("email", "is not a valid email address")
+	} else if h.authHandler.allowedAdmin(email) {
+		verr.add("email", "is an administrator from the configuration")
+	}
+	if input.Role != "" && indexOf(adminRoles, input.Role) < 0 {
+		verr.add("role", "must be one of %s", strings.Join(adminRoles, ", "))
+	}
+	if len(verr.Errors) != 0 {
+		writeValidationError(w, verr)
+		return
+	}
+
+	assignment := &RoleAssignment{
+		Email:     email,
+		Role:      input.Role,
+		UpdatedBy: h.authHandler.sessionUser(r),
+		Updated:   time.Now(),
+	}
+	if err := h.db.SetRole(assignment); err != nil {
+		log.Printf("Failed to store role for %s!  Error: %s", email, err)
+		httpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, assignment)
+}
+
+func NewRoleHandler(r *mux.Router, db RoleDb, authHandler *AuthenticationHandler) *RoleHandler {
+	h := &RoleHandler{
+		db:          db,
+		authHandler: authHandler,
+	}
+
+	r.HandleFunc("/roles", authHandler.RoleFunc(h.GetAll, RoleSuperadmin)).Methods("GET")
+	r.HandleFunc("/roles/{Email}", authHandler.RoleFunc(h.Set, RoleSuperadmin)).Methods("PUT")
+
+	return h
+}
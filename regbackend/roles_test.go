@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestRoleDb(t *testing.T) {
+	Convey("With a role database", t, func() {
+		roleDb, err := NewRoleDb(boltorm.NewMemoryDB())
+		So(err, ShouldBeNil)
+
+		Convey("Unknown administrators should have no role", func() {
+			role, err := roleDb.GetRole("nobody@example.com")
+			So(err, ShouldBeNil)
+			So(role, ShouldEqual, "")
+		})
+		Convey("Assigning a role", func() {
+			So(roleDb.SetRole(&RoleAssignment{Email: " Viewer@Example.com", Role: RoleViewer}), ShouldBeNil)
+			Convey("Should store it under the normalized email address", func() {
+				role, err := roleDb.GetRole("viewer@example.com")
+				So(err, ShouldBeNil)
+				So(role, ShouldEqual, RoleViewer)
+				assignments, err := roleDb.GetRoleAssignments()
+				So(err, ShouldBeNil)
+				So(len(assignments), ShouldEqual, 1)
+				So(assignments[0].Email, ShouldEqual, "viewer@example.com")
+			})
+			Convey("Should let it be changed and taken away", func() {
+				So(roleDb.SetRole(&RoleAssignment{Email: "viewer@example.com", Role: RoleFinance}), ShouldBeNil)
+				role, err := roleDb.GetRole("viewer@example.com")
+				So(err, ShouldBeNil)
+				So(role, ShouldEqual, RoleFinance)
+
+				So(roleDb.SetRole(&RoleAssignment{Email: "viewer@example.com"}), ShouldBeNil)
+				role, err = roleDb.GetRole("viewer@example.com")
+				So(err, ShouldBeNil)
+				So(role, ShouldEqual, "")
+				assignments, err := roleDb.GetRoleAssignments()
+				So(err, ShouldBeNil)
+				So(len(assignments), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestRoleAccess(t *testing.T) {
+	Convey("With administrators in each role", t, func() {
+		db := boltorm.NewMemoryDB()
+		invDb, err := NewInvoiceDb(db)
+		So(err, ShouldBeNil)
+		config := &configType{}
+		config.Auth.AllowedEmails = stringSliceConfig{"admin@example.com"}
+		prdb, err := NewPreRegBoltDb(db, config, invDb)
+		So(err, ShouldBeNil)
+		roleDb, err := NewRoleDb(db)
+		So(err, ShouldBeNil)
+		for _, role := range []string{RoleViewer, RoleRegistrar, RoleFinance} {
+			So(roleDb.SetRole(&RoleAssignment{Email: role + "@example.com", Role: role}), ShouldBeNil)
+		}
+		store := sessions.NewCookieStore([]byte("A"))
+		router := mux.NewRouter()
+		authHandler := NewAuthenticationHandler(router, config, store, nil, roleDb, nil, nil)
+		NewRoleHandler(router, roleDb, authHandler)
+		newTestPreRegHandler(router, config, prdb, newTestFormSchemaDb(db), authHandler, nil)
+
+		rec := &GroupPreRegistration{GroupName: "Group", PackName: "A", Council: "Voyageur", ContactLeaderEmail: "a@example.com"}
+		So(prdb.CreateRecord(rec), ShouldBeNil)
+
+		allowed := func(method, path, email string) bool {
+			return testRequest(router, method, path, nil, loggedInAs(store, email)).Code != http.StatusForbidden
+		}
+		promote := "/preregistration/" + rec.SecurityKey + "/promote"
+
+		Convey("Every role should see the registrations", func() {
+			for _, email := range []string{"viewer@example.com", "registrar@example.com", "finance@example.com", "admin@example.com"} {
+				So(allowed("GET", "/preregistration", email), ShouldBeTrue)
+			}
+			So(allowed("GET", "/preregistration", "nobody@example.com"), ShouldBeFalse)
+		})
+		Convey("Only registrars and superadmins should promote groups", func() {
+			So(allowed("POST", promote, "viewer@example.com"), ShouldBeFalse)
+			So(allowed("POST", promote, "finance@example.com"), ShouldBeFalse)
+			So(allowed("POST", promote, "registrar@example.com"), ShouldBeTrue)
+			So(allowed("POST", promote, "admin@example.com"), ShouldBeTrue)
+		})
+		Convey("Only finance, registrars and superadmins should export registrations", func() {
+			So(allowed("GET", "/preregistration/export", "viewer@example.com"), ShouldBeFalse)
+			So(allowed("GET", "/preregistration/export", "finance@example.com"), ShouldBeTrue)
+			So(allowed("GET", "/preregistration/export", "registrar@example.com"), ShouldBeTrue)
+		})
+		Convey("Only finance and superadmins should record payments", func() {
+			payments := "/preregistration/" + rec.SecurityKey + "/invoice/payments"
+			record := func(email string) *httptest.ResponseRecorder {
+				return testRequest(router, "POST", payments, &Payment{Amount: 5000, Method: "cheque", Reference: "102"}, loggedInAs(store, email))
+			}
+			So(record("viewer@example.com").Code, ShouldEqual, http.StatusForbidden)
+			So(record("registrar@example.com").Code, ShouldEqual, http.StatusForbidden)
+			Convey("Once the group has an invoice", func() {
+				_, err := prdb.CreateInvoiceIfNotExists(rec)
+				So(err, ShouldBeNil)
+				w := record("finance@example.com")
+				So(w.Code, ShouldEqual, http.StatusOK)
+				inv := &Invoice{}
+				So(json.Unmarshal(w.Body.Bytes(), inv), ShouldBeNil)
+				So(len(inv.Payments), ShouldEqual, 1)
+				So(inv.Payments[0].RecordedBy, ShouldEqual, "finance@example.com")
+				So(record("admin@example.com").Code, ShouldEqual, http.StatusOK)
+				stored, err := prdb.GetInvoice(rec.InvoiceID)
+				So(err, ShouldBeNil)
+				So(stored.Paid(), ShouldEqual, 10000)
+			})
+			Convey("Not before it has an invoice", func() {
+				So(record("finance@example.com").Code, ShouldEqual, http.StatusBadRequest)
+			})
+			Convey("Not for nothing", func() {
+				w := testRequest(router, "POST", payments, &Payment{Method: "cheque"}, loggedInAs(store, "finance@example.com"))
+				So(w.Code, ShouldEqual, http.StatusUnprocessableEntity)
+			})
+		})
+		Convey("Only superadmins should manage roles", func() {
+			So(allowed("GET", "/roles", "registrar@example.com"), ShouldBeFalse)
+			So(allowed("PUT", "/roles/viewer@example.com", "registrar@example.com"), ShouldBeFalse)
+			So(allowed("GET", "/roles", "admin@example.com"), ShouldBeTrue)
+		})
+		Convey("Listing the roles should include the configured administrators", func() {
+			w := testRequest(router, "GET", "/roles", nil, loggedInAs(store, "admin@example.com"))
+			So(w.Code, ShouldEqual, http.StatusOK)
+			assignments := []*RoleAssignment{}
+			So(json.Unmarshal(w.Body.Bytes(), &assignments), ShouldBeNil)
+			So(len(assignments), ShouldEqual, 4)
+			So(assignments[0].Email, ShouldEqual, "admin@example.com")
+			So(assignments[0].Role, ShouldEqual, RoleSuperadmin)
+			So(assignments[0].FromConfig, ShouldBeTrue)
+		})
+		Convey("Bad role changes should be refused", func() {
+			w := testRequest(router, "PUT", "/roles/admin@example.com", []byte(`{"role": "viewer"}`), loggedInAs(store, "admin@example.com"))
+			So(w.Code, ShouldEqual, http.StatusUnprocessableEntity)
+			w = testRequest(router, "PUT", "/roles/someone@example.com", []byte(`{"role": "owner"}`), loggedInAs(store, "admin@example.com"))
+			So(w.Code, ShouldEqual, http.StatusUnprocessableEntity)
+			w = testRequest(router, "PUT", "/roles/someone", []byte(`{"role": "viewer"}`), loggedInAs(store, "admin@example.com"))
+			So(w.Code, ShouldEqual, http.StatusUnprocessableEntity)
+		})
+		Convey("Changing a role should apply to existing sessions", func() {
+			w := testRequest(router, "PUT", "/roles/Viewer@example.com", []byte(`{"role": "registrar"}`), loggedInAs(store, "admin@example.com"))
+			So(w.Code, ShouldEqual, http.StatusOK)
+			assignment := &RoleAssignment{}
+			So(json.Unmarshal(w.Body.Bytes(), assignment), ShouldBeNil)
+			So(assignment.Email, ShouldEqual, "viewer@example.com")
+			So(assignment.UpdatedBy, ShouldEqual, "admin@example.com")
+			So(allowed("POST", promote, "viewer@example.com"), ShouldBeTrue)
+
+			So(testRequest(router, "PUT", "/roles/viewer@example.com", []byte(`{"role": ""}`), loggedInAs(store, "admin@example.com")).Code, ShouldEqual, http.StatusOK)
+			So(allowed("GET", "/preregistration", "viewer@example.com"), ShouldBeFalse)
+		})
+		Convey("isLoggedIn should report the role", func() {
+			w := testRequest(router, "GET", "/authentication/isLoggedIn", nil, loggedInAs(store, "finance@example.com"))
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqual, `{"loggedIn":true,"email":"finance@example.com","role":"finance"}`+"\n")
+		})
+	})
+}
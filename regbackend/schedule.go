@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+	"github.com/spacemonkeygo/errors/errhttp"
+)
+
+const (
+	PhaseNotYetOpen  = "notYetOpen"
+	PhaseOpen        = "open"
+	PhaseWaitingList = "waitingList"
+	PhaseClosed      = "closed"
+)
+
+// Wall clock times in the schedule's time zone.
+const scheduleTimeLayout = "2006-01-02T15:04"
+
+// A stretch of time during which groups can register, either outright or
+// onto the waiting list.
+type RegistrationWindow struct {
+	Phase string `json:"phase"`
+	Start string `json:"start"`
+	// Only the last window may leave this empty, to stay open indefinitely.
+	End string `json:"end"`
+}
+
+// Registration is not yet open before the first window, and closed between
+// and after them.  Without any windows the command line flags decide.
+type RegistrationSchedule struct {
+	TimeZone string               `json:"timeZone"`
+	Windows  []RegistrationWindow `json:"windows"`
+
+	UpdatedBy string    `json:"updatedBy"`
+	Updated   time.Time `json:"updated"`
+}
+
+var (
+	RegistrationNotOpen = DBError.NewClass("Group registrations are not open yet", errhttp.SetStatusCode(403))
+	RegistrationClosed  = DBError.NewClass("Group registrations are closed", errhttp.SetStatusCode(403))
+)
+
+var (
+	BOLT_SCHEDULEBUCKET = []byte("BUCKET_SCHEDULE")
+)
+
+var scheduleKey = []byte("schedule")
+
+func (s *RegistrationSchedule) Validate() error {
+	verr := &ValidationError{}
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil || (s.TimeZone == "" && len(s.Windows) != 0) {
+		verr.add("timeZone", "must be a time zone name, like America/Toronto")
+		loc = nil
+	}
+
+	var previousEnd time.Time
+	for i := range s.Windows {
+		window := &s.Windows[i]
+		prefix := "windows[" + strconv.Itoa(i) + "]."
+		if window.Phase != PhaseOpen && window.Phase != PhaseWaitingList {
+			verr.add(prefix+"phase", "must be %s or %s", PhaseOpen, PhaseWaitingList)
+		}
+		window.Start = strings.TrimSpace(window.Start)
+		window.End = strings.TrimSpace(window.End)
+		if loc == nil {
+			continue
+		}
+		start, err := time.ParseInLocation(scheduleTimeLayout, window.Start, loc)
+		if err != nil {
+			verr.add(prefix+"start", "must be a time, like 2016-01-15T09:00")
+			continue
+		}
+		if !previousEnd.IsZero() && start.Before(previousEnd) {
+			verr.add(prefix+"start", "must not be before the end of the previous window")
+		}
+		if window.End == "" {
+			if i != len(s.Windows)-1 {
+				verr.add(prefix+"end", "may only be left out on the last window")
+			}
+			continue
+		}
+		end, err := time.ParseInLocation(scheduleTimeLayout, window.End, loc)
+		if err != nil {
+			verr.add(prefix+"end", "must be a time, like 2016-01-15T09:00")
+			continue
+		} else if !end.After(start) {
+			verr.add(prefix+"end", "must be after the start")
+		}
+		previousEnd = end
+	}
+
+	if len(verr.Errors) != 0 {
+		return verr
+	}
+	return nil
+}
+
+// Returns the phase at now, and when it next changes (zero if it never does).
+// The schedule must have been validated.
+func (s *RegistrationSchedule) phaseAt(now time.Time) (phase string, changesAt time.Time) {
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		log.Printf("Registration schedule has a bad time zone %s, treating it as closed", s.TimeZone)
+		return PhaseClosed, time.Time{}
+	}
+	for i, window := range s.Windows {
+		start, _ := time.ParseInLocation(scheduleTimeLayout, window.Start, loc)
+		if now.Before(start) {
+			if i == 0 {
+				return PhaseNotYetOpen, start
+			}
+			return PhaseClosed, start
+		}
+		if window.End == "" {
+			return window.Phase, time.Time{}
+		}
+		end, _ := time.ParseInLocation(scheduleTimeLayout, window.End, loc)
+		if now.Before(end) {
+			return window.Phase, end
+		}
+	}
+	return PhaseClosed, time.Time{}
+}
+
+func configPhase(config *configType) string {
+	general := config.current().General
+	if !general.EnableGroupReg {
+		return PhaseClosed
+	} else if general.EnableWaitingList {
+		return PhaseWaitingList
+	}
+	return PhaseOpen
+}
+
+func getSchedule(tx boltorm.Tx) (*RegistrationSchedule, error) {
+	schedule := &RegistrationSchedule{}
+	if err := tx.Get(BOLT_SCHEDULEBUCKET, scheduleKey, schedule); err != nil && !boltorm.ErrKeyDoesNotExist.Contains(err) {
+		return nil, err
+	}
+	if schedule.Windows == nil {
+		schedule.Windows = []RegistrationWindow{}
+	}
+	return schedule, nil
+}
+
+// Decides whether a new record goes onto the waiting list, refusing it
+// outside of the scheduled windows when enforce is set.  Without a schedule
+// this is left to the flags, as it always has been.
+func (d *preRegDbBolt) newRecordOnWaitingList(tx boltorm.Tx, enforce bool) (bool, error) {
+	schedule, err := getSchedule(tx)
+	if err != nil {
+		return false, err
+	}
+	if len(schedule.Windows) == 0 {
+		return d.config.current().General.EnableWaitingList, nil
+	}
+	phase, _ := schedule.phaseAt(time.Now())
+	if enforce && phase == PhaseNotYetOpen {
+		return false, RegistrationNotOpen.New("Registration opens at %s", schedule.Windows[0].Start)
+	} else if enforce && phase == PhaseClosed {
+		return false, RegistrationClosed.New("Registration is closed")
+	}
+	return phase == PhaseWaitingList, nil
+}
+
+func (d *preRegDbBolt) CurrentPhase(now time.Time) (phase string, changesAt time.Time, err error) {
+	return phase, changesAt, d.db.View(func(tx boltorm.Tx) error {
+		schedule, err := getSchedule(tx)
+		if err != nil {
+			return err
+		}
+		if len(schedule.Windows) == 0 {
+			phase = configPhase(d.config)
+		} else {
+			phase, changesAt = schedule.phaseAt(now)
+		}
+		return nil
+	})
+}
+
+func (d *preRegDbBolt) GetSchedule() (schedule *RegistrationSchedule, err error) {
+	return schedule, d.db.View(func(tx boltorm.Tx) error {
+		schedule, err = getSchedule(tx)
+		return err
+	})
+}
+
+// Earlier schedules are kept as previous versions of the record.
+func (d *preRegDbBolt) SetSchedule(schedule *RegistrationSchedule) error {
+	return d.db.Update(func(tx boltorm.Tx) error {
+		err := tx.Update(BOLT_SCHEDULEBUCKET, scheduleKey, schedule)
+		if boltorm.ErrKeyDoesNotExist.Contains(err) {
+			return tx.Insert(BOLT_SCHEDULEBUCKET, scheduleKey, schedule)
+		}
+		return err
+	})
+}
+
+type ScheduleHandler struct {
+	db          PreRegDb
+	authHandler *AuthenticationHandler
+}
+
+func (h *ScheduleHandler) Get(w http.ResponseWriter, r *http.Request) {
+	schedule, err := h.db.GetSchedule()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, schedule)
+}
+
+// Replaces the whole schedule, an empty list of windows hands control back
+// to the flags.
+func (h *ScheduleHandler) Set(w http.ResponseWriter, r *http.Request) {
+	schedule := &RegistrationSchedule{}
+	if err := json.NewDecoder(r.Body).Decode(schedule); err != nil {
+		http.Error(w, "Invalid schedule json given", 400)
+		return
+	}
+	if err := schedule.Validate(); err != nil {
+		writeValidationError(w, err.(*ValidationError))
+		return
+	}
+	if schedule.Windows == nil {
+		schedule.Windows = []RegistrationWindow{}
+	}
+	schedule.UpdatedBy = h.authHandler.sessionUser(r)
+	schedule.Updated = time.Now()
+	if err := h.db.SetSchedule(schedule); err != nil {
+		log.Printf("Failed to store registration schedule!  Error: %s", err)
+		httpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, schedule)
+}
+
+func NewScheduleHandler(r *mux.Router, db PreRegDb, authHandler *AuthenticationHandler) *ScheduleHandler {
+	h := &ScheduleHandler{
+		db:          db,
+		authHandler: authHandler,
+	}
+
+	r.HandleFunc("/schedule", authHandler.AdminFunc(h.Get)).Methods("GET")
+	r.HandleFunc("/schedule", authHandler.RoleFunc(h.Set, RoleSuperadmin)).Methods("PUT")
+
+	return h
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestRegistrationScheduleValidate(t *testing.T) {
+	Convey("A schedule with an open window followed by an open ended waiting list should validate", t, func() {
+		schedule := &RegistrationSchedule{TimeZone: "America/Toronto", Windows: []RegistrationWindow{
+			{PhaseOpen, " 2016-01-15T09:00", "2016-02-01T00:00"},
+			{PhaseWaitingList, "2016-02-01T00:00", ""},
+		}}
+		So(schedule.Validate(), ShouldBeNil)
+		So(schedule.Windows[0].Start, ShouldEqual, "2016-01-15T09:00")
+	})
+	Convey("An empty schedule should validate without a time zone", t, func() {
+		So((&RegistrationSchedule{}).Validate(), ShouldBeNil)
+	})
+	Convey("Windows need a time zone", t, func() {
+		schedule := &RegistrationSchedule{Windows: []RegistrationWindow{{PhaseOpen, "2016-01-15T09:00", ""}}}
+		So(fieldsOf(schedule.Validate()), ShouldContainKey, "timeZone")
+		schedule.TimeZone = "Somewhere/Else"
+		So(fieldsOf(schedule.Validate()), ShouldContainKey, "timeZone")
+	})
+	Convey("Bad windows should each be reported", t, func() {
+		schedule := &RegistrationSchedule{TimeZone: "America/Toronto", Windows: []RegistrationWindow{
+			{"registered", "2016-01-15 09:00", "2016-02-01T00:00"},
+			{PhaseOpen, "2016-02-01T00:00", ""},
+			{PhaseWaitingList, "2016-02-02T00:00", "2016-02-01T00:00"},
+			{PhaseWaitingList, "2016-01-31T12:00", "2016-03-01T00:00"},
+		}}
+		So(fieldsOf(schedule.Validate()), ShouldResemble, map[string]string{
+			"windows[0].phase": "must be open or waitingList",
+			"windows[0].start": "must be a time, like 2016-01-15T09:00",
+			"windows[1].end":   "may only be left out on the last window",
+			"windows[2].end":   "must be after the start",
+			"windows[3].start": "must not be before the end of the previous window",
+		})
+	})
+}
+
+func TestRegistrationSchedulePhase(t *testing.T) {
+	Convey("With an open window, a gap and then the waiting list, in Toronto time", t, func() {
+		schedule := &RegistrationSchedule{TimeZone: "America/Toronto", Windows: []RegistrationWindow{
+			{PhaseOpen, "2016-01-15T09:00", "2016-02-01T00:00"},
+			{PhaseWaitingList, "2016-02-02T00:00", "2016-03-01T00:00"},
+		}}
+		So(schedule.Validate(), ShouldBeNil)
+		at := func(utc string) (string, time.Time) {
+			now, err := time.Parse(time.RFC3339, utc)
+			So(err, ShouldBeNil)
+			return schedule.phaseAt(now)
+		}
+		utc := func(s string) time.Time {
+			t, err := time.Parse(time.RFC3339, s)
+			So(err, ShouldBeNil)
+			return t
+		}
+
+		Convey("Registration shouldn't be open until 9:00 local time", func() {
+			phase, changesAt := at("2016-01-15T13:59:00Z")
+			So(phase, ShouldEqual, PhaseNotYetOpen)
+			So(changesAt.Equal(utc("2016-01-15T14:00:00Z")), ShouldBeTrue)
+		})
+		Convey("Registration should be open from then until the window ends", func() {
+			phase, changesAt := at("2016-01-15T14:00:00Z")
+			So(phase, ShouldEqual, PhaseOpen)
+			So(changesAt.Equal(utc("2016-02-01T05:00:00Z")), ShouldBeTrue)
+		})
+		Convey("Registration should be closed between windows", func() {
+			phase, changesAt := at("2016-02-01T12:00:00Z")
+			So(phase, ShouldEqual, PhaseClosed)
+			So(changesAt.Equal(utc("2016-02-02T05:00:00Z")), ShouldBeTrue)
+		})
+		Convey("The waiting list should follow", func() {
+			phase, _ := at("2016-02-15T12:00:00Z")
+			So(phase, ShouldEqual, PhaseWaitingList)
+		})
+		Convey("Registration should be closed for good after the last window", func() {
+			phase, changesAt := at("2016-03-01T05:00:00Z")
+			So(phase, ShouldEqual, PhaseClosed)
+			So(changesAt.IsZero(), ShouldBeTrue)
+		})
+	})
+}
+
+func TestScheduledRegistration(t *testing.T) {
+	Convey("With registration open by the flags", t, func() {
+		db := boltorm.NewMemoryDB()
+		invDb, err := NewInvoiceDb(db)
+		So(err, ShouldBeNil)
+		config := &configType{}
+		config.Auth.AllowedEmails = stringSliceConfig{"admin@example.com"}
+		config.General.EnableGroupReg = true
+		prdb, err := NewPreRegBoltDb(db, config, invDb)
+		So(err, ShouldBeNil)
+		store := sessions.NewCookieStore([]byte("A"))
+		authHandler := newTestAuthHandler(config, store)
+		router := mux.NewRouter()
+		ces := NewConfirmationEmailService("examplesite.com", "no-reply@examplesender.com", "no-reply", "info@infoexample.com", &testEmailSender{}, prdb)
+		newTestPreRegHandler(router, config, prdb, newTestFormSchemaDb(db), authHandler, ces)
+		NewScheduleHandler(router, prdb, authHandler)
+
+		loggedInCookie := loggedInAs(store, "admin@example.com")
+
+		register := func() *httptest.ResponseRecorder {
+			return testRequest(router, "POST", "/preregistration", GroupPreRegistration{
+				GroupName:          "1st Testingway",
+				Council:            "Council rock",
+				ContactLeaderEmail: "testemail@example.com",
+			}, nil)
+		}
+		getConfig := func() map[string]interface{} {
+			r, err := http.NewRequest("GET", "http://localhost:8080/config", nil)
+			So(err, ShouldBeNil)
+			w := httptest.NewRecorder()
+			(&configHandler{config, prdb, nil, nil}).ServeHTTP(w, r)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			output := make(map[string]interface{})
+			So(json.Unmarshal(w.Body.Bytes(), &output), ShouldBeNil)
+			return output
+		}
+		loc, err := time.LoadLocation("America/Toronto")
+		So(err, ShouldBeNil)
+		hoursFromNow := func(hours int) string {
+			return time.Now().In(loc).Add(time.Duration(hours) * time.Hour).Format(scheduleTimeLayout)
+		}
+		setSchedule := func(windows ...RegistrationWindow) {
+			w := testRequest(router, "PUT", "/schedule", &RegistrationSchedule{TimeZone: "America/Toronto", Windows: windows}, loggedInCookie)
+			So(w.Code, ShouldEqual, http.StatusOK)
+		}
+
+		Convey("Without a schedule the flags should decide", func() {
+			So(getConfig()["registrationPhase"], ShouldEqual, PhaseOpen)
+			So(getConfig(), ShouldNotContainKey, "phaseChangesAt")
+			So(register().Code, ShouldEqual, http.StatusCreated)
+		})
+		Convey("Changing the schedule should require an administrator", func() {
+			w := testRequest(router, "PUT", "/schedule", &RegistrationSchedule{TimeZone: "America/Toronto"}, nil)
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("An invalid schedule should be refused", func() {
+			w := testRequest(router, "PUT", "/schedule", &RegistrationSchedule{Windows: []RegistrationWindow{{PhaseOpen, "soon", ""}}}, loggedInCookie)
+			So(w.Code, ShouldEqual, http.StatusUnprocessableEntity)
+		})
+
+		Convey("Before the first window opens", func() {
+			setSchedule(RegistrationWindow{PhaseOpen, hoursFromNow(1), ""})
+			Convey("The config should say so, and when it opens", func() {
+				output := getConfig()
+				So(output["registrationOpen"], ShouldEqual, false)
+				So(output["registrationPhase"], ShouldEqual, PhaseNotYetOpen)
+				So(output, ShouldContainKey, "phaseChangesAt")
+			})
+			Convey("Registering should be refused", func() {
+				So(register().Code, ShouldEqual, http.StatusForbidden)
+				recs, err := prdb.GetAll()
+				So(err, ShouldBeNil)
+				So(len(recs), ShouldEqual, 0)
+			})
+			Convey("The database should refuse records too", func() {
+				err := prdb.CreateRecord(&GroupPreRegistration{GroupName: "1st Testingway", Council: "Council rock", ContactLeaderEmail: "testemail@example.com"})
+				So(RegistrationNotOpen.Contains(err), ShouldBeTrue)
+			})
+			Convey("Administrators should still be able to import", func() {
+				rowErrs, err := prdb.ImportRecords([]*GroupPreRegistration{{GroupName: "1st Testingway", Council: "Council rock", ContactLeaderEmail: "testemail@example.com"}}, false)
+				So(err, ShouldBeNil)
+				So(rowErrs, ShouldResemble, []error{nil})
+			})
+			Convey("The schedule should be fetchable by administrators", func() {
+				w := testRequest(router, "GET", "/schedule", nil, loggedInCookie)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				schedule := &RegistrationSchedule{}
+				So(json.Unmarshal(w.Body.Bytes(), schedule), ShouldBeNil)
+				So(len(schedule.Windows), ShouldEqual, 1)
+				So(schedule.UpdatedBy, ShouldEqual, "admin@example.com")
+			})
+		})
+
+		Convey("During a waiting list window", func() {
+			setSchedule(
+				RegistrationWindow{PhaseOpen, hoursFromNow(-3), hoursFromNow(-2)},
+				RegistrationWindow{PhaseWaitingList, hoursFromNow(-1), hoursFromNow(1)},
+			)
+			Convey("The config should show the waiting list", func() {
+				output := getConfig()
+				So(output["registrationOpen"], ShouldEqual, true)
+				So(output["registrationOnWaitingList"], ShouldEqual, true)
+			})
+			Convey("New groups should go onto the waiting list regardless of the flags", func() {
+				w := register()
+				So(w.Code, ShouldEqual, http.StatusCreated)
+				rec := &GroupPreRegistration{}
+				So(json.Unmarshal(w.Body.Bytes(), rec), ShouldBeNil)
+				So(rec.IsOnWaitingList, ShouldBeTrue)
+			})
+		})
+
+		Convey("After the last window closes", func() {
+			setSchedule(RegistrationWindow{PhaseOpen, hoursFromNow(-3), hoursFromNow(-2)})
+			Convey("Registering should be refused", func() {
+				So(getConfig()["registrationPhase"], ShouldEqual, PhaseClosed)
+				So(register().Code, ShouldEqual, http.StatusForbidden)
+			})
+			Convey("Clearing the schedule should hand control back to the flags", func() {
+				setSchedule()
+				So(register().Code, ShouldEqual, http.StatusCreated)
+			})
+		})
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/boltdb/bolt"
+	"github.com/spacemonkeygo/errors"
+)
+
+// Version of the database layout.  Bump this whenever a change requires a
+// migration, as older binaries and snapshots will no longer be compatible.
+//
+//  1. The original layout.
+//  2. Events other than the default one keep their buckets under their own
+//     prefix.  Groups are indexed by their normalized name, by a security
+//     key that can be rotated, and by their normalized email address.
+//     Email verification tokens expire.
+const schemaVersion = 2
+
+var (
+	SchemaError = errors.NewClass("Database schema error")
+)
+
+var (
+	BOLT_METABUCKET = []byte("BUCKET_META")
+
+	boltSchemaVersionKey = []byte("schemaversion")
+)
+
+// Passes bringing the groups of a database from an older version up to date,
+// in order.  Each event's database runs them when it is opened, so they must
+// leave records they already updated alone.
+var groupMigrations = []func(tx boltorm.Tx) error{
+	// Version 2.
+	indexSecurityKeys,
+	reindexGroupNames,
+	reindexGroupEmails,
+	expireValidationTokens,
+}
+
+// Buckets which must be present in any database created by this binary,
+// with the version they were added in.  Older databases, such as restored
+// snapshots, only need the buckets their version had.
+var requiredBuckets = []struct {
+	name    []byte
+	version uint64
+}{
+	{BOLT_METABUCKET, 1},
+	{BOLT_GROUPBUCKET, 1},
+	{BOLT_GROUPNAMEMAPBUCKET, 1},
+	{BOLT_GROUPEMAILMAPBUCKET, 1},
+	{BOLT_GROUPEWAITINGLISTBUCKET, 1},
+	{BOLT_INVOICEBUCKET, 1},
+	{BOLT_GROUPSECURITYKEYBUCKET, 2},
+}
+
+func ensureSchemaVersion(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(BOLT_METABUCKET)
+		if err != nil {
+			return err
+		}
+		if version, err := readSchemaVersion(tx); err != nil {
+			return err
+		} else if version > schemaVersion {
+			return SchemaError.New("Database schema version %d is newer than this binary supports (%d)", version, schemaVersion)
+		} else if version == schemaVersion {
+			return nil
+		}
+		var versionBytes [8]byte
+		binary.BigEndian.PutUint64(versionBytes[:], schemaVersion)
+		return bucket.Put(boltSchemaVersionKey, versionBytes[:])
+	})
+}
+
+// Returns the schema version stored in the database, or 0 if none is stored.
+func readSchemaVersion(tx *bolt.Tx) (uint64, error) {
+	bucket := tx.Bucket(BOLT_METABUCKET)
+	if bucket == nil {
+		return 0, nil
+	}
+	versionBytes := bucket.Get(boltSchemaVersionKey)
+	if versionBytes == nil {
+		return 0, nil
+	} else if len(versionBytes) != 8 {
+		return 0, SchemaError.New("Stored schema version is corrupt")
+	}
+	return binary.BigEndian.Uint64(versionBytes), nil
+}
+
+// Verifies the database was written by a compatible binary and contains
+// every bucket its version requires.  Databases from older versions are
+// accepted, groupMigrations brings them up to date when they are next opened.
+func checkSchema(tx *bolt.Tx) error {
+	version, err := readSchemaVersion(tx)
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		return SchemaError.New("Database has no schema version")
+	} else if version > schemaVersion {
+		return SchemaError.New("Database schema version %d is newer than this binary supports (%d)", version, schemaVersion)
+	}
+	for _, bucket := range requiredBuckets {
+		if bucket.version <= version && tx.Bucket(bucket.name) == nil {
+			return SchemaError.New("Database is missing bucket %s", bucket.name)
+		}
+	}
+	return nil
+}
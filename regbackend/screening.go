@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+	"github.com/spacemonkeygo/errors/errhttp"
+)
+
+const (
+	CertificateWoodBadge = "woodBadge"
+	CertificateSafety    = "safety"
+
+	ScreeningPending  = "pending"
+	ScreeningCleared  = "cleared"
+	ScreeningRejected = "rejected"
+)
+
+// Training a leader has completed.
+type Certificate struct {
+	Kind string `json:"kind"`
+	// As YYYY-MM-DD, empty if it doesn't expire.
+	ExpiresOn string `json:"expiresOn"`
+}
+
+// Outcome of an administrator reviewing a leader's police record check.
+type LeaderScreening struct {
+	Status string `json:"status"`
+	// As YYYY-MM-DD, empty if it doesn't expire.
+	ExpiresOn  string    `json:"expiresOn"`
+	ReviewedBy string    `json:"reviewedBy"`
+	ReviewedOn time.Time `json:"reviewedOn"`
+}
+
+// A document uploaded in support of a leader's screening, its contents are kept in the DocumentStore.
+type ScreeningDocument struct {
+	ID          uint64    `json:"id"`
+	Name        string    `json:"name"`
+	ContentType string    `json:"contentType"`
+	Size        int       `json:"size"`
+	Checksum    string    `json:"checksum"`
+	Uploaded    time.Time `json:"uploaded"`
+}
+
+var (
+	NotALeader                = DBError.NewClass("Screening is only tracked for leaders", errhttp.SetStatusCode(400))
+	ScreeningDocumentNotFound = DBError.NewClass("Screening document does not exist", errhttp.SetStatusCode(404))
+)
+
+var (
+	// Where screening documents were kept, unencrypted, before the
+	// DocumentStore.  Only read to move them into it.
+	BOLT_SCREENINGDOCUMENTBUCKET = []byte("BUCKET_SCREENINGDOCUMENTS")
+)
+
+type screeningDocumentData struct {
+	SecurityKey   string
+	ParticipantID uint64
+	Data          []byte
+}
+
+// Moves screening documents uploaded before the DocumentStore into it.
+// They are the ones without a checksum, and get new ids as they move.
+func moveLegacyScreeningDocuments(tx boltorm.Tx, docs *DocumentStore) error {
+	res, err := tx.GetAll(BOLT_GROUPBUCKET, &GroupPreRegistration{})
+	if err != nil {
+		return err
+	}
+	legacyBucket := false
+	for _, gpr := range res.([]*GroupPreRegistration) {
+		roster, exists, err := getRoster(tx, gpr)
+		if err != nil || !exists {
+			return err
+		}
+		moved := 0
+		for _, p := range roster.Participants {
+			for i := range p.Documents {
+				doc := &p.Documents[i]
+				if doc.Checksum != "" {
+					continue
+				}
+				if !legacyBucket {
+					if err := tx.CreateBucketIfNotExists(BOLT_SCREENINGDOCUMENTBUCKET); err != nil {
+						return err
+					}
+					legacyBucket = true
+				}
+				stored := &screeningDocumentData{}
+				if err := tx.Get(BOLT_SCREENINGDOCUMENTBUCKET, documentKey(doc.ID), stored); err != nil {
+					return err
+				}
+				if err := tx.Delete(BOLT_SCREENINGDOCUMENTBUCKET, documentKey(doc.ID)); err != nil {
+					return err
+				}
+				if doc.ID, doc.Checksum, err = docs.put(tx, stored.Data); err != nil {
+					return err
+				}
+				moved++
+			}
+		}
+		if moved != 0 {
+			log.Printf("Moved %d screening document(s) of group %s into the document store", moved, gpr.SecurityKey)
+			if err := tx.Update(BOLT_PARTICIPANTBUCKET, gpr.Key(), roster); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateDate(verr *ValidationError, field, value string) {
+	if value == "" {
+		return
+	}
+	if _, err := time.Parse(birthDateLayout, value); err != nil {
+		verr.add(field, "must be a date like 2006-01-02")
+	}
+}
+
+func validateCertificates(verr *ValidationError, certificates []Certificate) {
+	for i := range certificates {
+		field := "certificates." + strconv.Itoa(i)
+		validateText(verr, field+".kind", &certificates[i].Kind, true)
+		certificates[i].ExpiresOn = strings.TrimSpace(certificates[i].ExpiresOn)
+		validateDate(verr, field+".expiresOn", certificates[i].ExpiresOn)
+	}
+}
+
+// Dates are compared as YYYY-MM-DD strings, which sort the same as the dates themselves.
+func expiredOn(expiresOn, today string) bool {
+	return expiresOn != "" && expiresOn < today
+}
+
+// Returns what keeps a leader from being allowed to attend, if anything.
+func leaderScreeningIssues(p *Participant, requiredCertificates []string, today string) []string {
+	issues := []string{}
+	if p.Screening.Status != ScreeningCleared {
+		issues = append(issues, "police record check not cleared")
+	} else if expiredOn(p.Screening.ExpiresOn, today) {
+		issues = append(issues, "police record check expired")
+	}
+	for _, kind := range requiredCertificates {
+		found := false
+		expired := false
+		for _, cert := range p.Certificates {
+			if cert.Kind == kind {
+				if expiredOn(cert.ExpiresOn, today) {
+					expired = true
+				} else {
+					found = true
+				}
+			}
+		}
+		if !found && expired {
+			issues = append(issues, kind+" expired")
+		} else if !found {
+			issues = append(issues, kind+" missing")
+		}
+	}
+	return issues
+}
+
+func (d *participantDbBolt) SetScreening(securityKey string, id uint64, screening LeaderScreening) error {
+	return d.updateRoster(securityKey, func(tx boltorm.Tx, gpr *GroupPreRegistration, roster *ParticipantRoster) error {
+		i := roster.find(id)
+		if i < 0 {
+			return ParticipantDoesNotExist.New("No participant %d in group %s", id, securityKey)
+		}
+		if roster.Participants[i].Type != ParticipantLeader {
+			return NotALeader.New("Participant %d in group %s is not a leader", id, securityKey)
+		}
+		roster.Participants[i].Screening = screening
+		return nil
+	})
+}
+
+func (d *participantDbBolt) AddDocument(securityKey string, id uint64, doc *ScreeningDocument, data []byte) error {
+	return d.updateRoster(securityKey, func(tx boltorm.Tx, gpr *GroupPreRegistration, roster *ParticipantRoster) error {
+		i := roster.find(id)
+		if i < 0 {
+			return ParticipantDoesNotExist.New("No participant %d in group %s", id, securityKey)
+		}
+		if roster.Participants[i].Type != ParticipantLeader {
+			return NotALeader.New("Participant %d in group %s is not a leader", id, securityKey)
+		}
+		var err error
+		if doc.ID, doc.Checksum, err = d.docs.put(tx, data); err != nil {
+			return err
+		}
+		doc.Size = len(data)
+		doc.Uploaded = time.Now()
+		roster.Participants[i].Documents = append(roster.Participants[i].Documents, *doc)
+		return nil
+	})
+}
+
+func (d *participantDbBolt) GetDocument(securityKey string, id, docID uint64) (doc *ScreeningDocument, data []byte, err error) {
+	return doc, data, d.db.View(func(tx boltorm.Tx) error {
+		gpr, err := getPreRegRecord(tx, securityKey)
+		if err != nil {
+			return err
+		}
+		roster, _, err := getRoster(tx, gpr)
+		if err != nil {
+			return err
+		}
+		i := roster.find(id)
+		if i < 0 {
+			return ScreeningDocumentNotFound.New("No participant %d", id)
+		}
+		for j := range roster.Participants[i].Documents {
+			if roster.Participants[i].Documents[j].ID == docID {
+				doc = &roster.Participants[i].Documents[j]
+			}
+		}
+		if doc == nil {
+			return ScreeningDocumentNotFound.New("No document %d for participant %d", docID, id)
+		}
+		data, err = d.docs.get(tx, doc.ID, doc.Checksum)
+		return err
+	})
+}
+
+// Records an administrator's review of a leader's police record check.
+func (h *ParticipantHandler) SetScreening(w http.ResponseWriter, r *http.Request) {
+	id, ok := participantID(w, r)
+	if !ok {
+		return
+	}
+	screening := LeaderScreening{}
+	if err := json.NewDecoder(r.Body).Decode(&screening); err != nil {
+		http.Error(w, "Invalid screening json given", 400)
+		return
+	}
+	verr := &ValidationError{}
+	if screening.Status != ScreeningPending && screening.Status != ScreeningCleared && screening.Status != ScreeningRejected {
+		verr.add("status", "must be %s, %s or %s", ScreeningPending, ScreeningCleared, ScreeningRejected)
+	}
+	screening.ExpiresOn = strings.TrimSpace(screening.ExpiresOn)
+	validateDate(verr, "expiresOn", screening.ExpiresOn)
+	if len(verr.Errors) != 0 {
+		writeValidationError(w, verr)
+		return
+	}
+	screening.ReviewedBy = h.authHandler.sessionUser(r)
+	screening.ReviewedOn = time.Now()
+
+	if err := h.db.SetScreening(mux.Vars(r)["SecurityKey"], id, screening); err != nil {
+		participantError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, screening)
+}
+
+// Accepts the raw document as the body, with its file name in the name parameter.
+func (h *ParticipantHandler) UploadDocument(w http.ResponseWriter, r *http.Request) {
+	id, ok := participantID(w, r)
+	if !ok {
+		return
+	}
+	data, contentType, ok := h.docs.readUpload(w, r)
+	if !ok {
+		return
+	}
+
+	doc := &ScreeningDocument{
+		Name:        uploadName(r),
+		ContentType: contentType,
+	}
+	if err := h.db.AddDocument(mux.Vars(r)["SecurityKey"], id, doc, data); err != nil {
+		log.Printf("Failed to store screening document!  Error: %s", err)
+		participantError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, doc)
+}
+
+func (h *ParticipantHandler) GetDocument(w http.ResponseWriter, r *http.Request) {
+	id, ok := participantID(w, r)
+	if !ok {
+		return
+	}
+	docID, err := strconv.ParseUint(mux.Vars(r)["DocumentID"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid document id", 404)
+		return
+	}
+	doc, data, err := h.db.GetDocument(mux.Vars(r)["SecurityKey"], id, docID)
+	if err != nil {
+		participantError(w, err)
+		return
+	}
+	writeDocument(w, doc.Name, doc.ContentType, data)
+}
+
+type GroupCompliance struct {
+	SecurityKey string `json:"securityKey"`
+	PackName    string `json:"packName"`
+	GroupName   string `json:"groupName"`
+	Council     string `json:"council"`
+
+	// Either roster or estimate, depending on where the counts came from.
+	Source      string `json:"source"`
+	YouthCount  int    `json:"youthCount"`
+	LeaderCount int    `json:"leaderCount"`
+
+	RatioViolation    bool                `json:"ratioViolation"`
+	UnscreenedLeaders []*UnscreenedLeader `json:"unscreenedLeaders"`
+	Issues            []string            `json:"issues"`
+}
+
+// A leader on the roster who isn't allowed to attend yet, and why.
+type UnscreenedLeader struct {
+	ID     uint64   `json:"id"`
+	Name   string   `json:"name"`
+	Issues []string `json:"issues"`
+}
+
+type ComplianceHandler struct {
+	config        *configType
+	prdb          PreRegDb
+	participantDb ParticipantDb
+}
+
+func (h *ComplianceHandler) groupCompliance(rec *GroupPreRegistration, roster *ParticipantRoster, today string) *GroupCompliance {
+	compliance := h.config.current().Compliance
+	gc := &GroupCompliance{
+		SecurityKey:       rec.SecurityKey,
+		PackName:          rec.PackName,
+		GroupName:         rec.GroupName,
+		Council:           rec.Council,
+		UnscreenedLeaders: []*UnscreenedLeader{},
+		Issues:            []string{},
+	}
+	if roster != nil {
+		gc.Source = "roster"
+		gc.YouthCount, gc.LeaderCount = roster.Counts()
+		for _, p := range roster.Participants {
+			if p.Type != ParticipantLeader {
+				continue
+			}
+			if issues := leaderScreeningIssues(p, compliance.RequiredCertificates, today); len(issues) != 0 {
+				gc.UnscreenedLeaders = append(gc.UnscreenedLeaders, &UnscreenedLeader{p.ID, p.FirstName + " " + p.LastName, issues})
+			}
+		}
+		if len(gc.UnscreenedLeaders) != 0 {
+			gc.Issues = append(gc.Issues, strconv.Itoa(len(gc.UnscreenedLeaders))+" leader(s) not fully screened")
+		}
+	} else {
+		gc.Source = "estimate"
+		gc.YouthCount = rec.EstimatedYouth
+		gc.LeaderCount = rec.EstimatedLeaders
+	}
+
+	if gc.YouthCount > 0 || gc.LeaderCount > 0 {
+		if gc.LeaderCount < compliance.MinLeaders {
+			gc.RatioViolation = true
+			gc.Issues = append(gc.Issues, "fewer than "+strconv.Itoa(compliance.MinLeaders)+" leaders")
+		}
+		if perLeader := compliance.YouthPerLeader; perLeader > 0 && gc.YouthCount > gc.LeaderCount*perLeader {
+			gc.RatioViolation = true
+			gc.Issues = append(gc.Issues, "more than "+strconv.Itoa(perLeader)+" youth per leader")
+		}
+	}
+	return gc
+}
+
+// Lists every registered group with anything that keeps it from meeting
+// the screening and supervision requirements.  Passing flagged=true only
+// lists groups with issues.
+func (h *ComplianceHandler) Report(w http.ResponseWriter, r *http.Request) {
+	recs, err := h.prdb.GetAll()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	rosters, err := h.participantDb.GetAllRosters()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	rosterByKey := make(map[string]*ParticipantRoster, len(rosters))
+	for _, roster := range rosters {
+		rosterByKey[roster.SecurityKey] = roster
+	}
+
+	flaggedOnly := r.URL.Query().Get("flagged") == "true"
+	today := time.Now().Format(birthDateLayout)
+	output := []*GroupCompliance{}
+	for _, rec := range recs {
+		if rec.IsOnWaitingList {
+			continue
+		}
+		gc := h.groupCompliance(rec, rosterByKey[rec.SecurityKey], today)
+		if !flaggedOnly || len(gc.Issues) != 0 {
+			output = append(output, gc)
+		}
+	}
+	writeJSON(w, http.StatusOK, output)
+}
+
+func NewComplianceHandler(r *mux.Router, config *configType, prdb PreRegDb, participantDb ParticipantDb, authHandler *AuthenticationHandler) *ComplianceHandler {
+	h := &ComplianceHandler{
+		config:        config,
+		prdb:          prdb,
+		participantDb: participantDb,
+	}
+
+	r.HandleFunc("/compliance", authHandler.AdminFunc(h.Report)).Methods("GET")
+
+	return h
+}
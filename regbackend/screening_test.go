@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+var testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89")
+
+func TestLeaderScreeningIssues(t *testing.T) {
+	Convey("With a leader and two required certificates", t, func() {
+		required := []string{CertificateWoodBadge, CertificateSafety}
+		leader := &Participant{Type: ParticipantLeader}
+		Convey("An unreviewed leader without certificates should have every issue", func() {
+			So(leaderScreeningIssues(leader, required, "2016-07-01"), ShouldResemble, []string{
+				"police record check not cleared",
+				"woodBadge missing",
+				"safety missing",
+			})
+		})
+		Convey("A cleared leader with current certificates should have none", func() {
+			leader.Screening.Status = ScreeningCleared
+			leader.Screening.ExpiresOn = "2016-07-01"
+			leader.Certificates = []Certificate{{CertificateWoodBadge, ""}, {CertificateSafety, "2017-01-01"}}
+			So(leaderScreeningIssues(leader, required, "2016-07-01"), ShouldResemble, []string{})
+		})
+		Convey("Expired checks and certificates should be reported as such", func() {
+			leader.Screening.Status = ScreeningCleared
+			leader.Screening.ExpiresOn = "2016-06-30"
+			leader.Certificates = []Certificate{{CertificateWoodBadge, ""}, {CertificateSafety, "2015-01-01"}}
+			So(leaderScreeningIssues(leader, required, "2016-07-01"), ShouldResemble, []string{
+				"police record check expired",
+				"safety expired",
+			})
+		})
+		Convey("A renewed certificate should win over the expired one", func() {
+			leader.Screening.Status = ScreeningCleared
+			leader.Certificates = []Certificate{{CertificateWoodBadge, ""}, {CertificateSafety, "2015-01-01"}, {CertificateSafety, "2018-01-01"}}
+			So(leaderScreeningIssues(leader, required, "2016-07-01"), ShouldResemble, []string{})
+		})
+	})
+}
+
+func TestLeaderScreening(t *testing.T) {
+	Convey("Starting with a group with a youth and a leader", t, func() {
+		db := boltorm.NewMemoryDB()
+		invDb, err := NewInvoiceDb(db)
+		So(err, ShouldBeNil)
+		config := &configType{}
+		config.Auth.AllowedEmails = stringSliceConfig{"admin@example.com"}
+		config.Compliance.YouthPerLeader = 6
+		config.Compliance.MinLeaders = 2
+		config.Compliance.RequiredCertificates = []string{CertificateWoodBadge}
+		prdb, err := NewPreRegBoltDb(db, config, invDb)
+		So(err, ShouldBeNil)
+		docs := newTestDocumentStore(db)
+		participantDb, err := NewParticipantDb(db, docs)
+		So(err, ShouldBeNil)
+		store := sessions.NewCookieStore([]byte("A"))
+		authHandler := newTestAuthHandler(config, store)
+		router := mux.NewRouter()
+		NewParticipantHandler(router, participantDb, docs, authHandler)
+		NewComplianceHandler(router, config, prdb, participantDb, authHandler)
+
+		loggedInCookie := loggedInAs(store, "admin@example.com")
+
+		group := &GroupPreRegistration{
+			GroupName:          "1st Testingway",
+			Council:            "Council rock",
+			ContactLeaderEmail: "testemail@example.com",
+			EstimatedYouth:     12,
+			EstimatedLeaders:   2,
+		}
+		So(prdb.CreateRecord(group), ShouldBeNil)
+		estimated := &GroupPreRegistration{
+			GroupName:          "2nd Testingway",
+			Council:            "Council rock",
+			ContactLeaderEmail: "testemail2@example.com",
+			EstimatedYouth:     13,
+			EstimatedLeaders:   2,
+		}
+		So(prdb.CreateRecord(estimated), ShouldBeNil)
+
+		youth := &Participant{Type: ParticipantYouth, FirstName: "Sam", LastName: "Cub"}
+		So(participantDb.AddParticipant(group.SecurityKey, youth), ShouldBeNil)
+		leader := &Participant{Type: ParticipantLeader, FirstName: "Akela", LastName: "Wolf"}
+		So(participantDb.AddParticipant(group.SecurityKey, leader), ShouldBeNil)
+
+		participantPath := func(p *Participant) string {
+			return "/preregistration/" + group.SecurityKey + "/participants/" + strconv.FormatUint(p.ID, 10)
+		}
+		storedLeader := func() *Participant {
+			roster, err := participantDb.GetRoster(group.SecurityKey)
+			So(err, ShouldBeNil)
+			return roster.Participants[roster.find(leader.ID)]
+		}
+
+		Convey("Reviewing a leader's screening", func() {
+			Convey("Should require an administrator", func() {
+				w := testRequest(router, "PUT", participantPath(leader)+"/screening", []byte(`{"status":"cleared"}`), nil)
+				So(w.Code, ShouldEqual, http.StatusForbidden)
+				So(storedLeader().Screening.Status, ShouldEqual, "")
+			})
+			Convey("Should reject unknown statuses", func() {
+				w := testRequest(router, "PUT", participantPath(leader)+"/screening", []byte(`{"status":"maybe"}`), loggedInCookie)
+				So(w.Code, ShouldEqual, http.StatusUnprocessableEntity)
+			})
+			Convey("Should not apply to youth", func() {
+				w := testRequest(router, "PUT", participantPath(youth)+"/screening", []byte(`{"status":"cleared"}`), loggedInCookie)
+				So(w.Code, ShouldEqual, http.StatusBadRequest)
+			})
+			Convey("Should store who reviewed it", func() {
+				w := testRequest(router, "PUT", participantPath(leader)+"/screening", []byte(`{"status":"cleared","expiresOn":"2099-01-01"}`), loggedInCookie)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				screening := storedLeader().Screening
+				So(screening.Status, ShouldEqual, ScreeningCleared)
+				So(screening.ExpiresOn, ShouldEqual, "2099-01-01")
+				So(screening.ReviewedBy, ShouldEqual, "admin@example.com")
+
+				Convey("And keep it when the group updates the leader", func() {
+					updated := *leader
+					updated.Screening = LeaderScreening{}
+					updated.Certificates = []Certificate{{CertificateWoodBadge, ""}}
+					So(participantDb.UpdateParticipant(group.SecurityKey, &updated), ShouldBeNil)
+					So(storedLeader().Screening.Status, ShouldEqual, ScreeningCleared)
+					So(storedLeader().Certificates, ShouldResemble, []Certificate{{CertificateWoodBadge, ""}})
+				})
+			})
+		})
+
+		Convey("Uploading a screening document", func() {
+			Convey("That isn't an accepted type should fail", func() {
+				w := testRequest(router, "POST", participantPath(leader)+"/documents?name=check.txt", []byte("just some text"), nil)
+				So(w.Code, ShouldEqual, http.StatusUnsupportedMediaType)
+			})
+			Convey("For a youth should fail", func() {
+				w := testRequest(router, "POST", participantPath(youth)+"/documents?name=check.png", testPNG, nil)
+				So(w.Code, ShouldEqual, http.StatusBadRequest)
+			})
+			Convey("For a leader", func() {
+				w := testRequest(router, "POST", participantPath(leader)+"/documents?name=check.png", testPNG, nil)
+				So(w.Code, ShouldEqual, http.StatusCreated)
+				doc := &ScreeningDocument{}
+				So(json.Unmarshal(w.Body.Bytes(), doc), ShouldBeNil)
+				Convey("Should list it on the leader", func() {
+					uploaded := storedLeader().Documents
+					So(len(uploaded), ShouldEqual, 1)
+					So(uploaded[0].Name, ShouldEqual, "check.png")
+					So(uploaded[0].ContentType, ShouldEqual, "image/png")
+					So(uploaded[0].Size, ShouldEqual, len(testPNG))
+				})
+				docPath := participantPath(leader) + "/documents/" + strconv.FormatUint(doc.ID, 10)
+				Convey("Should let administrators download it", func() {
+					w := testRequest(router, "GET", docPath, nil, loggedInCookie)
+					So(w.Code, ShouldEqual, http.StatusOK)
+					So(w.HeaderMap.Get("Content-Type"), ShouldEqual, "image/png")
+					So(w.Body.Bytes(), ShouldResemble, testPNG)
+				})
+				Convey("Should not let anybody else download it", func() {
+					w := testRequest(router, "GET", docPath, nil, nil)
+					So(w.Code, ShouldEqual, http.StatusForbidden)
+				})
+				Convey("Should not be reachable through another participant", func() {
+					w := testRequest(router, "GET", participantPath(youth)+"/documents/"+strconv.FormatUint(doc.ID, 10), nil, loggedInCookie)
+					So(w.Code, ShouldEqual, http.StatusNotFound)
+				})
+				Convey("Should be deleted along with the leader", func() {
+					So(participantDb.DeleteParticipant(group.SecurityKey, leader.ID), ShouldBeNil)
+					err := db.View(func(tx boltorm.Tx) error {
+						_, err := docs.get(tx, doc.ID, doc.Checksum)
+						return err
+					})
+					So(DocumentNotFound.Contains(err), ShouldBeTrue)
+				})
+			})
+		})
+
+		Convey("The compliance report", func() {
+			report := func(query string) []*GroupCompliance {
+				w := testRequest(router, "GET", "/compliance"+query, nil, loggedInCookie)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				output := []*GroupCompliance{}
+				So(json.Unmarshal(w.Body.Bytes(), &output), ShouldBeNil)
+				return output
+			}
+			byKey := func(output []*GroupCompliance) map[string]*GroupCompliance {
+				ret := make(map[string]*GroupCompliance)
+				for _, gc := range output {
+					ret[gc.SecurityKey] = gc
+				}
+				return ret
+			}
+
+			Convey("Should require an administrator", func() {
+				So(testRequest(router, "GET", "/compliance", nil, nil).Code, ShouldEqual, http.StatusForbidden)
+			})
+			Convey("Should flag the unscreened leader and the missing second leader from the roster", func() {
+				gc := byKey(report(""))[group.SecurityKey]
+				So(gc.Source, ShouldEqual, "roster")
+				So(gc.YouthCount, ShouldEqual, 1)
+				So(gc.LeaderCount, ShouldEqual, 1)
+				So(gc.RatioViolation, ShouldBeTrue)
+				So(gc.UnscreenedLeaders, ShouldResemble, []*UnscreenedLeader{{leader.ID, "Akela Wolf", []string{"police record check not cleared", "woodBadge missing"}}})
+				So(len(gc.Issues), ShouldEqual, 2)
+			})
+			Convey("Should list leaders with the same name separately", func() {
+				namesake := &Participant{Type: ParticipantLeader, FirstName: "Akela", LastName: "Wolf"}
+				So(participantDb.AddParticipant(group.SecurityKey, namesake), ShouldBeNil)
+				gc := byKey(report(""))[group.SecurityKey]
+				So(len(gc.UnscreenedLeaders), ShouldEqual, 2)
+				So(gc.UnscreenedLeaders[1].ID, ShouldEqual, namesake.ID)
+				So(gc.Issues, ShouldContain, "2 leader(s) not fully screened")
+			})
+			Convey("Should check the ratio of groups without a roster from their estimates", func() {
+				gc := byKey(report(""))[estimated.SecurityKey]
+				So(gc.Source, ShouldEqual, "estimate")
+				So(gc.RatioViolation, ShouldBeTrue)
+				So(gc.Issues, ShouldResemble, []string{"more than 6 youth per leader"})
+			})
+			Convey("Once everything is fixed", func() {
+				So(participantDb.SetScreening(group.SecurityKey, leader.ID, LeaderScreening{Status: ScreeningCleared}), ShouldBeNil)
+				updated := *leader
+				updated.Certificates = []Certificate{{CertificateWoodBadge, ""}}
+				So(participantDb.UpdateParticipant(group.SecurityKey, &updated), ShouldBeNil)
+				second := &Participant{Type: ParticipantLeader, FirstName: "Baloo", LastName: "Bear"}
+				So(participantDb.AddParticipant(group.SecurityKey, second), ShouldBeNil)
+				So(participantDb.SetScreening(group.SecurityKey, second.ID, LeaderScreening{Status: ScreeningCleared}), ShouldBeNil)
+				second.Certificates = []Certificate{{CertificateWoodBadge, "2099-01-01"}}
+				So(participantDb.UpdateParticipant(group.SecurityKey, second), ShouldBeNil)
+
+				Convey("The group should no longer be flagged", func() {
+					output := report("?flagged=true")
+					So(len(output), ShouldEqual, 1)
+					So(output[0].SecurityKey, ShouldEqual, estimated.SecurityKey)
+				})
+			})
+		})
+	})
+}
+
+func TestLegacyScreeningDocuments(t *testing.T) {
+	Convey("With a screening document from before the document store", t, func() {
+		db := boltorm.NewMemoryDB()
+		invDb, err := NewInvoiceDb(db)
+		So(err, ShouldBeNil)
+		prdb, err := NewPreRegBoltDb(db, &configType{}, invDb)
+		So(err, ShouldBeNil)
+		group := &GroupPreRegistration{GroupName: "1st Testingway", Council: "Council rock", ContactLeaderEmail: "testemail@example.com"}
+		So(prdb.CreateRecord(group), ShouldBeNil)
+		So(db.Update(func(tx boltorm.Tx) error {
+			if err := tx.CreateBucketIfNotExists(BOLT_PARTICIPANTBUCKET); err != nil {
+				return err
+			}
+			if err := tx.CreateBucketIfNotExists(BOLT_SCREENINGDOCUMENTBUCKET); err != nil {
+				return err
+			}
+			roster := &ParticipantRoster{
+				SecurityKey: group.SecurityKey,
+				Participants: []*Participant{{
+					ID:        1,
+					Type:      ParticipantLeader,
+					FirstName: "Akela",
+					Documents: []ScreeningDocument{{ID: 1, Name: "check.png", ContentType: "image/png", Size: len(testPNG)}},
+				}},
+				LastID: 1,
+			}
+			if err := tx.Insert(BOLT_PARTICIPANTBUCKET, group.Key(), roster); err != nil {
+				return err
+			}
+			return tx.Insert(BOLT_SCREENINGDOCUMENTBUCKET, documentKey(1), &screeningDocumentData{group.SecurityKey, 1, testPNG})
+		}), ShouldBeNil)
+
+		Convey("Starting the participant database should move it into the store", func() {
+			participantDb, err := NewParticipantDb(db, newTestDocumentStore(db))
+			So(err, ShouldBeNil)
+			roster, err := participantDb.GetRoster(group.SecurityKey)
+			So(err, ShouldBeNil)
+			doc := roster.Participants[0].Documents[0]
+			So(doc.Checksum, ShouldNotEqual, "")
+			stored, data, err := participantDb.GetDocument(group.SecurityKey, 1, doc.ID)
+			So(err, ShouldBeNil)
+			So(stored.Name, ShouldEqual, "check.png")
+			So(data, ShouldResemble, testPNG)
+
+			Convey("And not leave a copy behind", func() {
+				err := db.View(func(tx boltorm.Tx) error {
+					return tx.Get(BOLT_SCREENINGDOCUMENTBUCKET, documentKey(1), &screeningDocumentData{})
+				})
+				So(boltorm.ErrKeyDoesNotExist.Contains(err), ShouldBeTrue)
+			})
+			Convey("And leave it alone when started again", func() {
+				_, err := NewParticipantDb(db, newTestDocumentStore(db))
+				So(err, ShouldBeNil)
+				_, data, err := participantDb.GetDocument(group.SecurityKey, 1, doc.ID)
+				So(err, ShouldBeNil)
+				So(data, ShouldResemble, testPNG)
+			})
+		})
+	})
+}
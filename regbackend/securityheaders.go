@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Largest CSP violation report that is read.
+const maxCSPReport = 64 * 1024
+
+// Where browsers send reports of content the policy blocked.
+const cspReportPath = "/csp-report"
+
+type cspNonceKey struct{}
+
+// Returns the nonce inline scripts in the page need for the request.
+func cspNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(cspNonceKey{}).(string)
+	return nonce
+}
+
+// Other sites the page loads from, beyond Google Fonts, by the CAPTCHA
+// registrations need to pass.
+var challengeSources = map[string][]string{
+	ChallengeHCaptcha:  {"https://hcaptcha.com", "https://*.hcaptcha.com"},
+	ChallengeReCaptcha: {"https://www.google.com/recaptcha/", "https://www.gstatic.com/recaptcha/"},
+}
+
+// Sets the headers that keep browsers from running injected scripts,
+// framing the site, or leaking the security keys in its URLs to other
+// sites.
+type securityHeadersHandler struct {
+	config *configType
+	h      http.Handler
+}
+
+func (h *securityHeadersHandler) policy(nonce string) string {
+	captcha := strings.Join(challengeSources[h.config.Challenge.Type], " ")
+	directives := []string{
+		"default-src 'self'",
+		strings.TrimSpace("script-src 'self' 'nonce-" + nonce + "' " + captcha),
+		// Angular Material adds its theme as inline styles.
+		"style-src 'self' 'unsafe-inline' https://fonts.googleapis.com",
+		"font-src 'self' https://fonts.gstatic.com",
+		"img-src 'self' data:",
+		strings.TrimSpace("connect-src 'self' " + captcha),
+		strings.TrimSpace("frame-src 'self' " + captcha),
+		"object-src 'none'",
+		"base-uri 'self'",
+		"form-action 'self'",
+		"frame-ancestors 'none'",
+		"report-uri " + cspReportPath,
+	}
+	return strings.Join(directives, "; ")
+}
+
+func (h *securityHeadersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var random [16]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		log.Print("Failed to get entropy for a CSP nonce: ", err)
+		http.Error(w, "Failed to serve page", http.StatusServiceUnavailable)
+		return
+	}
+	nonce := base64.StdEncoding.EncodeToString(random[:])
+
+	header := w.Header()
+	header.Set("Content-Security-Policy", h.policy(nonce))
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("X-Frame-Options", "DENY")
+	header.Set("Referrer-Policy", "no-referrer")
+	// Development and integration binaries are reached over plain http.
+	if !(h.config.General.Develop || h.config.General.Integration) {
+		header.Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
+	}
+	h.h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), cspNonceKey{}, nonce)))
+}
+
+// Serves index.html with the request's nonce on its scripts, so the inline
+// ones that bootstrap Angular may run.
+func serveIndex(w http.ResponseWriter, r *http.Request, location string) {
+	page, err := ioutil.ReadFile(location)
+	if err != nil {
+		log.Printf("Failed to read %s: %s", location, err)
+		http.NotFound(w, r)
+		return
+	}
+	page = bytes.Replace(page, []byte("<script"), []byte(`<script nonce="`+cspNonce(r)+`"`), -1)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// Each nonce is only good for one response.
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(page)
+}
+
+// Logs the reports browsers send of content the policy blocked.
+type cspReportHandler struct{}
+
+// Keeps only where the page was, as the rest of its URL can hold a group's
+// security key.
+func redactedReportURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" {
+		return uri
+	}
+	first := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)[0]
+	return u.Scheme + "://" + u.Host + "/" + first
+}
+
+func (cspReportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	report := struct {
+		Report struct {
+			DocumentURI        string `json:"document-uri"`
+			ViolatedDirective  string `json:"violated-directive"`
+			EffectiveDirective string `json:"effective-directive"`
+			BlockedURI         string `json:"blocked-uri"`
+			SourceFile         string `json:"source-file"`
+			LineNumber         int    `json:"line-number"`
+		} `json:"csp-report"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxCSPReport)).Decode(&report); err != nil {
+		http.Error(w, "Invalid report given", http.StatusBadRequest)
+		return
+	}
+	rep := report.Report
+	// Anyone can post here, only reports from pages on this site are logged.
+	if u, err := url.Parse(rep.DocumentURI); err != nil || !strings.EqualFold(u.Host, r.Host) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	directive := rep.EffectiveDirective
+	if directive == "" {
+		directive = rep.ViolatedDirective
+	}
+	log.Printf("CSP violation on %q: %q blocked %q (from %q line %d)", redactedReportURI(rep.DocumentURI), directive, redactedReportURI(rep.BlockedURI), redactedReportURI(rep.SourceFile), rep.LineNumber)
+	w.WriteHeader(http.StatusNoContent)
+}
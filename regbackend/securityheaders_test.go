@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	Convey("With the index page behind the security headers", t, func() {
+		dir, err := ioutil.TempDir("", "index")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+		index := filepath.Join(dir, "index.html")
+		So(ioutil.WriteFile(index, []byte(`<html><script>var a = 1</script><script src="app.js"></script></html>`), 0600), ShouldBeNil)
+
+		config := &configType{}
+		h := &securityHeadersHandler{config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveIndex(w, r, index)
+		})}
+		get := func() *httptest.ResponseRecorder {
+			r, err := http.NewRequest("GET", "http://localhost:8080/registration/key", nil)
+			So(err, ShouldBeNil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			return w
+		}
+
+		Convey("Its scripts should carry the nonce the policy allows", func() {
+			w := get()
+			So(w.Code, ShouldEqual, http.StatusOK)
+			policy := w.Header().Get("Content-Security-Policy")
+			start := strings.Index(policy, "'nonce-") + len("'nonce-")
+			So(start, ShouldBeGreaterThan, len("'nonce-"))
+			nonce := policy[start : start+strings.Index(policy[start:], "'")]
+			So(w.Body.String(), ShouldEqual, `<html><script nonce="`+nonce+`">var a = 1</script><script nonce="`+nonce+`" src="app.js"></script></html>`)
+			So(w.Header().Get("Cache-Control"), ShouldEqual, "no-store")
+
+			Convey("And a new one each time", func() {
+				So(get().Header().Get("Content-Security-Policy"), ShouldNotContainSubstring, nonce)
+			})
+		})
+		Convey("The other headers should be set", func() {
+			w := get()
+			So(w.Header().Get("Content-Security-Policy"), ShouldContainSubstring, "frame-ancestors 'none'")
+			So(w.Header().Get("Content-Security-Policy"), ShouldContainSubstring, "report-uri /csp-report")
+			So(w.Header().Get("X-Content-Type-Options"), ShouldEqual, "nosniff")
+			So(w.Header().Get("Referrer-Policy"), ShouldEqual, "no-referrer")
+			So(w.Header().Get("Strict-Transport-Security"), ShouldStartWith, "max-age=")
+		})
+		Convey("HSTS should be left out of development binaries", func() {
+			config.General.Develop = true
+			So(get().Header().Get("Strict-Transport-Security"), ShouldEqual, "")
+		})
+		Convey("The CAPTCHA provider should be allowed when used", func() {
+			So(get().Header().Get("Content-Security-Policy"), ShouldNotContainSubstring, "hcaptcha")
+			config.Challenge.Type = ChallengeHCaptcha
+			So(get().Header().Get("Content-Security-Policy"), ShouldContainSubstring, "frame-src 'self' https://hcaptcha.com https://*.hcaptcha.com")
+		})
+	})
+}
+
+func TestCSPReports(t *testing.T) {
+	Convey("Reporting a violation", t, func() {
+		logged := &bytes.Buffer{}
+		log.SetOutput(logged)
+		Reset(func() {
+			log.SetOutput(ioutil.Discard)
+		})
+		report := func(body string) int {
+			r, err := http.NewRequest("POST", "https://example.com/csp-report", bytes.NewReader([]byte(body)))
+			So(err, ShouldBeNil)
+			w := httptest.NewRecorder()
+			cspReportHandler{}.ServeHTTP(w, r)
+			return w.Code
+		}
+
+		Convey("Should be accepted", func() {
+			So(report(`{"csp-report": {"document-uri": "https://example.com/registration/key", "violated-directive": "script-src", "blocked-uri": "inline"}}`), ShouldEqual, http.StatusNoContent)
+			So(logged.String(), ShouldContainSubstring, `CSP violation on "https://example.com/registration": "script-src" blocked "inline"`)
+		})
+		Convey("Should quote what it was sent", func() {
+			So(report(`{"csp-report": {"document-uri": "https://example.com/", "violated-directive": "script-src\nforged line", "blocked-uri": "inline"}}`), ShouldEqual, http.StatusNoContent)
+			So(logged.String(), ShouldContainSubstring, `"script-src\nforged line"`)
+		})
+		Convey("Should leave out reports from other sites", func() {
+			So(report(`{"csp-report": {"document-uri": "https://elsewhere.example.com/", "violated-directive": "script-src", "blocked-uri": "inline"}}`), ShouldEqual, http.StatusNoContent)
+			So(logged.String(), ShouldEqual, "")
+		})
+		Convey("Should refuse anything else", func() {
+			So(report(`nonsense`), ShouldEqual, http.StatusBadRequest)
+		})
+	})
+	Convey("Reported addresses should leave out security keys", t, func() {
+		So(redactedReportURI("https://example.com/registration/key?x=1"), ShouldEqual, "https://example.com/registration")
+		So(redactedReportURI("inline"), ShouldEqual, "inline")
+	})
+}
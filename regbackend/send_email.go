@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"net/smtp"
+	"sync"
 	"text/template"
 )
 
@@ -12,11 +13,13 @@ type EmailSender interface {
 
 type localMailer struct {
 	serverAddr string
+	heloName   string
 }
 
-func NewLocalMailder(serverAddr string) EmailSender {
+func NewLocalMailder(serverAddr, heloName string) EmailSender {
 	return localMailer{
 		serverAddr: serverAddr,
+		heloName:   heloName,
 	}
 }
 
@@ -27,7 +30,7 @@ func (l localMailer) Send(from string, to []string, msg []byte) error {
 		return err
 	}
 	defer c.Close()
-	if err = c.Hello("registration.cubjamboree.ca"); err != nil {
+	if err = c.Hello(l.heloName); err != nil {
 		return err
 	}
 	if err = c.Mail(from); err != nil {
@@ -54,12 +57,17 @@ func (l localMailer) Send(from string, to []string, msg []byte) error {
 }
 
 type ConfirmationEmailService struct {
-	domain         string
-	emailSender    EmailSender
-	fromAddress    string
+	domain      string
+	emailSender EmailSender
+	fromAddress string
+	preRegDb    PreRegDb
+
+	// The names can be changed through the settings while running.
+	namesLock      sync.RWMutex
 	fromName       string
 	contactAddress string
-	preRegDb       PreRegDb
+	eventName      string
+	template       *template.Template
 }
 
 func NewConfirmationEmailService(domain, fromAddress, fromName, contactAddress string, emailSender EmailSender, preRegDb PreRegDb) *ConfirmationEmailService {
@@ -70,17 +78,37 @@ func NewConfirmationEmailService(domain, fromAddress, fromName, contactAddress s
 		emailSender:    emailSender,
 		contactAddress: contactAddress,
 		preRegDb:       preRegDb,
+		eventName:      "CCJ16",
+		template:       emailTemplate,
 	}
 
 	return ret
 }
 
+func (c *ConfirmationEmailService) setNames(fromName, contactAddress string) {
+	c.namesLock.Lock()
+	defer c.namesLock.Unlock()
+	c.fromName = fromName
+	c.contactAddress = contactAddress
+}
+
+func (c *ConfirmationEmailService) useEvent(eventName string, tmpl *template.Template) {
+	c.namesLock.Lock()
+	defer c.namesLock.Unlock()
+	c.eventName = eventName
+	c.template = tmpl
+}
+
 func (c *ConfirmationEmailService) RequestEmailConfirmation(gpr *GroupPreRegistration) error {
+	c.namesLock.RLock()
+	fromName, contactAddress, eventName, tmpl := c.fromName, c.contactAddress, c.eventName, c.template
+	c.namesLock.RUnlock()
+
 	buf := &bytes.Buffer{}
 	type confirmationData struct {
-		ToAddress, FirstName, LastName, SecurityKey, ValidationToken, Domain, FromAddress, FromName, ContactAddress string
+		ToAddress, FirstName, LastName, SecurityKey, ValidationToken, Domain, FromAddress, FromName, ContactAddress, EventName string
 	}
-	if err := emailTemplate.Execute(buf, confirmationData{
+	if err := tmpl.Execute(buf, confirmationData{
 		ToAddress:       gpr.ContactLeaderEmail,
 		FirstName:       gpr.ContactLeaderFirstName,
 		LastName:        gpr.ContactLeaderLastName,
@@ -88,8 +116,9 @@ func (c *ConfirmationEmailService) RequestEmailConfirmation(gpr *GroupPreRegistr
 		ValidationToken: gpr.ValidationToken,
 		Domain:          c.domain,
 		FromAddress:     c.fromAddress,
-		FromName:        c.fromName,
-		ContactAddress:  c.contactAddress,
+		FromName:        fromName,
+		ContactAddress:  contactAddress,
+		EventName:       eventName,
 	}); err != nil {
 		return err
 	}
@@ -99,14 +128,40 @@ func (c *ConfirmationEmailService) RequestEmailConfirmation(gpr *GroupPreRegistr
 	return c.preRegDb.NoteConfirmationEmailSent(gpr)
 }
 
+// Sends the leader a link to their record, after they asked for one.
+func (c *ConfirmationEmailService) SendRecoveryLink(gpr *GroupPreRegistration) error {
+	c.namesLock.RLock()
+	fromName, contactAddress, eventName := c.fromName, c.contactAddress, c.eventName
+	c.namesLock.RUnlock()
+
+	buf := &bytes.Buffer{}
+	type recoveryData struct {
+		ToAddress, FirstName, LastName, SecurityKey, Domain, FromAddress, FromName, ContactAddress, EventName string
+	}
+	if err := recoveryTemplate.Execute(buf, recoveryData{
+		ToAddress:      gpr.ContactLeaderEmail,
+		FirstName:      gpr.ContactLeaderFirstName,
+		LastName:       gpr.ContactLeaderLastName,
+		SecurityKey:    gpr.SecurityKey,
+		Domain:         c.domain,
+		FromAddress:    c.fromAddress,
+		FromName:       fromName,
+		ContactAddress: contactAddress,
+		EventName:      eventName,
+	}); err != nil {
+		return err
+	}
+	return c.emailSender.Send(c.fromAddress, []string{gpr.ContactLeaderEmail}, buf.Bytes())
+}
+
 const emailTemplateString = `From: {{.FromName}} <{{.FromAddress}}>
 To: {{.ToAddress}}
-Subject: Confirm CCJ16 Preregistration
+Subject: Confirm {{.EventName}} Preregistration
 Content-Type: text/plain; charset=UTF-8
 
 Hi Scouter {{.FirstName}} {{.LastName}},
 
-Thank you for preregistering for CCJ16!  We hope you are as excited about this amazing camp as we are.  In order to confirm your CCJ16 preregistration, we ask that you confirm your email address by visiting the following page:
+Thank you for preregistering for {{.EventName}}!  We hope you are as excited about this amazing camp as we are.  In order to confirm your {{.EventName}} preregistration, we ask that you confirm your email address by visiting the following page:
 
 https://{{.Domain}}/confirmpreregistration?email={{.ToAddress|urlquery}}&token={{.ValidationToken|urlquery}}
 
@@ -119,8 +174,32 @@ https://{{.Domain}}/registration/{{.SecurityKey}}
 
 Thanks again,
 --
-The CCJ16 team
+The {{.EventName}} team
 
 If you have any questions, please contact us at {{.ContactAddress}}`
 
 var emailTemplate = template.Must(template.New("email").Parse(emailTemplateString))
+
+const recoveryTemplateString = `From: {{.FromName}} <{{.FromAddress}}>
+To: {{.ToAddress}}
+Subject: Your {{.EventName}} Preregistration Link
+Content-Type: text/plain; charset=UTF-8
+
+Hi Scouter {{.FirstName}} {{.LastName}},
+
+Someone, hopefully you, asked for the link to your {{.EventName}} preregistration.  You can review it by visiting the following page:
+
+https://{{.Domain}}/registration/{{.SecurityKey}}
+
+If you are unable to click the link, please copy and paste it into your web browser.
+
+If you think someone else has the link who shouldn't, you can get a new one from that page, and the old one will stop working.  If you didn't ask for this email, you can ignore it.
+
+
+Thanks,
+--
+The {{.EventName}} team
+
+If you have any questions, please contact us at {{.ContactAddress}}`
+
+var recoveryTemplate = template.Must(template.New("recovery").Parse(recoveryTemplateString))
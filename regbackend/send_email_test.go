@@ -94,6 +94,16 @@ If you have any questions, please contact us at info@infoexample.com`, gpr.Secur
 					})
 				})
 			})
+			Convey("For another event", func() {
+				tmpl, err := (&Event{ConfirmationEmail: "Subject: Welcome to {{.EventName}}\r\n\r\nYour key is {{.SecurityKey}}"}).confirmationTemplate()
+				So(err, ShouldBeNil)
+				ces.useEvent("Regional Camp", tmpl)
+				So(ces.RequestEmailConfirmation(gpr), ShouldBeNil)
+				Convey("Should send the event's own email", func() {
+					So(len(testEmailSender.Emails), ShouldEqual, 1)
+					So(string(testEmailSender.Emails[0].Msg), ShouldEqual, "Subject: Welcome to Regional Camp\r\n\r\nYour key is "+gpr.SecurityKey)
+				})
+			})
 		})
 	})
 }
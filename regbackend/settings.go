@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+	"github.com/spacemonkeygo/errors"
+	"github.com/spacemonkeygo/errors/errhttp"
+)
+
+var (
+	SettingsError   = errors.NewClass("Settings error")
+	SettingNotFound = SettingsError.NewClass("Setting does not exist", errhttp.SetStatusCode(404))
+)
+
+var (
+	BOLT_SETTINGSBUCKET       = []byte("BUCKET_SETTINGS")
+	BOLT_SETTINGHISTORYBUCKET = []byte("BUCKET_SETTINGHISTORY")
+)
+
+// Guards the fields of configType that can be changed through the settings
+// while the server is running.  Anything reading them outside of startup
+// should go through current.
+var settingsLock sync.RWMutex
+
+// Returns a copy of the configuration that won't change underneath the caller.
+func (c *configType) current() configType {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+	return *c
+}
+
+// A part of the configuration that administrators may change at runtime.
+// Values are handled as strings, the same way they are given as flags.
+type settingDefinition struct {
+	Name  string
+	Usage string
+	get   func(c *configType) string
+	// Checks the value, storing it into c when it is good.  Returns a
+	// description of the problem otherwise.
+	set func(c *configType, value string) string
+}
+
+func boolSetting(name, usage string, field func(c *configType) *bool) *settingDefinition {
+	return &settingDefinition{
+		Name:  name,
+		Usage: usage,
+		get:   func(c *configType) string { return strconv.FormatBool(*field(c)) },
+		set: func(c *configType, value string) string {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return "must be true or false"
+			}
+			*field(c) = b
+			return ""
+		},
+	}
+}
+
+func intSetting(name, usage string, min int, field func(c *configType) *int) *settingDefinition {
+	return &settingDefinition{
+		Name:  name,
+		Usage: usage,
+		get:   func(c *configType) string { return strconv.Itoa(*field(c)) },
+		set: func(c *configType, value string) string {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return "must be a whole number"
+			} else if n < min {
+				return "must be at least " + strconv.Itoa(min)
+			}
+			*field(c) = n
+			return ""
+		},
+	}
+}
+
+var settingDefinitions = []*settingDefinition{
+	{
+		Name:  "email.fromName",
+		Usage: "From name for use in emails",
+		get:   func(c *configType) string { return c.Email.FromName },
+		set: func(c *configType, value string) string {
+			if len(value) > maxTextFieldLength {
+				return "must be at most " + strconv.Itoa(maxTextFieldLength) + " characters"
+			}
+			c.Email.FromName = value
+			return ""
+		},
+	},
+	{
+		Name:  "email.contactEmail",
+		Usage: "Contact email address for use in emails",
+		get:   func(c *configType) string { return c.Email.ContactEmail },
+		set: func(c *configType, value string) string {
+			if !validEmailAddress(value) {
+				return "is not a valid email address"
+			}
+			c.Email.ContactEmail = value
+			return ""
+		},
+	},
+	boolSetting("enableGroupReg", "Enable any registration, including onto the waiting list", func(c *configType) *bool { return &c.General.EnableGroupReg }),
+	boolSetting("enableWaitingList", "Set to put people into a waiting list instead of registering", func(c *configType) *bool { return &c.General.EnableWaitingList }),
+	intSetting("compliance.youthPerLeader", "Most youth allowed per leader in a group.  0 disables the check", 0, func(c *configType) *int { return &c.Compliance.YouthPerLeader }),
+	intSetting("compliance.minLeaders", "Fewest leaders a group may bring", 0, func(c *configType) *int { return &c.Compliance.MinLeaders }),
+	{
+		Name:  "compliance.requiredCertificates",
+		Usage: "Certificates every leader needs, comma separated",
+		get:   func(c *configType) string { return strings.Join(c.Compliance.RequiredCertificates, ",") },
+		set: func(c *configType, value string) string {
+			certificates := stringSliceConfig{}
+			for _, certificate := range strings.Split(value, ",") {
+				if certificate = strings.TrimSpace(certificate); certificate != "" {
+					certificates = append(certificates, certificate)
+				}
+			}
+			c.Compliance.RequiredCertificates = certificates
+			return ""
+		},
+	},
+}
+
+func findSetting(name string) *settingDefinition {
+	for _, def := range settingDefinitions {
+		if def.Name == name {
+			return def
+		}
+	}
+	return nil
+}
+
+type Setting struct {
+	Name      string    `json:"name"`
+	Usage     string    `json:"usage"`
+	Value     string    `json:"value"`
+	UpdatedBy string    `json:"updatedBy"`
+	Updated   time.Time `json:"updated"`
+}
+
+type SettingChange struct {
+	ID       uint64    `json:"id"`
+	Name     string    `json:"name"`
+	OldValue string    `json:"oldValue"`
+	NewValue string    `json:"newValue"`
+	User     string    `json:"user"`
+	Time     time.Time `json:"time"`
+}
+
+// Settings without a stored value keep whatever the flags gave them.
+type storedSetting struct {
+	Value     string
+	UpdatedBy string
+	Updated   time.Time
+}
+
+type SettingsStore struct {
+	db     boltorm.DB
+	config *configType
+
+	// Serializes changes, so they are applied in the order they are stored.
+	setLock sync.Mutex
+	onApply []func(config configType)
+}
+
+// Applies any stored settings over the flags in config.
+func NewSettingsStore(db boltorm.DB, config *configType) (*SettingsStore, error) {
+	s := &SettingsStore{
+		db:     db,
+		config: config,
+	}
+	if err := db.Update(func(tx boltorm.Tx) error {
+		if err := tx.CreateBucketIfNotExists(BOLT_SETTINGSBUCKET); err != nil {
+			return err
+		}
+		return tx.CreateBucketIfNotExists(BOLT_SETTINGHISTORYBUCKET)
+	}); err != nil {
+		return nil, err
+	}
+
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	return s, db.View(func(tx boltorm.Tx) error {
+		for _, def := range settingDefinitions {
+			stored := &storedSetting{}
+			if err := tx.Get(BOLT_SETTINGSBUCKET, []byte(def.Name), stored); boltorm.ErrKeyDoesNotExist.Contains(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if problem := def.set(config, stored.Value); problem != "" {
+				log.Printf("Ignoring stored setting %s, value %q %s", def.Name, stored.Value, problem)
+			}
+		}
+		return nil
+	})
+}
+
+// Registers fn to be called with the new configuration after every change,
+// for anything that keeps its own copy of a setting.
+func (s *SettingsStore) OnApply(fn func(config configType)) {
+	s.setLock.Lock()
+	defer s.setLock.Unlock()
+	s.onApply = append(s.onApply, fn)
+}
+
+func (s *SettingsStore) GetAll() (settings []*Setting, err error) {
+	config := s.config.current()
+	return settings, s.db.View(func(tx boltorm.Tx) error {
+		for _, def := range settingDefinitions {
+			setting := &Setting{
+				Name:  def.Name,
+				Usage: def.Usage,
+				Value: def.get(&config),
+			}
+			stored := &storedSetting{}
+			if err := tx.Get(BOLT_SETTINGSBUCKET, []byte(def.Name), stored); err == nil {
+				setting.UpdatedBy = stored.UpdatedBy
+				setting.Updated = stored.Updated
+			} else if !boltorm.ErrKeyDoesNotExist.Contains(err) {
+				return err
+			}
+			settings = append(settings, setting)
+		}
+		return nil
+	})
+}
+
+// Stores and applies a new value for the named setting.  A bad value gives a
+// *ValidationError.
+func (s *SettingsStore) Set(name, value, user string) (*Setting, error) {
+	def := findSetting(name)
+	if def == nil {
+		return nil, SettingNotFound.New("No setting named %s", name)
+	}
+
+	s.setLock.Lock()
+	defer s.setLock.Unlock()
+
+	config := s.config.current()
+	oldValue := def.get(&config)
+	if problem := def.set(&config, strings.TrimSpace(value)); problem != "" {
+		verr := &ValidationError{}
+		verr.add("value", "%s", problem)
+		return nil, verr
+	}
+	setting := &Setting{
+		Name:      def.Name,
+		Usage:     def.Usage,
+		Value:     def.get(&config),
+		UpdatedBy: user,
+		Updated:   time.Now(),
+	}
+
+	if err := s.db.Update(func(tx boltorm.Tx) error {
+		stored := &storedSetting{setting.Value, setting.UpdatedBy, setting.Updated}
+		err := tx.Update(BOLT_SETTINGSBUCKET, []byte(def.Name), stored)
+		if boltorm.ErrKeyDoesNotExist.Contains(err) {
+			err = tx.Insert(BOLT_SETTINGSBUCKET, []byte(def.Name), stored)
+		}
+		if err != nil {
+			return err
+		}
+
+		id, err := tx.NextSequenceForBucket(BOLT_SETTINGHISTORYBUCKET)
+		if err != nil {
+			return err
+		}
+		var idBytes [8]byte
+		binary.BigEndian.PutUint64(idBytes[:], id)
+		return tx.Insert(BOLT_SETTINGHISTORYBUCKET, idBytes[:], &SettingChange{
+			ID:       id,
+			Name:     def.Name,
+			OldValue: oldValue,
+			NewValue: setting.Value,
+			User:     user,
+			Time:     setting.Updated,
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	settingsLock.Lock()
+	def.set(s.config, setting.Value)
+	settingsLock.Unlock()
+	for _, fn := range s.onApply {
+		fn(config)
+	}
+	return setting, nil
+}
+
+// Every change made through Set, oldest first.
+func (s *SettingsStore) History() (changes []*SettingChange, err error) {
+	return changes, s.db.View(func(tx boltorm.Tx) error {
+		res, err := tx.GetAll(BOLT_SETTINGHISTORYBUCKET, &SettingChange{})
+		if err != nil {
+			return err
+		}
+		changes = res.([]*SettingChange)
+		return nil
+	})
+}
+
+type SettingsHandler struct {
+	settings    *SettingsStore
+	authHandler *AuthenticationHandler
+}
+
+func (h *SettingsHandler) GetAll(w http.ResponseWriter, r *http.Request) {
+	settings, err := h.settings.GetAll()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, settings)
+}
+
+func (h *SettingsHandler) History(w http.ResponseWriter, r *http.Request) {
+	changes, err := h.settings.History()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if changes == nil {
+		changes = []*SettingChange{}
+	}
+	writeJSON(w, http.StatusOK, changes)
+}
+
+func (h *SettingsHandler) Set(w http.ResponseWriter, r *http.Request) {
+	input := struct {
+		Value *string `json:"value"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil || input.Value == nil {
+		http.Error(w, "Invalid setting json given", http.StatusBadRequest)
+		return
+	}
+	setting, err := h.settings.Set(mux.Vars(r)["Name"], *input.Value, h.authHandler.sessionUser(r))
+	if verr, ok := err.(*ValidationError); ok {
+		writeValidationError(w, verr)
+		return
+	} else if err != nil {
+		log.Printf("Failed to change setting %s!  Error: %s", mux.Vars(r)["Name"], err)
+		httpError(w, err)
+		return
+	}
+	log.Printf("Setting %s changed to %q by %s", setting.Name, setting.Value, setting.UpdatedBy)
+	writeJSON(w, http.StatusOK, setting)
+}
+
+func NewSettingsHandler(r *mux.Router, settings *SettingsStore, authHandler *AuthenticationHandler) *SettingsHandler {
+	h := &SettingsHandler{
+		settings:    settings,
+		authHandler: authHandler,
+	}
+
+	r.HandleFunc("/settings", authHandler.AdminFunc(h.GetAll)).Methods("GET")
+	r.HandleFunc("/settings/history", authHandler.AdminFunc(h.History)).Methods("GET")
+	r.HandleFunc("/settings/{Name}", authHandler.RoleFunc(h.Set, RoleSuperadmin)).Methods("PUT")
+
+	return h
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestSettingsStore(t *testing.T) {
+	Convey("With a settings store over flag values", t, func() {
+		db := boltorm.NewMemoryDB()
+		config := &configType{}
+		config.Email.ContactEmail = "info@example.com"
+		config.General.EnableGroupReg = true
+		config.Compliance.MinLeaders = 2
+		settings, err := NewSettingsStore(db, config)
+		So(err, ShouldBeNil)
+
+		Convey("Listing the settings should give the flag values", func() {
+			all, err := settings.GetAll()
+			So(err, ShouldBeNil)
+			So(len(all), ShouldEqual, len(settingDefinitions))
+			for _, setting := range all {
+				switch setting.Name {
+				case "email.contactEmail":
+					So(setting.Value, ShouldEqual, "info@example.com")
+					So(setting.UpdatedBy, ShouldEqual, "")
+				case "enableGroupReg":
+					So(setting.Value, ShouldEqual, "true")
+				case "compliance.minLeaders":
+					So(setting.Value, ShouldEqual, "2")
+				}
+			}
+		})
+
+		Convey("Changing a setting", func() {
+			var applied []configType
+			settings.OnApply(func(config configType) {
+				applied = append(applied, config)
+			})
+			setting, err := settings.Set("email.contactEmail", " help@example.com ", "admin@example.com")
+			So(err, ShouldBeNil)
+			Convey("Should give back the normalized value", func() {
+				So(setting.Value, ShouldEqual, "help@example.com")
+				So(setting.UpdatedBy, ShouldEqual, "admin@example.com")
+			})
+			Convey("Should apply it to the running configuration", func() {
+				So(config.Email.ContactEmail, ShouldEqual, "help@example.com")
+				So(len(applied), ShouldEqual, 1)
+				So(applied[0].Email.ContactEmail, ShouldEqual, "help@example.com")
+			})
+			Convey("Should record the change", func() {
+				_, err := settings.Set("email.contactEmail", "desk@example.com", "other@example.com")
+				So(err, ShouldBeNil)
+				changes, err := settings.History()
+				So(err, ShouldBeNil)
+				So(len(changes), ShouldEqual, 2)
+				So(changes[0].OldValue, ShouldEqual, "info@example.com")
+				So(changes[0].NewValue, ShouldEqual, "help@example.com")
+				So(changes[1].OldValue, ShouldEqual, "help@example.com")
+				So(changes[1].User, ShouldEqual, "other@example.com")
+			})
+			Convey("Should override the flags on the next start", func() {
+				restarted := &configType{}
+				restarted.Email.ContactEmail = "info@example.com"
+				_, err := NewSettingsStore(db, restarted)
+				So(err, ShouldBeNil)
+				So(restarted.Email.ContactEmail, ShouldEqual, "help@example.com")
+			})
+		})
+
+		Convey("Each type of setting should be parsed", func() {
+			_, err := settings.Set("enableWaitingList", "1", "")
+			So(err, ShouldBeNil)
+			So(config.General.EnableWaitingList, ShouldBeTrue)
+			_, err = settings.Set("compliance.youthPerLeader", "8", "")
+			So(err, ShouldBeNil)
+			So(config.Compliance.YouthPerLeader, ShouldEqual, 8)
+			_, err = settings.Set("compliance.requiredCertificates", "woodBadge, safety,", "")
+			So(err, ShouldBeNil)
+			So(config.Compliance.RequiredCertificates, ShouldResemble, stringSliceConfig{"woodBadge", "safety"})
+		})
+
+		Convey("Bad values should be refused without changing anything", func() {
+			for name, value := range map[string]string{
+				"email.contactEmail":    "Help <help@example.com>",
+				"enableGroupReg":        "sometimes",
+				"compliance.minLeaders": "-1",
+			} {
+				_, err := settings.Set(name, value, "")
+				So(fieldsOf(err), ShouldContainKey, "value")
+			}
+			So(config.Email.ContactEmail, ShouldEqual, "info@example.com")
+			So(config.General.EnableGroupReg, ShouldBeTrue)
+			So(config.Compliance.MinLeaders, ShouldEqual, 2)
+			changes, err := settings.History()
+			So(err, ShouldBeNil)
+			So(len(changes), ShouldEqual, 0)
+		})
+
+		Convey("Unknown settings should not be found", func() {
+			_, err := settings.Set("general.database", "other.bolt", "")
+			So(SettingNotFound.Contains(err), ShouldBeTrue)
+		})
+	})
+}
+
+func TestSettingsHandler(t *testing.T) {
+	Convey("With a settings handler", t, func() {
+		db := boltorm.NewMemoryDB()
+		config := &configType{}
+		config.Auth.AllowedEmails = stringSliceConfig{"admin@example.com"}
+		config.General.EnableGroupReg = true
+		settings, err := NewSettingsStore(db, config)
+		So(err, ShouldBeNil)
+		store := sessions.NewCookieStore([]byte("A"))
+		authHandler := newTestAuthHandler(config, store)
+		router := mux.NewRouter()
+		NewSettingsHandler(router, settings, authHandler)
+
+		invDb, err := NewInvoiceDb(db)
+		So(err, ShouldBeNil)
+		prdb, err := NewPreRegBoltDb(db, config, invDb)
+		So(err, ShouldBeNil)
+		emailSender := &testEmailSender{}
+		ces := NewConfirmationEmailService("examplesite.com", "no-reply@examplesender.com", "no-reply", "info@infoexample.com", emailSender, prdb)
+		settings.OnApply(func(config configType) {
+			ces.setNames(config.Email.FromName, config.Email.ContactEmail)
+		})
+
+		loggedInCookie := loggedInAs(store, "admin@example.com")
+
+		Convey("Settings should only be visible to administrators", func() {
+			So(testRequest(router, "GET", "/settings", "", nil).Code, ShouldEqual, http.StatusForbidden)
+			w := testRequest(router, "GET", "/settings", "", loggedInCookie)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			all := []*Setting{}
+			So(json.Unmarshal(w.Body.Bytes(), &all), ShouldBeNil)
+			So(len(all), ShouldEqual, len(settingDefinitions))
+		})
+		Convey("Changing a setting should require an administrator", func() {
+			So(testRequest(router, "PUT", "/settings/enableGroupReg", `{"value": "false"}`, nil).Code, ShouldEqual, http.StatusForbidden)
+			So(config.General.EnableGroupReg, ShouldBeTrue)
+		})
+		Convey("Changing a setting without a value should be a bad request", func() {
+			So(testRequest(router, "PUT", "/settings/enableGroupReg", `{}`, loggedInCookie).Code, ShouldEqual, http.StatusBadRequest)
+		})
+		Convey("Changing an unknown setting should not be found", func() {
+			So(testRequest(router, "PUT", "/settings/general.database", `{"value": "x"}`, loggedInCookie).Code, ShouldEqual, http.StatusNotFound)
+		})
+		Convey("A bad value should be refused", func() {
+			So(testRequest(router, "PUT", "/settings/compliance.minLeaders", `{"value": "two"}`, loggedInCookie).Code, ShouldEqual, http.StatusUnprocessableEntity)
+		})
+
+		Convey("Closing registration", func() {
+			w := testRequest(router, "PUT", "/settings/enableGroupReg", `{"value": "false"}`, loggedInCookie)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			Convey("Should take effect straight away", func() {
+				phase, _, err := prdb.CurrentPhase(time.Now())
+				So(err, ShouldBeNil)
+				So(phase, ShouldEqual, PhaseClosed)
+			})
+			Convey("Should show up in the history", func() {
+				w := testRequest(router, "GET", "/settings/history", "", loggedInCookie)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				changes := []*SettingChange{}
+				So(json.Unmarshal(w.Body.Bytes(), &changes), ShouldBeNil)
+				So(len(changes), ShouldEqual, 1)
+				So(changes[0].Name, ShouldEqual, "enableGroupReg")
+				So(changes[0].User, ShouldEqual, "admin@example.com")
+			})
+		})
+
+		Convey("Changing the contact email should be used in the next confirmation email", func() {
+			So(testRequest(router, "PUT", "/settings/email.contactEmail", `{"value": "help@example.com"}`, loggedInCookie).Code, ShouldEqual, http.StatusOK)
+			gpr := &GroupPreRegistration{GroupName: "1st Testingway", Council: "Council rock", ContactLeaderEmail: "test@example.com"}
+			So(prdb.CreateRecord(gpr), ShouldBeNil)
+			So(ces.RequestEmailConfirmation(gpr), ShouldBeNil)
+			So(len(emailSender.Emails), ShouldEqual, 1)
+			So(string(emailSender.Emails[0].Msg), ShouldContainSubstring, "contact us at help@example.com")
+		})
+	})
+}
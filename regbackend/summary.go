@@ -5,21 +5,43 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"sort"
 
 	"github.com/gorilla/mux"
 )
 
 type SummaryHandler struct {
-	prdb PreRegDb
+	prdb          PreRegDb
+	participantDb ParticipantDb
 }
 
 type PackSummaryOutput struct {
 	YouthCount  int `json:"youthCount"`
 	LeaderCount int `json:"leaderCount"`
+	// Groups counted from their participant roster rather than their estimates.
+	RosterCount int `json:"rosterCount"`
 }
 
-func (sh *SummaryHandler) GetPack(w http.ResponseWriter, r *http.Request) {
+// Fetches every registration along with the rosters of those that have one.
+func (sh *SummaryHandler) recordsAndRosters() ([]*GroupPreRegistration, map[string]*ParticipantRoster, error) {
 	recs, err := sh.prdb.GetAll()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rosters, err := sh.participantDb.GetAllRosters()
+	if err != nil {
+		return nil, nil, err
+	}
+	rosterByKey := make(map[string]*ParticipantRoster, len(rosters))
+	for _, roster := range rosters {
+		rosterByKey[roster.SecurityKey] = roster
+	}
+	return recs, rosterByKey, nil
+}
+
+func (sh *SummaryHandler) GetPack(w http.ResponseWriter, r *http.Request) {
+	recs, rosterByKey, err := sh.recordsAndRosters()
 	if err != nil {
 		httpError(w, err)
 		return
@@ -28,8 +50,13 @@ func (sh *SummaryHandler) GetPack(w http.ResponseWriter, r *http.Request) {
 	output := PackSummaryOutput{}
 	for i := 0; i < len(recs); i++ {
 		if !recs[i].IsOnWaitingList {
-			output.YouthCount += recs[i].EstimatedYouth
-			output.LeaderCount += recs[i].EstimatedLeaders
+			roster := rosterByKey[recs[i].SecurityKey]
+			youth, leaders := groupSpots(recs[i], roster)
+			output.YouthCount += youth
+			output.LeaderCount += leaders
+			if roster != nil {
+				output.RosterCount++
+			}
 		}
 	}
 
@@ -45,12 +72,84 @@ func (sh *SummaryHandler) GetPack(w http.ResponseWriter, r *http.Request) {
 	io.Copy(w, buf)
 }
 
-func NewSummaryHandler(apiR *mux.Router, prdb PreRegDb) *SummaryHandler {
+type CouncilSummaryOutput struct {
+	Council     string `json:"council"`
+	YouthCount  int    `json:"youthCount"`
+	LeaderCount int    `json:"leaderCount"`
+	RosterCount int    `json:"rosterCount"`
+	// Groups waiting for a spot in this council's quota.
+	WaitingCount int `json:"waitingCount"`
+
+	HasQuota     bool `json:"hasQuota"`
+	YouthQuota   int  `json:"youthQuota"`
+	LeadersQuota int  `json:"leadersQuota"`
+}
+
+// Counts the spots used by each council the same way as the pack summary,
+// next to the spots allocated to it.  Councils with a quota are listed even
+// before any of their groups register.
+func (sh *SummaryHandler) GetCouncil(w http.ResponseWriter, r *http.Request) {
+	recs, rosterByKey, err := sh.recordsAndRosters()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	quotas, err := sh.prdb.GetCouncilQuotas()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	councils := make(map[string]*CouncilSummaryOutput)
+	council := func(name string) *CouncilSummaryOutput {
+		if _, ok := councils[normalizeName(name)]; !ok {
+			councils[normalizeName(name)] = &CouncilSummaryOutput{Council: name}
+		}
+		return councils[normalizeName(name)]
+	}
+	for _, quota := range quotas.Quotas {
+		output := council(quota.Council)
+		output.HasQuota = true
+		output.YouthQuota = quota.Youth
+		output.LeadersQuota = quota.Leaders
+	}
+	for _, rec := range recs {
+		output := council(rec.Council)
+		if rec.OnCouncilWaitingList {
+			output.WaitingCount++
+		}
+		if rec.IsOnWaitingList {
+			continue
+		}
+		roster := rosterByKey[rec.SecurityKey]
+		youth, leaders := groupSpots(rec, roster)
+		output.YouthCount += youth
+		output.LeaderCount += leaders
+		if roster != nil {
+			output.RosterCount++
+		}
+	}
+
+	names := make([]string, 0, len(councils))
+	for name := range councils {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	outputs := make([]*CouncilSummaryOutput, len(names))
+	for i, name := range names {
+		outputs[i] = councils[name]
+	}
+	writeJSON(w, http.StatusOK, outputs)
+}
+
+func NewSummaryHandler(apiR *mux.Router, prdb PreRegDb, participantDb ParticipantDb) *SummaryHandler {
 	sh := &SummaryHandler{
-		prdb: prdb,
+		prdb:          prdb,
+		participantDb: participantDb,
 	}
 
 	apiR.HandleFunc("/summary/pack", sh.GetPack).Methods("GET")
+	apiR.HandleFunc("/summary/council", sh.GetCouncil).Methods("GET")
 
 	return sh
 }
@@ -21,8 +21,10 @@ func TestSummaryPackEndPoint(t *testing.T) {
 		config := &configType{}
 		prdb, err := NewPreRegBoltDb(db, config, invDb)
 		So(err, ShouldBeNil)
+		participantDb, err := NewParticipantDb(db, newTestDocumentStore(db))
+		So(err, ShouldBeNil)
 		router := mux.NewRouter()
-		sh := NewSummaryHandler(router, prdb)
+		sh := NewSummaryHandler(router, prdb, participantDb)
 		So(sh, ShouldNotBeNil)
 
 		Convey("Requesting the pack summary should give a 200 output with a body", func() {
@@ -105,6 +107,74 @@ func TestSummaryPackEndPoint(t *testing.T) {
 					})
 				})
 			})
+
+			Convey("And a roster for the first pack", func() {
+				recs, err := prdb.GetAll()
+				So(err, ShouldBeNil)
+				var packA *GroupPreRegistration
+				for _, rec := range recs {
+					if rec.PackName == "Pack A" {
+						packA = rec
+					}
+				}
+				for _, participantType := range []string{ParticipantYouth, ParticipantYouth, ParticipantLeader} {
+					So(participantDb.AddParticipant(packA.SecurityKey, &Participant{Type: participantType}), ShouldBeNil)
+				}
+				r, err := http.NewRequest("GET", "http://localhost:8080/summary/pack", nil)
+				So(err, ShouldBeNil)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, r)
+				So(w.Code, ShouldEqual, 200)
+				outputVar := PackSummaryOutput{}
+				So(json.Unmarshal(w.Body.Bytes(), &outputVar), ShouldBeNil)
+
+				Convey("Should count the roster instead of the estimates for that pack", func() {
+					So(outputVar.YouthCount, ShouldEqual, 14)
+					So(outputVar.LeaderCount, ShouldEqual, 7)
+					So(outputVar.RosterCount, ShouldEqual, 1)
+				})
+			})
+		})
+	})
+}
+
+func TestSummaryCouncilEndPoint(t *testing.T) {
+	Convey("With registrations from two councils, one with a quota", t, func() {
+		db := boltorm.NewMemoryDB()
+		invDb, err := NewInvoiceDb(db)
+		So(err, ShouldBeNil)
+		prdb, err := NewPreRegBoltDb(db, &configType{}, invDb)
+		So(err, ShouldBeNil)
+		participantDb, err := NewParticipantDb(db, newTestDocumentStore(db))
+		So(err, ShouldBeNil)
+		router := mux.NewRouter()
+		NewSummaryHandler(router, prdb, participantDb)
+		So(prdb.SetCouncilQuotas(&CouncilQuotas{Quotas: []CouncilQuota{{"Voyageur", 10, 4}, {"Northern Lights", 8, 2}}}), ShouldBeNil)
+
+		for _, rec := range []*GroupPreRegistration{
+			{PackName: "A", GroupName: "Group", Council: "Voyageur", ContactLeaderEmail: "a@example.com", EstimatedYouth: 6, EstimatedLeaders: 2},
+			{PackName: "B", GroupName: "Group", Council: "voyageur", ContactLeaderEmail: "b@example.com", EstimatedYouth: 6, EstimatedLeaders: 2},
+			{PackName: "C", GroupName: "Group", Council: "Battle River", ContactLeaderEmail: "c@example.com", EstimatedYouth: 3, EstimatedLeaders: 1},
+		} {
+			So(prdb.CreateRecord(rec), ShouldBeNil)
+			if rec.PackName == "C" {
+				So(participantDb.AddParticipant(rec.SecurityKey, &Participant{Type: ParticipantYouth}), ShouldBeNil)
+			}
+		}
+
+		Convey("The council summary should list used and allocated spots", func() {
+			r, err := http.NewRequest("GET", "http://localhost:8080/summary/council", nil)
+			So(err, ShouldBeNil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			So(w.Code, ShouldEqual, 200)
+			output := []CouncilSummaryOutput{}
+			So(json.Unmarshal(w.Body.Bytes(), &output), ShouldBeNil)
+			So(output, ShouldResemble, []CouncilSummaryOutput{
+				{Council: "Battle River", YouthCount: 1, RosterCount: 1},
+				{Council: "Northern Lights", HasQuota: true, YouthQuota: 8, LeadersQuota: 2},
+				{Council: "Voyageur", YouthCount: 6, LeaderCount: 2, WaitingCount: 1, HasQuota: true, YouthQuota: 10, LeadersQuota: 4},
+			})
 		})
 	})
 }
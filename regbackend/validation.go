@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// A problem with a single field, named by its JSON path.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, fieldErr := range e.Errors {
+		messages[i] = fieldErr.Field + ": " + fieldErr.Message
+	}
+	return "Validation failed: " + strings.Join(messages, "; ")
+}
+
+func (e *ValidationError) add(field, format string, args ...interface{}) {
+	e.Errors = append(e.Errors, FieldError{field, fmt.Sprintf(format, args...)})
+}
+
+func writeValidationError(w http.ResponseWriter, err *ValidationError) {
+	buf := &bytes.Buffer{}
+	if encodeErr := json.NewEncoder(buf).Encode(err); encodeErr != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header()["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	io.Copy(w, buf)
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	buf := &bytes.Buffer{}
+	if err := json.NewEncoder(buf).Encode(data); err != nil {
+		http.Error(w, "Failed to encode response", 500)
+		return
+	}
+	w.Header()["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(status)
+	io.Copy(w, buf)
+}
+
+const maxTextFieldLength = 200
+
+var provinceCodes = map[string]string{
+	"AB": "AB", "ALBERTA": "AB",
+	"BC": "BC", "BRITISH COLUMBIA": "BC", "COLOMBIE-BRITANNIQUE": "BC",
+	"MB": "MB", "MANITOBA": "MB",
+	"NB": "NB", "NEW BRUNSWICK": "NB", "NOUVEAU-BRUNSWICK": "NB",
+	"NL": "NL", "NEWFOUNDLAND AND LABRADOR": "NL", "NEWFOUNDLAND": "NL", "TERRE-NEUVE-ET-LABRADOR": "NL",
+	"NS": "NS", "NOVA SCOTIA": "NS", "NOUVELLE-ECOSSE": "NS", "NOUVELLE-ÉCOSSE": "NS",
+	"NT": "NT", "NORTHWEST TERRITORIES": "NT", "TERRITOIRES DU NORD-OUEST": "NT",
+	"NU": "NU", "NUNAVUT": "NU",
+	"ON": "ON", "ONTARIO": "ON",
+	"PE": "PE", "PEI": "PE", "PRINCE EDWARD ISLAND": "PE", "ILE-DU-PRINCE-EDOUARD": "PE", "ÎLE-DU-PRINCE-ÉDOUARD": "PE",
+	"QC": "QC", "PQ": "QC", "QUEBEC": "QC", "QUÉBEC": "QC",
+	"SK": "SK", "SASKATCHEWAN": "SK",
+	"YT": "YT", "YUKON": "YT",
+}
+
+var (
+	// Canadian postal codes never use D, F, I, O, Q or U, nor W or Z as the first letter.
+	postalCodeRegexp  = regexp.MustCompile(`^([ABCEGHJ-NPRSTVXY][0-9][ABCEGHJ-NPRSTV-Z]) ?([0-9][ABCEGHJ-NPRSTV-Z][0-9])$`)
+	phoneNumberRegexp = regexp.MustCompile(`^\+?1?[ .-]*\(?([2-9][0-9]{2})\)?[ .-]*([2-9][0-9]{2})[ .-]*([0-9]{4})(?:\s*(?:x|ext\.?|extension)\s*([0-9]{1,6}))?$`)
+)
+
+// Normalizes a Canadian postal code to the A1A 1A1 form.
+func normalizePostalCode(in string) (string, bool) {
+	match := postalCodeRegexp.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(in)))
+	if match == nil {
+		return "", false
+	}
+	return match[1] + " " + match[2], true
+}
+
+// Normalizes a North American phone number to the 613-555-0123 form, keeping
+// any extension as x123.
+func normalizePhoneNumber(in PhoneNumber) (PhoneNumber, bool) {
+	match := phoneNumberRegexp.FindStringSubmatch(strings.ToLower(strings.TrimSpace(string(in))))
+	if match == nil {
+		return "", false
+	}
+	out := match[1] + "-" + match[2] + "-" + match[3]
+	if match[4] != "" {
+		out += " x" + match[4]
+	}
+	return PhoneNumber(out), true
+}
+
+func normalizeProvince(in string) (string, bool) {
+	code, ok := provinceCodes[strings.ToUpper(strings.Join(strings.Fields(in), " "))]
+	return code, ok
+}
+
+// Only accepts a bare address (no display name) with a dotted domain.
+func validEmailAddress(in string) bool {
+	addr, err := mail.ParseAddress(in)
+	if err != nil || addr.Address != in {
+		return false
+	}
+	return strings.Contains(in[strings.LastIndex(in, "@"):], ".")
+}
+
+func validateText(verr *ValidationError, field string, value *string, required bool) {
+	*value = strings.TrimSpace(*value)
+	if *value == "" {
+		if required {
+			verr.add(field, "is required")
+		}
+	} else if utf8.RuneCountInString(*value) > maxTextFieldLength {
+		verr.add(field, "must be at most %d characters", maxTextFieldLength)
+	}
+}
+
+// Checks a registration submitted by a group, normalizing it in place.  Any
+// problems are returned together as a *ValidationError.
+func (gpr *GroupPreRegistration) Validate() error {
+	verr := &ValidationError{}
+
+	// Fields that belong to the server.
+	if gpr.SecurityKey != "" {
+		verr.add("securityKey", "is assigned by the server")
+	}
+	if !gpr.ValidatedOn.IsZero() {
+		verr.add("validatedOn", "is set by confirming the contact email address")
+	}
+	if gpr.InvoiceID != 0 {
+		verr.add("invoiceId", "is assigned by the server")
+	}
+	if gpr.IsOnWaitingList {
+		verr.add("isOnWaitingList", "is decided by the server")
+	}
+	if gpr.OnCouncilWaitingList {
+		verr.add("onCouncilWaitingList", "is decided by the server")
+	}
+
+	validateText(verr, "packName", &gpr.PackName, false)
+	validateText(verr, "groupName", &gpr.GroupName, true)
+	validateText(verr, "council", &gpr.Council, true)
+	validateText(verr, "contactLeaderFirstName", &gpr.ContactLeaderFirstName, false)
+	validateText(verr, "contactLeaderLastName", &gpr.ContactLeaderLastName, false)
+
+	gpr.ContactLeaderEmail = strings.TrimSpace(gpr.ContactLeaderEmail)
+	if gpr.ContactLeaderEmail == "" {
+		verr.add("contactLeaderEmail", "is required")
+	} else if !validEmailAddress(gpr.ContactLeaderEmail) {
+		verr.add("contactLeaderEmail", "is not a valid email address")
+	}
+
+	if strings.TrimSpace(string(gpr.ContactLeaderPhoneNumber)) != "" {
+		if phone, ok := normalizePhoneNumber(gpr.ContactLeaderPhoneNumber); ok {
+			gpr.ContactLeaderPhoneNumber = phone
+		} else {
+			verr.add("contactLeaderPhoneNumber", "must be a 10 digit phone number, like 613-555-0123")
+		}
+	} else {
+		gpr.ContactLeaderPhoneNumber = ""
+	}
+
+	address := &gpr.ContactLeaderAddress
+	validateText(verr, "contactLeaderAddress.address1", &address.Address1, false)
+	validateText(verr, "contactLeaderAddress.address2", &address.Address2, false)
+	validateText(verr, "contactLeaderAddress.city", &address.City, false)
+	if strings.TrimSpace(address.Province) != "" {
+		if code, ok := normalizeProvince(address.Province); ok {
+			address.Province = code
+		} else {
+			verr.add("contactLeaderAddress.province", "must be a Canadian province or territory")
+		}
+	} else {
+		address.Province = ""
+	}
+	if strings.TrimSpace(address.PostalCode) != "" {
+		if code, ok := normalizePostalCode(address.PostalCode); ok {
+			address.PostalCode = code
+		} else {
+			verr.add("contactLeaderAddress.postalCode", "must be a Canadian postal code, like K1A 0B1")
+		}
+	} else {
+		address.PostalCode = ""
+	}
+
+	if gpr.EstimatedYouth < 0 {
+		verr.add("estimatedYouth", "must not be negative")
+	}
+	if gpr.EstimatedLeaders < 0 {
+		verr.add("estimatedLeaders", "must not be negative")
+	}
+
+	if len(verr.Errors) != 0 {
+		return verr
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/CCJ16/registration/regbackend/boltorm"
+	"github.com/gorilla/mux"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func fieldsOf(err error) map[string]string {
+	fields := make(map[string]string)
+	if verr, ok := err.(*ValidationError); ok {
+		for _, fieldErr := range verr.Errors {
+			fields[fieldErr.Field] = fieldErr.Message
+		}
+	}
+	return fields
+}
+
+func TestGroupPreRegistrationValidate(t *testing.T) {
+	Convey("With a complete registration", t, func() {
+		rec := &GroupPreRegistration{
+			PackName:                 " Pack A ",
+			GroupName:                "1st Testingway",
+			Council:                  "Council rock",
+			ContactLeaderFirstName:   "First",
+			ContactLeaderLastName:    "Last",
+			ContactLeaderPhoneNumber: "+1 (613) 555.0123 ext. 42",
+			ContactLeaderEmail:       " test@example.com ",
+			ContactLeaderAddress: Address{
+				Address1:   "1 Test Street",
+				City:       "Ottawa",
+				Province:   "ontario",
+				PostalCode: "k1a0b1",
+			},
+			EstimatedYouth:   10,
+			EstimatedLeaders: 2,
+		}
+		Convey("Validating should succeed", func() {
+			So(rec.Validate(), ShouldBeNil)
+			Convey("And normalize the phone number", func() {
+				So(rec.ContactLeaderPhoneNumber, ShouldEqual, PhoneNumber("613-555-0123 x42"))
+			})
+			Convey("And normalize the address", func() {
+				So(rec.ContactLeaderAddress.Province, ShouldEqual, "ON")
+				So(rec.ContactLeaderAddress.PostalCode, ShouldEqual, "K1A 0B1")
+			})
+			Convey("And trim the text fields", func() {
+				So(rec.PackName, ShouldEqual, "Pack A")
+				So(rec.ContactLeaderEmail, ShouldEqual, "test@example.com")
+			})
+		})
+		Convey("Leaving out the optional fields should still validate", func() {
+			rec.PackName = ""
+			rec.ContactLeaderPhoneNumber = " "
+			rec.ContactLeaderAddress = Address{}
+			So(rec.Validate(), ShouldBeNil)
+			So(rec.ContactLeaderPhoneNumber, ShouldEqual, PhoneNumber(""))
+		})
+		Convey("Bad values should each be reported against their field", func() {
+			rec.GroupName = "  "
+			rec.ContactLeaderEmail = "Test <test@example.com>"
+			rec.ContactLeaderPhoneNumber = "555-0123"
+			rec.ContactLeaderAddress.Province = "Narnia"
+			rec.ContactLeaderAddress.PostalCode = "D1A 0B1"
+			rec.EstimatedYouth = -1
+			fields := fieldsOf(rec.Validate())
+			So(len(fields), ShouldEqual, 6)
+			So(fields["groupName"], ShouldEqual, "is required")
+			So(fields, ShouldContainKey, "contactLeaderEmail")
+			So(fields, ShouldContainKey, "contactLeaderPhoneNumber")
+			So(fields, ShouldContainKey, "contactLeaderAddress.province")
+			So(fields, ShouldContainKey, "contactLeaderAddress.postalCode")
+			So(fields, ShouldContainKey, "estimatedYouth")
+		})
+		Convey("Emails without a dotted domain should be rejected", func() {
+			rec.ContactLeaderEmail = "test@localhost"
+			So(fieldsOf(rec.Validate()), ShouldContainKey, "contactLeaderEmail")
+		})
+		Convey("Server owned fields should be rejected", func() {
+			rec.ValidatedOn = time.Now()
+			rec.InvoiceID = 5
+			rec.IsOnWaitingList = true
+			fields := fieldsOf(rec.Validate())
+			So(len(fields), ShouldEqual, 3)
+			So(fields, ShouldContainKey, "validatedOn")
+			So(fields, ShouldContainKey, "invoiceId")
+			So(fields, ShouldContainKey, "isOnWaitingList")
+		})
+	})
+}
+
+func TestPreRegCreateValidation(t *testing.T) {
+	Convey("With a group preregistration handler", t, func() {
+		db := boltorm.NewMemoryDB()
+		invDb, err := NewInvoiceDb(db)
+		So(err, ShouldBeNil)
+		config := &configType{}
+		config.General.EnableGroupReg = true
+		prdb, err := NewPreRegBoltDb(db, config, invDb)
+		So(err, ShouldBeNil)
+		router := mux.NewRouter()
+		ces := NewConfirmationEmailService("examplesite.com", "no-reply@examplesender.com", "no-reply", "info@infoexample.com", &testEmailSender{}, prdb)
+		formSchemaDb := newTestFormSchemaDb(db)
+		newTestPreRegHandler(router, config, prdb, formSchemaDb, nil, ces)
+
+		create := func(rec GroupPreRegistration) *httptest.ResponseRecorder {
+			body, err := json.Marshal(rec)
+			So(err, ShouldBeNil)
+			r, err := http.NewRequest("POST", "http://localhost:8080/preregistration", bytes.NewReader(body))
+			So(err, ShouldBeNil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			return w
+		}
+
+		Convey("Creating an invalid record", func() {
+			w := create(GroupPreRegistration{
+				Council:            "Council rock",
+				ContactLeaderEmail: "not an email",
+				InvoiceID:          12,
+			})
+			Convey("Should fail with a 422 status code", func() {
+				So(w.Code, ShouldEqual, http.StatusUnprocessableEntity)
+			})
+			Convey("Should list the bad fields as json", func() {
+				So(w.HeaderMap.Get("Content-Type"), ShouldEqual, "application/json")
+				verr := &ValidationError{}
+				So(json.Unmarshal(w.Body.Bytes(), verr), ShouldBeNil)
+				So(verr.Errors, ShouldResemble, []FieldError{
+					{"invoiceId", "is assigned by the server"},
+					{"groupName", "is required"},
+					{"contactLeaderEmail", "is not a valid email address"},
+				})
+			})
+			Convey("Should not store anything", func() {
+				recs, err := prdb.GetAll()
+				So(err, ShouldBeNil)
+				So(len(recs), ShouldEqual, 0)
+			})
+		})
+
+		Convey("With questions on the form", func() {
+			So(formSchemaDb.SetFormSchema(testFormSchema()), ShouldBeNil)
+			rec := GroupPreRegistration{
+				GroupName:          "1st Testingway",
+				Council:            "Council rock",
+				ContactLeaderEmail: "test@example.com",
+			}
+			Convey("Leaving out a required answer should be reported with the other problems", func() {
+				rec.GroupName = ""
+				w := create(rec)
+				So(w.Code, ShouldEqual, http.StatusUnprocessableEntity)
+				verr := &ValidationError{}
+				So(json.Unmarshal(w.Body.Bytes(), verr), ShouldBeNil)
+				So(verr.Errors, ShouldResemble, []FieldError{
+					{"groupName", "is required"},
+					{"customFields.campsites", "is required"},
+				})
+			})
+			Convey("Answering them should store the normalized answers", func() {
+				rec.CustomFields = map[string]string{"campsites": "03", "firstCamp": "T"}
+				w := create(rec)
+				So(w.Code, ShouldEqual, http.StatusCreated)
+				created := GroupPreRegistration{}
+				So(json.Unmarshal(w.Body.Bytes(), &created), ShouldBeNil)
+				stored, err := prdb.GetRecord(created.SecurityKey)
+				So(err, ShouldBeNil)
+				So(stored.CustomFields, ShouldResemble, map[string]string{"campsites": "3", "firstCamp": "true"})
+			})
+		})
+
+		Convey("Creating a valid record should store it normalized", func() {
+			w := create(GroupPreRegistration{
+				GroupName:                "1st Testingway",
+				Council:                  "Council rock",
+				ContactLeaderEmail:       "test@example.com",
+				ContactLeaderPhoneNumber: "6135550123",
+				ContactLeaderAddress:     Address{Province: "QC", PostalCode: "h2x 1y4"},
+			})
+			So(w.Code, ShouldEqual, http.StatusCreated)
+			rec := GroupPreRegistration{}
+			So(json.Unmarshal(w.Body.Bytes(), &rec), ShouldBeNil)
+			stored, err := prdb.GetRecord(rec.SecurityKey)
+			So(err, ShouldBeNil)
+			So(stored.ContactLeaderPhoneNumber, ShouldEqual, PhoneNumber("613-555-0123"))
+			So(stored.ContactLeaderAddress.PostalCode, ShouldEqual, "H2X 1Y4")
+		})
+	})
+}